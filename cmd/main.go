@@ -1,30 +1,252 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
 
+	"github.com/go-redis/redis/v7"
 	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/middleware"
 	"github.com/mqtt-pipeline/internal/server"
 	"github.com/mqtt-pipeline/internal/service"
 	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
 )
 
 func main() {
+	configPath := flag.String("config", config.EnvOrDefault(config.EnvPrefix+"CONFIG", config.DefaultPath), "path of the base config file")
+	environment := flag.String("env", os.Getenv(config.EnvPrefix+"ENV"), "environment overlay loaded from <env>.toml next to the config file")
+	flag.Parse()
+
 	// Initializing the Log client
 	utils.InitLogClient()
 
 	// Initializing the GlobalConfig
-	err := config.InitGlobalConfig()
+	err := config.InitGlobalConfig(config.Options{Path: *configPath, Environment: *environment})
+	if err != nil {
+		log.Fatalf("Unable to initialize global config, err %v", err)
+	}
+	err = utils.InitLogger(config.GetConfig().Log)
 	if err != nil {
-		log.Fatalf("Unable to initialize global config")
+		log.Fatalf("Unable to initialize logger, err %v", err)
+	}
+	if config.GetConfig().Auth.JWTSecret == "" {
+		utils.Logger.Warn("auth.jwt_secret is not set, tokens are signed with the built-in development key")
 	}
 	utils.InitMQTT()
 	utils.InitMQTTSubscribe()
+	utils.InitCommands(true)
 	utils.Logger.Info("main started")
 
 	// Initialize Redis
 	redisClient := utils.InitRedis()
 	// create client
 	service.NewMQTTPipelineService(redisClient)
-	server.Start()
+	middleware.NewRateLimiter(redisClient)
+	middleware.NewIdempotencyStore(redisClient)
+	service.StartIngestion()
+	workers, stopWorkers := context.WithCancel(context.Background())
+	service.StartOutboundFlusher(workers)
+	service.StartCompaction(workers)
+	service.StartImports(workers)
+	service.StartReplays(workers)
+	service.StartPresence(workers)
+	service.StartCommands(workers)
+
+	app := &lifecycle{
+		srv:         server.New(),
+		redisClient: redisClient,
+		stopWorkers: stopWorkers,
+	}
+	if config.GetConfig().GRPC.Enabled {
+		app.grpcSrv = server.NewGRPC()
+	}
+	os.Exit(app.run())
+}
+
+// lifecycle owns the long running parts of the pipeline and tears them down in
+// dependency order: HTTP and gRPC first, then the subscription, the ingest queue, MQTT
+// and Redis.
+type lifecycle struct {
+	srv         *http.Server
+	grpcSrv     *server.GRPCServer
+	redisClient redis.UniversalClient
+	stopWorkers context.CancelFunc
+}
+
+// run starts the HTTP and gRPC servers and blocks until a termination signal is received or
+// the server fails. It returns the process exit code.
+func (l *lifecycle) run() int {
+	serverErr := make(chan error, 2)
+	go func() {
+		utils.Logger.Info("starting server", zap.String("address", l.srv.Addr))
+		if err := l.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			serverErr <- err
+		}
+	}()
+	if l.grpcSrv != nil {
+		go func() {
+			address := config.GetConfig().GRPC.Address
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				serverErr <- err
+				return
+			}
+			utils.Logger.Info("starting grpc server", zap.String("address", address))
+			if err := l.grpcSrv.Serve(listener); err != nil {
+				serverErr <- err
+			}
+		}()
+	}
+
+	/*
+		SIGINT means is Signal Interrupted, send when the user types the INTR character (e.g. Ctrl-C).
+		SIGTERM signal is a generic signal used to cause program termination.
+	*/
+	interruptChan := make(chan os.Signal, 1)
+	signal.Notify(interruptChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+
+	// SIGHUP and edits to the config files reload the configuration.
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	fileChanged := make(chan struct{}, 1)
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	if err := config.Watch(watchCtx, func() {
+		select {
+		case fileChanged <- struct{}{}:
+		default:
+		}
+	}); err != nil {
+		utils.Logger.Error("unable to watch config files, reload with SIGHUP only", zap.Error(err))
+	}
+
+	exitCode := 0
+	for running := true; running; {
+		select {
+		case <-reloadChan:
+			utils.Logger.Info("received SIGHUP, reloading config")
+			l.reload()
+		case <-fileChanged:
+			utils.Logger.Info("config files changed, reloading config")
+			l.reload()
+		case sig := <-interruptChan:
+			utils.Logger.Info("received signal, shutting down", zap.String("signal", sig.String()))
+			running = false
+		case err := <-serverErr:
+			utils.Logger.Error("server stopped unexpectedly, shutting down", zap.Error(err))
+			exitCode = 1
+			running = false
+		}
+	}
+
+	if !l.shutdown() {
+		exitCode = 1
+	}
+	return exitCode
+}
+
+// reload applies a new configuration. Settings that are read on every use, such as
+// rate limits, take effect as soon as the config is swapped; the log level and the
+// subscription are updated here, and anything else is reported as needing a restart.
+func (l *lifecycle) reload() {
+	change, err := config.Reload()
+	if err != nil {
+		utils.Logger.Error("config reload rejected, keeping the current config", zap.Error(err))
+		return
+	}
+
+	if change.Old.Log.Level != change.New.Log.Level {
+		if err := utils.SetLogLevel(change.New.Log.Level); err != nil {
+			utils.Logger.Error("unable to apply log level", zap.Error(err))
+		}
+	}
+	if change.Old.MQTTConfig.Topic != change.New.MQTTConfig.Topic || change.Old.MQTTConfig.QoS != change.New.MQTTConfig.QoS ||
+		!reflect.DeepEqual(change.Old.Routing, change.New.Routing) ||
+		change.Old.Devices.Presence != change.New.Devices.Presence || change.Old.Devices.StatusTopic != change.New.Devices.StatusTopic {
+		if err := utils.Resubscribe(); err != nil {
+			utils.Logger.Error("unable to resubscribe after config reload", zap.Error(err))
+		}
+	}
+	if change.Old.Commands.Enabled != change.New.Commands.Enabled || change.Old.Commands.ResponseTopic != change.New.Commands.ResponseTopic {
+		if err := utils.ResubscribeCommands(); err != nil {
+			utils.Logger.Error("unable to resubscribe to the command responses after config reload", zap.Error(err))
+		}
+	}
+
+	utils.Logger.Info("config reloaded", zap.Strings("applied", change.Applied), zap.Strings("restart_required", change.RestartRequired))
+	if len(change.RestartRequired) > 0 {
+		utils.Logger.Warn("some changed settings only take effect after a restart", zap.Strings("settings", change.RestartRequired))
+	}
+}
+
+// shutdown stops every component within the configured deadline and reports whether
+// all buffered readings made it to storage.
+func (l *lifecycle) shutdown() bool {
+	cfg := config.GetConfig()
+
+	// Fail readiness first so the orchestrator stops routing traffic before the listener closes.
+	service.SetShuttingDown()
+	time.Sleep(time.Duration(cfg.Health.ReadinessDrainDelay) * time.Second)
+
+	timeout := time.Duration(cfg.Server.ShutdownTimeOut) * time.Second
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Stop accepting HTTP and gRPC requests and wait for in-flight ones to finish.
+	if err := l.srv.Shutdown(ctx); err != nil {
+		utils.Logger.Error("unable to shut down the http server cleanly", zap.Error(err))
+	}
+	if l.grpcSrv != nil {
+		l.grpcSrv.Shutdown(ctx)
+	}
+
+	// Let background publishes accepted before the listener closed reach the broker or the outbound queue.
+	if pending := service.WaitForAsyncPublishes(ctx); pending > 0 {
+		utils.Logger.Error("shutdown deadline reached before asynchronous publishes completed", zap.Int64("pending", pending))
+	}
+
+	// Stop receiving new readings, then store whatever is already buffered.
+	shutdownDeadline, _ := ctx.Deadline()
+	if err := utils.UnsubscribeMQTT(time.Until(shutdownDeadline)); err != nil {
+		utils.Logger.Error("unable to unsubscribe from the topic", zap.Error(err))
+	}
+	lost, err := service.DrainIngestion(ctx)
+	if err != nil {
+		utils.Logger.Error("shutdown deadline reached before the ingest queue was drained", zap.Int("lost", lost), zap.Error(err))
+	}
+
+	// Messages still in the outbound queue stay in redis and are flushed on the next start.
+	l.stopWorkers()
+	if utils.MQTTClient != nil {
+		utils.MQTTClient.Disconnect(250)
+	}
+	if err := utils.DisconnectCommands(ctx); err != nil {
+		utils.Logger.Error("unable to disconnect the command client", zap.Error(err))
+	}
+	if err := l.redisClient.Close(); err != nil {
+		utils.Logger.Error("unable to close redis client", zap.Error(err))
+	}
+
+	stats := utils.GetIngestStats()
+	dropped := utils.DroppedReadings()
+	utils.Logger.Info("shutdown complete",
+		zap.Int64("received", stats.Received),
+		zap.Int64("stored", stats.Stored),
+		zap.Int("lost", lost),
+		zap.Int64("dropped_after_unsubscribe", dropped),
+	)
+	_ = utils.Logger.Sync()
+	return lost == 0 && dropped == 0
 }
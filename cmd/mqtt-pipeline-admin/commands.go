@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+	"github.com/mqtt-pipeline/internal/utils"
+)
+
+// parseFlags parses the flags of a subcommand and reports whether to continue.
+func parseFlags(fs *flag.FlagSet, args []string) bool {
+	return fs.Parse(args) == nil
+}
+
+func tokenCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: token mint|revoke [flags]")
+		return 2
+	}
+
+	switch args[0] {
+	case "mint":
+		fs := flag.NewFlagSet("token mint", flag.ContinueOnError)
+		email := fs.String("email", "", "email the token is issued to")
+		ttl := fs.Duration("ttl", 0, "token lifetime, defaults to [auth] token_ttl")
+		tenant := fs.String("tenant", "", "tenant the token is scoped to")
+		admin := fs.Bool("admin", false, "allow the token to use the admin APIs")
+		if !parseFlags(fs, args[1:]) {
+			return 2
+		}
+		if *email == "" {
+			fmt.Fprintln(os.Stderr, "-email is required")
+			return 2
+		}
+		if err := loadConfig(); err != nil {
+			return fail(err)
+		}
+		var token string
+		var err error
+		switch {
+		case *admin && *tenant != "":
+			token, err = service.MintTenantAdminToken(*email, *tenant, *ttl)
+		case *admin:
+			token, err = service.MintAdminToken(*email, *ttl)
+		case *tenant != "":
+			token, err = service.MintTenantToken(*email, *tenant, *ttl)
+		default:
+			token, err = service.MintToken(*email, *ttl)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Println(token)
+		return 0
+
+	case "revoke":
+		fs := flag.NewFlagSet("token revoke", flag.ContinueOnError)
+		token := fs.String("token", "", "token to revoke")
+		if !parseFlags(fs, args[1:]) {
+			return 2
+		}
+		if *token == "" {
+			fmt.Fprintln(os.Stderr, "-token is required")
+			return 2
+		}
+		if err := loadConfig(); err != nil {
+			return fail(err)
+		}
+		connectRedis()
+		tokenID, err := service.RevokeToken(context.Background(), *token)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Println("revoked token", tokenID)
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown token command %q\n", args[0])
+	return 2
+}
+
+func deviceCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: device create|list|get|update|delete|status [flags]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("device "+args[0], flag.ContinueOnError)
+	id := fs.String("id", "", "device ID")
+	name := fs.String("name", "", "display name")
+	kind := fs.String("type", "", "device type, also filters list")
+	owner := fs.String("owner", "", "owner, also filters list")
+	tags := fs.String("tags", "", "comma separated tags, list takes a single tag")
+	firmware := fs.String("firmware", "", "firmware version")
+	enabled := fs.Bool("enabled", true, "whether readings of the device are accepted")
+	status := fs.String("status", "", "list only online or offline devices")
+	tenant := fs.String("tenant", "", "tenant the device belongs to")
+	if !parseFlags(fs, args[1:]) {
+		return 2
+	}
+	if *id == "" && args[0] != "list" {
+		fmt.Fprintln(os.Stderr, "-id is required")
+		return 2
+	}
+	// only the flags given on the command line are set on the device
+	req := models.DeviceRequest{ID: *id}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			req.Name = name
+		case "type":
+			req.Type = kind
+		case "owner":
+			req.Owner = owner
+		case "tags":
+			req.Tags = strings.Split(*tags, ",")
+		case "firmware":
+			req.FirmwareVersion = firmware
+		case "enabled":
+			req.Enabled = enabled
+		}
+	})
+
+	if err := loadConfig(); err != nil {
+		return fail(err)
+	}
+	connectRedis()
+	ctx := service.WithTenant(context.Background(), *tenant)
+	switch args[0] {
+	case "create":
+		device, err := service.RegisterDevice(ctx, req)
+		if err != nil {
+			return fail(err)
+		}
+		printJSON(device)
+	case "list":
+		devices, err := service.AllDevices(ctx, service.DeviceFilter{Type: *kind, Owner: *owner, Tag: *tags, Status: *status})
+		if err != nil {
+			return fail(err)
+		}
+		for _, device := range devices {
+			printJSON(device)
+		}
+	case "get":
+		device, err := service.LookupDevice(ctx, *id)
+		if err != nil {
+			return fail(err)
+		}
+		if device == nil {
+			return fail(service.ErrDeviceNotFound)
+		}
+		printJSON(device)
+	case "update":
+		device, err := service.UpdateDevice(ctx, *id, req)
+		if err != nil {
+			return fail(err)
+		}
+		printJSON(device)
+	case "delete":
+		if err := service.RemoveDevice(ctx, *id); err != nil {
+			return fail(err)
+		}
+	case "status":
+		presence, err := service.LookupPresence(ctx, *id)
+		if err != nil {
+			return fail(err)
+		}
+		printJSON(presence)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown device command %q\n", args[0])
+		return 2
+	}
+	return 0
+}
+
+func publishCommand(args []string) int {
+	fs := flag.NewFlagSet("publish", flag.ContinueOnError)
+	speed := fs.Int("speed", -1, "speed value to publish")
+	count := fs.Int("count", 1, "number of readings to publish")
+	interval := fs.Duration("interval", time.Second, "pause between readings")
+	tenant := fs.String("tenant", "", "tenant to publish for")
+	if !parseFlags(fs, args) {
+		return 2
+	}
+	if *speed < 0 {
+		fmt.Fprintln(os.Stderr, "-speed is required")
+		return 2
+	}
+	if err := loadConfig(); err != nil {
+		return fail(err)
+	}
+	connectRedis()
+	connectMQTT()
+	defer utils.MQTTClient.Disconnect(250)
+
+	ctx := service.WithTenant(context.Background(), *tenant)
+	for i := 0; i < *count; i++ {
+		if i > 0 {
+			time.Sleep(*interval)
+		}
+		messageID, queued, err := service.PublishReading(ctx, models.SpeedData{Speed: speed})
+		if err != nil {
+			return fail(err)
+		}
+		printJSON(map[string]interface{}{"message_id": messageID, "speed": *speed, "queued": queued})
+	}
+	return 0
+}
+
+func tailCommand(args []string) int {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	topic := fs.String("topic", "", "topic to follow, defaults to [mqtt] topic")
+	tenant := fs.String("tenant", "", "follow the topic of this tenant")
+	if !parseFlags(fs, args) {
+		return 2
+	}
+	if err := loadConfig(); err != nil {
+		return fail(err)
+	}
+	if *topic == "" {
+		*topic = utils.TenantTopic(*tenant)
+	}
+	connectMQTT()
+	defer utils.MQTTClient.Disconnect(250)
+
+	token := utils.MQTTClient.Subscribe(*topic, byte(config.GetConfig().MQTTConfig.QoS), func(client mqtt.Client, msg mqtt.Message) {
+		printJSON(map[string]string{
+			"topic":       msg.Topic(),
+			"received_at": time.Now().UTC().Format(time.RFC3339Nano),
+			"payload":     string(msg.Payload()),
+		})
+	})
+	if token.Wait() && token.Error() != nil {
+		return fail(token.Error())
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	return 0
+}
+
+func historyCommand(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	since := fs.Duration("since", 0, "only readings stored within this duration")
+	from := fs.String("from", "", "start of the range, RFC 3339")
+	to := fs.String("to", "", "end of the range, RFC 3339")
+	limit := fs.Int64("limit", 100, "maximum number of readings, 0 for all")
+	tenant := fs.String("tenant", "", "tenant whose readings to query")
+	metric := fs.String("metric", "", "query a metric routed to the metrics storage instead of the speed history")
+	if !parseFlags(fs, args) {
+		return 2
+	}
+
+	var start, end time.Time
+	var err error
+	if *since > 0 {
+		start = time.Now().Add(-*since)
+	}
+	if *from != "" {
+		if start, err = time.Parse(time.RFC3339, *from); err != nil {
+			return fail(fmt.Errorf("invalid -from, err %v", err))
+		}
+	}
+	if *to != "" {
+		if end, err = time.Parse(time.RFC3339, *to); err != nil {
+			return fail(fmt.Errorf("invalid -to, err %v", err))
+		}
+	}
+
+	if err := loadConfig(); err != nil {
+		return fail(err)
+	}
+	connectRedis()
+	ctx := service.WithTenant(context.Background(), *tenant)
+	if *metric != "" {
+		entries, err := service.QueryMetric(ctx, *metric, start, end, *limit)
+		if err != nil {
+			return fail(err)
+		}
+		for _, entry := range entries {
+			printJSON(entry)
+		}
+		return 0
+	}
+	entries, err := service.QueryHistory(ctx, start, end, *limit)
+	if err != nil {
+		return fail(err)
+	}
+	for _, entry := range entries {
+		printJSON(entry)
+	}
+	return 0
+}
+
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := fs.String("out", "", "file to write the readings to")
+	format := fs.String("format", "", "csv, ndjson or parquet, defaults to the extension of -out")
+	since := fs.Duration("since", 0, "only readings stored within this duration")
+	from := fs.String("from", "", "start of the range, RFC 3339")
+	to := fs.String("to", "", "end of the range, RFC 3339")
+	tenant := fs.String("tenant", "", "tenant whose readings to export")
+	if !parseFlags(fs, args) {
+		return 2
+	}
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "-out is required")
+		return 2
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(*out), ".")
+	}
+
+	var start, end time.Time
+	var err error
+	if *since > 0 {
+		start = time.Now().Add(-*since)
+	}
+	if *from != "" {
+		if start, err = time.Parse(time.RFC3339, *from); err != nil {
+			return fail(fmt.Errorf("invalid -from, err %v", err))
+		}
+	}
+	if *to != "" {
+		if end, err = time.Parse(time.RFC3339, *to); err != nil {
+			return fail(fmt.Errorf("invalid -to, err %v", err))
+		}
+	}
+
+	if err := loadConfig(); err != nil {
+		return fail(err)
+	}
+	connectRedis()
+	file, err := os.Create(*out)
+	if err != nil {
+		return fail(err)
+	}
+	w := bufio.NewWriter(file)
+	written, err := service.ExportHistory(service.WithTenant(context.Background(), *tenant), w, *format, start, end)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// a partial export is not left behind
+		os.Remove(*out)
+		return fail(err)
+	}
+	printJSON(map[string]interface{}{"file": *out, "format": *format, "readings": written})
+	return 0
+}
+
+func importCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	path := fs.String("file", "", "csv or ndjson file of readings to import")
+	format := fs.String("format", "", "csv or ndjson, defaults to the extension of -file")
+	rejections := fs.String("rejections", "", "file to write the rejected records to")
+	tenant := fs.String("tenant", "", "tenant to import the readings for")
+	if !parseFlags(fs, args) {
+		return 2
+	}
+	if *path == "" {
+		fmt.Fprintln(os.Stderr, "-file is required")
+		return 2
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(*path), ".")
+		if *format == "jsonl" {
+			*format = service.FormatNDJSON
+		}
+	}
+
+	if err := loadConfig(); err != nil {
+		return fail(err)
+	}
+	connectRedis()
+	file, err := os.Open(*path)
+	if err != nil {
+		return fail(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fail(err)
+	}
+
+	ctx := service.WithTenant(context.Background(), *tenant)
+	job, err := service.ImportHistory(ctx, bufio.NewReader(file), *format, info.Size())
+	if job != nil {
+		printJSON(job)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if *rejections != "" && job.Rejected > 0 {
+		out, err := os.Create(*rejections)
+		if err != nil {
+			return fail(err)
+		}
+		err = service.WriteImportRejections(ctx, job.ID, out)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+	return 0
+}
+
+func commandCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: command send|list|get [flags]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("command "+args[0], flag.ContinueOnError)
+	device := fs.String("id", "", "device ID")
+	commandID := fs.String("command", "", "command ID")
+	name := fs.String("name", "", "name of the command to send")
+	params := fs.String("params", "", "parameters of the command as JSON")
+	timeout := fs.Int("timeout", 0, "seconds the device has to respond, defaults to [commands] timeout")
+	limit := fs.Int64("limit", 100, "number of commands to list")
+	tenant := fs.String("tenant", "", "tenant the device belongs to")
+	if !parseFlags(fs, args[1:]) {
+		return 2
+	}
+	if *device == "" {
+		fmt.Fprintln(os.Stderr, "-id is required")
+		return 2
+	}
+	if err := loadConfig(); err != nil {
+		return fail(err)
+	}
+	connectRedis()
+	ctx := service.WithTenant(context.Background(), *tenant)
+
+	switch args[0] {
+	case "send":
+		req := models.CommandRequest{Name: *name, Timeout: *timeout}
+		if *params != "" {
+			if !json.Valid([]byte(*params)) {
+				return fail(errors.New("-params must be JSON"))
+			}
+			req.Params = json.RawMessage(*params)
+		}
+		connectCommands()
+		defer utils.DisconnectCommands(context.Background())
+		// responses are recorded by the running service, follow them with command get
+		command, err := service.SendCommand(ctx, *device, req)
+		if err != nil {
+			return fail(err)
+		}
+		printJSON(command)
+	case "list":
+		commands, err := service.DeviceCommands(ctx, *device, *limit)
+		if err != nil {
+			return fail(err)
+		}
+		for _, command := range commands {
+			printJSON(command)
+		}
+	case "get":
+		command, err := service.LookupCommand(ctx, *device, *commandID)
+		if err != nil {
+			return fail(err)
+		}
+		if command == nil {
+			return fail(service.ErrCommandNotFound)
+		}
+		printJSON(command)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command action %q\n", args[0])
+		return 2
+	}
+	return 0
+}
+
+func replayCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: replay start|status|pause|resume|cancel [flags]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("replay "+args[0], flag.ContinueOnError)
+	id := fs.String("id", "", "replay job ID")
+	from := fs.String("from", "", "start of the range to replay, RFC 3339")
+	to := fs.String("to", "", "end of the range to replay, RFC 3339")
+	topic := fs.String("topic", "", "topic to publish the readings onto")
+	speed := fs.Float64("speed", 1, "speed factor, 2 replays twice as fast as recorded and 0 as fast as possible")
+	tenant := fs.String("tenant", "", "tenant whose readings to replay")
+	if !parseFlags(fs, args[1:]) {
+		return 2
+	}
+	if *id == "" && args[0] != "start" {
+		fmt.Fprintln(os.Stderr, "-id is required")
+		return 2
+	}
+	if err := loadConfig(); err != nil {
+		return fail(err)
+	}
+	connectRedis()
+	ctx := service.WithTenant(context.Background(), *tenant)
+
+	var job *models.ReplayJob
+	var err error
+	switch args[0] {
+	case "start":
+		req := models.ReplayRequest{Topic: *topic, SpeedFactor: speed}
+		if req.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			return fail(fmt.Errorf("invalid -from, err %v", err))
+		}
+		if req.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			return fail(fmt.Errorf("invalid -to, err %v", err))
+		}
+		connectMQTT()
+		defer utils.MQTTClient.Disconnect(250)
+		// interrupting the command stops the replay, which is then marked failed
+		ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		job, err = service.Replay(ctx, req)
+	case "status":
+		if job, err = service.LookupReplay(ctx, *id); err == nil && job == nil {
+			err = service.ErrReplayNotFound
+		}
+	case service.ReplayPause, service.ReplayResume, service.ReplayCancel:
+		job, err = service.ControlReplay(ctx, *id, args[0])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown replay command %q\n", args[0])
+		return 2
+	}
+	if job != nil {
+		printJSON(job)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func tenantCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: tenant create|list|get|suspend|activate [flags]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("tenant "+args[0], flag.ContinueOnError)
+	id := fs.String("id", "", "tenant ID")
+	name := fs.String("name", "", "display name of a new tenant")
+	readingsPerDay := fs.Int64("readings-per-day", -1, "daily reading quota of a new tenant, defaults to [tenancy] default_readings_per_day")
+	maxDevices := fs.Int64("max-devices", -1, "device quota of a new tenant, defaults to [tenancy] default_max_devices")
+	if !parseFlags(fs, args[1:]) {
+		return 2
+	}
+	if *id == "" && args[0] != "list" {
+		fmt.Fprintln(os.Stderr, "-id is required")
+		return 2
+	}
+	if err := loadConfig(); err != nil {
+		return fail(err)
+	}
+	connectRedis()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "create":
+		req := models.TenantRequest{ID: *id, Name: *name}
+		if *readingsPerDay >= 0 || *maxDevices >= 0 {
+			cfg := config.GetConfig().Tenancy
+			req.Quota = &models.TenantQuota{ReadingsPerDay: cfg.DefaultReadingsPerDay, MaxDevices: cfg.DefaultMaxDevices}
+			if *readingsPerDay >= 0 {
+				req.Quota.ReadingsPerDay = *readingsPerDay
+			}
+			if *maxDevices >= 0 {
+				req.Quota.MaxDevices = *maxDevices
+			}
+		}
+		tenant, apiKey, err := service.RegisterTenant(ctx, req)
+		if err != nil {
+			return fail(err)
+		}
+		printJSON(map[string]interface{}{"tenant": tenant, "api_key": apiKey})
+		return 0
+
+	case "list":
+		tenants, err := service.AllTenants(ctx)
+		if err != nil {
+			return fail(err)
+		}
+		for _, tenant := range tenants {
+			printJSON(tenant)
+		}
+		return 0
+
+	case "get":
+		tenant, err := service.LookupTenant(ctx, *id)
+		if err != nil {
+			return fail(err)
+		}
+		if tenant == nil {
+			return fail(service.ErrTenantNotFound)
+		}
+		printJSON(tenant)
+		return 0
+
+	case "suspend", "activate":
+		status := service.TenantSuspended
+		if args[0] == "activate" {
+			status = service.TenantActive
+		}
+		tenant, err := service.SetTenantStatus(ctx, *id, status)
+		if err != nil {
+			return fail(err)
+		}
+		printJSON(tenant)
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown tenant command %q\n", args[0])
+	return 2
+}
+
+func deadLettersCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: dead-letters list|replay [flags]")
+		return 2
+	}
+
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("dead-letters list", flag.ContinueOnError)
+		limit := fs.Int64("limit", 20, "maximum number of dead letters, 0 for all")
+		if !parseFlags(fs, args[1:]) {
+			return 2
+		}
+		if err := loadConfig(); err != nil {
+			return fail(err)
+		}
+		connectRedis()
+		letters, err := service.ListDeadLetters(context.Background(), *limit)
+		if err != nil {
+			return fail(err)
+		}
+		for _, letter := range letters {
+			printJSON(letter)
+		}
+		return 0
+
+	case "replay":
+		fs := flag.NewFlagSet("dead-letters replay", flag.ContinueOnError)
+		id := fs.String("id", "", "dead letter to replay")
+		all := fs.Bool("all", false, "replay every dead letter")
+		if !parseFlags(fs, args[1:]) {
+			return 2
+		}
+		if (*id == "") == !*all {
+			fmt.Fprintln(os.Stderr, "exactly one of -id or -all is required")
+			return 2
+		}
+		if err := loadConfig(); err != nil {
+			return fail(err)
+		}
+		connectRedis()
+		connectMQTT()
+		defer utils.MQTTClient.Disconnect(250)
+		replayed, err := service.ReplayDeadLetters(context.Background(), *id)
+		fmt.Println("replayed", replayed, "dead letters")
+		if err != nil {
+			return fail(err)
+		}
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown dead-letters command %q\n", args[0])
+	return 2
+}
+
+func storageCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: storage usage|compact")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("storage "+args[0], flag.ContinueOnError)
+	if !parseFlags(fs, args[1:]) {
+		return 2
+	}
+	if err := loadConfig(); err != nil {
+		return fail(err)
+	}
+	connectRedis()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "usage":
+		policies, err := service.StorageUsage(ctx)
+		if err != nil {
+			return fail(err)
+		}
+		for _, policy := range policies {
+			printJSON(policy)
+		}
+		return 0
+
+	case "compact":
+		if err := service.Compact(ctx); err != nil {
+			return fail(err)
+		}
+		fmt.Println("compacted stored readings")
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown storage command %q\n", args[0])
+	return 2
+}
+
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: config validate")
+		return 2
+	}
+
+	if _, err := config.Load(options); err != nil {
+		var joined interface{ Unwrap() []error }
+		if errors.As(err, &joined) {
+			fmt.Fprintln(os.Stderr, "invalid config:")
+			for _, problem := range joined.Unwrap() {
+				fmt.Fprintln(os.Stderr, " -", problem)
+			}
+			return 1
+		}
+		return fail(err)
+	}
+	fmt.Println("config is valid:", options.Path)
+	return 0
+}
@@ -0,0 +1,126 @@
+// Command mqtt-pipeline-admin runs operational tasks against the pipeline's Redis and
+// MQTT broker directly, using the same config files as the server.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/uuid"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/service"
+	"github.com/mqtt-pipeline/internal/utils"
+)
+
+const usage = `usage: mqtt-pipeline-admin [-config path] [-env name] <command> [flags]
+
+commands:
+  token mint -email <email> [-ttl 5m]      mint a token, -tenant <id> or -admin to scope it
+  token revoke -token <token>              revoke a token until it expires
+  tenant create -id <id> [-name n]         create a tenant and print its API key
+  tenant list | get -id <id>               show tenants and their quota usage
+  tenant suspend|activate -id <id>         suspend or reactivate a tenant
+  device create -id <id> [-type t]         register a device, -name, -owner, -tags and -firmware set its fields
+  device list [-status online]             list devices, filtered by -type, -owner, -tags or -status
+  device get|update|delete -id <id>        show, change or remove a device, -enabled=false disables it
+  device status -id <id>                   show whether a device is online, why and since when
+  command send -id <id> -name <n>          send a command to a device, with -params <json> and -timeout
+  command list|get -id <id>                show the commands of a device, get takes -command <id>
+  publish -speed <n> [-count n]            publish test readings
+  tail                                     print messages arriving on the topic
+  history [-since 1h | -from t -to t]      query stored readings, -metric <name> for routed metrics
+  export -out <file> [-since 1h]           write stored readings to a csv, ndjson or parquet file
+  import -file <file> [-rejections f]      import a csv or ndjson file of readings into the history
+  replay start -from t -to t -topic <t>    publish stored readings onto a topic, -speed 0 for no delays
+  replay status|pause|resume|cancel -id    follow or control a replay, wherever it runs
+  dead-letters list [-limit n]             show messages that could not be ingested
+  dead-letters replay [-id id | -all]      publish dead letters to their topic again
+  storage usage                            show stored readings and rollups per retention policy
+  storage compact                          roll up and expire stored readings now
+  config validate                          load and validate the config files
+`
+
+// command is a subcommand; it returns the process exit code.
+type command func(args []string) int
+
+var commands = map[string]command{
+	"token":        tokenCommand,
+	"tenant":       tenantCommand,
+	"device":       deviceCommand,
+	"command":      commandCommand,
+	"publish":      publishCommand,
+	"tail":         tailCommand,
+	"history":      historyCommand,
+	"export":       exportCommand,
+	"import":       importCommand,
+	"replay":       replayCommand,
+	"dead-letters": deadLettersCommand,
+	"storage":      storageCommand,
+	"config":       configCommand,
+}
+
+var options config.Options
+
+func main() {
+	flag.StringVar(&options.Path, "config", config.EnvOrDefault(config.EnvPrefix+"CONFIG", config.DefaultPath), "path of the base config file")
+	flag.StringVar(&options.Environment, "env", os.Getenv(config.EnvPrefix+"ENV"), "environment overlay loaded from <env>.toml next to the config file")
+	flag.Usage = func() { fmt.Fprint(flag.CommandLine.Output(), usage) }
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	os.Exit(cmd(flag.Args()[1:]))
+}
+
+// loadConfig loads the config and keeps the logger quiet so only command output
+// reaches stdout.
+func loadConfig() error {
+	utils.InitLogClient()
+	if err := utils.SetLogLevel("warn"); err != nil {
+		return err
+	}
+	return config.InitGlobalConfig(options)
+}
+
+// connectRedis initialises the service packages on top of redis.
+func connectRedis() {
+	service.NewMQTTPipelineService(utils.InitRedis())
+}
+
+// connectMQTT connects to the broker under its own client ID so that the running
+// server is not disconnected.
+func connectMQTT() {
+	cfg := config.GetConfig()
+	cfg.MQTTConfig.ClientID = "mqtt-pipeline-admin-" + uuid.New().String()[:8]
+	config.SetConfig(cfg)
+	utils.InitMQTT()
+}
+
+// connectCommands connects the MQTT 5 command client under its own client ID, without
+// subscribing to the responses the running server records.
+func connectCommands() {
+	cfg := config.GetConfig()
+	cfg.MQTTConfig.ClientID = "mqtt-pipeline-admin-" + uuid.New().String()[:8]
+	config.SetConfig(cfg)
+	utils.InitCommands(false)
+}
+
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	return 1
+}
+
+func printJSON(v interface{}) {
+	out, _ := json.Marshal(v)
+	fmt.Println(string(out))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/models"
+)
+
+// profile describes how a vehicle drives: the range its cruising speed is picked
+// from, how fast it changes speed per reading and how often it comes to a stop.
+type profile struct {
+	min, max   float64
+	accel      float64
+	stopChance float64
+}
+
+var profiles = map[string]profile{
+	"urban":   {min: 10, max: 60, accel: 5, stopChance: 0.3},
+	"highway": {min: 70, max: 100, accel: 3, stopChance: 0},
+	"rural":   {min: 40, max: 90, accel: 4, stopChance: 0.05},
+}
+
+// vehicle produces a speed reading per tick, accelerating towards a target speed
+// that it holds for a while before picking the next one.
+type vehicle struct {
+	rng     *rand.Rand
+	profile profile
+	speed   float64
+	target  float64
+	hold    int
+}
+
+func newVehicle(name string, rng *rand.Rand) *vehicle {
+	p, ok := profiles[name]
+	if !ok {
+		// mixed: every vehicle gets one of the profiles
+		names := []string{"urban", "highway", "rural"}
+		p = profiles[names[rng.Intn(len(names))]]
+	}
+	return &vehicle{rng: rng, profile: p}
+}
+
+func (v *vehicle) next() int {
+	if v.hold <= 0 {
+		if v.rng.Float64() < v.profile.stopChance {
+			v.target = 0
+		} else {
+			v.target = v.profile.min + v.rng.Float64()*(v.profile.max-v.profile.min)
+		}
+		v.hold = 5 + v.rng.Intn(20)
+	}
+	v.hold--
+
+	step := math.Min(math.Abs(v.target-v.speed), v.profile.accel)
+	if v.target < v.speed {
+		step = -step
+	}
+	v.speed += step + v.rng.NormFloat64()*0.5
+	v.speed = math.Max(constants.MinSpeed, math.Min(constants.MaxSpeed, v.speed))
+	return int(math.Round(v.speed))
+}
+
+// publisher sends the readings of one device.
+type publisher interface {
+	publish(ctx context.Context, reading models.SpeedData) error
+	close()
+}
+
+// httpPublisher publishes through the REST API with a token of its own.
+type httpPublisher struct {
+	client   *http.Client
+	baseURL  string
+	email    string
+	tenant   string
+	apiKey   string
+	deviceID string
+	token    string
+}
+
+func newHTTPPublisher(ctx context.Context, client *http.Client, baseURL, deviceID, tenant, apiKey string) (*httpPublisher, error) {
+	p := &httpPublisher{
+		client:   client,
+		baseURL:  strings.TrimSuffix(baseURL, constants.ForwardSlash),
+		email:    deviceID + "@simulate.local",
+		tenant:   tenant,
+		apiKey:   apiKey,
+		deviceID: deviceID,
+	}
+	return p, p.login(ctx)
+}
+
+// login gets a token for the device. Token requests are rate limited per IP, so when
+// the limit is hit it waits for the Retry-After of the response, or backs off, and
+// tries again until ctx is done.
+func (p *httpPublisher) login(ctx context.Context) error {
+	body, _ := json.Marshal(models.Email{Email: p.email, Tenant: p.tenant, APIKey: p.apiKey})
+	backoff := time.Second
+	var resp *http.Response
+	for {
+		var err error
+		resp, err = p.do(ctx, constants.ForwardSlash+constants.Version+constants.ForwardSlash, body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+		resp.Body.Close()
+		wait := backoff
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			wait = time.Duration(seconds) * time.Second
+		} else if backoff < 30*time.Second {
+			backoff *= 2
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request failed with http %d", resp.StatusCode)
+	}
+	var token map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+	p.token = token["token"]
+	return nil
+}
+
+func (p *httpPublisher) publish(ctx context.Context, reading models.SpeedData) error {
+	body, _ := json.Marshal(reading)
+	path := constants.ForwardSlash + constants.Version + constants.ForwardSlash + constants.Publish
+	for attempt := 0; ; attempt++ {
+		resp, err := p.do(ctx, path, body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted:
+			return nil
+		case resp.StatusCode == http.StatusUnauthorized && attempt == 0:
+			// the token expired, get a new one and retry once
+			if err := p.login(ctx); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("http %d", resp.StatusCode)
+		}
+	}
+}
+
+func (p *httpPublisher) do(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", constants.ContentType)
+	req.Header.Set(constants.TransactionID, uuid.New().String())
+	req.Header.Set(constants.DeviceID, p.deviceID)
+	if p.token != "" {
+		req.Header.Set("authorization", p.token)
+	}
+	return p.client.Do(req)
+}
+
+func (p *httpPublisher) close() {}
+
+// mqttPublisher publishes straight to the topic over its own broker connection.
+type mqttPublisher struct {
+	client mqtt.Client
+	topic  string
+	qos    byte
+}
+
+func newMQTTPublisher(cfg config.MQTT, topic, deviceID string) (*mqttPublisher, error) {
+	opts := mqtt.NewClientOptions().AddBroker(cfg.MQTTBroker)
+	opts.SetClientID(deviceID)
+	opts.SetCleanSession(true)
+	if cfg.Username != "" {
+		opts.SetUsername(cfg.Username)
+		opts.SetPassword(cfg.Password)
+	}
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return &mqttPublisher{client: client, topic: topic, qos: byte(cfg.QoS)}, nil
+}
+
+func (p *mqttPublisher) publish(ctx context.Context, reading models.SpeedData) error {
+	payload, _ := json.Marshal(reading)
+	token := p.client.Publish(p.topic, p.qos, false, payload)
+	if !token.WaitTimeout(10 * time.Second) {
+		return errors.New("publish timed out")
+	}
+	return token.Error()
+}
+
+func (p *mqttPublisher) close() {
+	p.client.Disconnect(250)
+}
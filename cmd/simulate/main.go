@@ -0,0 +1,233 @@
+// Command simulate runs a fleet of virtual devices that publish speed readings through
+// the REST API or directly to the MQTT topic, and reports error rates and the latency
+// from publish until the reading is stored in Redis.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+	"github.com/mqtt-pipeline/internal/utils"
+)
+
+// sent is a reading the service accepted.
+type sent struct {
+	messageID string
+	at        time.Time
+}
+
+// results collects the outcome of every publish across devices.
+type results struct {
+	mu     sync.Mutex
+	sent   []sent
+	errors map[string]int
+}
+
+func (r *results) ok(messageID string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, sent{messageID: messageID, at: at})
+}
+
+func (r *results) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors[err.Error()]++
+}
+
+func main() {
+	mode := flag.String("mode", "http", "publish through the REST API (http) or straight to the topic (mqtt)")
+	baseURL := flag.String("url", "http://127.0.0.1:4000", "base URL of the service in http mode")
+	devices := flag.Int("devices", 10, "number of virtual devices")
+	rate := flag.Float64("rate", 1, "readings per second per device")
+	duration := flag.Duration("duration", time.Minute, "how long to publish for")
+	profileName := flag.String("profile", "mixed", "speed profile: urban, highway, rural or mixed")
+	measureLatency := flag.Bool("latency", true, "read the message status from redis to measure end-to-end latency")
+	drain := flag.Duration("drain", 10*time.Second, "how long to wait for readings to be stored before measuring latency")
+	tenant := flag.String("tenant", "", "tenant the devices publish for when multi-tenancy is enabled")
+	apiKey := flag.String("api-key", "", "API key of the tenant, used for tokens in http mode")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "random seed for the speed profiles")
+	configPath := flag.String("config", config.EnvOrDefault(config.EnvPrefix+"CONFIG", config.DefaultPath), "config file used for the broker in mqtt mode and redis for latency")
+	environment := flag.String("env", os.Getenv(config.EnvPrefix+"ENV"), "environment overlay loaded from <env>.toml next to the config file")
+	flag.Parse()
+
+	if *mode != "http" && *mode != "mqtt" {
+		log.Fatalf("unknown mode %q, use http or mqtt", *mode)
+	}
+	if _, ok := profiles[*profileName]; !ok && *profileName != "mixed" {
+		log.Fatalf("unknown profile %q", *profileName)
+	}
+	if *devices <= 0 || *rate <= 0 {
+		log.Fatal("-devices and -rate must be positive")
+	}
+
+	utils.InitLogClient()
+	if err := utils.SetLogLevel("warn"); err != nil {
+		log.Fatal(err)
+	}
+	if *mode == "mqtt" || *measureLatency {
+		if err := config.InitGlobalConfig(config.Options{Path: *configPath, Environment: *environment}); err != nil {
+			log.Fatalf("Unable to initialize global config, err %v", err)
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	run := uuid.New().String()[:8]
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	publishers := make([]publisher, 0, *devices)
+	deviceIDs := make([]string, 0, *devices)
+	for i := 0; i < *devices; i++ {
+		deviceID := fmt.Sprintf("sim-%s-%d", run, i)
+		var p publisher
+		var err error
+		if *mode == "http" {
+			p, err = newHTTPPublisher(ctx, httpClient, *baseURL, deviceID, *tenant, *apiKey)
+		} else {
+			p, err = newMQTTPublisher(config.GetConfig().MQTTConfig, utils.TenantTopic(*tenant), deviceID)
+		}
+		if err != nil {
+			log.Fatalf("unable to start device %v, err %v", deviceID, err)
+		}
+		publishers = append(publishers, p)
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	fmt.Printf("started %d devices publishing over %s, %.2f readings/s each for %v\n", *devices, *mode, *rate, *duration)
+
+	res := &results{errors: map[string]int{}}
+	runCtx, stop := context.WithTimeout(ctx, *duration)
+	defer stop()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i, p := range publishers {
+		wg.Add(1)
+		go func(deviceID string, p publisher, v *vehicle) {
+			defer wg.Done()
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-runCtx.Done():
+					return
+				case <-ticker.C:
+				}
+				speed := v.next()
+				reading := models.SpeedData{Speed: &speed, MessageID: uuid.New().String(), DeviceID: deviceID}
+				at := time.Now()
+				if err := p.publish(runCtx, reading); err != nil {
+					if runCtx.Err() == nil {
+						res.fail(err)
+					}
+					continue
+				}
+				res.ok(reading.MessageID, at)
+			}
+		}(deviceIDs[i], p, newVehicle(*profileName, rand.New(rand.NewSource(*seed+int64(i)))))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	for _, p := range publishers {
+		p.close()
+	}
+
+	failed := 0
+	for _, n := range res.errors {
+		failed += n
+	}
+	total := len(res.sent) + failed
+	fmt.Printf("\npublished %d readings in %v (%.1f/s), %d errors (%.2f%%)\n",
+		len(res.sent), elapsed.Round(time.Millisecond), float64(len(res.sent))/elapsed.Seconds(), failed, percent(failed, total))
+	for reason, n := range res.errors {
+		fmt.Printf("  %6d  %s\n", n, reason)
+	}
+
+	if *measureLatency && len(res.sent) > 0 {
+		fmt.Printf("\nwaiting %v for readings to be stored\n", *drain)
+		select {
+		case <-time.After(*drain):
+		case <-ctx.Done():
+		}
+		reportLatency(service.WithTenant(context.Background(), *tenant), res.sent)
+	}
+}
+
+// reportLatency looks up the ingested_at time of every accepted reading, using the
+// tenant of ctx.
+func reportLatency(ctx context.Context, readings []sent) {
+	client, err := utils.NewRedisClient(config.GetConfig().RedisConfig)
+	if err != nil {
+		log.Fatalf("unable to connect to redis, err %v", err)
+	}
+	defer client.Close()
+	service.NewMQTTPipelineService(client)
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	notStored, lookupErrors := 0, 0
+	jobs := make(chan sent)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for reading := range jobs {
+				status, err := service.LookupMessageStatus(ctx, reading.messageID)
+				mu.Lock()
+				switch {
+				case err != nil:
+					lookupErrors++
+				case status == nil || status.IngestedAt == nil:
+					notStored++
+				default:
+					latencies = append(latencies, status.IngestedAt.Sub(reading.at))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, reading := range readings {
+		jobs <- reading
+	}
+	close(jobs)
+	wg.Wait()
+
+	fmt.Printf("stored %d of %d readings, %d not stored, %d status lookups failed\n",
+		len(latencies), len(readings), notStored, lookupErrors)
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Printf("publish to storage latency: p50 %v, p90 %v, p99 %v, max %v\n",
+		quantile(latencies, 0.5), quantile(latencies, 0.9), quantile(latencies, 0.99), latencies[len(latencies)-1])
+}
+
+func quantile(sorted []time.Duration, q float64) time.Duration {
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i].Round(time.Microsecond)
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
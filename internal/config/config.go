@@ -3,73 +3,292 @@ package config
 import (
 	"fmt"
 	"log"
-	"os"
-
-	"github.com/pelletier/go-toml"
+	"sync"
 )
 
 var (
-	globalConfig GlobalConfig
+	globalConfig   GlobalConfig
+	globalConfigMu sync.RWMutex
+	loadedOptions  Options
 )
 
 // Global Configuration
 type GlobalConfig struct {
-	Server      Server `toml:"server"`
-	RedisConfig Redis  `toml:"redis"`
-	MQTTConfig  MQTT   `toml:"mqtt"`
+	Server        Server        `toml:"server"`
+	GRPC          GRPC          `toml:"grpc"`
+	RedisConfig   Redis         `toml:"redis"`
+	MQTTConfig    MQTT          `toml:"mqtt"`
+	Routing       Routing       `toml:"routing"`
+	Health        Health        `toml:"health"`
+	Log           Log           `toml:"log"`
+	RateLimit     RateLimit     `toml:"rate_limit"`
+	Idempotency   Idempotency   `toml:"idempotency"`
+	OutboundQueue OutboundQueue `toml:"outbound_queue"`
+	MessageStatus MessageStatus `toml:"message_status"`
+	Retention     Retention     `toml:"retention"`
+	Import        Import        `toml:"import"`
+	Devices       Devices       `toml:"devices"`
+	Commands      Commands      `toml:"commands"`
+	Auth          Auth          `toml:"auth"`
+	Tenancy       Tenancy       `toml:"tenancy"`
+	Secrets       Secrets       `toml:"secrets"`
 }
 
-// Redis Configuration
+// Redis Configuration, redis_mode is single, sentinel or cluster. Timeouts are in seconds.
 type Redis struct {
-	Cert        string `toml:"redis_cert"`
-	URL         string `toml:"redis_url"`
-	IdleTimeout int    `toml:"redis_idle_timeout"`
-	DBNum       int    `toml:"redis_db_num"`
+	Mode             string   `toml:"redis_mode"`
+	URL              string   `toml:"redis_url"`
+	Addrs            []string `toml:"redis_addrs"`
+	MasterName       string   `toml:"redis_master_name"`
+	Username         string   `toml:"redis_username" secret:"true"`
+	Password         string   `toml:"redis_password" secret:"true"`
+	SentinelUsername string   `toml:"redis_sentinel_username" secret:"true"`
+	SentinelPassword string   `toml:"redis_sentinel_password" secret:"true"`
+	TLS              bool     `toml:"redis_tls"`
+	Cert             string   `toml:"redis_cert" secret:"true"`
+	ClientCert       string   `toml:"redis_client_cert" secret:"true"`
+	ClientKey        string   `toml:"redis_client_key" secret:"true"`
+	TLSServerName    string   `toml:"redis_tls_server_name"`
+	TLSSkipVerify    bool     `toml:"redis_tls_insecure_skip_verify"`
+	IdleTimeout      int      `toml:"redis_idle_timeout"`
+	DBNum            int      `toml:"redis_db_num"`
+	PoolSize         int      `toml:"redis_pool_size"`
+	MinIdleConns     int      `toml:"redis_min_idle_conns"`
+	PoolTimeout      int      `toml:"redis_pool_timeout"`
+	MaxConnAge       int      `toml:"redis_max_conn_age"`
+	DialTimeout      int      `toml:"redis_dial_timeout"`
+	ReadTimeout      int      `toml:"redis_read_timeout"`
+	WriteTimeout     int      `toml:"redis_write_timeout"`
+	MaxRetries       int      `toml:"redis_max_retries"`
+	StartupTimeout   int      `toml:"redis_startup_timeout"`
 }
 
-// server configuration
+// server configuration. trusted_proxies lists the IPs or CIDRs of the proxies whose
+// X-Forwarded-For header is trusted for the client IP; by default none is.
 type Server struct {
-	Address      string `toml:"address"`
-	ReadTimeOut  int    `toml:"read_time_out"`
-	WriteTimeOut int    `toml:"write_time_out"`
+	Address         string   `toml:"address"`
+	ReadTimeOut     int      `toml:"read_time_out"`
+	WriteTimeOut    int      `toml:"write_time_out"`
+	ShutdownTimeOut int      `toml:"shutdown_time_out"`
+	TrustedProxies  []string `toml:"trusted_proxies"`
+}
+
+// gRPC server, served next to the HTTP server on its own address
+type GRPC struct {
+	Enabled bool   `toml:"enabled"`
+	Address string `toml:"address"`
 }
 
 type MQTT struct {
-	MQTTBroker string `toml:"mqtt_broker"`
-	Topic      string `toml:"topic"`
+	MQTTBroker     string `toml:"mqtt_broker"`
+	ClientID       string `toml:"mqtt_client_id"`
+	Username       string `toml:"mqtt_username" secret:"true"`
+	Password       string `toml:"mqtt_password" secret:"true"`
+	Topic          string `toml:"topic"`
+	IngestBuffer   int    `toml:"ingest_buffer"`
+	IngestTimeout  int    `toml:"ingest_timeout"`
+	QoS            int    `toml:"qos"`
+	PublishTimeout int    `toml:"publish_timeout"`
+	AsyncPublish   bool   `toml:"async_publish"`
+}
+
+// topic routing, every rule maps the messages of a topic filter to a metric. + in a
+// filter matches one topic level and a trailing # the remaining ones. The first
+// matching rule wins and messages on [mqtt] topic that match none are speed readings.
+type Routing struct {
+	Routes []Route `toml:"routes"`
+}
+
+// decoder is json (the number in field, value by default) or text (the payload is
+// the number), validator is range (min to max) or none and storage is speed or
+// metrics. device_level is the topic level, counting from 1, holding the device ID.
+type Route struct {
+	Topic       string `toml:"topic"`
+	Metric      string `toml:"metric"`
+	Decoder     string `toml:"decoder"`
+	Field       string `toml:"field"`
+	Validator   string `toml:"validator"`
+	Min         Number `toml:"min"`
+	Max         Number `toml:"max"`
+	Storage     string `toml:"storage"`
+	DeviceLevel int    `toml:"device_level"`
+}
+
+// Number is a float setting that may also be written as an integer, which go-toml
+// does not convert to float64 by itself.
+type Number float64
+
+func (n *Number) UnmarshalTOML(value interface{}) error {
+	switch value := value.(type) {
+	case int64:
+		*n = Number(value)
+	case float64:
+		*n = Number(value)
+	default:
+		return fmt.Errorf("expected a number, got %v", value)
+	}
+	return nil
+}
+
+// health check configuration
+type Health struct {
+	MaxIngestLag        int `toml:"max_ingest_lag"`
+	ReadinessDrainDelay int `toml:"readiness_drain_delay"`
+	CheckTimeout        int `toml:"check_timeout"`
+}
+
+// logging configuration, output is stdout, stderr or a file path rotated by size
+type Log struct {
+	Level      string `toml:"level"`
+	Format     string `toml:"format"`
+	Output     string `toml:"output"`
+	MaxSize    int    `toml:"max_size"`
+	MaxBackups int    `toml:"max_backups"`
+	MaxAge     int    `toml:"max_age"`
+	Compress   bool   `toml:"compress"`
+}
+
+// rate limit configuration, each rule applies to one route and one key (subject, device or ip)
+type RateLimit struct {
+	Enabled bool            `toml:"enabled"`
+	Routes  []RateLimitRule `toml:"routes"`
+}
+
+type RateLimitRule struct {
+	Route     string `toml:"route"`
+	Key       string `toml:"key"`
+	Algorithm string `toml:"algorithm"`
+	Limit     int    `toml:"limit"`
+	Window    int    `toml:"window"`
+}
+
+// idempotency configuration, ttls are in seconds
+type Idempotency struct {
+	Enabled        bool `toml:"enabled"`
+	TTL            int  `toml:"ttl"`
+	IngestDedupTTL int  `toml:"ingest_dedup_ttl"`
+}
+
+// store-and-forward queue used while the broker is unavailable,
+// overflow_policy is reject or drop_oldest
+type OutboundQueue struct {
+	Enabled        bool   `toml:"enabled"`
+	MaxSize        int    `toml:"max_size"`
+	OverflowPolicy string `toml:"overflow_policy"`
+	FlushInterval  int    `toml:"flush_interval"`
+}
+
+// delivery status tracking for published messages, ttl is in seconds
+type MessageStatus struct {
+	Enabled bool `toml:"enabled"`
+	TTL     int  `toml:"ttl"`
+}
+
+// retention of stored readings, ages are in seconds and 0 keeps data forever. Raw
+// readings are rolled up per minute and the minutes per hour before they expire. The
+// first policy matching the metric and tenant of a series replaces the default ages.
+type Retention struct {
+	Enabled  bool              `toml:"enabled"`
+	Interval int               `toml:"interval"`
+	Raw      int               `toml:"raw"`
+	Minute   int               `toml:"minute"`
+	Hour     int               `toml:"hour"`
+	Policies []RetentionPolicy `toml:"policies"`
+}
+
+// an empty metric or tenant matches every metric or tenant
+type RetentionPolicy struct {
+	Name   string `toml:"name"`
+	Metric string `toml:"metric"`
+	Tenant string `toml:"tenant"`
+	Raw    int    `toml:"raw"`
+	Minute int    `toml:"minute"`
+	Hour   int    `toml:"hour"`
+}
+
+// bulk imports of historical readings, max_size is in MB and job_ttl in seconds. An
+// empty dir spools uploads to the system temporary directory.
+type Import struct {
+	MaxSize       int    `toml:"max_size"`
+	Dir           string `toml:"dir"`
+	JobTTL        int    `toml:"job_ttl"`
+	MaxRejections int    `toml:"max_rejections"`
+}
+
+// device registry, registry is off, flag or reject and decides what happens to readings
+// of devices that are not registered or are disabled. Devices that have not sent a
+// reading for offline_after seconds are offline. With presence enabled devices also
+// report online and offline on status_topic, whose + level is the device ID, and
+// presence changes are posted to the webhooks. webhook_timeout is in seconds.
+type Devices struct {
+	Registry       string   `toml:"registry"`
+	OfflineAfter   int      `toml:"offline_after"`
+	Presence       bool     `toml:"presence"`
+	StatusTopic    string   `toml:"status_topic"`
+	Webhooks       []string `toml:"webhooks"`
+	WebhookTimeout int      `toml:"webhook_timeout"`
+}
+
+// commands sent to devices, published on topic and acknowledged by the devices on
+// response_topic, where the + level is the device ID. Commands not acknowledged within
+// timeout seconds time out and are kept for retention seconds.
+type Commands struct {
+	Enabled       bool   `toml:"enabled"`
+	Topic         string `toml:"topic"`
+	ResponseTopic string `toml:"response_topic"`
+	Timeout       int    `toml:"timeout"`
+	Retention     int    `toml:"retention"`
+}
+
+// token signing configuration, token_ttl is in seconds
+type Auth struct {
+	JWTSecret string `toml:"jwt_secret" secret:"true"`
+	TokenTTL  int    `toml:"token_ttl"`
+}
+
+// multi-tenancy, when enabled tokens are issued per tenant and every tenant's topic
+// and redis keys are prefixed with its ID. Quotas of 0 are unlimited and only apply
+// to tenants created without quotas of their own.
+type Tenancy struct {
+	Enabled               bool  `toml:"enabled"`
+	DefaultReadingsPerDay int64 `toml:"default_readings_per_day"`
+	DefaultMaxDevices     int64 `toml:"default_max_devices"`
+}
+
+// secret providers, fields tagged secret may hold a reference such as
+// file:///run/secrets/redis_pw, env:NAME or vault:<mount>/<path>#<field>
+type Secrets struct {
+	VaultAddress   string `toml:"vault_address"`
+	VaultToken     string `toml:"vault_token"`
+	VaultNamespace string `toml:"vault_namespace"`
+	VaultKVVersion int    `toml:"vault_kv_version"`
+	Timeout        int    `toml:"timeout"`
 }
 
 // Setter method for GlobalConfig
 func SetConfig(cfg GlobalConfig) {
+	globalConfigMu.Lock()
+	defer globalConfigMu.Unlock()
 	globalConfig = cfg
 }
 
 // Getter method for GlobalConfig
 func GetConfig() GlobalConfig {
+	globalConfigMu.RLock()
+	defer globalConfigMu.RUnlock()
 	return globalConfig
 }
 
-// Loading the values from default.toml and assigning them as part of GlobalConfig struct
-func InitGlobalConfig() error {
-	path, err := os.Getwd()
-	if err != nil {
-		log.Println(err)
-	}
-	fmt.Println(path)
-	config, err := toml.LoadFile("config/defaults.toml")
-	fmt.Println("Err : ", err)
-	if err != nil {
-		log.Printf("Error while loading defaults.toml file : %v ", err)
-		return err
-	}
-
-	var appConfig GlobalConfig
-	err = config.Unmarshal(&appConfig)
+// Loading the values from the layered config files and environment, validating them
+// and assigning them as part of GlobalConfig struct
+func InitGlobalConfig(opts Options) error {
+	appConfig, err := Load(opts)
 	if err != nil {
-		log.Printf("Error while unmarshalling config : %v", err)
+		log.Printf("Error while loading config : %v", err)
 		return err
 	}
 
+	loadedOptions = opts
 	SetConfig(appConfig)
 	return nil
 }
@@ -0,0 +1,237 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const baseConfig = `
+[server]
+address = "0.0.0.0:4000"
+read_time_out = 10
+
+[redis]
+redis_url = "localhost:6379"
+
+[mqtt]
+mqtt_broker = "tcp://localhost:1883"
+topic = "speed_topic"
+qos = 1
+
+[[rate_limit.routes]]
+route = "publish"
+key = "ip"
+limit = 10
+window = 60
+`
+
+func writeConfig(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	assert.NilError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, dir, "defaults.toml", baseConfig)
+	writeConfig(t, dir, "production.toml", `
+[redis]
+redis_url = "redis.internal:6379"
+
+[mqtt]
+topic = "fleet/speed"
+`)
+
+	// Case 1 : base file only
+	cfg, err := Load(Options{Path: path})
+	assert.NilError(t, err)
+	assert.Equal(t, "localhost:6379", cfg.RedisConfig.URL)
+	assert.Equal(t, 10, cfg.Server.ReadTimeOut)
+	assert.Equal(t, 1, len(cfg.RateLimit.Routes))
+
+	// Case 2 : environment overlay replaces only the keys it sets
+	cfg, err = Load(Options{Path: path, Environment: "production"})
+	assert.NilError(t, err)
+	assert.Equal(t, "redis.internal:6379", cfg.RedisConfig.URL)
+	assert.Equal(t, "fleet/speed", cfg.MQTTConfig.Topic)
+	assert.Equal(t, "tcp://localhost:1883", cfg.MQTTConfig.MQTTBroker)
+	assert.Equal(t, 10, cfg.Server.ReadTimeOut)
+
+	// Case 3 : environment variables win over both files
+	t.Setenv("MQTTPIPELINE_REDIS_URL", "redis.override:6380")
+	t.Setenv("MQTTPIPELINE_SERVER_READ_TIME_OUT", "30")
+	t.Setenv("MQTTPIPELINE_RATE_LIMIT_ENABLED", "true")
+	cfg, err = Load(Options{Path: path, Environment: "production"})
+	assert.NilError(t, err)
+	assert.Equal(t, "redis.override:6380", cfg.RedisConfig.URL)
+	assert.Equal(t, 30, cfg.Server.ReadTimeOut)
+	assert.Equal(t, true, cfg.RateLimit.Enabled)
+
+	// Case 4 : malformed environment variable
+	t.Setenv("MQTTPIPELINE_SERVER_READ_TIME_OUT", "thirty")
+	_, err = Load(Options{Path: path})
+	assert.ErrorContains(t, err, "MQTTPIPELINE_SERVER_READ_TIME_OUT")
+
+	// Case 5 : missing overlay file
+	os.Unsetenv("MQTTPIPELINE_SERVER_READ_TIME_OUT")
+	_, err = Load(Options{Path: path, Environment: "staging"})
+	assert.ErrorContains(t, err, "staging")
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, dir, "defaults.toml", baseConfig)
+	t.Setenv("MQTTPIPELINE_REDIS_URL", "")
+	t.Setenv("MQTTPIPELINE_MQTT_QOS", "3")
+	t.Setenv("MQTTPIPELINE_DEVICES_REGISTRY", "strict")
+	t.Setenv("MQTTPIPELINE_DEVICES_PRESENCE", "true")
+	t.Setenv("MQTTPIPELINE_DEVICES_STATUS_TOPIC", "devices/#")
+	t.Setenv("MQTTPIPELINE_COMMANDS_ENABLED", "true")
+	t.Setenv("MQTTPIPELINE_COMMANDS_RESPONSE_TOPIC", "devices/commands")
+	t.Setenv("MQTTPIPELINE_SERVER_TRUSTED_PROXIES", "10.0.0.0/8,proxy.internal")
+
+	_, err := Load(Options{Path: path})
+	assert.ErrorContains(t, err, "redis.redis_url is required")
+	assert.Assert(t, strings.Contains(err.Error(), "mqtt.qos must be 0, 1 or 2"))
+	assert.Assert(t, strings.Contains(err.Error(), "devices.registry must be one of"))
+	assert.Assert(t, strings.Contains(err.Error(), "devices.status_topic"))
+	assert.Assert(t, strings.Contains(err.Error(), "commands.response_topic"))
+	assert.Assert(t, strings.Contains(err.Error(), `server.trusted_proxies "proxy.internal"`))
+	assert.Assert(t, !strings.Contains(err.Error(), `"10.0.0.0/8"`))
+}
+
+func TestValidateRoutes(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, dir, "defaults.toml", baseConfig+`
+[[routing.routes]]
+topic = "vehicles/+/rpm"
+metric = "rpm"
+validator = "range"
+min = 0
+max = 10000
+
+[[routing.routes]]
+topic = "vehicles/#/fuel"
+metric = "Fuel Level"
+decoder = "xml"
+
+[[routing.routes]]
+topic = "vehicles/temp+"
+metric = "temperature"
+validator = "range"
+min = 10
+max = -10
+`)
+
+	_, err := Load(Options{Path: path})
+	assert.ErrorContains(t, err, `routing.routes[1].topic "vehicles/#/fuel" may only use # as the last level`)
+	assert.Assert(t, strings.Contains(err.Error(), "routing.routes[1].metric must be lowercase letters"))
+	assert.Assert(t, strings.Contains(err.Error(), "routing.routes[1].decoder must be one of"))
+	assert.Assert(t, strings.Contains(err.Error(), `routing.routes[2].topic "vehicles/temp+" must use + and # as a whole level`))
+	assert.Assert(t, strings.Contains(err.Error(), "routing.routes[2].min must not be greater than max"))
+	assert.Assert(t, !strings.Contains(err.Error(), "routing.routes[0]"))
+}
+
+func TestValidateRetention(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, dir, "defaults.toml", baseConfig+`
+[retention]
+enabled = true
+interval = 300
+raw = -1
+
+[[retention.policies]]
+name = "engine"
+metric = "rpm"
+raw = 86400
+
+[[retention.policies]]
+minute = -60
+
+[[routing.routes]]
+topic = "fleet/speed"
+metric = "speed"
+`)
+
+	_, err := Load(Options{Path: path})
+	assert.ErrorContains(t, err, "retention.raw must not be negative")
+	assert.Assert(t, strings.Contains(err.Error(), "retention.policies[1].name is required"))
+	assert.Assert(t, strings.Contains(err.Error(), "retention.policies[1].minute must not be negative"))
+	assert.Assert(t, strings.Contains(err.Error(), "routing.routes[0].storage must be speed for the speed metric"))
+	assert.Assert(t, !strings.Contains(err.Error(), "retention.policies[0]"))
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "MQTTPIPELINE_REDIS_URL", EnvName("redis", "redis_url"))
+	assert.Equal(t, "MQTTPIPELINE_MQTT_BROKER", EnvName("mqtt", "mqtt_broker"))
+	assert.Equal(t, "MQTTPIPELINE_SERVER_ADDRESS", EnvName("server", "address"))
+}
+
+func TestEnvOrDefault(t *testing.T) {
+	t.Setenv("MQTTPIPELINE_CONFIG", "/etc/mqtt-pipeline/config.toml")
+	assert.Equal(t, "/etc/mqtt-pipeline/config.toml", EnvOrDefault("MQTTPIPELINE_CONFIG", DefaultPath))
+	// set but empty falls back like unset
+	t.Setenv("MQTTPIPELINE_CONFIG", "")
+	assert.Equal(t, DefaultPath, EnvOrDefault("MQTTPIPELINE_CONFIG", DefaultPath))
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, dir, "defaults.toml", baseConfig)
+	assert.NilError(t, InitGlobalConfig(Options{Path: path}))
+
+	writeConfig(t, dir, "defaults.toml", strings.NewReplacer(
+		`topic = "speed_topic"`, `topic = "fleet/speed"`,
+		`address = "0.0.0.0:4000"`, `address = "0.0.0.0:5000"`,
+		`limit = 10`, `limit = 20`,
+	).Replace(baseConfig))
+
+	// Case 1 : live and restart-only settings are reported separately
+	change, err := Reload()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"mqtt.topic", "rate_limit.routes"}, change.Applied)
+	assert.DeepEqual(t, []string{"server.address"}, change.RestartRequired)
+	assert.Equal(t, "fleet/speed", GetConfig().MQTTConfig.Topic)
+
+	// Case 2 : an invalid config is rejected and the current one kept
+	writeConfig(t, dir, "defaults.toml", strings.Replace(baseConfig, `topic = "speed_topic"`, `topic = ""`, 1))
+	_, err = Reload()
+	assert.ErrorContains(t, err, "mqtt.topic is required")
+	assert.Equal(t, "fleet/speed", GetConfig().MQTTConfig.Topic)
+
+	// Case 3 : the broker credentials are only used when connecting
+	writeConfig(t, dir, "defaults.toml", strings.Replace(baseConfig, `topic = "speed_topic"`, `topic = "fleet/speed"`, 1))
+	t.Setenv("MQTTPIPELINE_MQTT_USERNAME", "pipeline")
+	t.Setenv("MQTTPIPELINE_MQTT_PASSWORD", "rotated")
+	change, err = Reload()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"mqtt.mqtt_password", "mqtt.mqtt_username", "server.address"}, change.RestartRequired)
+}
+
+func TestLoadSecrets(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := writeConfig(t, dir, "mqtt_pw", "mqtt-secret\n")
+	path := writeConfig(t, dir, "defaults.toml", strings.Replace(baseConfig, `redis_url = "localhost:6379"`,
+		`redis_url = "localhost:6379"
+redis_password = "env:TEST_REDIS_PASSWORD"`, 1)+`
+[auth]
+jwt_secret = "env:TEST_JWT_SECRET"
+`)
+	t.Setenv("TEST_REDIS_PASSWORD", "redis-secret")
+	t.Setenv("TEST_JWT_SECRET", "signing-key")
+	t.Setenv("MQTTPIPELINE_MQTT_PASSWORD", "file://"+passwordFile)
+
+	cfg, err := Load(Options{Path: path})
+	assert.NilError(t, err)
+	assert.Equal(t, "redis-secret", cfg.RedisConfig.Password)
+	assert.Equal(t, "signing-key", cfg.Auth.JWTSecret)
+	assert.Equal(t, "mqtt-secret", cfg.MQTTConfig.Password)
+
+	os.Unsetenv("TEST_JWT_SECRET")
+	_, err = Load(Options{Path: path})
+	assert.ErrorContains(t, err, "auth.jwt_secret")
+}
@@ -0,0 +1,210 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mqtt-pipeline/internal/secrets"
+	"github.com/pelletier/go-toml"
+)
+
+const (
+	DefaultPath = "config/defaults.toml"
+	EnvPrefix   = "MQTTPIPELINE_"
+)
+
+// Options controls where the configuration is loaded from.
+type Options struct {
+	// Path of the base config file, defaults to config/defaults.toml.
+	Path string
+	// Environment selects an overlay file <env>.toml next to the base file whose
+	// values replace the ones in the base file.
+	Environment string
+}
+
+// EnvOrDefault returns the value of the environment variable name, or fallback when
+// it is not set or empty. The commands use it for the defaults of their flags.
+func EnvOrDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Load reads the base file, merges the environment overlay, applies the
+// MQTTPIPELINE_* environment variables and validates the result.
+func Load(opts Options) (GlobalConfig, error) {
+	var appConfig GlobalConfig
+	path := opts.Path
+	if path == "" {
+		path = DefaultPath
+	}
+
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		return appConfig, fmt.Errorf("unable to load config file %v, err %v", path, err)
+	}
+
+	if opts.Environment != "" {
+		overlayPath := filepath.Join(filepath.Dir(path), opts.Environment+".toml")
+		overlay, err := toml.LoadFile(overlayPath)
+		if err != nil {
+			return appConfig, fmt.Errorf("unable to load config file %v for environment %v, err %v", overlayPath, opts.Environment, err)
+		}
+		mergeTrees(tree, overlay)
+	}
+
+	if err := tree.Unmarshal(&appConfig); err != nil {
+		return appConfig, fmt.Errorf("unable to unmarshal config, err %v", err)
+	}
+
+	if err := applyEnvOverrides(&appConfig, os.LookupEnv); err != nil {
+		return appConfig, err
+	}
+
+	if err := resolveSecrets(&appConfig); err != nil {
+		return appConfig, err
+	}
+
+	if err := Validate(appConfig); err != nil {
+		return appConfig, err
+	}
+	return appConfig, nil
+}
+
+// mergeTrees copies every value of overlay into base. Tables are merged key by key,
+// anything else (including arrays of tables) replaces the base value.
+func mergeTrees(base, overlay *toml.Tree) {
+	for _, key := range overlay.Keys() {
+		overlayValue := overlay.GetPath([]string{key})
+		if overlayTree, ok := overlayValue.(*toml.Tree); ok {
+			if baseTree, ok := base.GetPath([]string{key}).(*toml.Tree); ok {
+				mergeTrees(baseTree, overlayTree)
+				continue
+			}
+		}
+		base.SetPath([]string{key}, overlayValue)
+	}
+}
+
+// EnvName returns the environment variable overriding key in section, e.g.
+// redis.redis_url is MQTTPIPELINE_REDIS_URL and server.address is MQTTPIPELINE_SERVER_ADDRESS.
+func EnvName(section, key string) string {
+	key = strings.TrimPrefix(key, section+"_")
+	return EnvPrefix + strings.ToUpper(section+"_"+key)
+}
+
+// applyEnvOverrides sets every scalar field of every section from its environment
+// variable when present. Lists of strings are comma separated; arrays of tables,
+// such as the rate limit rules, can only be set in the config files.
+func applyEnvOverrides(cfg *GlobalConfig, lookup func(string) (string, bool)) error {
+	root := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := tomlName(root.Type().Field(i))
+		sectionValue := root.Field(i)
+		if section == "" || sectionValue.Kind() != reflect.Struct {
+			continue
+		}
+
+		for j := 0; j < sectionValue.NumField(); j++ {
+			key := tomlName(sectionValue.Type().Field(j))
+			if key == "" {
+				continue
+			}
+			name := EnvName(section, key)
+			raw, ok := lookup(name)
+			if !ok {
+				continue
+			}
+			if err := setField(sectionValue.Field(j), raw); err != nil {
+				return fmt.Errorf("invalid value for %v, err %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveSecrets replaces every field tagged secret:"true" that holds a reference
+// with the secret it points to.
+func resolveSecrets(cfg *GlobalConfig) error {
+	resolver, err := secrets.NewResolver(secrets.Options{
+		VaultAddress:   cfg.Secrets.VaultAddress,
+		VaultToken:     cfg.Secrets.VaultToken,
+		VaultNamespace: cfg.Secrets.VaultNamespace,
+		VaultKVVersion: cfg.Secrets.VaultKVVersion,
+		Timeout:        time.Duration(cfg.Secrets.Timeout) * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	root := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Field(i)
+		if section.Kind() != reflect.Struct {
+			continue
+		}
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Field(j)
+			if section.Type().Field(j).Tag.Get("secret") != "true" || field.Kind() != reflect.String || !secrets.IsReference(field.String()) {
+				continue
+			}
+			value, err := resolver.Resolve(ctx, field.String())
+			if err != nil {
+				return fmt.Errorf("unable to resolve %v.%v, err %v", tomlName(root.Type().Field(i)), tomlName(section.Type().Field(j)), err)
+			}
+			field.SetString(value)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		value, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(value)
+	case reflect.Bool:
+		value, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return err
+		}
+		field.SetBool(value)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("only lists of strings can be set from the environment")
+		}
+		var values []string
+		for _, value := range strings.Split(raw, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		field.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported type %v", field.Type())
+	}
+	return nil
+}
+
+func tomlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
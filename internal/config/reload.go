@@ -0,0 +1,130 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// restartRequired lists the settings that are only read at startup. A section
+// mapped to nil requires a restart for every key in it.
+var restartRequired = map[string]map[string]bool{
+	"server":         nil,
+	"grpc":           nil,
+	"redis":          nil,
+	"mqtt":           {"mqtt_broker": true, "mqtt_client_id": true, "mqtt_username": true, "mqtt_password": true, "ingest_buffer": true},
+	"log":            {"format": true, "output": true, "max_size": true, "max_backups": true, "max_age": true, "compress": true},
+	"outbound_queue": {"flush_interval": true},
+	"retention":      {"interval": true},
+	"tenancy":        {"enabled": true},
+}
+
+// Change describes the outcome of a reload. Applied settings take effect without a
+// restart, RestartRequired ones were stored but are only used after a restart.
+type Change struct {
+	Old             GlobalConfig
+	New             GlobalConfig
+	Applied         []string
+	RestartRequired []string
+}
+
+// Reload loads the configuration again with the options used at startup and makes
+// it the global config. An invalid configuration is rejected and the current one kept.
+func Reload() (Change, error) {
+	appConfig, err := Load(loadedOptions)
+	if err != nil {
+		return Change{}, err
+	}
+
+	change := Change{Old: GetConfig(), New: appConfig}
+	for _, key := range Diff(change.Old, change.New) {
+		if needsRestart(key) {
+			change.RestartRequired = append(change.RestartRequired, key)
+		} else {
+			change.Applied = append(change.Applied, key)
+		}
+	}
+	SetConfig(appConfig)
+	return change, nil
+}
+
+// Diff returns the section.key names whose values differ between old and new.
+func Diff(old, new GlobalConfig) []string {
+	var changed []string
+	oldRoot, newRoot := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < oldRoot.NumField(); i++ {
+		section := tomlName(oldRoot.Type().Field(i))
+		oldSection, newSection := oldRoot.Field(i), newRoot.Field(i)
+		for j := 0; j < oldSection.NumField(); j++ {
+			if !reflect.DeepEqual(oldSection.Field(j).Interface(), newSection.Field(j).Interface()) {
+				changed = append(changed, section+"."+tomlName(oldSection.Type().Field(j)))
+			}
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func needsRestart(key string) bool {
+	section, name, _ := strings.Cut(key, ".")
+	keys, ok := restartRequired[section]
+	return ok && (keys == nil || keys[name])
+}
+
+// Watch calls onChange when one of the loaded config files changes, until ctx is
+// done. Events are debounced because editors write files in several steps.
+func Watch(ctx context.Context, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("unable to create config watcher, err %v", err)
+	}
+
+	path := loadedOptions.Path
+	if path == "" {
+		path = DefaultPath
+	}
+	files := map[string]bool{filepath.Clean(path): true}
+	if loadedOptions.Environment != "" {
+		files[filepath.Join(filepath.Dir(path), loadedOptions.Environment+".toml")] = true
+	}
+
+	// Watch the directory rather than the files so that atomic renames are noticed.
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("unable to watch %v, err %v", filepath.Dir(path), err)
+	}
+
+	go func() {
+		defer watcher.Close()
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if files[filepath.Clean(event.Name)] && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					debounce = time.After(500 * time.Millisecond)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error while watching config files : %v", err)
+			case <-debounce:
+				debounce = nil
+				onChange()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// metric names are used in redis keys and URLs
+var metricPattern = regexp.MustCompile(`^[a-z0-9_]{1,64}$`)
+
+// Validate checks that the values required at startup are present and consistent
+// and returns every problem found, not only the first one.
+func Validate(cfg GlobalConfig) error {
+	var errs []error
+	required := func(name, value string) {
+		if strings.TrimSpace(value) == "" {
+			errs = append(errs, fmt.Errorf("%v is required", name))
+		}
+	}
+	nonNegative := func(name string, value int) {
+		if value < 0 {
+			errs = append(errs, fmt.Errorf("%v must not be negative, got %d", name, value))
+		}
+	}
+	oneOf := func(name, value string, allowed ...string) {
+		for _, candidate := range allowed {
+			if value == candidate {
+				return
+			}
+		}
+		errs = append(errs, fmt.Errorf("%v must be one of %v, got %q", name, strings.Join(allowed, ", "), value))
+	}
+	// deviceTopic checks a topic whose single + level is the device ID
+	deviceTopic := func(name, topic string) {
+		if err := validateTopicFilter(topic); err != nil {
+			errs = append(errs, fmt.Errorf("%v %w", name, err))
+		} else if strings.Count(topic, "+") != 1 || strings.Contains(topic, "#") {
+			errs = append(errs, fmt.Errorf("%v %q must have one + level for the device ID and no #", name, topic))
+		}
+	}
+
+	required("server.address", cfg.Server.Address)
+	nonNegative("server.read_time_out", cfg.Server.ReadTimeOut)
+	nonNegative("server.write_time_out", cfg.Server.WriteTimeOut)
+	nonNegative("server.shutdown_time_out", cfg.Server.ShutdownTimeOut)
+	for _, proxy := range cfg.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			errs = append(errs, fmt.Errorf("server.trusted_proxies %q must be an IP or CIDR", proxy))
+		}
+	}
+
+	switch cfg.RedisConfig.Mode {
+	case "", "single":
+		required("redis.redis_url", cfg.RedisConfig.URL)
+	case "sentinel":
+		required("redis.redis_master_name", cfg.RedisConfig.MasterName)
+		if len(cfg.RedisConfig.Addrs) == 0 {
+			errs = append(errs, fmt.Errorf("redis.redis_addrs must list the sentinels in sentinel mode"))
+		}
+	case "cluster":
+		if len(cfg.RedisConfig.Addrs) == 0 {
+			errs = append(errs, fmt.Errorf("redis.redis_addrs must list the seed nodes in cluster mode"))
+		}
+		if cfg.RedisConfig.DBNum != 0 {
+			errs = append(errs, fmt.Errorf("redis.redis_db_num must be 0 in cluster mode"))
+		}
+	default:
+		oneOf("redis.redis_mode", cfg.RedisConfig.Mode, "single", "sentinel", "cluster")
+	}
+	if (cfg.RedisConfig.ClientCert == "") != (cfg.RedisConfig.ClientKey == "") {
+		errs = append(errs, fmt.Errorf("redis.redis_client_cert and redis.redis_client_key must be set together"))
+	}
+	nonNegative("redis.redis_idle_timeout", cfg.RedisConfig.IdleTimeout)
+	nonNegative("redis.redis_db_num", cfg.RedisConfig.DBNum)
+	nonNegative("redis.redis_pool_size", cfg.RedisConfig.PoolSize)
+	nonNegative("redis.redis_min_idle_conns", cfg.RedisConfig.MinIdleConns)
+	nonNegative("redis.redis_startup_timeout", cfg.RedisConfig.StartupTimeout)
+
+	if cfg.GRPC.Enabled {
+		required("grpc.address", cfg.GRPC.Address)
+	}
+
+	required("mqtt.topic", cfg.MQTTConfig.Topic)
+	if cfg.MQTTConfig.QoS < 0 || cfg.MQTTConfig.QoS > 2 {
+		errs = append(errs, fmt.Errorf("mqtt.qos must be 0, 1 or 2, got %d", cfg.MQTTConfig.QoS))
+	}
+	nonNegative("mqtt.ingest_buffer", cfg.MQTTConfig.IngestBuffer)
+	nonNegative("mqtt.ingest_timeout", cfg.MQTTConfig.IngestTimeout)
+	nonNegative("mqtt.publish_timeout", cfg.MQTTConfig.PublishTimeout)
+
+	for i, route := range cfg.Routing.Routes {
+		name := fmt.Sprintf("routing.routes[%d]", i)
+		if err := validateTopicFilter(route.Topic); err != nil {
+			errs = append(errs, fmt.Errorf("%v.topic %w", name, err))
+		}
+		if !metricPattern.MatchString(route.Metric) {
+			errs = append(errs, fmt.Errorf("%v.metric must be lowercase letters, digits and _, got %q", name, route.Metric))
+		}
+		oneOf(name+".decoder", route.Decoder, "", "json", "text")
+		oneOf(name+".validator", route.Validator, "", "range", "none")
+		oneOf(name+".storage", route.Storage, "", "speed", "metrics")
+		if route.Validator == "range" && route.Min > route.Max {
+			errs = append(errs, fmt.Errorf("%v.min must not be greater than max", name))
+		}
+		nonNegative(name+".device_level", route.DeviceLevel)
+		if route.Metric == "speed" && route.Storage != "speed" {
+			errs = append(errs, fmt.Errorf("%v.storage must be speed for the speed metric", name))
+		}
+	}
+
+	if cfg.Retention.Enabled {
+		nonNegative("retention.interval", cfg.Retention.Interval)
+		nonNegative("retention.raw", cfg.Retention.Raw)
+		nonNegative("retention.minute", cfg.Retention.Minute)
+		nonNegative("retention.hour", cfg.Retention.Hour)
+	}
+	for i, policy := range cfg.Retention.Policies {
+		name := fmt.Sprintf("retention.policies[%d]", i)
+		required(name+".name", policy.Name)
+		nonNegative(name+".raw", policy.Raw)
+		nonNegative(name+".minute", policy.Minute)
+		nonNegative(name+".hour", policy.Hour)
+	}
+
+	nonNegative("import.max_size", cfg.Import.MaxSize)
+	nonNegative("import.job_ttl", cfg.Import.JobTTL)
+	nonNegative("import.max_rejections", cfg.Import.MaxRejections)
+
+	oneOf("devices.registry", cfg.Devices.Registry, "", "off", "flag", "reject")
+	nonNegative("devices.offline_after", cfg.Devices.OfflineAfter)
+	if cfg.Devices.Presence {
+		deviceTopic("devices.status_topic", cfg.Devices.StatusTopic)
+	}
+	for i, webhook := range cfg.Devices.Webhooks {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("devices.webhooks[%d] must be an http or https URL, got %q", i, webhook))
+		}
+	}
+	nonNegative("devices.webhook_timeout", cfg.Devices.WebhookTimeout)
+
+	if cfg.Commands.Enabled {
+		deviceTopic("commands.topic", cfg.Commands.Topic)
+		deviceTopic("commands.response_topic", cfg.Commands.ResponseTopic)
+		if cfg.Commands.Topic == cfg.Commands.ResponseTopic {
+			errs = append(errs, errors.New("commands.topic and commands.response_topic must differ"))
+		}
+	}
+	nonNegative("commands.timeout", cfg.Commands.Timeout)
+	nonNegative("commands.retention", cfg.Commands.Retention)
+
+	nonNegative("auth.token_ttl", cfg.Auth.TokenTTL)
+
+	if cfg.Tenancy.DefaultReadingsPerDay < 0 {
+		errs = append(errs, fmt.Errorf("tenancy.default_readings_per_day must not be negative, got %d", cfg.Tenancy.DefaultReadingsPerDay))
+	}
+	if cfg.Tenancy.DefaultMaxDevices < 0 {
+		errs = append(errs, fmt.Errorf("tenancy.default_max_devices must not be negative, got %d", cfg.Tenancy.DefaultMaxDevices))
+	}
+
+	oneOf("log.level", cfg.Log.Level, "", "debug", "info", "warn", "error", "dpanic", "panic", "fatal")
+	oneOf("log.format", cfg.Log.Format, "", "json", "console")
+
+	if cfg.OutboundQueue.Enabled {
+		oneOf("outbound_queue.overflow_policy", cfg.OutboundQueue.OverflowPolicy, "reject", "drop_oldest")
+		nonNegative("outbound_queue.max_size", cfg.OutboundQueue.MaxSize)
+	}
+
+	for i, rule := range cfg.RateLimit.Routes {
+		name := fmt.Sprintf("rate_limit.routes[%d]", i)
+		required(name+".route", rule.Route)
+		oneOf(name+".key", rule.Key, "subject", "device", "ip")
+		oneOf(name+".algorithm", rule.Algorithm, "", "sliding_window", "token_bucket")
+		if rule.Limit <= 0 || rule.Window <= 0 {
+			errs = append(errs, fmt.Errorf("%v limit and window must be positive", name))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// validateTopicFilter checks that + and # take up a whole topic level and that # is
+// the last level.
+func validateTopicFilter(filter string) error {
+	if filter == "" {
+		return errors.New("is required")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) > 1 {
+			return fmt.Errorf("%q must use + and # as a whole level", filter)
+		}
+		if level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("%q may only use # as the last level", filter)
+		}
+	}
+	return nil
+}
@@ -5,8 +5,77 @@ const (
 	Version       = "v1"
 	Get           = "get"
 	TransactionID = "transaction-id"
+	DeviceID      = "device-id"
+	LoggerKey     = "logger"
+	EmailKey      = "email"
+	TokenIDKey    = "jti"
+	TenantKey     = "tenant"
+	AdminKey      = "admin"
+	MessageIDKey  = "message_id"
+	// GlobalAdminKey marks admin tokens that are not scoped to a tenant
+	GlobalAdminKey = "global_admin"
+
+	IdempotencyKey     = "Idempotency-Key"
+	IdempotentReplayed = "Idempotent-Replayed"
 	//Topic  = "speed_topic"
-	Publish = "publish"
+	Publish        = "publish"
+	Messages       = "messages"
+	MessageIDParam = "id"
+	Async          = "async"
+	Prefer         = "Prefer"
+	RespondAsync   = "respond-async"
+
+	// route names used by the [rate_limit] rules
+	TokenRoute   = "token"
+	PublishRoute = "publish"
+	SpeedRoute   = "speed"
+
+	Admin         = "admin"
+	Tenants       = "tenants"
+	TenantIDParam = "id"
+	Suspend       = "suspend"
+	Activate      = "activate"
+
+	Metrics     = "metrics"
+	MetricParam = "metric"
+	From        = "from"
+	To          = "to"
+	Limit       = "limit"
+	Rollups     = "rollups"
+	Resolution  = "resolution"
+	Storage     = "storage"
+	Speed       = "speed"
+	Export      = "export"
+	Format      = "format"
+
+	Import        = "import"
+	ImportIDParam = "id"
+	Rejections    = "rejections"
+
+	Replay        = "replay"
+	ReplayIDParam = "id"
+	Pause         = "pause"
+	Resume        = "resume"
+	Cancel        = "cancel"
+
+	Devices       = "devices"
+	DeviceIDParam = "id"
+	Type          = "type"
+	Owner         = "owner"
+	Tag           = "tag"
+	Status        = "status"
+
+	Commands       = "commands"
+	CommandIDParam = "command_id"
+
+	OpenAPI = "openapi.json"
+	GraphQL = "graphql"
+	Healthz = "healthz"
+	Readyz  = "readyz"
+
+	// accepted speed range for published and ingested readings
+	MinSpeed = 0
+	MaxSpeed = 100
 
 	InvalidBody = "invalid body"
 	ContentType = "application/json"
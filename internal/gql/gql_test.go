@@ -0,0 +1,299 @@
+package gql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/websocket"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+	"github.com/mqtt-pipeline/internal/utils"
+	"gotest.tools/assert"
+)
+
+type result struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func post(t *testing.T, router *gin.Engine, query string, variables map[string]interface{}) result {
+	body, _ := json.Marshal(request{Query: query, Variables: variables})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res result
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	return res
+}
+
+func TestGraphQL(t *testing.T) {
+	// init logging client
+	utils.InitLogClient()
+	gin.SetMode(gin.TestMode)
+
+	redisServer := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+	service.NewMQTTPipelineService(redisClient)
+
+	// five readings, the last three at the same millisecond
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	stored := []models.HistoryEntry{
+		{Speed: 10, MessageID: "m0", DeviceID: "a", Timestamp: start},
+		{Speed: 20, MessageID: "m1", DeviceID: "b", Timestamp: start.Add(time.Minute)},
+		{Speed: 30, MessageID: "m2", DeviceID: "a", Timestamp: start.Add(2 * time.Minute)},
+		{Speed: 40, MessageID: "m3", DeviceID: "b", Timestamp: start.Add(2 * time.Minute)},
+		{Speed: 50, MessageID: "m4", DeviceID: "a", Timestamp: start.Add(2 * time.Minute)},
+	}
+	for _, entry := range stored {
+		member, _ := json.Marshal(entry)
+		assert.NilError(t, redisClient.ZAdd("speed_history", &redis.Z{Score: float64(entry.Timestamp.UnixMilli()), Member: member}).Err())
+		assert.NilError(t, redisClient.HSet("device_readings", entry.DeviceID, member).Err())
+	}
+
+	router := gin.New()
+	router.POST("/graphql", Handler())
+	router.GET("/graphql", WebSocketHandler())
+
+	// Case 1 : paging through readings, including readings sharing a timestamp
+	const readingsQuery = `query($after: String) {
+		readings(first: 2, after: $after) { edges { node { messageId } } pageInfo { hasNextPage endCursor } }
+	}`
+	var ids []string
+	variables := map[string]interface{}{}
+	for page := 0; page < 5; page++ {
+		res := post(t, router, readingsQuery, variables)
+		assert.Equal(t, 0, len(res.Errors))
+		var data struct {
+			Readings struct {
+				Edges []struct {
+					Node struct{ MessageID string }
+				}
+				PageInfo struct {
+					HasNextPage bool
+					EndCursor   string
+				}
+			}
+		}
+		assert.NilError(t, json.Unmarshal(res.Data, &data))
+		for _, edge := range data.Readings.Edges {
+			ids = append(ids, edge.Node.MessageID)
+		}
+		if !data.Readings.PageInfo.HasNextPage {
+			break
+		}
+		variables["after"] = data.Readings.PageInfo.EndCursor
+	}
+	assert.DeepEqual(t, []string{"m0", "m1", "m2", "m3", "m4"}, ids)
+
+	// Case 2 : filtering by device and speed
+	res := post(t, router, `{ readings(filter: {deviceId: "a", minSpeed: 20}) { edges { node { speed } } } }`, nil)
+	assert.Equal(t, 0, len(res.Errors))
+	assert.Equal(t, `{"readings":{"edges":[{"node":{"speed":30}},{"node":{"speed":50}}]}}`, string(res.Data))
+
+	// Case 3 : devices with their latest reading and stats
+	res = post(t, router, `{ devices { totalCount edges { node { id latest { speed } stats { count min max avg } } } } }`, nil)
+	assert.Equal(t, 0, len(res.Errors))
+	assert.Equal(t, `{"devices":{"totalCount":2,"edges":[`+
+		`{"node":{"id":"a","latest":{"speed":50},"stats":{"count":3,"min":10,"max":50,"avg":30}}},`+
+		`{"node":{"id":"b","latest":{"speed":40},"stats":{"count":2,"min":20,"max":40,"avg":30}}}]}}`, string(res.Data))
+
+	// Case 4 : unknown device
+	res = post(t, router, `{ device(id: "missing") { id } }`, nil)
+	assert.Equal(t, `{"device":null}`, string(res.Data))
+
+	// Case 5 : subscriptions are rejected over plain HTTP
+	res = post(t, router, `subscription { readingStored { speed } }`, nil)
+	assert.Assert(t, len(res.Errors) > 0)
+
+	// Case 6 : websocket connections without a valid token are closed
+	server := httptest.NewServer(router)
+	defer server.Close()
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocol}}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/graphql"
+	conn, _, err := dialer.Dial(url, nil)
+	assert.NilError(t, err)
+	assert.NilError(t, conn.WriteJSON(message{Type: msgConnectionInit, Payload: json.RawMessage(`{"authorization":"invalid"}`)}))
+	_, _, err = conn.ReadMessage()
+	assert.Assert(t, websocket.IsCloseError(err, closeForbidden))
+	conn.Close()
+
+	// Case 7 : subscribers receive readings of the device they asked for
+	token, err := service.MintToken("ankitchahal20@gmail.com", time.Minute)
+	assert.NilError(t, err)
+	conn, _, err = dialer.Dial(url, nil)
+	assert.NilError(t, err)
+	defer conn.Close()
+	payload, _ := json.Marshal(initPayload{Authorization: token})
+	assert.NilError(t, conn.WriteJSON(message{Type: msgConnectionInit, Payload: payload}))
+	var msg message
+	assert.NilError(t, conn.ReadJSON(&msg))
+	assert.Equal(t, msgConnectionAck, msg.Type)
+
+	payload, _ = json.Marshal(request{Query: `subscription { readingStored(deviceId: "a") { speed deviceId } }`})
+	assert.NilError(t, conn.WriteJSON(message{ID: "1", Type: msgSubscribe, Payload: payload}))
+	assert.NilError(t, waitForSubscriber(redisServer, "speed_live"))
+	for _, entry := range []models.HistoryEntry{{Speed: 60, DeviceID: "b"}, {Speed: 70, DeviceID: "a"}} {
+		member, _ := json.Marshal(entry)
+		assert.NilError(t, redisClient.Publish("speed_live", member).Err())
+	}
+	assert.NilError(t, conn.ReadJSON(&msg))
+	assert.Equal(t, msgNext, msg.Type)
+	assert.Equal(t, "1", msg.ID)
+	assert.Equal(t, `{"data":{"readingStored":{"speed":70,"deviceId":"a"}}}`, string(msg.Payload))
+
+	// Case 8 : reusing an active operation ID closes the connection
+	assert.NilError(t, conn.WriteJSON(message{ID: "1", Type: msgSubscribe, Payload: payload}))
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	assert.Assert(t, websocket.IsCloseError(err, closeDuplicateID))
+}
+
+// waitForSubscriber waits until the subscription has subscribed to the channel, since
+// readings published before that are not delivered.
+func waitForSubscriber(server *miniredis.Miniredis, channel string) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if server.PubSubNumSub(channel)[channel] > 0 {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return context.DeadlineExceeded
+}
+
+func TestScanBudget(t *testing.T) {
+	// init logging client
+	utils.InitLogClient()
+	gin.SetMode(gin.TestMode)
+
+	redisServer := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+	service.NewMQTTPipelineService(redisClient)
+
+	// one more reading of device "a" than a request may scan, followed by one of "b"
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	_, err := redisClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for i := 0; i <= maxScannedReadings; i++ {
+			entry := models.HistoryEntry{Speed: i, DeviceID: "a", Timestamp: start.Add(time.Duration(i) * time.Millisecond)}
+			member, _ := json.Marshal(entry)
+			pipe.ZAdd("speed_history", &redis.Z{Score: float64(entry.Timestamp.UnixMilli()), Member: member})
+		}
+		entry := models.HistoryEntry{Speed: 1, DeviceID: "b", Timestamp: start.Add(time.Minute)}
+		member, _ := json.Marshal(entry)
+		pipe.ZAdd("speed_history", &redis.Z{Score: float64(entry.Timestamp.UnixMilli()), Member: member})
+		return nil
+	})
+	assert.NilError(t, err)
+
+	router := gin.New()
+	router.POST("/graphql", Handler())
+
+	// Case 1 : stats over more readings than the budget fail
+	res := post(t, router, `{ stats { count } }`, nil)
+	assert.Equal(t, 1, len(res.Errors))
+	assert.Equal(t, errScanLimit.Error(), res.Errors[0].Message)
+
+	// Case 2 : stats within the time range of the budget succeed
+	res = post(t, router, `query($to: Time) { stats(filter: {to: $to}) { count } }`,
+		map[string]interface{}{"to": start.Add(99 * time.Millisecond).Format(time.RFC3339Nano)})
+	assert.Equal(t, 0, len(res.Errors))
+	assert.Equal(t, `{"stats":{"count":100}}`, string(res.Data))
+
+	// Case 3 : a page ends where the budget runs out and the next page carries on
+	const readingsQuery = `query($after: String) {
+		readings(filter: {deviceId: "b"}, after: $after) { edges { node { speed } } pageInfo { hasNextPage endCursor } }
+	}`
+	type page struct {
+		Readings struct {
+			Edges []struct {
+				Node struct{ Speed int }
+			}
+			PageInfo struct {
+				HasNextPage bool
+				EndCursor   string
+			}
+		}
+	}
+	res = post(t, router, readingsQuery, nil)
+	assert.Equal(t, 0, len(res.Errors))
+	var first page
+	assert.NilError(t, json.Unmarshal(res.Data, &first))
+	assert.Equal(t, 0, len(first.Readings.Edges))
+	assert.Assert(t, first.Readings.PageInfo.HasNextPage)
+
+	res = post(t, router, readingsQuery, map[string]interface{}{"after": first.Readings.PageInfo.EndCursor})
+	assert.Equal(t, 0, len(res.Errors))
+	var second page
+	assert.NilError(t, json.Unmarshal(res.Data, &second))
+	assert.Equal(t, 1, len(second.Readings.Edges))
+	assert.Equal(t, false, second.Readings.PageInfo.HasNextPage)
+
+	// Case 4 : stats repeated per device share the budget of the request
+	assert.NilError(t, redisClient.HSet("device_readings", "a", `{"speed":1,"device_id":"a"}`, "b", `{"speed":1,"device_id":"b"}`).Err())
+	res = post(t, router, `{ devices { edges { node { id stats { count } } } } }`, nil)
+	assert.Assert(t, len(res.Errors) > 0)
+	assert.Equal(t, errScanLimit.Error(), res.Errors[0].Message)
+}
+
+func TestWebSocketLimits(t *testing.T) {
+	// init logging client
+	utils.InitLogClient()
+	gin.SetMode(gin.TestMode)
+
+	redisServer := miniredis.RunT(t)
+	service.NewMQTTPipelineService(redis.NewClient(&redis.Options{Addr: redisServer.Addr()}))
+
+	router := gin.New()
+	router.GET("/graphql", WebSocketHandler())
+	server := httptest.NewServer(router)
+	defer server.Close()
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocol}}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/graphql"
+
+	connect := func(ttl time.Duration) *websocket.Conn {
+		token, err := service.MintToken("ankitchahal20@gmail.com", ttl)
+		assert.NilError(t, err)
+		conn, _, err := dialer.Dial(url, nil)
+		assert.NilError(t, err)
+		payload, _ := json.Marshal(initPayload{Authorization: token})
+		assert.NilError(t, conn.WriteJSON(message{Type: msgConnectionInit, Payload: payload}))
+		var msg message
+		assert.NilError(t, conn.ReadJSON(&msg))
+		assert.Equal(t, msgConnectionAck, msg.Type)
+		return conn
+	}
+
+	// Case 1 : operations beyond the limit of the connection are rejected
+	conn := connect(time.Minute)
+	defer conn.Close()
+	payload, _ := json.Marshal(request{Query: `subscription { readingStored { speed } }`})
+	for i := 0; i <= maxOperations; i++ {
+		assert.NilError(t, conn.WriteJSON(message{ID: strconv.Itoa(i), Type: msgSubscribe, Payload: payload}))
+	}
+	var msg message
+	assert.NilError(t, conn.ReadJSON(&msg))
+	assert.Equal(t, msgError, msg.Type)
+	assert.Equal(t, strconv.Itoa(maxOperations), msg.ID)
+
+	// Case 2 : the connection is closed once its token expires
+	expiring := connect(time.Second)
+	defer expiring.Close()
+	_ = expiring.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := expiring.ReadMessage()
+	assert.Assert(t, websocket.IsCloseError(err, closeForbidden), err)
+}
@@ -0,0 +1,57 @@
+// Package gql serves the GraphQL API over stored readings and devices, with
+// subscriptions for live readings over websockets.
+package gql
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+//go:embed schema.graphql
+var schemaSDL string
+
+// maxQueryDepth bounds how deeply queries may nest, device readings being the deepest
+// legitimate selection.
+const maxQueryDepth = 8
+
+var schema = graphql.MustParseSchema(schemaSDL, &Resolver{},
+	graphql.MaxDepth(maxQueryDepth))
+
+type request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Handler executes GraphQL queries posted as JSON. Subscriptions are only served
+// over the websocket handler.
+func Handler() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		var req request
+		if err := ctx.ShouldBindJSON(&req); err != nil || req.Query == "" {
+			logger.Error("invalid graphql request", zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusBadRequest, constants.InvalidBody)
+			return
+		}
+
+		response := schema.Exec(withScanBudget(ctx.Request.Context()), req.Query, req.OperationName, req.Variables)
+		if len(response.Errors) > 0 {
+			logger.Info("graphql request returned errors", zap.Int("errors", len(response.Errors)))
+		}
+		body, err := json.Marshal(response)
+		if err != nil {
+			logger.Error("unable to encode graphql response", zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, "unable to encode the response")
+			return
+		}
+		ctx.Data(http.StatusOK, constants.ContentType, body)
+	}
+}
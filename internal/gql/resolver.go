@@ -0,0 +1,559 @@
+package gql
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+)
+
+const (
+	// maxPageSize caps the first argument of paginated fields.
+	maxPageSize = 1000
+	// scanBatchSize is how many stored readings are read from redis at a time while
+	// filtering.
+	scanBatchSize = 1000
+	// maxScannedReadings is how many stored readings a request may read from redis
+	// across all of its fields, so that wide ranges or stats repeated per device cannot
+	// scan the whole history.
+	maxScannedReadings = 10000
+)
+
+var errScanLimit = fmt.Errorf("the query reads more than %d stored readings, narrow its time range", maxScannedReadings)
+
+type scanBudgetKey struct{}
+
+// scanBudget is how many stored readings are left to the request to scan. Fields are
+// resolved concurrently, so it is shared atomically.
+type scanBudget struct {
+	remaining atomic.Int64
+}
+
+// withScanBudget gives the request executed with ctx a budget of maxScannedReadings.
+func withScanBudget(ctx context.Context) context.Context {
+	budget := &scanBudget{}
+	budget.remaining.Store(maxScannedReadings)
+	return context.WithValue(ctx, scanBudgetKey{}, budget)
+}
+
+func scanBudgetFromContext(ctx context.Context) *scanBudget {
+	if budget, ok := ctx.Value(scanBudgetKey{}).(*scanBudget); ok {
+		return budget
+	}
+	return withScanBudget(ctx).Value(scanBudgetKey{}).(*scanBudget)
+}
+
+// take reserves up to n readings of the budget and returns how many it got.
+func (b *scanBudget) take(n int64) int64 {
+	for {
+		remaining := b.remaining.Load()
+		taken := min(n, remaining)
+		if b.remaining.CompareAndSwap(remaining, remaining-taken) {
+			return taken
+		}
+	}
+}
+
+// giveBack returns readings reserved but not read to the budget.
+func (b *scanBudget) giveBack(n int64) {
+	b.remaining.Add(n)
+}
+
+// Resolver is the root resolver of the schema.
+type Resolver struct{}
+
+type readingFilter struct {
+	DeviceID *graphql.ID
+	From     *graphql.Time
+	To       *graphql.Time
+	MinSpeed *int32
+	MaxSpeed *int32
+}
+
+func (f *readingFilter) matches(entry models.HistoryEntry) bool {
+	if f == nil {
+		return true
+	}
+	if f.DeviceID != nil && string(*f.DeviceID) != entry.DeviceID {
+		return false
+	}
+	if f.MinSpeed != nil && entry.Speed < int(*f.MinSpeed) {
+		return false
+	}
+	if f.MaxSpeed != nil && entry.Speed > int(*f.MaxSpeed) {
+		return false
+	}
+	return true
+}
+
+func (f *readingFilter) timeRange() (time.Time, time.Time) {
+	var from, to time.Time
+	if f != nil && f.From != nil {
+		from = f.From.Time
+	}
+	if f != nil && f.To != nil {
+		to = f.To.Time
+	}
+	return from, to
+}
+
+// forDevice returns a copy of the filter restricted to one device.
+func (f *readingFilter) forDevice(deviceID string) *readingFilter {
+	scoped := readingFilter{}
+	if f != nil {
+		scoped = *f
+	}
+	id := graphql.ID(deviceID)
+	scoped.DeviceID = &id
+	return &scoped
+}
+
+type readingsArgs struct {
+	Filter *readingFilter
+	First  int32
+	After  *string
+}
+
+type statsArgs struct {
+	Filter *readingFilter
+}
+
+func (r *Resolver) Latest(ctx context.Context) (*readingResolver, error) {
+	entry, err := service.LatestReading(ctx)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return &readingResolver{entry: *entry}, nil
+}
+
+func (r *Resolver) Readings(ctx context.Context, args readingsArgs) (*readingConnectionResolver, error) {
+	return queryReadings(ctx, args.Filter, args.First, args.After)
+}
+
+func (r *Resolver) Stats(ctx context.Context, args statsArgs) (*statsResolver, error) {
+	return queryStats(ctx, args.Filter)
+}
+
+func (r *Resolver) Devices(ctx context.Context, args struct {
+	First int32
+	After *string
+}) (*deviceConnectionResolver, error) {
+	entries, err := service.LatestDeviceReadings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	after := ""
+	if args.After != nil {
+		decoded, err := base64.StdEncoding.DecodeString(*args.After)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor %q", *args.After)
+		}
+		after = string(decoded)
+	}
+	first := pageSize(args.First)
+
+	conn := &deviceConnectionResolver{totalCount: int32(len(entries))}
+	for _, entry := range entries {
+		if entry.DeviceID <= after {
+			continue
+		}
+		if len(conn.edges) == first {
+			conn.pageInfo.hasNextPage = true
+			break
+		}
+		conn.edges = append(conn.edges, &deviceEdgeResolver{
+			cursor: base64.StdEncoding.EncodeToString([]byte(entry.DeviceID)),
+			node:   &deviceResolver{latest: entry},
+		})
+	}
+	if len(conn.edges) > 0 {
+		conn.pageInfo.endCursor = &conn.edges[len(conn.edges)-1].cursor
+	}
+	return conn, nil
+}
+
+func (r *Resolver) Device(ctx context.Context, args struct{ ID graphql.ID }) (*deviceResolver, error) {
+	entry, err := service.LatestDeviceReading(ctx, string(args.ID))
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return &deviceResolver{latest: *entry}, nil
+}
+
+// ReadingStored streams readings as they are stored until the subscription ends.
+func (r *Resolver) ReadingStored(ctx context.Context, args struct{ DeviceID *graphql.ID }) (<-chan *readingResolver, error) {
+	entries, err := service.SubscribeReadings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	readings := make(chan *readingResolver)
+	go func() {
+		defer close(readings)
+		for entry := range entries {
+			if args.DeviceID != nil && string(*args.DeviceID) != entry.DeviceID {
+				continue
+			}
+			select {
+			case readings <- &readingResolver{entry: entry}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return readings, nil
+}
+
+// PresenceChanged streams presence changes of devices until the subscription ends.
+func (r *Resolver) PresenceChanged(ctx context.Context, args struct{ DeviceID *graphql.ID }) (<-chan *presenceEventResolver, error) {
+	events, err := service.SubscribePresence(ctx)
+	if err != nil {
+		return nil, err
+	}
+	changes := make(chan *presenceEventResolver)
+	go func() {
+		defer close(changes)
+		for event := range events {
+			if args.DeviceID != nil && string(*args.DeviceID) != event.DeviceID {
+				continue
+			}
+			select {
+			case changes <- &presenceEventResolver{event: event}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
+
+func pageSize(first int32) int {
+	if first <= 0 {
+		return 0
+	}
+	if first > maxPageSize {
+		return maxPageSize
+	}
+	return int(first)
+}
+
+// historyCursor is a position in the history: the timestamp of a reading in
+// milliseconds and how many readings with that timestamp come before it, including
+// itself. Readings are read again from that timestamp, skipping those.
+type historyCursor struct {
+	millis int64
+	skip   int64
+}
+
+func (c historyCursor) String() string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.millis, c.skip)))
+}
+
+func parseHistoryCursor(value string) (historyCursor, error) {
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return historyCursor{}, fmt.Errorf("invalid cursor %q", value)
+	}
+	millis, skip, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return historyCursor{}, fmt.Errorf("invalid cursor %q", value)
+	}
+	c := historyCursor{}
+	if c.millis, err = strconv.ParseInt(millis, 10, 64); err != nil {
+		return historyCursor{}, fmt.Errorf("invalid cursor %q", value)
+	}
+	if c.skip, err = strconv.ParseInt(skip, 10, 64); err != nil {
+		return historyCursor{}, fmt.Errorf("invalid cursor %q", value)
+	}
+	return c, nil
+}
+
+// scanReadings calls visit with every stored reading in the filter's time range, and
+// the cursor pointing after it, until visit returns false. It returns errScanLimit when
+// the scan budget of the request runs out first.
+func scanReadings(ctx context.Context, filter *readingFilter, start *historyCursor, visit func(models.HistoryEntry, historyCursor) bool) error {
+	from, to := filter.timeRange()
+	position := historyCursor{}
+	if start != nil {
+		position = *start
+	} else if !from.IsZero() {
+		position.millis = from.UnixMilli()
+	} else {
+		position.millis = math.MinInt64
+	}
+
+	budget := scanBudgetFromContext(ctx)
+	for {
+		size := budget.take(scanBatchSize)
+		if size == 0 {
+			return errScanLimit
+		}
+		scanFrom := time.UnixMilli(position.millis)
+		if position.millis == math.MinInt64 {
+			scanFrom = time.Time{}
+		}
+		batch, err := service.ScanHistory(ctx, scanFrom, to, position.skip, size)
+		if err != nil {
+			budget.giveBack(size)
+			return err
+		}
+		budget.giveBack(size - int64(len(batch)))
+		for _, entry := range batch {
+			millis := entry.Timestamp.UnixMilli()
+			if millis == position.millis {
+				position.skip++
+			} else {
+				position = historyCursor{millis: millis, skip: 1}
+			}
+			if !visit(entry, position) {
+				return nil
+			}
+		}
+		if int64(len(batch)) < size {
+			return nil
+		}
+	}
+}
+
+func queryReadings(ctx context.Context, filter *readingFilter, first int32, after *string) (*readingConnectionResolver, error) {
+	var start *historyCursor
+	if after != nil {
+		c, err := parseHistoryCursor(*after)
+		if err != nil {
+			return nil, err
+		}
+		start = &c
+	}
+	size := pageSize(first)
+
+	conn := &readingConnectionResolver{}
+	var scanned *historyCursor
+	err := scanReadings(ctx, filter, start, func(entry models.HistoryEntry, position historyCursor) bool {
+		scanned = &position
+		if !filter.matches(entry) {
+			return true
+		}
+		if len(conn.edges) == size {
+			conn.pageInfo.hasNextPage = true
+			return false
+		}
+		conn.edges = append(conn.edges, &readingEdgeResolver{cursor: position.String(), node: &readingResolver{entry: entry}})
+		return true
+	})
+	if errors.Is(err, errScanLimit) && scanned != nil {
+		// The page ends where the budget ran out, which may be past readings that did
+		// not match, so the next page carries on from there.
+		cursor := scanned.String()
+		conn.pageInfo.hasNextPage = true
+		conn.pageInfo.endCursor = &cursor
+		return conn, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(conn.edges) > 0 {
+		conn.pageInfo.endCursor = &conn.edges[len(conn.edges)-1].cursor
+	}
+	return conn, nil
+}
+
+func queryStats(ctx context.Context, filter *readingFilter) (*statsResolver, error) {
+	stats := &statsResolver{}
+	var sum int64
+	err := scanReadings(ctx, filter, nil, func(entry models.HistoryEntry, _ historyCursor) bool {
+		if !filter.matches(entry) {
+			return true
+		}
+		speed := int32(entry.Speed)
+		if stats.count == 0 || speed < *stats.min {
+			stats.min = &speed
+		}
+		if stats.count == 0 || speed > *stats.max {
+			stats.max = &speed
+		}
+		stats.count++
+		sum += int64(entry.Speed)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if stats.count > 0 {
+		avg := float64(sum) / float64(stats.count)
+		stats.avg = &avg
+	}
+	return stats, nil
+}
+
+type readingResolver struct {
+	entry models.HistoryEntry
+}
+
+func (r *readingResolver) Speed() int32 {
+	return int32(r.entry.Speed)
+}
+
+func (r *readingResolver) MessageID() *string {
+	if r.entry.MessageID == "" {
+		return nil
+	}
+	return &r.entry.MessageID
+}
+
+func (r *readingResolver) DeviceID() *graphql.ID {
+	if r.entry.DeviceID == "" {
+		return nil
+	}
+	id := graphql.ID(r.entry.DeviceID)
+	return &id
+}
+
+func (r *readingResolver) Timestamp() graphql.Time {
+	return graphql.Time{Time: r.entry.Timestamp}
+}
+
+type readingEdgeResolver struct {
+	cursor string
+	node   *readingResolver
+}
+
+func (r *readingEdgeResolver) Cursor() string {
+	return r.cursor
+}
+
+func (r *readingEdgeResolver) Node() *readingResolver {
+	return r.node
+}
+
+type readingConnectionResolver struct {
+	edges    []*readingEdgeResolver
+	pageInfo pageInfoResolver
+}
+
+func (r *readingConnectionResolver) Edges() []*readingEdgeResolver {
+	return r.edges
+}
+
+func (r *readingConnectionResolver) PageInfo() *pageInfoResolver {
+	return &r.pageInfo
+}
+
+type deviceResolver struct {
+	latest models.HistoryEntry
+}
+
+func (r *deviceResolver) ID() graphql.ID {
+	return graphql.ID(r.latest.DeviceID)
+}
+
+func (r *deviceResolver) LastSeen() graphql.Time {
+	return graphql.Time{Time: r.latest.Timestamp}
+}
+
+func (r *deviceResolver) Latest() *readingResolver {
+	return &readingResolver{entry: r.latest}
+}
+
+func (r *deviceResolver) Readings(ctx context.Context, args readingsArgs) (*readingConnectionResolver, error) {
+	return queryReadings(ctx, args.Filter.forDevice(r.latest.DeviceID), args.First, args.After)
+}
+
+func (r *deviceResolver) Stats(ctx context.Context, args statsArgs) (*statsResolver, error) {
+	return queryStats(ctx, args.Filter.forDevice(r.latest.DeviceID))
+}
+
+type deviceEdgeResolver struct {
+	cursor string
+	node   *deviceResolver
+}
+
+func (r *deviceEdgeResolver) Cursor() string {
+	return r.cursor
+}
+
+func (r *deviceEdgeResolver) Node() *deviceResolver {
+	return r.node
+}
+
+type deviceConnectionResolver struct {
+	edges      []*deviceEdgeResolver
+	pageInfo   pageInfoResolver
+	totalCount int32
+}
+
+func (r *deviceConnectionResolver) Edges() []*deviceEdgeResolver {
+	return r.edges
+}
+
+func (r *deviceConnectionResolver) PageInfo() *pageInfoResolver {
+	return &r.pageInfo
+}
+
+func (r *deviceConnectionResolver) TotalCount() int32 {
+	return r.totalCount
+}
+
+type pageInfoResolver struct {
+	hasNextPage bool
+	endCursor   *string
+}
+
+func (r *pageInfoResolver) HasNextPage() bool {
+	return r.hasNextPage
+}
+
+func (r *pageInfoResolver) EndCursor() *string {
+	return r.endCursor
+}
+
+type statsResolver struct {
+	count int32
+	min   *int32
+	max   *int32
+	avg   *float64
+}
+
+func (r *statsResolver) Count() int32 {
+	return r.count
+}
+
+func (r *statsResolver) Min() *int32 {
+	return r.min
+}
+
+func (r *statsResolver) Max() *int32 {
+	return r.max
+}
+
+func (r *statsResolver) Avg() *float64 {
+	return r.avg
+}
+
+type presenceEventResolver struct {
+	event models.PresenceEvent
+}
+
+func (r *presenceEventResolver) DeviceID() graphql.ID {
+	return graphql.ID(r.event.DeviceID)
+}
+
+func (r *presenceEventResolver) Status() string {
+	return r.event.Status
+}
+
+func (r *presenceEventResolver) Reason() string {
+	return r.event.Reason
+}
+
+func (r *presenceEventResolver) At() graphql.Time {
+	return graphql.Time{Time: r.event.At}
+}
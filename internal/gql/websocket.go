@@ -0,0 +1,326 @@
+package gql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/mqtt-pipeline/internal/service"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+// subprotocol is the graphql-transport-ws protocol spoken by current GraphQL clients
+// such as graphql-ws.
+const subprotocol = "graphql-transport-ws"
+
+const (
+	msgConnectionInit = "connection_init"
+	msgConnectionAck  = "connection_ack"
+	msgPing           = "ping"
+	msgPong           = "pong"
+	msgSubscribe      = "subscribe"
+	msgNext           = "next"
+	msgError          = "error"
+	msgComplete       = "complete"
+)
+
+// close codes defined by the protocol
+const (
+	closeBadRequest        = 4400
+	closeUnauthorized      = 4401
+	closeForbidden         = 4403
+	closeInitTimeout       = 4408
+	closeDuplicateID       = 4409
+	closeTooManyInitialise = 4429
+)
+
+const (
+	// initTimeout is how long a client has to send connection_init after connecting.
+	initTimeout  = 10 * time.Second
+	writeTimeout = 10 * time.Second
+	// tokenCheckInterval is how often the token of a connection is verified again, so
+	// that revoked tokens stop being served before they expire.
+	tokenCheckInterval = time.Minute
+	// maxOperations is how many operations a connection may run at the same time.
+	maxOperations = 10
+)
+
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{subprotocol},
+	// browsers are authenticated by token rather than cookies, so any origin may
+	// connect
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type message struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type initPayload struct {
+	Authorization string `json:"authorization"`
+}
+
+// wsConn serialises writes to a websocket shared by the operations running on it.
+type wsConn struct {
+	conn   *websocket.Conn
+	mu     sync.Mutex
+	logger *zap.Logger
+}
+
+func (c *wsConn) send(id, kind string, payload interface{}) error {
+	msg := message{ID: id, Type: kind}
+	if payload != nil {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		msg.Payload = body
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.conn.WriteJSON(msg)
+}
+
+func (c *wsConn) close(code int, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeTimeout))
+	c.conn.Close()
+}
+
+// WebSocketHandler serves queries and subscriptions over the graphql-transport-ws
+// protocol. The token is taken from the Authorization header of the upgrade request
+// or, since browsers cannot set headers on websockets, from the authorization field
+// of the connection_init payload.
+func WebSocketHandler() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+		if err != nil {
+			// the upgrader has already responded
+			logger.Error("unable to upgrade graphql websocket", zap.Error(err))
+			return
+		}
+		// the server read and write timeouts are meant for requests, not long lived
+		// connections
+		_ = conn.SetReadDeadline(time.Time{})
+		ws := &wsConn{conn: conn, logger: logger}
+		if conn.Subprotocol() != subprotocol {
+			ws.close(closeBadRequest, "unsupported subprotocol")
+			return
+		}
+
+		serve(ctx.Request.Context(), ws, ctx.GetHeader("Authorization"))
+	}
+}
+
+func serve(ctx context.Context, ws *wsConn, headerToken string) {
+	operations := map[string]context.CancelFunc{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	defer func() {
+		mu.Lock()
+		for _, cancel := range operations {
+			cancel()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	initialised := false
+	timer := time.AfterFunc(initTimeout, func() {
+		ws.close(closeInitTimeout, "connection initialisation timeout")
+	})
+	defer timer.Stop()
+	var tokenCheck *time.Timer
+	defer func() {
+		if tokenCheck != nil {
+			tokenCheck.Stop()
+		}
+	}()
+
+	for {
+		var msg message
+		if err := ws.conn.ReadJSON(&msg); err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) {
+				ws.logger.Debug("graphql websocket closed", zap.Error(err))
+			}
+			ws.conn.Close()
+			return
+		}
+
+		switch msg.Type {
+		case msgConnectionInit:
+			if initialised {
+				ws.close(closeTooManyInitialise, "too many initialisation requests")
+				return
+			}
+			timer.Stop()
+			var payload initPayload
+			if len(msg.Payload) > 0 {
+				_ = json.Unmarshal(msg.Payload, &payload)
+			}
+			token := headerToken
+			if payload.Authorization != "" {
+				token = payload.Authorization
+			}
+			if token == "" {
+				ws.close(closeForbidden, "Unauthorized")
+				return
+			}
+			claims, err := service.VerifyToken(ctx, token)
+			if err == nil {
+				tokenCheck = checkToken(ctx, ws, token, claims)
+				// operations started on the connection are scoped to the tenant
+				ctx, err = service.AuthorizeTenant(ctx, claims)
+			}
+			if err != nil {
+				ws.logger.Error("graphql websocket token rejected", zap.Error(err))
+				ws.close(closeForbidden, err.Error())
+				return
+			}
+			initialised = true
+			if err := ws.send("", msgConnectionAck, nil); err != nil {
+				return
+			}
+
+		case msgPing:
+			if err := ws.send("", msgPong, nil); err != nil {
+				return
+			}
+
+		case msgPong:
+
+		case msgSubscribe:
+			if !initialised {
+				ws.close(closeUnauthorized, "Unauthorized")
+				return
+			}
+			var req request
+			if msg.ID == "" || json.Unmarshal(msg.Payload, &req) != nil || req.Query == "" {
+				ws.close(closeBadRequest, "invalid subscribe message")
+				return
+			}
+			mu.Lock()
+			if _, ok := operations[msg.ID]; ok {
+				mu.Unlock()
+				ws.close(closeDuplicateID, "subscriber for "+msg.ID+" already exists")
+				return
+			}
+			if len(operations) >= maxOperations {
+				mu.Unlock()
+				if err := ws.send(msg.ID, msgError, []map[string]string{{"message": "too many operations on the connection"}}); err != nil {
+					return
+				}
+				continue
+			}
+			opCtx, cancel := context.WithCancel(ctx)
+			operations[msg.ID] = cancel
+			mu.Unlock()
+
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				completed := run(opCtx, ws, id, req)
+				mu.Lock()
+				delete(operations, id)
+				mu.Unlock()
+				cancel()
+				if completed {
+					_ = ws.send(id, msgComplete, nil)
+				}
+			}(msg.ID)
+
+		case msgComplete:
+			mu.Lock()
+			if cancel, ok := operations[msg.ID]; ok {
+				cancel()
+			}
+			mu.Unlock()
+
+		default:
+			ws.close(closeBadRequest, "unknown message type "+msg.Type)
+			return
+		}
+	}
+}
+
+// checkToken verifies the token of the connection again when it expires and every
+// tokenCheckInterval, closing the connection once it is rejected.
+func checkToken(ctx context.Context, ws *wsConn, token string, claims map[string]interface{}) *time.Timer {
+	next := func() time.Duration {
+		wait := tokenCheckInterval
+		if exp, ok := claims["exp"].(float64); ok {
+			// tokens are valid through the second they expire at
+			wait = min(wait, time.Until(time.Unix(int64(exp)+1, 0)))
+		}
+		return max(wait, time.Second)
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(next(), func() {
+		// the connection has ended
+		if ctx.Err() != nil {
+			return
+		}
+		if _, err := service.VerifyToken(ctx, token); err != nil {
+			ws.logger.Info("graphql websocket token no longer valid", zap.Error(err))
+			ws.close(closeForbidden, err.Error())
+			return
+		}
+		timer.Reset(next())
+	})
+	return timer
+}
+
+// run executes an operation, sending its results to the client until it ends or is
+// cancelled. It reports whether the client should be told the operation completed.
+func run(ctx context.Context, ws *wsConn, id string, req request) bool {
+	responses, err := schema.Subscribe(withScanBudget(ctx), req.Query, req.OperationName, req.Variables)
+	if err != nil {
+		_ = ws.send(id, msgError, []map[string]string{{"message": err.Error()}})
+		return false
+	}
+	// the schema stops sending once ctx is done, but may be blocked handing over a
+	// response
+	defer func() {
+		for range responses {
+		}
+	}()
+
+	first := true
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case value, ok := <-responses:
+			if !ok {
+				return true
+			}
+			response, ok := value.(*graphql.Response)
+			if !ok {
+				continue
+			}
+			// errors before any data mean the operation was rejected
+			if first && response.Data == nil && len(response.Errors) > 0 {
+				_ = ws.send(id, msgError, response.Errors)
+				return false
+			}
+			first = false
+			if err := ws.send(id, msgNext, response); err != nil {
+				ws.logger.Debug("unable to send graphql result", zap.Error(err))
+				return false
+			}
+		}
+	}
+}
@@ -1,57 +1,94 @@
 package middleware
 
 import (
-	"fmt"
+	"errors"
 	"net/http"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/service"
 	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
 )
 
 func Authorization() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		txid := ctx.Request.Header.Get(constants.TransactionID)
+		logger := utils.LoggerFromContext(ctx)
 		tokenString := ctx.GetHeader("Authorization")
 		if tokenString == "" {
-			utils.Logger.Error(fmt.Sprintf("authorization header is empty, txid : %v", txid))
+			logger.Error("authorization header is empty")
 			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			ctx.Abort()
 			return
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return constants.SecretKey, nil
-		})
+		claims, err := service.VerifyToken(ctx.Request.Context(), tokenString)
+		if err != nil {
+			var tokenErr *service.TokenError
+			switch {
+			case errors.As(err, &tokenErr):
+				logger.Error(tokenErr.Message, zap.Error(tokenErr.Err))
+				utils.RespondWithError(ctx, http.StatusInternalServerError, tokenErr.Message)
+			default:
+				logger.Error("token rejected", zap.Error(err))
+				utils.RespondWithError(ctx, http.StatusUnauthorized, err.Error())
+			}
+			return
+		}
+
+		if email, ok := claims[constants.EmailKey].(string); ok {
+			ctx.Set(constants.EmailKey, email)
+			logger = utils.WithLogFields(ctx, zap.String("user", email))
+		}
 
+		tenantCtx, err := service.AuthorizeTenant(ctx.Request.Context(), claims)
 		if err != nil {
-			switch err1 := err.(type) {
-			case *jwt.ValidationError: // something was wrong during the validation
-				vErr := err1
-				switch vErr.Errors {
-				case jwt.ValidationErrorExpired:
-					utils.Logger.Error(fmt.Sprintf("token expired, txid : %v", txid))
-					utils.RespondWithError(ctx, http.StatusUnauthorized, "token expired")
-					return
-				default:
-					utils.Logger.Error(fmt.Sprintf("error while parsing token, txid : %v", txid))
-					utils.RespondWithError(ctx, http.StatusInternalServerError, "error while parsing token")
-					return
-				}
-			default: // something else went wrong
-				utils.Logger.Error(fmt.Sprintf("error while parsing token, txid : %v", txid))
-				utils.RespondWithError(ctx, http.StatusInternalServerError, "error while parsing token")
+			var tokenErr *service.TokenError
+			if errors.As(err, &tokenErr) {
+				logger.Error(tokenErr.Message, zap.Error(tokenErr.Err))
+				utils.RespondWithError(ctx, http.StatusInternalServerError, tokenErr.Message)
 				return
 			}
+			logger.Error("tenant rejected", zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusForbidden, err.Error())
+			return
+		}
+		// service calls made with the request context are scoped to the tenant
+		ctx.Request = ctx.Request.WithContext(service.WithSubject(tenantCtx, ctx.GetString(constants.EmailKey)))
+		if tenant := service.TenantFromContext(tenantCtx); tenant != "" {
+			ctx.Set(constants.TenantKey, tenant)
+			logger = utils.WithLogFields(ctx, zap.String("tenant", tenant))
 		}
-		if !token.Valid {
-			utils.Logger.Error(fmt.Sprintf("invalid token received, txid : %v", txid))
-			utils.RespondWithError(ctx, http.StatusUnauthorized, "invalid token")
+		ctx.Set(constants.AdminKey, service.IsAdmin(claims))
+		ctx.Set(constants.GlobalAdminKey, service.IsGlobalAdmin(claims))
+
+		logger.Info("received valid token")
+		ctx.Next()
+	}
+}
+
+// RequireAdmin only lets requests with an admin token through. It runs after
+// Authorization.
+func RequireAdmin() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !ctx.GetBool(constants.AdminKey) {
+			utils.LoggerFromContext(ctx).Error("admin token required")
+			utils.RespondWithError(ctx, http.StatusForbidden, "admin token required")
 			return
 		}
+		ctx.Next()
+	}
+}
 
-		utils.Logger.Info(fmt.Sprintf("received valid token, txid : %v", txid))
+// RequireGlobalAdmin only lets requests with an admin token that is not scoped to a
+// tenant through, for the APIs that manage all tenants. It runs after Authorization.
+func RequireGlobalAdmin() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !ctx.GetBool(constants.GlobalAdminKey) {
+			utils.LoggerFromContext(ctx).Error("admin token without a tenant required")
+			utils.RespondWithError(ctx, http.StatusForbidden, "admin token without a tenant required")
+			return
+		}
 		ctx.Next()
 	}
 }
@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+	"github.com/mqtt-pipeline/internal/utils"
+	"gotest.tools/assert"
+)
+
+func TestAuthorization(t *testing.T) {
+	// init logging client
+	utils.InitLogClient()
+
+	sign := func(expiry time.Time) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			constants.EmailKey: "ankitchahal20@gmail.com",
+			"exp":              expiry.Unix(),
+		})
+		tokenString, _ := token.SignedString(constants.SecretKey)
+		return tokenString
+	}
+
+	var email string
+	_, e := gin.CreateTestContext(httptest.NewRecorder())
+	e.Use(Authorization())
+	e.GET("/v1", func(ctx *gin.Context) {
+		email = ctx.GetString(constants.EmailKey)
+		ctx.Status(http.StatusOK)
+	})
+
+	// Case 1 : authorization header missing
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/v1", nil)
+	e.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Case 2 : expired token
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/v1", nil)
+	req.Header.Add("authorization", sign(time.Now().Add(-time.Minute)))
+	e.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Case 3 : valid token, the email is available to later handlers
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/v1", nil)
+	req.Header.Add("authorization", sign(time.Now().Add(time.Minute)))
+	e.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ankitchahal20@gmail.com", email)
+
+	// Case 4 : revoked token
+	server := miniredis.RunT(t)
+	service.NewMQTTPipelineService(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	tokenString, err := service.MintToken("ankitchahal20@gmail.com", time.Minute)
+	assert.NilError(t, err)
+	_, err = service.RevokeToken(context.Background(), tokenString)
+	assert.NilError(t, err)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/v1", nil)
+	req.Header.Add("authorization", tokenString)
+	e.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestTenantAuthorization(t *testing.T) {
+	// init logging client
+	utils.InitLogClient()
+
+	server := miniredis.RunT(t)
+	service.NewMQTTPipelineService(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	config.SetConfig(config.GlobalConfig{Tenancy: config.Tenancy{Enabled: true}})
+	defer config.SetConfig(config.GlobalConfig{})
+
+	_, _, err := service.RegisterTenant(context.Background(), models.TenantRequest{ID: "acme"})
+	assert.NilError(t, err)
+
+	var tenant string
+	_, e := gin.CreateTestContext(httptest.NewRecorder())
+	e.Use(Authorization())
+	e.GET("/v1", func(ctx *gin.Context) {
+		tenant = service.TenantFromContext(ctx.Request.Context())
+		ctx.Status(http.StatusOK)
+	})
+	e.GET("/v1/admin", RequireAdmin(), func(ctx *gin.Context) {
+		ctx.Status(http.StatusOK)
+	})
+	e.GET("/v1/admin/tenants", RequireGlobalAdmin(), func(ctx *gin.Context) {
+		ctx.Status(http.StatusOK)
+	})
+
+	send := func(path, token string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		req.Header.Add("authorization", token)
+		e.ServeHTTP(w, req)
+		return w.Code
+	}
+	tenantToken, err := service.MintTenantToken("ankitchahal20@gmail.com", "acme", time.Minute)
+	assert.NilError(t, err)
+
+	// Case 1 : a token without a tenant is rejected
+	plainToken, err := service.MintToken("ankitchahal20@gmail.com", time.Minute)
+	assert.NilError(t, err)
+	assert.Equal(t, http.StatusForbidden, send("/v1", plainToken))
+
+	// Case 2 : a tenant token scopes the request to the tenant
+	assert.Equal(t, http.StatusOK, send("/v1", tenantToken))
+	assert.Equal(t, "acme", tenant)
+
+	// Case 3 : tenant tokens cannot use the admin APIs, admin tokens can
+	assert.Equal(t, http.StatusForbidden, send("/v1/admin", tenantToken))
+	adminToken, err := service.MintAdminToken("ankitchahal20@gmail.com", time.Minute)
+	assert.NilError(t, err)
+	assert.Equal(t, http.StatusOK, send("/v1/admin", adminToken))
+
+	// Case 4 : admin tokens of a tenant cannot use the APIs that span all tenants
+	tenantAdminToken, err := service.MintTenantAdminToken("ankitchahal20@gmail.com", "acme", time.Minute)
+	assert.NilError(t, err)
+	assert.Equal(t, http.StatusOK, send("/v1/admin", tenantAdminToken))
+	assert.Equal(t, http.StatusForbidden, send("/v1/admin/tenants", tenantAdminToken))
+	assert.Equal(t, http.StatusOK, send("/v1/admin/tenants", adminToken))
+
+	// Case 5 : tokens of a suspended tenant are rejected
+	_, err = service.SetTenantStatus(context.Background(), "acme", service.TenantSuspended)
+	assert.NilError(t, err)
+	assert.Equal(t, http.StatusForbidden, send("/v1", tenantToken))
+
+	// Case 6 : tokens of an unknown tenant are rejected
+	unknownToken, err := service.MintTenantToken("ankitchahal20@gmail.com", "initech", time.Minute)
+	assert.NilError(t, err)
+	assert.Equal(t, http.StatusForbidden, send("/v1", unknownToken))
+}
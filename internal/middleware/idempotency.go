@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	idempotencyInProgress = "in_progress"
+	idempotencyCompleted  = "completed"
+)
+
+var idempotencyStore *IdempotencyStore
+
+// IdempotencyStore remembers responses by Idempotency-Key so that retried
+// requests are answered without being processed twice.
+type IdempotencyStore struct {
+	redisClient redis.UniversalClient
+}
+
+// responseRecorder copies the response body so it can be replayed later.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(data string) (int, error) {
+	w.body.WriteString(data)
+	return w.ResponseWriter.WriteString(data)
+}
+
+// NewIdempotencyStore initialises the store used by Idempotency.
+func NewIdempotencyStore(redisClient redis.UniversalClient) {
+	idempotencyStore = &IdempotencyStore{
+		redisClient: redisClient,
+	}
+}
+
+// requestHash returns the SHA-256 of the request body, which stays readable by the
+// handlers.
+func requestHash(ctx *gin.Context) (string, error) {
+	var body []byte
+	if cached, ok := ctx.Get(gin.BodyBytesKey); ok {
+		body, _ = cached.([]byte)
+	} else if ctx.Request.Body != nil {
+		var err error
+		if body, err = io.ReadAll(ctx.Request.Body); err != nil {
+			return "", err
+		}
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Idempotency de-duplicates requests using the Idempotency-Key header, falling back
+// to the transaction ID. The first request is processed and a successful response
+// stored; a retry with the same key and body gets the stored response back, a retry
+// while the first request is still running gets 409 and a request reusing the key
+// with another body gets 422. Other responses are not stored, so the request can be
+// retried. A message ID derived from the key is set on the context so that the ingest
+// side can de-duplicate as well.
+func Idempotency() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key := ctx.GetHeader(constants.IdempotencyKey)
+		if key == "" {
+			key = ctx.Request.Header.Get(constants.TransactionID)
+		}
+		scope := ctx.GetString(constants.EmailKey) + ":" + key
+		if tenant := ctx.GetString(constants.TenantKey); tenant != "" {
+			scope = tenant + ":" + scope
+		}
+		ctx.Set(constants.MessageIDKey, uuid.NewSHA1(uuid.NameSpaceOID, []byte(scope)).String())
+
+		cfg := config.GetConfig().Idempotency
+		if idempotencyStore == nil || !cfg.Enabled || key == "" {
+			ctx.Next()
+			return
+		}
+		logger := utils.LoggerFromContext(ctx).With(zap.String("idempotency_key", key))
+		redisKey := "idempotency:" + scope
+		ttl := time.Duration(cfg.TTL) * time.Second
+
+		hash, err := requestHash(ctx)
+		if err != nil {
+			logger.Error("unable to read the request body", zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusBadRequest, constants.InvalidBody)
+			return
+		}
+		pending, _ := json.Marshal(models.IdempotentResponse{Status: idempotencyInProgress, RequestHash: hash})
+		claimed, err := idempotencyStore.redisClient.SetNX(redisKey, pending, ttl).Result()
+		if err != nil {
+			logger.Error("unable to check idempotency key, processing request", zap.Error(err))
+			ctx.Next()
+			return
+		}
+
+		if !claimed {
+			idempotencyStore.replay(ctx, logger, redisKey, hash)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: ctx.Writer}
+		ctx.Writer = recorder
+		ctx.Next()
+
+		// Only successful responses are remembered, others may turn out differently
+		// when the client retries, like a quota that has been reset.
+		if recorder.Status() < http.StatusOK || recorder.Status() >= http.StatusMultipleChoices {
+			if err := idempotencyStore.redisClient.Del(redisKey).Err(); err != nil {
+				logger.Error("unable to release idempotency key", zap.Error(err))
+			}
+			return
+		}
+		completed, _ := json.Marshal(models.IdempotentResponse{
+			Status:      idempotencyCompleted,
+			RequestHash: hash,
+			Code:        recorder.Status(),
+			Body:        recorder.body.String(),
+		})
+		if err := idempotencyStore.redisClient.Set(redisKey, completed, ttl).Err(); err != nil {
+			logger.Error("unable to store idempotent response", zap.Error(err))
+		}
+	}
+}
+
+func (store *IdempotencyStore) replay(ctx *gin.Context, logger *zap.Logger, redisKey, hash string) {
+	val, err := store.redisClient.Get(redisKey).Result()
+	if err != nil {
+		logger.Error("unable to fetch idempotent response", zap.Error(err))
+		utils.RespondWithError(ctx, http.StatusInternalServerError, "unable to fetch the response for the idempotency key")
+		return
+	}
+
+	var stored models.IdempotentResponse
+	if err := json.Unmarshal([]byte(val), &stored); err != nil {
+		logger.Error("unable to unmarshal idempotent response", zap.Error(err))
+		utils.RespondWithError(ctx, http.StatusInternalServerError, "unable to fetch the response for the idempotency key")
+		return
+	}
+
+	if stored.RequestHash != hash {
+		logger.Warn("idempotency key reused with a different request")
+		utils.RespondWithError(ctx, http.StatusUnprocessableEntity, "the idempotency key was used with a different request")
+		return
+	}
+	if stored.Status == idempotencyInProgress {
+		logger.Warn("request with the same idempotency key is in progress")
+		utils.RespondWithError(ctx, http.StatusConflict, "a request with the same idempotency key is in progress")
+		return
+	}
+
+	logger.Info("replaying stored response for idempotency key")
+	ctx.Header(constants.IdempotentReplayed, "true")
+	ctx.Data(stored.Code, constants.ContentType, []byte(stored.Body))
+	ctx.Abort()
+}
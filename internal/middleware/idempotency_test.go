@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/utils"
+	"gotest.tools/assert"
+)
+
+func TestIdempotency(t *testing.T) {
+	// init logging client
+	utils.InitLogClient()
+
+	server := miniredis.RunT(t)
+	NewIdempotencyStore(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	defer func() { idempotencyStore = nil }()
+	config.SetConfig(config.GlobalConfig{
+		Idempotency: config.Idempotency{Enabled: true, TTL: 60},
+	})
+
+	calls := 0
+	status := http.StatusOK
+	_, e := gin.CreateTestContext(httptest.NewRecorder())
+	e.Use(Idempotency())
+	e.POST("/v1/publish", func(ctx *gin.Context) {
+		calls++
+		body, _ := io.ReadAll(ctx.Request.Body)
+		ctx.JSON(status, gin.H{"message_id": ctx.GetString(constants.MessageIDKey), "body": string(body)})
+	})
+
+	sendBody := func(key, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/v1/publish", strings.NewReader(body))
+		req.Header.Add(constants.IdempotencyKey, key)
+		e.ServeHTTP(w, req)
+		return w
+	}
+	send := func(key string) *httptest.ResponseRecorder {
+		return sendBody(key, `{"speed": 10}`)
+	}
+
+	// Case 1 : first request is processed, with its body
+	first := send("key-1")
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Assert(t, strings.Contains(first.Body.String(), `speed`))
+	assert.Equal(t, 1, calls)
+
+	// Case 2 : retry returns the stored response without processing
+	retry := send("key-1")
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, "true", retry.Header().Get(constants.IdempotentReplayed))
+	assert.Equal(t, 1, calls)
+
+	// Case 3 : a different key is processed
+	other := send("key-2")
+	assert.Equal(t, http.StatusOK, other.Code)
+	assert.Assert(t, first.Body.String() != other.Body.String())
+	assert.Equal(t, 2, calls)
+
+	// Case 4 : reusing a key with another body is rejected
+	w := sendBody("key-1", `{"speed": 11}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, 2, calls)
+
+	// Case 5 : responses other than 2xx are not stored, the retry is processed again
+	status = http.StatusTooManyRequests
+	assert.Equal(t, http.StatusTooManyRequests, send("key-3").Code)
+	status = http.StatusAccepted
+	retry = send("key-3")
+	assert.Equal(t, http.StatusAccepted, retry.Code)
+	assert.Equal(t, "", retry.Header().Get(constants.IdempotentReplayed))
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, "true", send("key-3").Header().Get(constants.IdempotentReplayed))
+	assert.Equal(t, 4, calls)
+}
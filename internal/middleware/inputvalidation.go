@@ -9,9 +9,11 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/google/uuid"
+	"github.com/mqtt-pipeline/internal/config"
 	"github.com/mqtt-pipeline/internal/constants"
 	"github.com/mqtt-pipeline/internal/models"
 	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
 )
 
 // This function gets the unique transactionID
@@ -34,26 +36,26 @@ func SetTransactionId() gin.HandlerFunc {
 
 func ValidatePublishEndpointRequest() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		txid := ctx.Request.Header.Get(constants.TransactionID)
+		logger := utils.LoggerFromContext(ctx)
 
 		var speedData models.SpeedData
 		err := ctx.ShouldBindBodyWith(&speedData, binding.JSON)
 		if err != nil {
-			utils.Logger.Error(fmt.Sprintf("error while unmarshaling the request field for create account data validation, txid : %v", txid))
+			logger.Error("error while unmarshaling the request field for create account data validation", zap.Error(err))
 			utils.RespondWithError(ctx, http.StatusBadRequest, constants.InvalidBody)
 			return
 		}
 
 		// Validate request body
 		if speedData.Speed == nil {
-			utils.Logger.Error(fmt.Sprintf("request does not have speed field, txid : %v", txid))
+			logger.Error("request does not have speed field")
 			err := errors.New("invalid request received")
 			utils.RespondWithError(ctx, http.StatusBadRequest, err.Error())
 			return
 		}
 
-		if *speedData.Speed < 0 || *speedData.Speed > 100 {
-			utils.Logger.Error(fmt.Sprintf("speed range is incorrect, it's range should be between 0 and 100, txid : %v", txid))
+		if *speedData.Speed < constants.MinSpeed || *speedData.Speed > constants.MaxSpeed {
+			logger.Error("speed range is incorrect, it's range should be between 0 and 100", zap.Int("speed", *speedData.Speed))
 			err := errors.New("speed should be range between 0 and 100")
 			utils.RespondWithError(ctx, http.StatusBadRequest, err.Error())
 			return
@@ -65,18 +67,18 @@ func ValidatePublishEndpointRequest() gin.HandlerFunc {
 
 func ValidateGetTokenEndointRequest() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		txid := ctx.Request.Header.Get(constants.TransactionID)
+		logger := utils.LoggerFromContext(ctx)
 		var emailInfo models.Email
 		err := ctx.ShouldBindBodyWith(&emailInfo, binding.JSON)
 		if err != nil {
-			utils.Logger.Error(fmt.Sprintf("error while unmarshaling the request field for get token data validation, txid : %v", txid))
+			logger.Error("error while unmarshaling the request field for get token data validation", zap.Error(err))
 			utils.RespondWithError(ctx, http.StatusBadRequest, constants.InvalidBody)
 			return
 		}
 
 		// Validate request body
 		if emailInfo.Email == "" {
-			utils.Logger.Error(fmt.Sprintf("request does not have email field, txid : %v", txid))
+			logger.Error("request does not have email field")
 			err := fmt.Errorf("invalid request received")
 			utils.RespondWithError(ctx, http.StatusBadRequest, err.Error())
 			return
@@ -84,12 +86,18 @@ func ValidateGetTokenEndointRequest() gin.HandlerFunc {
 
 		_, parseErr := mail.ParseAddress(emailInfo.Email)
 		if parseErr != nil {
-			utils.Logger.Error(fmt.Sprintf("email received is incorrect, txid : %v", txid))
+			logger.Error("email received is incorrect", zap.Error(parseErr))
 			err := fmt.Errorf("invalid email found, err : %v", parseErr)
 			utils.RespondWithError(ctx, http.StatusBadRequest, err.Error())
 			return
 		}
 
+		if config.GetConfig().Tenancy.Enabled && (emailInfo.Tenant == "" || emailInfo.APIKey == "") {
+			logger.Error("request does not have tenant or api_key field")
+			utils.RespondWithError(ctx, http.StatusBadRequest, "tenant and api_key are required")
+			return
+		}
+
 		ctx.Next()
 	}
 }
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+// RequestLogger attaches a logger carrying the txid, route and device to the request.
+func RequestLogger() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		fields := []zap.Field{
+			zap.String("txid", ctx.Request.Header.Get(constants.TransactionID)),
+			zap.String("route", ctx.FullPath()),
+		}
+		if device := ctx.GetHeader(constants.DeviceID); device != "" {
+			fields = append(fields, zap.String("device", device))
+		}
+		utils.WithLogFields(ctx, fields...)
+		ctx.Next()
+	}
+}
+
+// AccessLog writes one structured line per request once the handlers have run.
+func AccessLog() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		fields := []zap.Field{
+			zap.String("method", ctx.Request.Method),
+			zap.String("path", ctx.Request.URL.Path),
+			zap.Int("status", ctx.Writer.Status()),
+			zap.Int("size", ctx.Writer.Size()),
+			zap.Duration("latency", time.Since(start)),
+			zap.String("client_ip", ctx.ClientIP()),
+			zap.String("user_agent", ctx.Request.UserAgent()),
+		}
+		if len(ctx.Errors) > 0 {
+			fields = append(fields, zap.String("errors", ctx.Errors.String()))
+		}
+
+		logger := utils.LoggerFromContext(ctx)
+		switch status := ctx.Writer.Status(); {
+		case status >= 500:
+			logger.Error("request completed", fields...)
+		case status >= 400:
+			logger.Warn("request completed", fields...)
+		default:
+			logger.Info("request completed", fields...)
+		}
+	}
+}
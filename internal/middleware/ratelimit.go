@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	RateLimitBySubject = "subject"
+	RateLimitByDevice  = "device"
+	RateLimitByIP      = "ip"
+
+	SlidingWindow = "sliding_window"
+	TokenBucket   = "token_bucket"
+)
+
+var rateLimiter *RateLimiter
+
+// slidingWindowScript keeps one sorted set entry per request inside the window.
+// It returns {allowed, remaining, retry_after_ms, reset_ms}.
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], 0, now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local reset = window
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], window)
+	return {1, limit - count - 1, 0, reset}
+end
+return {0, 0, reset, reset}
+`)
+
+// tokenBucketScript refills limit tokens per window and takes one per request.
+// It returns {allowed, remaining, retry_after_ms, reset_ms}.
+var tokenBucketScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local rate = limit / window
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or limit
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(limit, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], window)
+return {allowed, math.floor(tokens), retry, math.ceil((limit - tokens) / rate)}
+`)
+
+// RateLimiter enforces the [rate_limit] rules using counters shared through redis.
+type RateLimiter struct {
+	redisClient redis.UniversalClient
+}
+
+type rateLimitResult struct {
+	rule       config.RateLimitRule
+	allowed    bool
+	remaining  int64
+	retryAfter time.Duration
+	reset      time.Duration
+}
+
+// NewRateLimiter initialises the limiter used by RateLimit.
+func NewRateLimiter(redisClient redis.UniversalClient) {
+	rateLimiter = &RateLimiter{
+		redisClient: redisClient,
+	}
+}
+
+// RateLimit applies every configured rule for route. When a rule is exceeded the
+// request is rejected with 429 and a Retry-After header. Redis failures let the
+// request through so that the limiter never takes the API down.
+func RateLimit(route string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		cfg := config.GetConfig().RateLimit
+		if rateLimiter == nil || !cfg.Enabled {
+			ctx.Next()
+			return
+		}
+		logger := utils.LoggerFromContext(ctx)
+
+		var tightest *rateLimitResult
+		for _, rule := range cfg.Routes {
+			if rule.Route != route || rule.Limit <= 0 || rule.Window <= 0 {
+				continue
+			}
+			identity, ok := rateLimitIdentity(ctx, rule.Key)
+			if !ok {
+				continue
+			}
+
+			result, err := rateLimiter.take(rule, route, identity)
+			if err != nil {
+				logger.Error("unable to evaluate rate limit, allowing request", zap.String("key", rule.Key), zap.Error(err))
+				continue
+			}
+			if tightest == nil || !result.allowed || (tightest.allowed && result.remaining < tightest.remaining) {
+				tightest = &result
+			}
+			if !result.allowed {
+				break
+			}
+		}
+
+		if tightest == nil {
+			ctx.Next()
+			return
+		}
+
+		ctx.Header("X-RateLimit-Limit", strconv.Itoa(tightest.rule.Limit))
+		ctx.Header("X-RateLimit-Remaining", strconv.FormatInt(tightest.remaining, 10))
+		ctx.Header("X-RateLimit-Reset", strconv.FormatInt(ceilSeconds(tightest.reset), 10))
+		if !tightest.allowed {
+			ctx.Header("Retry-After", strconv.FormatInt(ceilSeconds(tightest.retryAfter), 10))
+			logger.Warn("rate limit exceeded", zap.String("key", tightest.rule.Key), zap.Int("limit", tightest.rule.Limit), zap.Int("window", tightest.rule.Window))
+			utils.RespondWithError(ctx, http.StatusTooManyRequests, fmt.Sprintf("rate limit exceeded for %v, retry after %v seconds", tightest.rule.Key, ceilSeconds(tightest.retryAfter)))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+func (limiter *RateLimiter) take(rule config.RateLimitRule, route, identity string) (rateLimitResult, error) {
+	script := slidingWindowScript
+	if rule.Algorithm == TokenBucket {
+		script = tokenBucketScript
+	}
+
+	key := fmt.Sprintf("rate_limit:%v:%v:%v", route, rule.Key, identity)
+	now := time.Now().UnixMilli()
+	window := (time.Duration(rule.Window) * time.Second).Milliseconds()
+	reply, err := script.Run(limiter.redisClient, []string{key}, now, window, rule.Limit, uuid.New().String()).Result()
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	values, ok := toInt64s(reply)
+	if !ok || len(values) != 4 {
+		return rateLimitResult{}, fmt.Errorf("unexpected rate limit script result %v", reply)
+	}
+
+	return rateLimitResult{
+		rule:       rule,
+		allowed:    values[0] == 1,
+		remaining:  values[1],
+		retryAfter: time.Duration(values[2]) * time.Millisecond,
+		reset:      time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
+
+// rateLimitIdentity resolves who the rule applies to; rules whose identity is not
+// present on the request (e.g. no device header) are skipped.
+func rateLimitIdentity(ctx *gin.Context, key string) (string, bool) {
+	switch key {
+	case RateLimitBySubject:
+		email := ctx.GetString(constants.EmailKey)
+		return email, email != ""
+	case RateLimitByDevice:
+		device := ctx.GetHeader(constants.DeviceID)
+		return device, device != ""
+	case RateLimitByIP:
+		return ctx.ClientIP(), true
+	default:
+		return "", false
+	}
+}
+
+func toInt64s(reply interface{}) ([]int64, bool) {
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	values := make([]int64, 0, len(items))
+	for _, item := range items {
+		value, ok := item.(int64)
+		if !ok {
+			return nil, false
+		}
+		values = append(values, value)
+	}
+	return values, true
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/utils"
+	"gotest.tools/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	// init logging client
+	utils.InitLogClient()
+
+	server := miniredis.RunT(t)
+	NewRateLimiter(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	defer func() { rateLimiter = nil }()
+
+	for _, algorithm := range []string{SlidingWindow, TokenBucket} {
+		server.FlushAll()
+		config.SetConfig(config.GlobalConfig{
+			RateLimit: config.RateLimit{
+				Enabled: true,
+				Routes: []config.RateLimitRule{
+					{Route: "test", Key: RateLimitByIP, Algorithm: algorithm, Limit: 2, Window: 60},
+				},
+			},
+		})
+
+		_, e := gin.CreateTestContext(httptest.NewRecorder())
+		e.Use(RateLimit("test"))
+		e.GET("/v1", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+
+		// Case 1 : requests within the limit
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/v1", nil)
+			e.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code, algorithm)
+			assert.Equal(t, "2", w.Header().Get("X-RateLimit-Limit"))
+		}
+
+		// Case 2 : limit exceeded
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/v1", nil)
+		e.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code, algorithm)
+		assert.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+		assert.Assert(t, w.Header().Get("Retry-After") != "")
+	}
+}
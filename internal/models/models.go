@@ -1,9 +1,330 @@
 package models
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type SpeedData struct {
-	Speed *int `json:"speed"`
+	Speed     *int   `json:"speed"`
+	MessageID string `json:"message_id,omitempty"`
+	DeviceID  string `json:"device_id,omitempty"`
 }
 
 type Email struct {
-	Email string `json:"email,omitempty"`
+	Email  string `json:"email,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+	APIKey string `json:"api_key,omitempty"`
+}
+
+type DependencyStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+type HealthStatus struct {
+	Status       string                      `json:"status"`
+	ShuttingDown bool                        `json:"shutting_down"`
+	Checks       map[string]DependencyStatus `json:"checks"`
+}
+
+// Kinds of the messages devices publish on the [devices] status topic, which the
+// ingest worker applies to their presence, and on the [commands] response topic, which
+// it records as the outcome of the command.
+const (
+	ReadingDeviceStatus    = "device_status"
+	ReadingCommandResponse = "command_response"
+)
+
+// Reading is a value received from a topic and waiting to be stored. Storage is the
+// storage target of its route; readings stored as speed carry the value in Speed.
+type Reading struct {
+	// Kind is empty for a reading of a metric, ReadingDeviceStatus for the status a
+	// device published, which is in Status, and ReadingCommandResponse for the response
+	// of a device to a command, which is in Response.
+	Kind       string
+	Status     string
+	Response   *CommandResponse
+	Metric     string
+	Value      float64
+	Storage    string
+	Speed      int
+	MessageID  string
+	DeviceID   string
+	Tenant     string
+	Flag       string
+	ReceivedAt time.Time
+	Topic      string
+	Payload    []byte
+}
+
+// HistoryEntry is a stored reading in the speed history.
+type HistoryEntry struct {
+	Speed     int       `json:"speed"`
+	MessageID string    `json:"message_id,omitempty"`
+	DeviceID  string    `json:"device_id,omitempty"`
+	Flag      string    `json:"flag,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// MetricEntry is a stored reading of a metric routed to the metrics storage.
+type MetricEntry struct {
+	Metric    string    `json:"metric"`
+	Value     float64   `json:"value"`
+	MessageID string    `json:"message_id,omitempty"`
+	DeviceID  string    `json:"device_id,omitempty"`
+	Flag      string    `json:"flag,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Rollup summarises the readings of a series within a minute or an hour.
+type Rollup struct {
+	Start time.Time `json:"start"`
+	Count int64     `json:"count"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Sum   float64   `json:"sum"`
+	Avg   float64   `json:"avg"`
+}
+
+// PolicyUsage is the data stored under a retention policy. Retention is in seconds,
+// 0 keeps data forever.
+type PolicyUsage struct {
+	Name            string        `json:"name"`
+	RawRetention    int           `json:"raw_retention"`
+	MinuteRetention int           `json:"minute_retention"`
+	HourRetention   int           `json:"hour_retention"`
+	Readings        int64         `json:"readings"`
+	Rollups         int64         `json:"rollups"`
+	Series          []SeriesUsage `json:"series"`
+}
+
+// SeriesUsage is the data stored for one metric of one tenant.
+type SeriesUsage struct {
+	Tenant         string     `json:"tenant,omitempty"`
+	Metric         string     `json:"metric"`
+	Raw            TierUsage  `json:"raw"`
+	Minute         TierUsage  `json:"minute"`
+	Hour           TierUsage  `json:"hour"`
+	CompactedUntil *time.Time `json:"compacted_until,omitempty"`
+}
+
+// TierUsage is the size of one resolution of a series.
+type TierUsage struct {
+	Count  int64      `json:"count"`
+	Oldest *time.Time `json:"oldest,omitempty"`
+}
+
+// DeadLetter is a message from the topic that could not be ingested.
+type DeadLetter struct {
+	ID       string    `json:"id"`
+	Topic    string    `json:"topic"`
+	Payload  string    `json:"payload"`
+	Reason   string    `json:"reason"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// IdempotentResponse is the response remembered for an Idempotency-Key.
+type IdempotentResponse struct {
+	Status      string `json:"status"`
+	RequestHash string `json:"request_hash,omitempty"`
+	Code        int    `json:"code,omitempty"`
+	Body        string `json:"body,omitempty"`
+}
+
+// OutboundMessage is a publish waiting in the store-and-forward queue for the broker.
+type OutboundMessage struct {
+	MessageID string          `json:"message_id,omitempty"`
+	Tenant    string          `json:"tenant,omitempty"`
+	Topic     string          `json:"topic"`
+	Payload   json.RawMessage `json:"payload"`
+	QueuedAt  time.Time       `json:"queued_at"`
+}
+
+// MessageStatus tracks a published message from the publish request to storage.
+type MessageStatus struct {
+	MessageID      string     `json:"message_id"`
+	Status         string     `json:"status"`
+	Reason         string     `json:"reason,omitempty"`
+	QueuedAt       *time.Time `json:"queued_at,omitempty"`
+	PublishedAt    *time.Time `json:"published_at,omitempty"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	IngestedAt     *time.Time `json:"ingested_at,omitempty"`
+	FailedAt       *time.Time `json:"failed_at,omitempty"`
+}
+
+// ImportJob is a bulk import of historical readings, processed in the background.
+type ImportJob struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	Format     string     `json:"format"`
+	Size       int64      `json:"size"`
+	Progress   float64    `json:"progress"`
+	Records    int64      `json:"records"`
+	Imported   int64      `json:"imported"`
+	Rejected   int64      `json:"rejected"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// ImportRejection is a record of an import that could not be stored.
+type ImportRejection struct {
+	Line   int64  `json:"line"`
+	Reason string `json:"reason"`
+	Record string `json:"record"`
+}
+
+// ReplayRequest starts publishing the readings stored between From and To onto Topic.
+// A SpeedFactor of 1 keeps the original timing, 10 replays ten times faster and 0 as
+// fast as possible.
+type ReplayRequest struct {
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	Topic       string    `json:"topic"`
+	SpeedFactor *float64  `json:"speed_factor,omitempty"`
+}
+
+// ReplayJob is a replay of stored readings onto a topic, processed in the background.
+type ReplayJob struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Topic       string     `json:"topic"`
+	From        time.Time  `json:"from"`
+	To          time.Time  `json:"to"`
+	SpeedFactor float64    `json:"speed_factor"`
+	Total       int64      `json:"total"`
+	Published   int64      `json:"published"`
+	Progress    float64    `json:"progress"`
+	Position    *time.Time `json:"position,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+// Device is a device in the registry. Status is online when the device sent a reading
+// within [devices] offline_after seconds.
+type Device struct {
+	ID              string     `json:"id"`
+	Name            string     `json:"name,omitempty"`
+	Type            string     `json:"type,omitempty"`
+	Owner           string     `json:"owner,omitempty"`
+	Tags            []string   `json:"tags,omitempty"`
+	FirmwareVersion string     `json:"firmware_version,omitempty"`
+	Enabled         bool       `json:"enabled"`
+	Status          string     `json:"status,omitempty"`
+	LastSeen        *time.Time `json:"last_seen,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// DeviceRequest registers a device, new devices are enabled unless enabled is false.
+// When updating a device only the fields that are set are changed.
+type DeviceRequest struct {
+	ID              string   `json:"id,omitempty"`
+	Name            *string  `json:"name,omitempty"`
+	Type            *string  `json:"type,omitempty"`
+	Owner           *string  `json:"owner,omitempty"`
+	Tags            []string `json:"tags,omitempty"`
+	FirmwareVersion *string  `json:"firmware_version,omitempty"`
+	Enabled         *bool    `json:"enabled,omitempty"`
+}
+
+// DevicePresence is whether a device is connected, why and since when. Since and
+// reason are only known when [devices] presence is enabled.
+type DevicePresence struct {
+	DeviceID string     `json:"device_id"`
+	Status   string     `json:"status"`
+	Reason   string     `json:"reason,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// CommandRequest is a command to send to a device, with its parameters and how many
+// seconds the device has to acknowledge it, [commands] timeout when not set.
+type CommandRequest struct {
+	Name    string          `json:"name"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Timeout int             `json:"timeout,omitempty"`
+}
+
+// Command is a command sent to a device and what became of it. Its ID is the
+// correlation ID the device responds with.
+type Command struct {
+	ID            string          `json:"id"`
+	DeviceID      string          `json:"device_id"`
+	Name          string          `json:"name"`
+	Params        json.RawMessage `json:"params,omitempty"`
+	Topic         string          `json:"topic"`
+	ResponseTopic string          `json:"response_topic"`
+	Status        string          `json:"status"`
+	Result        json.RawMessage `json:"result,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	SentAt        *time.Time      `json:"sent_at,omitempty"`
+	ExpiresAt     time.Time       `json:"expires_at"`
+	CompletedAt   *time.Time      `json:"completed_at,omitempty"`
+}
+
+// CommandMessage is the payload of a command published to a device. The command ID
+// and the topic to respond on are sent as the MQTT 5 correlation data and response
+// topic properties of the message.
+type CommandMessage struct {
+	Name      string          `json:"name"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// CommandResponse is what a device publishes on its response topic once it carried
+// out a command, with status ok or error. CorrelationID is the correlation data of
+// the response, the ID of the command.
+type CommandResponse struct {
+	CorrelationID string          `json:"-"`
+	Status        string          `json:"status"`
+	Result        json.RawMessage `json:"result,omitempty"`
+	Error         string          `json:"error,omitempty"`
+}
+
+// PresenceEvent announces that a device went online or offline.
+type PresenceEvent struct {
+	DeviceID string    `json:"device_id"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Status   string    `json:"status"`
+	Reason   string    `json:"reason"`
+	At       time.Time `json:"at"`
+}
+
+// Tenant is a customer whose readings, devices and topic are kept apart from those
+// of other tenants.
+type Tenant struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name,omitempty"`
+	Status    string       `json:"status"`
+	Quota     TenantQuota  `json:"quota"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+	Usage     *TenantUsage `json:"usage,omitempty"`
+}
+
+// TenantQuota limits a tenant, 0 means unlimited.
+type TenantQuota struct {
+	ReadingsPerDay int64 `json:"readings_per_day"`
+	MaxDevices     int64 `json:"max_devices"`
+}
+
+// TenantUsage is what a tenant has used of its quota.
+type TenantUsage struct {
+	ReadingsToday int64 `json:"readings_today"`
+	Devices       int64 `json:"devices"`
+}
+
+// TenantRequest creates a tenant. Without a quota the [tenancy] defaults apply.
+type TenantRequest struct {
+	ID    string       `json:"id"`
+	Name  string       `json:"name,omitempty"`
+	Quota *TenantQuota `json:"quota,omitempty"`
 }
@@ -0,0 +1,180 @@
+// Package routing decides how a message received from the broker is ingested: which
+// metric it carries, how the value is decoded and validated and where it is stored.
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+)
+
+const (
+	MetricSpeed = "speed"
+
+	DecoderJSON = "json"
+	DecoderText = "text"
+
+	ValidatorRange = "range"
+	ValidatorNone  = "none"
+
+	// StorageSpeed stores readings in the speed history, the latest speed and the
+	// latest reading of every device, and streams them to live subscribers.
+	StorageSpeed = "speed"
+	// StorageMetrics stores readings in a history and latest readings of their own
+	// metric.
+	StorageMetrics = "metrics"
+)
+
+// Decoded is the value read from a message with the IDs it carried.
+type Decoded struct {
+	Value     float64
+	MessageID string
+	DeviceID  string
+}
+
+// DefaultRoute is the route of messages on the [mqtt] topic that match no rule, the
+// speed readings published by the service itself.
+func DefaultRoute() config.Route {
+	return config.Route{
+		Topic:     config.GetConfig().MQTTConfig.Topic,
+		Metric:    MetricSpeed,
+		Decoder:   DecoderJSON,
+		Field:     "speed",
+		Validator: ValidatorRange,
+		Min:       constants.MinSpeed,
+		Max:       constants.MaxSpeed,
+		Storage:   StorageSpeed,
+	}
+}
+
+// Topics returns the topic filters to subscribe to, the [mqtt] topic followed by the
+// filter of every rule, without duplicates.
+func Topics() []string {
+	cfg := config.GetConfig()
+	topics := []string{cfg.MQTTConfig.Topic}
+	seen := map[string]bool{cfg.MQTTConfig.Topic: true}
+	for _, route := range cfg.Routing.Routes {
+		if !seen[route.Topic] {
+			seen[route.Topic] = true
+			topics = append(topics, route.Topic)
+		}
+	}
+	return topics
+}
+
+// Resolve returns the first rule whose filter matches topic, or the default route
+// for the [mqtt] topic. ok is false when nothing matches.
+func Resolve(topic string) (config.Route, bool) {
+	cfg := config.GetConfig()
+	for _, route := range cfg.Routing.Routes {
+		if Match(route.Topic, topic) {
+			return withDefaults(route), true
+		}
+	}
+	if topic == cfg.MQTTConfig.Topic {
+		return DefaultRoute(), true
+	}
+	return config.Route{}, false
+}
+
+func withDefaults(route config.Route) config.Route {
+	if route.Decoder == "" {
+		route.Decoder = DecoderJSON
+	}
+	if route.Field == "" {
+		route.Field = "value"
+	}
+	if route.Validator == "" {
+		route.Validator = ValidatorNone
+	}
+	if route.Storage == "" {
+		route.Storage = StorageMetrics
+	}
+	return route
+}
+
+// Match reports whether topic matches filter, where + matches exactly one level and
+// a trailing # matches any number of remaining levels, including none.
+func Match(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			// topics starting with $ are reserved for the broker and are not matched
+			// by a wildcard in the first level
+			return i > 0 || !strings.HasPrefix(topic, "$")
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level == "+" {
+			if i == 0 && strings.HasPrefix(topic, "$") {
+				return false
+			}
+			continue
+		}
+		if level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// Decode reads the value of a message on topic according to the route's decoder.
+func Decode(route config.Route, topic string, payload []byte) (Decoded, error) {
+	var decoded Decoded
+	switch route.Decoder {
+	case DecoderText:
+		value, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+		if err != nil {
+			return decoded, fmt.Errorf("invalid payload, err %v", err)
+		}
+		decoded.Value = value
+	default:
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return decoded, fmt.Errorf("invalid payload, err %v", err)
+		}
+		raw, ok := fields[route.Field]
+		if !ok || string(raw) == "null" {
+			return decoded, fmt.Errorf("%v is missing", route.Field)
+		}
+		if err := json.Unmarshal(raw, &decoded.Value); err != nil {
+			return decoded, fmt.Errorf("invalid payload, %v is not a number", route.Field)
+		}
+		// the IDs are optional, a payload with IDs of the wrong type is still accepted
+		if raw, ok := fields["message_id"]; ok {
+			_ = json.Unmarshal(raw, &decoded.MessageID)
+		}
+		if raw, ok := fields["device_id"]; ok {
+			_ = json.Unmarshal(raw, &decoded.DeviceID)
+		}
+	}
+
+	if route.DeviceLevel > 0 {
+		levels := strings.Split(topic, "/")
+		if route.DeviceLevel <= len(levels) {
+			decoded.DeviceID = levels[route.DeviceLevel-1]
+		}
+	}
+	return decoded, nil
+}
+
+// Validate checks a decoded value against the route's validator and storage.
+func Validate(route config.Route, value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("%v must be a finite number", route.Metric)
+	}
+	if route.Validator == ValidatorRange && (value < float64(route.Min) || value > float64(route.Max)) {
+		return fmt.Errorf("%v should be range between %v and %v", route.Metric, route.Min, route.Max)
+	}
+	if route.Storage == StorageSpeed && value != math.Trunc(value) {
+		return fmt.Errorf("%v must be a whole number to be stored as speed", route.Metric)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/mqtt-pipeline/internal/config"
+	"gotest.tools/assert"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"speed_topic", "speed_topic", true},
+		{"speed_topic", "speed_topic/x", false},
+		{"vehicles/+/rpm", "vehicles/truck-42/rpm", true},
+		{"vehicles/+/rpm", "vehicles/rpm", false},
+		{"vehicles/+/rpm", "vehicles/truck-42/fuel", false},
+		{"vehicles/+/rpm", "vehicles//rpm", true},
+		{"vehicles/#", "vehicles", true},
+		{"vehicles/#", "vehicles/truck-42/engine/temperature", true},
+		{"vehicles/#", "fleet/vehicles", false},
+		{"+/+", "a/b", true},
+		{"+/+", "a/b/c", false},
+		{"#", "a/b/c", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, Match(c.filter, c.topic), "filter %q, topic %q", c.filter, c.topic)
+	}
+}
+
+func TestRouting(t *testing.T) {
+	config.SetConfig(config.GlobalConfig{
+		MQTTConfig: config.MQTT{Topic: "speed_topic"},
+		Routing: config.Routing{Routes: []config.Route{
+			{Topic: "vehicles/+/rpm", Metric: "rpm", Validator: ValidatorRange, Min: 0, Max: 10000, DeviceLevel: 2},
+			{Topic: "vehicles/#", Metric: "other"},
+			{Topic: "sensors/+/temperature", Metric: "temperature", Decoder: DecoderText},
+			{Topic: "fleet/speed", Metric: "speed", Field: "kmh", Validator: ValidatorRange, Min: 0, Max: 100, Storage: StorageSpeed},
+		}},
+	})
+	defer config.SetConfig(config.GlobalConfig{})
+
+	// Case 1 : every filter is subscribed to once, after the [mqtt] topic
+	assert.DeepEqual(t, []string{"speed_topic", "vehicles/+/rpm", "vehicles/#", "sensors/+/temperature", "fleet/speed"}, Topics())
+
+	// Case 2 : the first matching rule wins and gets the defaults filled in
+	route, ok := Resolve("vehicles/truck-42/rpm")
+	assert.Assert(t, ok)
+	assert.Equal(t, "rpm", route.Metric)
+	assert.Equal(t, DecoderJSON, route.Decoder)
+	assert.Equal(t, "value", route.Field)
+	assert.Equal(t, StorageMetrics, route.Storage)
+	route, ok = Resolve("vehicles/truck-42/fuel")
+	assert.Assert(t, ok)
+	assert.Equal(t, "other", route.Metric)
+
+	// Case 3 : the [mqtt] topic falls back to speed readings, other topics match nothing
+	route, ok = Resolve("speed_topic")
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, DefaultRoute(), route)
+	_, ok = Resolve("unrouted")
+	assert.Assert(t, !ok)
+
+	// Case 4 : json payloads, with the device taken from the topic level
+	route, _ = Resolve("vehicles/truck-42/rpm")
+	decoded, err := Decode(route, "vehicles/truck-42/rpm", []byte(`{"value": 3200.5, "message_id": "m1", "device_id": "ignored"}`))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, Decoded{Value: 3200.5, MessageID: "m1", DeviceID: "truck-42"}, decoded)
+	_, err = Decode(route, "vehicles/truck-42/rpm", []byte(`{"rpm": 3200}`))
+	assert.Error(t, err, "value is missing")
+	_, err = Decode(route, "vehicles/truck-42/rpm", []byte(`{"value": "fast"}`))
+	assert.Error(t, err, "invalid payload, value is not a number")
+
+	// Case 5 : text payloads
+	route, _ = Resolve("sensors/s1/temperature")
+	decoded, err = Decode(route, "sensors/s1/temperature", []byte(" -4.5\n"))
+	assert.NilError(t, err)
+	assert.Equal(t, -4.5, decoded.Value)
+	_, err = Decode(route, "sensors/s1/temperature", []byte("cold"))
+	assert.ErrorContains(t, err, "invalid payload")
+
+	// Case 6 : validators, and whole numbers for the speed storage
+	route, _ = Resolve("vehicles/truck-42/rpm")
+	assert.NilError(t, Validate(route, 10000))
+	assert.Error(t, Validate(route, 10001), "rpm should be range between 0 and 10000")
+	route, _ = Resolve("sensors/s1/temperature")
+	assert.NilError(t, Validate(route, -273))
+	route, _ = Resolve("fleet/speed")
+	assert.NilError(t, Validate(route, 42))
+	assert.Error(t, Validate(route, 42.5), "speed must be a whole number to be stored as speed")
+	assert.Error(t, Validate(DefaultRoute(), 101), "speed should be range between 0 and 100")
+}
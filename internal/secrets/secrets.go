@@ -0,0 +1,115 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	FileScheme  = "file://"
+	EnvScheme   = "env:"
+	VaultScheme = "vault:"
+)
+
+// Provider resolves the part of a secret reference that follows its scheme.
+type Provider interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// Options configures the providers available to a Resolver.
+type Options struct {
+	VaultAddress   string
+	VaultToken     string
+	VaultNamespace string
+	VaultKVVersion int
+	Timeout        time.Duration
+}
+
+// Resolver turns config values such as file:///run/secrets/redis_pw, env:REDIS_PW
+// or vault:secret/mqtt-pipeline#redis_password into the secret they point to.
+// Values without a known scheme are returned unchanged.
+type Resolver struct {
+	providers map[string]Provider
+}
+
+// NewResolver registers the file and env providers, and the vault provider when a
+// vault address is configured. The vault token may itself be a file or env reference.
+func NewResolver(opts Options) (*Resolver, error) {
+	resolver := &Resolver{
+		providers: map[string]Provider{
+			FileScheme: fileProvider{},
+			EnvScheme:  envProvider{},
+		},
+	}
+
+	if opts.VaultAddress != "" {
+		token, err := resolver.Resolve(context.Background(), opts.VaultToken)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve the vault token, err %v", err)
+		}
+		timeout := opts.Timeout
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		resolver.providers[VaultScheme] = &VaultProvider{
+			Address:   strings.TrimSuffix(opts.VaultAddress, "/"),
+			Token:     token,
+			Namespace: opts.VaultNamespace,
+			KVVersion: opts.VaultKVVersion,
+			Client:    &http.Client{Timeout: timeout},
+		}
+	}
+	return resolver, nil
+}
+
+// Register adds or replaces the provider used for scheme.
+func (r *Resolver) Register(scheme string, provider Provider) {
+	r.providers[scheme] = provider
+}
+
+// Resolve returns the secret referenced by value, or value itself when it is not a reference.
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	for scheme, provider := range r.providers {
+		if ref, ok := strings.CutPrefix(value, scheme); ok {
+			secret, err := provider.Resolve(ctx, ref)
+			if err != nil {
+				return "", fmt.Errorf("unable to resolve %v%v, err %v", scheme, ref, err)
+			}
+			return secret, nil
+		}
+	}
+	if strings.HasPrefix(value, VaultScheme) {
+		return "", fmt.Errorf("vault reference %v used but no vault address is configured", value)
+	}
+	return value, nil
+}
+
+// IsReference reports whether value points to a secret rather than holding one.
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, FileScheme) || strings.HasPrefix(value, EnvScheme) || strings.HasPrefix(value, VaultScheme)
+}
+
+type fileProvider struct{}
+
+// Resolve reads the file, dropping the trailing newline most secret mounts add.
+func (fileProvider) Resolve(_ context.Context, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+type envProvider struct{}
+
+func (envProvider) Resolve(_ context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %v is not set", name)
+	}
+	return value, nil
+}
@@ -0,0 +1,77 @@
+package secrets
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestResolve(t *testing.T) {
+	// stub of the Vault KV v2 read endpoint
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		if r.URL.Path != "/v1/secret/data/mqtt-pipeline" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"redis_password":"from-vault","port":6379},"metadata":{"version":3}}}`))
+	}))
+	defer vault.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "redis_pw")
+	assert.NilError(t, os.WriteFile(path, []byte("from-file\n"), 0o600))
+	t.Setenv("TEST_SECRET", "from-env")
+	t.Setenv("TEST_VAULT_TOKEN", "root-token")
+
+	resolver, err := NewResolver(Options{VaultAddress: vault.URL, VaultToken: "env:TEST_VAULT_TOKEN"})
+	assert.NilError(t, err)
+	ctx := context.Background()
+
+	cases := []struct {
+		value    string
+		expected string
+		err      string
+	}{
+		{value: "plain-value", expected: "plain-value"},
+		{value: "file://" + path, expected: "from-file"},
+		{value: "env:TEST_SECRET", expected: "from-env"},
+		{value: "vault:secret/mqtt-pipeline#redis_password", expected: "from-vault"},
+		{value: "vault:secret/mqtt-pipeline#port", expected: "6379"},
+		{value: "env:MISSING_SECRET", err: "MISSING_SECRET is not set"},
+		{value: "file://" + filepath.Join(dir, "missing"), err: "no such file"},
+		{value: "vault:secret/mqtt-pipeline#missing", err: "field missing not found"},
+		{value: "vault:secret/other#redis_password", err: "vault returned 404"},
+		{value: "vault:secret/mqtt-pipeline", err: "<mount>/<path>#<field>"},
+	}
+	for _, c := range cases {
+		value, err := resolver.Resolve(ctx, c.value)
+		if c.err != "" {
+			assert.ErrorContains(t, err, c.err, c.value)
+			continue
+		}
+		assert.NilError(t, err, c.value)
+		assert.Equal(t, c.expected, value)
+	}
+
+	// Case : wrong token
+	resolver.Register(VaultScheme, &VaultProvider{Address: vault.URL, Token: "wrong", Client: http.DefaultClient})
+	_, err = resolver.Resolve(ctx, "vault:secret/mqtt-pipeline#redis_password")
+	assert.ErrorContains(t, err, "permission denied")
+
+	// Case : vault reference without a vault address
+	resolver, err = NewResolver(Options{})
+	assert.NilError(t, err)
+	_, err = resolver.Resolve(ctx, "vault:secret/mqtt-pipeline#redis_password")
+	assert.ErrorContains(t, err, "no vault address")
+}
@@ -0,0 +1,84 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// VaultProvider reads secrets from a Vault-compatible KV engine over HTTP. A reference
+// is <mount>/<path>#<field>, e.g. secret/mqtt-pipeline#redis_password.
+type VaultProvider struct {
+	Address   string
+	Token     string
+	Namespace string
+	// KVVersion is 1 or 2, defaults to 2.
+	KVVersion int
+	Client    *http.Client
+}
+
+type vaultResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []string                   `json:"errors"`
+}
+
+func (p *VaultProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || field == "" {
+		return "", fmt.Errorf("vault reference must be <mount>/<path>#<field>")
+	}
+	mount, secretPath, ok := strings.Cut(strings.Trim(path, "/"), "/")
+	if !ok || secretPath == "" {
+		return "", fmt.Errorf("vault reference must be <mount>/<path>#<field>")
+	}
+
+	url := fmt.Sprintf("%v/v1/%v/%v", p.Address, mount, secretPath)
+	if p.KVVersion != 1 {
+		url = fmt.Sprintf("%v/v1/%v/data/%v", p.Address, mount, secretPath)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", p.Token)
+	if p.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.Namespace)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body vaultResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("unable to decode vault response, err %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %v %v", resp.StatusCode, strings.Join(body.Errors, ", "))
+	}
+
+	data := body.Data
+	if p.KVVersion != 1 {
+		// KV v2 nests the secret under data.data next to its metadata.
+		var nested map[string]json.RawMessage
+		if err := json.Unmarshal(data["data"], &nested); err != nil {
+			return "", fmt.Errorf("unexpected kv v2 response, err %v", err)
+		}
+		data = nested
+	}
+
+	raw, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("field %v not found in %v", field, path)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		// Non-string values are returned as their JSON text.
+		return string(raw), nil
+	}
+	return value, nil
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+	"github.com/mqtt-pipeline/internal/utils"
+	"gotest.tools/assert"
+)
+
+func TestCommands(t *testing.T) {
+	cfg := config.GlobalConfig{MQTTConfig: config.MQTT{Topic: "speed_topic"}}
+	s := newIngestionTestServer(t, cfg)
+	broker := s.useBroker()
+	request := s.request
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service.StartCommands(ctx)
+
+	command := func(w *httptest.ResponseRecorder) models.Command {
+		var command models.Command
+		s.decode(w, &command)
+		return command
+	}
+	send := func(deviceID, body string) models.Command {
+		w := request(http.MethodPost, "/v1/devices/"+deviceID+"/commands", body)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		return command(w)
+	}
+	// respond queues a response of the device and waits for the ingest worker to
+	// handle it
+	respond := func(deviceID, commandID, status, result, reason string) {
+		handled := utils.GetIngestStats().Stored
+		response := models.CommandResponse{CorrelationID: commandID, Status: status, Result: json.RawMessage(result), Error: reason}
+		utils.SpeedChannel <- models.Reading{Kind: models.ReadingCommandResponse, Response: &response, DeviceID: deviceID, ReceivedAt: time.Now()}
+		eventually(t, "response to "+commandID+" was not handled", func() bool {
+			return utils.GetIngestStats().Stored > handled
+		})
+	}
+	get := func(deviceID, commandID string) models.Command {
+		w := request(http.MethodGet, "/v1/devices/"+deviceID+"/commands/"+commandID, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		return command(w)
+	}
+
+	// Case 1 : sending commands needs an admin token, and commands have to be enabled
+	// and valid
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/v1/devices/truck-1/commands", `{"name": "reboot"}`).Code)
+	adminToken, err := service.MintAdminToken("admin@example.com", time.Minute)
+	assert.NilError(t, err)
+	s.token = adminToken
+	assert.Equal(t, http.StatusServiceUnavailable, request(http.MethodPost, "/v1/devices/truck-1/commands", `{"name": "reboot"}`).Code)
+	cfg.Commands = config.Commands{Enabled: true, Topic: "devices/+/commands", ResponseTopic: "devices/+/commands/response", Timeout: 30}
+	config.SetConfig(cfg)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/v1/devices/truck-1/commands", `{"params": {}}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/v1/devices/-truck/commands", `{"name": "reboot"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/v1/devices/truck-1/commands", `{"name": "reboot", "timeout": -1}`).Code)
+	assert.Equal(t, 0, len(broker.messages()))
+
+	// Case 2 : a command is accepted pending and published with QoS 1 to the topic of
+	// the device in the background, with its ID as the correlation data and the
+	// response topic of the device
+	w := request(http.MethodPost, "/v1/devices/truck-1/commands", `{"name": "set_speed_limit", "params": {"limit": 80}}`)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	limit := command(w)
+	assert.Equal(t, "/v1/devices/truck-1/commands/"+limit.ID, w.Header().Get("Location"))
+	assert.Equal(t, service.CommandPending, limit.Status)
+	assert.Assert(t, limit.ExpiresAt.Sub(limit.CreatedAt) == 30*time.Second)
+	eventually(t, "command was not sent", func() bool {
+		return get("truck-1", limit.ID).Status == service.CommandSent
+	})
+	assert.Assert(t, get("truck-1", limit.ID).SentAt != nil)
+	messages := broker.messages()
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, "devices/truck-1/commands", messages[0].topic)
+	assert.Equal(t, byte(1), messages[0].qos)
+	assert.Equal(t, limit.ID, messages[0].correlationID)
+	assert.Equal(t, "devices/truck-1/commands/response", messages[0].responseTopic)
+	assert.Assert(t, messages[0].expiry > 29*time.Second && messages[0].expiry <= 30*time.Second)
+	var message models.CommandMessage
+	assert.NilError(t, json.Unmarshal(messages[0].payload, &message))
+	assert.Equal(t, "set_speed_limit", message.Name)
+	assert.Equal(t, `{"limit":80}`, string(message.Params))
+
+	// Case 3 : responses are correlated to the command of the device that sent them
+	respond("truck-2", limit.ID, "ok", "", "")
+	assert.Equal(t, service.CommandSent, get("truck-1", limit.ID).Status)
+	respond("truck-1", limit.ID, "ok", `{"limit": 80}`, "")
+	acked := get("truck-1", limit.ID)
+	assert.Equal(t, service.CommandAcknowledged, acked.Status)
+	assert.Equal(t, `{"limit":80}`, string(acked.Result))
+	assert.Assert(t, acked.CompletedAt != nil)
+	// a later response does not change the outcome
+	respond("truck-1", limit.ID, "error", "", "too late")
+	assert.Equal(t, service.CommandAcknowledged, get("truck-1", limit.ID).Status)
+
+	reboot := send("truck-1", `{"name": "reboot"}`)
+	respond("truck-1", reboot.ID, "error", "", "reboot not allowed while moving")
+	failed := get("truck-1", reboot.ID)
+	assert.Equal(t, service.CommandFailed, failed.Status)
+	assert.Equal(t, "reboot not allowed while moving", failed.Error)
+
+	// Case 4 : commands without a response time out
+	ping := send("truck-1", `{"name": "ping", "timeout": 1}`)
+	eventually(t, "command did not time out", func() bool {
+		return get("truck-1", ping.ID).Status == service.CommandTimedOut
+	})
+	respond("truck-1", ping.ID, "ok", "", "")
+	assert.Equal(t, service.CommandTimedOut, get("truck-1", ping.ID).Status)
+
+	// Case 5 : the commands of a device are listed newest first
+	list := func(deviceID, query string) []string {
+		w := request(http.MethodGet, "/v1/devices/"+deviceID+"/commands"+query, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var body struct {
+			Commands []models.Command `json:"commands"`
+		}
+		s.decode(w, &body)
+		ids := []string{}
+		for _, command := range body.Commands {
+			ids = append(ids, command.ID)
+		}
+		return ids
+	}
+	assert.DeepEqual(t, []string{ping.ID, reboot.ID, limit.ID}, list("truck-1", ""))
+	assert.DeepEqual(t, []string{ping.ID}, list("truck-1", "?limit=1"))
+	assert.DeepEqual(t, []string{}, list("truck-2", ""))
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodGet, "/v1/devices/truck-1/commands?limit=0", "").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/v1/devices/truck-2/commands/"+limit.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/v1/devices/truck-1/commands/unknown", "").Code)
+
+	// Case 6 : commands the broker does not accept fail after they were accepted
+	broker.rejectPublishes.Store(true)
+	rejected := send("truck-1", `{"name": "reboot"}`)
+	assert.Equal(t, service.CommandPending, rejected.Status)
+	eventually(t, "command did not fail", func() bool {
+		return get("truck-1", rejected.ID).Status == service.CommandFailed
+	})
+	assert.Assert(t, strings.Contains(get("truck-1", rejected.ID).Error, "publish rejected"))
+	broker.rejectPublishes.Store(false)
+
+	// Case 7 : commands are not sent to devices the registry rejects or without a broker
+	cfg.Devices.Registry = service.RegistryReject
+	config.SetConfig(cfg)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodPost, "/v1/devices/truck-9/commands", `{"name": "reboot"}`).Code)
+	cfg.Devices.Registry = service.RegistryOff
+	config.SetConfig(cfg)
+	broker.disconnected.Store(true)
+	assert.Equal(t, http.StatusServiceUnavailable, request(http.MethodPost, "/v1/devices/truck-1/commands", `{"name": "reboot"}`).Code)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+	"github.com/mqtt-pipeline/internal/utils"
+	"gotest.tools/assert"
+)
+
+func TestDevices(t *testing.T) {
+	cfg := config.GlobalConfig{MQTTConfig: config.MQTT{Topic: "speed_topic"}, MessageStatus: config.MessageStatus{Enabled: true}}
+	s := newIngestionTestServer(t, cfg)
+	request := s.request
+	device := func(w *httptest.ResponseRecorder) models.Device {
+		var device models.Device
+		s.decode(w, &device)
+		return device
+	}
+
+	// ingest stores a reading of the device and returns the status of its message
+	ingest := func(messageID, deviceID string) models.MessageStatus {
+		utils.SpeedChannel <- models.Reading{Metric: "speed", Storage: "speed", Value: 42, Speed: 42, MessageID: messageID, DeviceID: deviceID, ReceivedAt: time.Now(), Topic: "speed_topic"}
+		var status models.MessageStatus
+		eventually(t, "message "+messageID+" was not ingested", func() bool {
+			w := request(http.MethodGet, "/v1/messages/"+messageID, "")
+			if w.Code != http.StatusOK {
+				return false
+			}
+			s.decode(w, &status)
+			return true
+		})
+		return status
+	}
+
+	// Case 1 : creating, changing and deleting devices needs an admin token
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/v1/devices", `{"id": "truck-1"}`).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPatch, "/v1/devices/truck-1", `{"enabled": false}`).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodDelete, "/v1/devices/truck-1", "").Code)
+	adminToken, err := service.MintAdminToken("admin@example.com", time.Minute)
+	assert.NilError(t, err)
+	s.token = adminToken
+
+	// Case 2 : devices are registered enabled, once, with a valid ID
+	w := request(http.MethodPost, "/v1/devices", `{"id": "truck-1", "name": "Truck 1", "type": "truck", "owner": "fleet-a", "tags": ["north", "refrigerated"], "firmware_version": "1.4.2"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "/v1/devices/truck-1", w.Header().Get("Location"))
+	truck := device(w)
+	assert.Equal(t, true, truck.Enabled)
+	assert.Equal(t, service.DeviceOffline, truck.Status)
+	assert.Assert(t, truck.LastSeen == nil)
+	assert.Equal(t, http.StatusConflict, request(http.MethodPost, "/v1/devices", `{"id": "truck-1"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/v1/devices", `{"id": "truck/1"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/v1/devices", `{"name": "no id"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/v1/devices", `{"id": "truck-3", "tags": [""]}`).Code)
+
+	// Case 3 : updates only change the fields that are set
+	assert.Equal(t, http.StatusCreated, request(http.MethodPost, "/v1/devices", `{"id": "truck-2", "type": "truck", "owner": "fleet-b"}`).Code)
+	w = request(http.MethodPatch, "/v1/devices/truck-2", `{"enabled": false, "firmware_version": "2.0.0"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	truck = device(w)
+	assert.Equal(t, false, truck.Enabled)
+	assert.Equal(t, "2.0.0", truck.FirmwareVersion)
+	assert.Equal(t, "fleet-b", truck.Owner)
+	assert.Equal(t, "fleet-b", device(request(http.MethodGet, "/v1/devices/truck-2", "")).Owner)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPatch, "/v1/devices/truck-2", `{"id": "truck-9"}`).Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodPatch, "/v1/devices/truck-9", `{"enabled": true}`).Code)
+	// concurrent updates of different fields both apply
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.Check(t, request(http.MethodPatch, "/v1/devices/truck-2", `{"name": "Truck 2"}`).Code == http.StatusOK)
+		}()
+		go func() {
+			defer wg.Done()
+			assert.Check(t, request(http.MethodPatch, "/v1/devices/truck-2", `{"type": "van"}`).Code == http.StatusOK)
+		}()
+	}
+	wg.Wait()
+	truck = device(request(http.MethodGet, "/v1/devices/truck-2", ""))
+	assert.Equal(t, "Truck 2", truck.Name)
+	assert.Equal(t, "van", truck.Type)
+	assert.Equal(t, "2.0.0", truck.FirmwareVersion)
+	assert.Equal(t, http.StatusOK, request(http.MethodPatch, "/v1/devices/truck-2", `{"type": "truck"}`).Code)
+
+	// Case 4 : with the registry off every reading is stored as before
+	assert.Equal(t, service.StatusIngested, ingest("m1", "truck-9").Status)
+
+	// Case 5 : flagged readings of disabled and unregistered devices are stored with their flag
+	cfg.Devices.Registry = service.RegistryFlag
+	config.SetConfig(cfg)
+	assert.Equal(t, service.StatusIngested, ingest("m2", "truck-1").Status)
+	assert.Equal(t, service.StatusIngested, ingest("m3", "truck-2").Status)
+	assert.Equal(t, service.StatusIngested, ingest("m4", "truck-9").Status)
+	assert.Equal(t, service.StatusIngested, ingest("m5", "").Status)
+	history, err := service.QueryHistory(context.Background(), time.Time{}, time.Time{}, 0)
+	assert.NilError(t, err)
+	flags := map[string]string{}
+	for _, entry := range history {
+		flags[entry.MessageID] = entry.Flag
+	}
+	assert.DeepEqual(t, map[string]string{
+		"m1": "",
+		"m2": "",
+		"m3": service.FlagDisabledDevice,
+		"m4": service.FlagUnregisteredDevice,
+		"m5": service.FlagUnregisteredDevice,
+	}, flags)
+
+	truck = device(request(http.MethodGet, "/v1/devices/truck-1", ""))
+	assert.Equal(t, service.DeviceOnline, truck.Status)
+	assert.Assert(t, truck.LastSeen != nil)
+
+	// Case 6 : rejected readings fail and are dead-lettered
+	cfg.Devices.Registry = service.RegistryReject
+	config.SetConfig(cfg)
+	assert.Equal(t, service.StatusIngested, ingest("m6", "truck-1").Status)
+	status := ingest("m7", "truck-2")
+	assert.Equal(t, service.StatusFailed, status.Status)
+	assert.Equal(t, service.ErrDeviceDisabled.Error(), status.Reason)
+	status = ingest("m8", "truck-9")
+	assert.Equal(t, service.StatusFailed, status.Status)
+	assert.Equal(t, service.ErrDeviceUnregistered.Error(), status.Reason)
+	letters, err := service.ListDeadLetters(context.Background(), 10)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(letters))
+
+	// Case 7 : devices are listed by ID and filtered by their fields and status
+	list := func(query string) []string {
+		w := request(http.MethodGet, "/v1/devices"+query, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var body struct {
+			Devices []models.Device `json:"devices"`
+		}
+		s.decode(w, &body)
+		ids := []string{}
+		for _, device := range body.Devices {
+			ids = append(ids, device.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, http.StatusCreated, request(http.MethodPost, "/v1/devices", `{"id": "trailer-7", "type": "trailer", "tags": ["north"]}`).Code)
+	assert.DeepEqual(t, []string{"trailer-7", "truck-1", "truck-2"}, list(""))
+	assert.DeepEqual(t, []string{"trailer-7", "truck-1"}, list("?tag=north"))
+	assert.DeepEqual(t, []string{"truck-2"}, list("?owner=fleet-b&type=truck"))
+	assert.DeepEqual(t, []string{"truck-1", "truck-2"}, list("?status=online"))
+	assert.DeepEqual(t, []string{"trailer-7"}, list("?status=offline"))
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodGet, "/v1/devices?status=lost", "").Code)
+
+	// Case 8 : deleted devices are gone
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/v1/devices/truck-2", "").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/v1/devices/truck-2", "").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/v1/devices/truck-2", "").Code)
+}
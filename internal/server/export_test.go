@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/parquet-go/parquet-go"
+	"gotest.tools/assert"
+)
+
+func TestExport(t *testing.T) {
+	s := newTestServer(t, config.GlobalConfig{})
+	export := func(query string) *httptest.ResponseRecorder {
+		return s.request(http.MethodGet, "/v1/speed/export"+query, "")
+	}
+
+	// 2500 readings, seven of them stored within every millisecond so that pages end
+	// in the middle of readings sharing a score
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2500; i++ {
+		at := start.Add(time.Duration(i/7) * time.Millisecond)
+		entry, _ := json.Marshal(models.HistoryEntry{Speed: i % 100, MessageID: fmt.Sprintf("m%d", i), Timestamp: at})
+		assert.NilError(t, s.redis.ZAdd("speed_history", &redis.Z{Score: float64(at.UnixMilli()), Member: entry}).Err())
+	}
+
+	// Case 1 : csv by default, every reading exactly once
+	w := export("")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	assert.NilError(t, err)
+	assert.Equal(t, 2501, len(records))
+	assert.DeepEqual(t, []string{"timestamp", "speed", "device_id", "message_id"}, records[0])
+	seen := map[string]bool{}
+	for _, record := range records[1:] {
+		assert.Assert(t, !seen[record[3]], "%v exported twice", record[3])
+		seen[record[3]] = true
+	}
+
+	// Case 2 : ndjson within a time range
+	w = export("?format=ndjson&from=2026-01-01T00:00:00.1Z&to=2026-01-01T00:00:00.149Z")
+	assert.Equal(t, http.StatusOK, w.Code)
+	lines := 0
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var entry models.HistoryEntry
+		assert.NilError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		lines++
+	}
+	assert.Equal(t, 350, lines)
+
+	// Case 3 : parquet
+	w = export("?format=parquet")
+	assert.Equal(t, http.StatusOK, w.Code)
+	file, err := parquet.OpenFile(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	assert.NilError(t, err)
+	assert.Equal(t, int64(2500), file.NumRows())
+	assert.Equal(t, 3, len(file.RowGroups()))
+
+	// Case 4 : unknown formats and invalid times are rejected
+	assert.Equal(t, http.StatusBadRequest, export("?format=xlsx").Code)
+	assert.Equal(t, http.StatusBadRequest, export("?from=yesterday").Code)
+
+	// Case 5 : the limit of paginated range queries does not apply to exports
+	w = export("?format=ndjson&limit=5000")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 2500, bytes.Count(w.Body.Bytes(), []byte("\n")))
+}
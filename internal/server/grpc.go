@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+	"github.com/mqtt-pipeline/internal/utils"
+	"github.com/mqtt-pipeline/pkg/pipelinepb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type loggerKey struct{}
+
+// GRPCServer serves the Pipeline gRPC API on top of the service package.
+type GRPCServer struct {
+	*grpc.Server
+	stopping chan struct{}
+}
+
+// NewGRPC builds the gRPC server. Every call is authenticated with the same tokens as
+// the HTTP routes. The caller owns its lifecycle.
+func NewGRPC() *GRPCServer {
+	s := &GRPCServer{stopping: make(chan struct{})}
+	s.Server = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unaryAuthInterceptor),
+		grpc.ChainStreamInterceptor(streamAuthInterceptor),
+	)
+	pipelinepb.RegisterPipelineServer(s.Server, &pipelineServer{stopping: s.stopping})
+	return s
+}
+
+// Shutdown ends the open Subscribe streams and waits for the other calls to finish.
+// Calls still running when ctx expires are cancelled.
+func (s *GRPCServer) Shutdown(ctx context.Context) {
+	close(s.stopping)
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.Stop()
+	}
+}
+
+// authenticate verifies the token in the authorization metadata and returns a
+// context carrying a logger for the call.
+func authenticate(ctx context.Context, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	fields := []zap.Field{zap.String("txid", first(constants.TransactionID)), zap.String("method", method)}
+	if device := first(constants.DeviceID); device != "" {
+		fields = append(fields, zap.String("device", device))
+	}
+	logger := utils.Logger.With(fields...)
+
+	tokenString := first("authorization")
+	if tokenString == "" {
+		logger.Error("authorization metadata is empty")
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	claims, err := service.VerifyToken(ctx, tokenString)
+	if err != nil {
+		var tokenErr *service.TokenError
+		if errors.As(err, &tokenErr) {
+			logger.Error(tokenErr.Message, zap.Error(tokenErr.Err))
+			return nil, status.Error(codes.Internal, tokenErr.Message)
+		}
+		logger.Error("token rejected", zap.Error(err))
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	email, _ := claims[constants.EmailKey].(string)
+	if email != "" {
+		logger = logger.With(zap.String("user", email))
+	}
+	ctx, err = service.AuthorizeTenant(service.WithSubject(ctx, email), claims)
+	if err != nil {
+		var tokenErr *service.TokenError
+		if errors.As(err, &tokenErr) {
+			logger.Error(tokenErr.Message, zap.Error(tokenErr.Err))
+			return nil, status.Error(codes.Internal, tokenErr.Message)
+		}
+		logger.Error("tenant rejected", zap.Error(err))
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if tenant := service.TenantFromContext(ctx); tenant != "" {
+		logger = logger.With(zap.String("tenant", tenant))
+	}
+	return context.WithValue(ctx, loggerKey{}, logger), nil
+}
+
+func grpcLogger(ctx context.Context) *zap.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return logger
+	}
+	return utils.Logger
+}
+
+func unaryAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx, err := authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := handler(ctx, req)
+	grpcLogger(ctx).Info("grpc call", zap.String("code", status.Code(err).String()), zap.Duration("latency", time.Since(start)))
+	return resp, err
+}
+
+// authenticatedStream replaces the context of a stream with the authenticated one.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func streamAuthInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, err := authenticate(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	err = handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+	grpcLogger(ctx).Info("grpc stream", zap.String("code", status.Code(err).String()), zap.Duration("latency", time.Since(start)))
+	return err
+}
+
+type pipelineServer struct {
+	pipelinepb.UnimplementedPipelineServer
+	stopping <-chan struct{}
+}
+
+func (s *pipelineServer) publish(ctx context.Context, req *pipelinepb.PublishRequest) (*pipelinepb.PublishResponse, error) {
+	if req.Speed < constants.MinSpeed || req.Speed > constants.MaxSpeed {
+		return nil, status.Errorf(codes.InvalidArgument, "speed should be range between %d and %d", constants.MinSpeed, constants.MaxSpeed)
+	}
+	speed := int(req.Speed)
+	reading := models.SpeedData{Speed: &speed, MessageID: req.MessageId}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(constants.DeviceID)) > 0 {
+		reading.DeviceID = md.Get(constants.DeviceID)[0]
+	}
+	messageID, queued, err := service.PublishReading(ctx, reading)
+	if err != nil {
+		grpcLogger(ctx).Error("unable to publish the speed data", zap.Error(err))
+		switch {
+		case errors.Is(err, service.ErrQuotaExceeded):
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		case errors.Is(err, service.ErrTenantRequired), errors.Is(err, service.ErrTenantNotFound):
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &pipelinepb.PublishResponse{MessageId: messageID, Queued: queued}, nil
+}
+
+func (s *pipelineServer) Publish(ctx context.Context, req *pipelinepb.PublishRequest) (*pipelinepb.PublishResponse, error) {
+	grpcLogger(ctx).Info("received request for publish the speed on mqtt", zap.Int32("speed", req.Speed))
+	return s.publish(ctx, req)
+}
+
+func (s *pipelineServer) PublishStream(stream pipelinepb.Pipeline_PublishStreamServer) error {
+	ctx := stream.Context()
+	summary := &pipelinepb.PublishStreamResponse{}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			grpcLogger(ctx).Info("publish stream closed", zap.Int64("published", summary.Published), zap.Int64("queued", summary.Queued), zap.Int64("rejected", summary.Rejected))
+			return stream.SendAndClose(summary)
+		}
+		if err != nil {
+			return err
+		}
+
+		resp, err := s.publish(ctx, req)
+		switch {
+		case err != nil:
+			summary.Rejected++
+			continue
+		case resp.Queued:
+			summary.Queued++
+		default:
+			summary.Published++
+		}
+		summary.MessageIds = append(summary.MessageIds, resp.MessageId)
+	}
+}
+
+func (s *pipelineServer) GetLatest(ctx context.Context, req *pipelinepb.GetLatestRequest) (*pipelinepb.GetLatestResponse, error) {
+	speed, err := service.GetLatestSpeed(ctx)
+	if err != nil {
+		grpcLogger(ctx).Error("unable to get the latest speed data", zap.Error(err))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Unable to fetch latest speed data from redis, err %v", err))
+	}
+	if speed == nil {
+		return &pipelinepb.GetLatestResponse{}, nil
+	}
+	return &pipelinepb.GetLatestResponse{Found: true, Speed: int32(*speed)}, nil
+}
+
+func (s *pipelineServer) QueryHistory(ctx context.Context, req *pipelinepb.QueryHistoryRequest) (*pipelinepb.QueryHistoryResponse, error) {
+	var from, to time.Time
+	if req.From != nil {
+		from = req.From.AsTime()
+	}
+	if req.To != nil {
+		to = req.To.AsTime()
+	}
+	entries, err := service.QueryHistory(ctx, from, to, req.Limit)
+	if err != nil {
+		grpcLogger(ctx).Error("unable to query the speed history", zap.Error(err))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Unable to query the speed history, err %v", err))
+	}
+
+	resp := &pipelinepb.QueryHistoryResponse{Readings: make([]*pipelinepb.Reading, 0, len(entries))}
+	for _, entry := range entries {
+		resp.Readings = append(resp.Readings, toReading(entry))
+	}
+	return resp, nil
+}
+
+func (s *pipelineServer) Subscribe(req *pipelinepb.SubscribeRequest, stream pipelinepb.Pipeline_SubscribeServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	readings, err := service.SubscribeReadings(ctx)
+	if err != nil {
+		grpcLogger(ctx).Error("unable to subscribe to live readings", zap.Error(err))
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	for {
+		select {
+		case <-s.stopping:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case entry, ok := <-readings:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return status.Error(codes.Unavailable, "live stream closed")
+			}
+			if err := stream.Send(toReading(entry)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func toReading(entry models.HistoryEntry) *pipelinepb.Reading {
+	return &pipelinepb.Reading{
+		Speed:     int32(entry.Speed),
+		MessageId: entry.MessageID,
+		Timestamp: timestamppb.New(entry.Timestamp),
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+	"github.com/mqtt-pipeline/internal/utils"
+	"github.com/mqtt-pipeline/pkg/pipelinepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gotest.tools/assert"
+)
+
+func TestGRPC(t *testing.T) {
+	// init logging client
+	utils.InitLogClient()
+
+	redisServer := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+	service.NewMQTTPipelineService(redisClient)
+
+	listener := bufconn.Listen(1 << 20)
+	srv := NewGRPC()
+	go func() { _ = srv.Serve(listener) }()
+	defer srv.Shutdown(context.Background())
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NilError(t, err)
+	defer conn.Close()
+	client := pipelinepb.NewPipelineClient(conn)
+
+	// Case 1 : calls without a token are rejected
+	_, err = client.GetLatest(context.Background(), &pipelinepb.GetLatestRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	token, err := service.MintToken("ankitchahal20@gmail.com", time.Minute)
+	assert.NilError(t, err)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", token)
+
+	// Case 2 : nothing stored yet
+	latest, err := client.GetLatest(ctx, &pipelinepb.GetLatestRequest{})
+	assert.NilError(t, err)
+	assert.Equal(t, false, latest.Found)
+
+	// Case 3 : latest speed
+	assert.NilError(t, redisClient.Set("latest_speed_data", `{"speed":42}`, 0).Err())
+	latest, err = client.GetLatest(ctx, &pipelinepb.GetLatestRequest{})
+	assert.NilError(t, err)
+	assert.Equal(t, true, latest.Found)
+	assert.Equal(t, int32(42), latest.Speed)
+
+	// Case 4 : history within a time range
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	for i := 0; i < 3; i++ {
+		at := start.Add(time.Duration(i) * 10 * time.Minute)
+		entry, _ := json.Marshal(models.HistoryEntry{Speed: 10 + i, Timestamp: at})
+		assert.NilError(t, redisClient.ZAdd("speed_history", &redis.Z{Score: float64(at.UnixMilli()), Member: entry}).Err())
+	}
+	history, err := client.QueryHistory(ctx, &pipelinepb.QueryHistoryRequest{From: timestamppb.New(start.Add(time.Minute))})
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(history.Readings))
+	assert.Equal(t, int32(11), history.Readings[0].Speed)
+
+	// Case 5 : out of range speeds are rejected before publishing
+	_, err = client.Publish(ctx, &pipelinepb.PublishRequest{Speed: 101})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Case 6 : subscribers receive stored readings
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.Subscribe(subCtx, &pipelinepb.SubscribeRequest{})
+	assert.NilError(t, err)
+	entry, _ := json.Marshal(models.HistoryEntry{Speed: 77, MessageID: "m1", Timestamp: time.Now()})
+	assert.NilError(t, waitForSubscriber(redisServer, "speed_live"))
+	assert.NilError(t, redisClient.Publish("speed_live", entry).Err())
+	reading, err := stream.Recv()
+	assert.NilError(t, err)
+	assert.Equal(t, int32(77), reading.Speed)
+	assert.Equal(t, "m1", reading.MessageId)
+}
+
+// waitForSubscriber waits until the stream has subscribed to the channel, since
+// readings published before that are not delivered.
+func waitForSubscriber(server *miniredis.Miniredis, channel string) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if server.PubSubNumSub(channel)[channel] > 0 {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return context.DeadlineExceeded
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+	"gotest.tools/assert"
+)
+
+func TestImport(t *testing.T) {
+	s := newTestServer(t, config.GlobalConfig{MQTTConfig: config.MQTT{Topic: "speed_topic"}, Import: config.Import{MaxSize: 1, Dir: t.TempDir()}})
+	request := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		return s.send(req)
+	}
+	// wait polls the job until it is no longer pending or running
+	wait := func(location string) models.ImportJob {
+		var job models.ImportJob
+		eventually(t, "import "+location+" did not finish", func() bool {
+			w := request(http.MethodGet, location, "", "")
+			assert.Equal(t, http.StatusOK, w.Code)
+			s.decode(w, &job)
+			return job.Status != service.ImportPending && job.Status != service.ImportRunning
+		})
+		return job
+	}
+
+	// Case 1 : csv, valid records are stored and the others reported with their line
+	file := strings.Join([]string{
+		"timestamp,speed,device_id,message_id",
+		"2026-01-01T00:00:00Z,42,truck-1,m1",
+		"2026-01-01T00:00:01Z,101,truck-1,m2",
+		"yesterday,40,truck-1,m3",
+		"2026-01-01T00:00:03Z,,truck-1,m4",
+		"2026-01-01T00:00:04.5Z,17,truck-2,m5",
+		"2099-01-01T00:00:00Z,10,truck-2,m6",
+	}, "\n")
+	w := request(http.MethodPost, "/v1/speed/import", "text/csv", file)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	job := wait(w.Header().Get("Location"))
+	assert.Equal(t, service.ImportCompleted, job.Status)
+	assert.Equal(t, int64(6), job.Records)
+	assert.Equal(t, int64(2), job.Imported)
+	assert.Equal(t, int64(4), job.Rejected)
+	assert.Equal(t, 1.0, job.Progress)
+
+	history, err := service.QueryHistory(context.Background(), time.Time{}, time.Time{}, 0)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []models.HistoryEntry{
+		{Speed: 42, DeviceID: "truck-1", MessageID: "m1", Timestamp: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Speed: 17, DeviceID: "truck-2", MessageID: "m5", Timestamp: time.Date(2026, 1, 1, 0, 0, 4, 5e8, time.UTC)},
+	}, history)
+
+	w = request(http.MethodGet, "/v1/speed/import/"+job.ID+"/rejections", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	report, err := csv.NewReader(w.Body).ReadAll()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, [][]string{
+		{"line", "reason", "record"},
+		{"3", "speed should be range between 0 and 100", "2026-01-01T00:00:01Z,101,truck-1,m2"},
+		{"4", `invalid timestamp "yesterday", expected RFC 3339`, "yesterday,40,truck-1,m3"},
+		{"5", "speed is missing", "2026-01-01T00:00:03Z,,truck-1,m4"},
+		{"7", "timestamp is in the future", "2099-01-01T00:00:00Z,10,truck-2,m6"},
+	}, report)
+
+	// Case 2 : ndjson, importing a reading again does not store it twice
+	file = `{"speed": 42, "device_id": "truck-1", "message_id": "m1", "timestamp": "2026-01-01T00:00:00Z"}
+
+{"speed": 42.5, "timestamp": "2026-01-01T00:00:02Z"}
+not json
+{"speed": 55, "timestamp": "2026-01-01T00:00:03Z"}`
+	w = request(http.MethodPost, "/v1/speed/import?format=ndjson", "", file)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	job = wait(w.Header().Get("Location"))
+	assert.Equal(t, service.ImportCompleted, job.Status)
+	assert.Equal(t, int64(2), job.Imported)
+	assert.Equal(t, int64(2), job.Rejected)
+	history, err = service.QueryHistory(context.Background(), time.Time{}, time.Time{}, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(history))
+
+	// Case 3 : a csv file without the required columns fails the job
+	w = request(http.MethodPost, "/v1/speed/import", "text/csv", "time,value\n2026-01-01T00:00:00Z,1\n")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	job = wait(w.Header().Get("Location"))
+	assert.Equal(t, service.ImportFailed, job.Status)
+	assert.Equal(t, "the header has no timestamp column", job.Error)
+
+	// Case 4 : unknown formats, empty and oversized files and unknown jobs
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/v1/speed/import", "application/json", "{}").Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/v1/speed/import", "text/csv", "").Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, request(http.MethodPost, "/v1/speed/import", "text/csv", strings.Repeat("x", 1<<20+1)).Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/v1/speed/import/unknown", "", "").Code)
+}
+
+func TestImportAdmission(t *testing.T) {
+	s := newTestServer(t, config.GlobalConfig{
+		MQTTConfig: config.MQTT{Topic: "speed_topic"},
+		Import:     config.Import{MaxSize: 1, Dir: t.TempDir()},
+		Devices:    config.Devices{Registry: service.RegistryReject},
+		Tenancy:    config.Tenancy{Enabled: true},
+	})
+	ctx := service.WithTenant(context.Background(), "acme")
+	_, _, err := service.RegisterTenant(context.Background(), models.TenantRequest{ID: "acme", Quota: &models.TenantQuota{ReadingsPerDay: 3}})
+	assert.NilError(t, err)
+	disabled := false
+	for _, req := range []models.DeviceRequest{{ID: "truck-1"}, {ID: "truck-2", Enabled: &disabled}} {
+		_, err := service.RegisterDevice(ctx, req)
+		assert.NilError(t, err)
+	}
+	// the minute rollups of the tenant's history reach up to 00:01
+	assert.NilError(t, s.redis.HSet("retention:watermarks", "tenant:{acme}:speed_history:1m", time.Date(2026, 1, 1, 0, 1, 0, 0, time.UTC).UnixMilli()).Err())
+	s.token, err = service.MintTenantToken("ankitchahal20@gmail.com", "acme", time.Minute)
+	assert.NilError(t, err)
+
+	// Case 1 : records are checked against the registry and the daily quota, also those
+	// before the rollups
+	file := strings.Join([]string{
+		"timestamp,speed,device_id,message_id",
+		"2026-01-01T00:00:59Z,40,truck-1,m1",
+		"2026-01-01T00:01:00Z,41,truck-1,m2",
+		"2026-01-01T00:01:01Z,42,truck-2,m3",
+		"2026-01-01T00:01:02Z,43,truck-3,m4",
+		"2026-01-01T00:01:03Z,44,truck-1,m5",
+		"2026-01-01T00:01:04Z,45,truck-1,m6",
+		"2026-01-01T00:01:05Z,46,truck-1,m7",
+	}, "\n")
+	req, _ := http.NewRequest(http.MethodPost, "/v1/speed/import", strings.NewReader(file))
+	req.Header.Set("Content-Type", "text/csv")
+	w := s.send(req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	location := w.Header().Get("Location")
+	var job models.ImportJob
+	eventually(t, "import did not finish", func() bool {
+		w := s.request(http.MethodGet, location, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		s.decode(w, &job)
+		return job.Status == service.ImportCompleted
+	})
+	assert.Equal(t, int64(3), job.Imported)
+	assert.Equal(t, int64(4), job.Rejected)
+
+	history, err := service.QueryHistory(ctx, time.Time{}, time.Time{}, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(history))
+	assert.Equal(t, "m1", history[0].MessageID)
+
+	w = s.request(http.MethodGet, "/v1/speed/import/"+job.ID+"/rejections", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	report, err := csv.NewReader(w.Body).ReadAll()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, [][]string{
+		{"line", "reason", "record"},
+		{"4", "device is disabled", "2026-01-01T00:01:01Z,42,truck-2,m3"},
+		{"5", "device is not registered", "2026-01-01T00:01:02Z,43,truck-3,m4"},
+		{"7", "tenant quota exceeded, 3 readings per day", "2026-01-01T00:01:04Z,45,truck-1,m6"},
+		{"8", "tenant quota exceeded, 3 readings per day", "2026-01-01T00:01:05Z,46,truck-1,m7"},
+	}, report)
+
+	// Case 2 : the readings imported today count towards the daily quota
+	tenant, err := service.LookupTenant(context.Background(), "acme")
+	assert.NilError(t, err)
+	assert.Equal(t, int64(5), tenant.Usage.ReadingsToday)
+
+	// Case 3 : the reading before the watermark is merged into the minute rollups
+	rollups, err := service.QueryRollups(ctx, "speed", service.ResolutionMinute, time.Time{}, time.Time{}, 0)
+	assert.NilError(t, err)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.DeepEqual(t, []models.Rollup{{Start: start, Count: 1, Min: 40, Max: 40, Sum: 40, Avg: 40}}, rollups)
+}
+
+func TestImportRollups(t *testing.T) {
+	s := newTestServer(t, config.GlobalConfig{
+		MQTTConfig: config.MQTT{Topic: "speed_topic"},
+		Import:     config.Import{MaxSize: 1, Dir: t.TempDir()},
+		Retention:  config.Retention{Enabled: true},
+	})
+	ctx := context.Background()
+	importFile := func(lines ...string) models.ImportJob {
+		req, _ := http.NewRequest(http.MethodPost, "/v1/speed/import", strings.NewReader(strings.Join(append([]string{"timestamp,speed,message_id"}, lines...), "\n")))
+		req.Header.Set("Content-Type", "text/csv")
+		w := s.send(req)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		var job models.ImportJob
+		eventually(t, "import did not finish", func() bool {
+			s.decode(s.request(http.MethodGet, w.Header().Get("Location"), ""), &job)
+			return job.Status == service.ImportCompleted || job.Status == service.ImportFailed
+		})
+		assert.Equal(t, service.ImportCompleted, job.Status)
+		return job
+	}
+	rollups := func(resolution string) []models.Rollup {
+		rollups, err := service.QueryRollups(ctx, "speed", resolution, time.Time{}, time.Time{}, 0)
+		assert.NilError(t, err)
+		return rollups
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Case 1 : imported history is rolled up by compaction
+	importFile("2026-01-01T00:00:10Z,10,m1", "2026-01-01T00:00:20Z,20,m2", "2026-01-01T01:30:00Z,30,m3")
+	assert.NilError(t, service.Compact(ctx))
+	assert.DeepEqual(t, []models.Rollup{
+		{Start: start, Count: 2, Min: 10, Max: 20, Sum: 30, Avg: 15},
+		{Start: start.Add(90 * time.Minute), Count: 1, Min: 30, Max: 30, Sum: 30, Avg: 30},
+	}, rollups(service.ResolutionMinute))
+
+	// Case 2 : readings imported after their minute and hour were rolled up are merged
+	// into those rollups, once, and compaction does not count them again
+	job := importFile("2026-01-01T00:00:30Z,60,m4", "2026-01-01T00:00:10Z,10,m1", "2026-01-01T01:30:30Z,0,m5", "2026-01-01T02:00:00Z,5,m6")
+	assert.Equal(t, int64(4), job.Imported)
+	assert.NilError(t, service.Compact(ctx))
+	assert.DeepEqual(t, []models.Rollup{
+		{Start: start, Count: 3, Min: 10, Max: 60, Sum: 90, Avg: 30},
+		{Start: start.Add(90 * time.Minute), Count: 2, Min: 0, Max: 30, Sum: 30, Avg: 15},
+		{Start: start.Add(2 * time.Hour), Count: 1, Min: 5, Max: 5, Sum: 5, Avg: 5},
+	}, rollups(service.ResolutionMinute))
+	assert.DeepEqual(t, []models.Rollup{
+		{Start: start, Count: 3, Min: 10, Max: 60, Sum: 90, Avg: 30},
+		{Start: start.Add(time.Hour), Count: 2, Min: 0, Max: 30, Sum: 30, Avg: 15},
+		{Start: start.Add(2 * time.Hour), Count: 1, Min: 5, Max: 5, Sum: 5, Avg: 5},
+	}, rollups(service.ResolutionHour))
+}
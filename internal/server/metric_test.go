@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"gotest.tools/assert"
+)
+
+func TestMetricDevices(t *testing.T) {
+	server := newTestServer(t, config.GlobalConfig{})
+	assert.NilError(t, server.redis.HSet("metric:rpm:devices",
+		"truck-2", `{"metric":"rpm","value":1800,"device_id":"truck-2","timestamp":"2026-01-01T00:00:01Z"}`,
+		"truck-1", `{"metric":"rpm","value":900,"device_id":"truck-1","timestamp":"2026-01-01T00:00:02Z"}`).Err())
+	assert.NilError(t, server.redis.HSet("device_readings",
+		"truck-1", `{"speed":42,"message_id":"m1","device_id":"truck-1","timestamp":"2026-01-01T00:00:03Z"}`).Err())
+
+	type response struct {
+		Metric  string
+		Devices []models.MetricEntry
+	}
+
+	// Case 1 : the latest reading of a metric of every device, ordered by device
+	w := server.request(http.MethodGet, "/v1/metrics/rpm/devices", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var rpm response
+	server.decode(w, &rpm)
+	assert.Equal(t, "rpm", rpm.Metric)
+	assert.Equal(t, 2, len(rpm.Devices))
+	assert.Equal(t, "truck-1", rpm.Devices[0].DeviceID)
+	assert.Equal(t, float64(900), rpm.Devices[0].Value)
+	assert.Equal(t, "truck-2", rpm.Devices[1].DeviceID)
+
+	// Case 2 : speed reads the latest speed readings
+	w = server.request(http.MethodGet, "/v1/metrics/speed/devices", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var speed response
+	server.decode(w, &speed)
+	assert.Equal(t, 1, len(speed.Devices))
+	assert.Equal(t, models.MetricEntry{Metric: "speed", Value: 42, MessageID: "m1", DeviceID: "truck-1", Timestamp: speed.Devices[0].Timestamp}, speed.Devices[0])
+
+	// Case 3 : metrics without devices return none
+	w = server.request(http.MethodGet, "/v1/metrics/unknown/devices", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"devices":[],"metric":"unknown"}`, w.Body.String())
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+	"github.com/mqtt-pipeline/internal/utils"
+	"gotest.tools/assert"
+)
+
+func TestPresence(t *testing.T) {
+	webhookEvents := make(chan models.PresenceEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event models.PresenceEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err == nil {
+			webhookEvents <- event
+		}
+	}))
+	defer webhook.Close()
+
+	cfg := config.GlobalConfig{
+		MQTTConfig:    config.MQTT{Topic: "speed_topic"},
+		MessageStatus: config.MessageStatus{Enabled: true},
+		Devices:       config.Devices{OfflineAfter: 1, Presence: true, StatusTopic: "devices/+/status", Webhooks: []string{webhook.URL}},
+	}
+	s := newIngestionTestServer(t, cfg)
+	request := s.request
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := service.SubscribePresence(ctx)
+	assert.NilError(t, err)
+	service.StartPresence(ctx)
+
+	presence := func(deviceID string) models.DevicePresence {
+		w := request(http.MethodGet, "/v1/devices/"+deviceID+"/status", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var presence models.DevicePresence
+		s.decode(w, &presence)
+		return presence
+	}
+	// next returns the next presence change from the live stream and the webhook
+	next := func(timeout time.Duration) models.PresenceEvent {
+		var event models.PresenceEvent
+		select {
+		case event = <-events:
+		case <-time.After(timeout):
+			t.Fatal("no presence change")
+		}
+		select {
+		case delivered := <-webhookEvents:
+			assert.DeepEqual(t, event, delivered)
+		case <-time.After(time.Second):
+			t.Fatal("presence change was not posted to the webhook")
+		}
+		return event
+	}
+
+	// announce queues a status the device published for the ingest worker
+	announce := func(deviceID, status string) {
+		utils.SpeedChannel <- models.Reading{Kind: models.ReadingDeviceStatus, Status: status, DeviceID: deviceID, ReceivedAt: time.Now(), Topic: "devices/" + deviceID + "/status"}
+	}
+
+	// Case 1 : a device announcing itself goes online once
+	announce("truck-1", service.DeviceOnline)
+	announce("truck-1", service.DeviceOnline)
+	event := next(time.Second)
+	assert.Equal(t, "truck-1", event.DeviceID)
+	assert.Equal(t, service.DeviceOnline, event.Status)
+	assert.Equal(t, service.PresenceReasonStatus, event.Reason)
+	status := presence("truck-1")
+	assert.Equal(t, service.DeviceOnline, status.Status)
+	assert.Equal(t, service.PresenceReasonStatus, status.Reason)
+	assert.Assert(t, status.Since != nil && status.LastSeen != nil)
+
+	// Case 2 : without heartbeats it goes offline after offline_after
+	event = next(3 * time.Second)
+	assert.Equal(t, service.DeviceOffline, event.Status)
+	assert.Equal(t, service.PresenceReasonTimeout, event.Reason)
+	assert.Equal(t, service.DeviceOffline, presence("truck-1").Status)
+
+	// Case 3 : readings are heartbeats, and the last will takes the device offline
+	utils.SpeedChannel <- models.Reading{Metric: "speed", Storage: "speed", Value: 42, Speed: 42, MessageID: "p1", DeviceID: "truck-1", ReceivedAt: time.Now(), Topic: "speed_topic"}
+	event = next(time.Second)
+	assert.Equal(t, service.DeviceOnline, event.Status)
+	assert.Equal(t, service.PresenceReasonReading, event.Reason)
+	announce("truck-1", service.DeviceOffline)
+	event = next(time.Second)
+	assert.Equal(t, service.DeviceOffline, event.Status)
+	assert.Equal(t, service.PresenceReasonStatus, event.Reason)
+
+	// Case 4 : registered devices have the status of their presence
+	announce("truck-1", service.DeviceOnline)
+	next(time.Second)
+	_, err = service.RegisterDevice(context.Background(), models.DeviceRequest{ID: "truck-1"})
+	assert.NilError(t, err)
+	w := request(http.MethodGet, "/v1/devices/truck-1", "")
+	var device models.Device
+	s.decode(w, &device)
+	assert.Equal(t, service.DeviceOnline, device.Status)
+
+	// Case 5 : with the registry rejecting them, unregistered devices are not tracked
+	cfg.Devices.Registry = service.RegistryReject
+	config.SetConfig(cfg)
+	announce("ghost", service.DeviceOnline)
+	// statuses are applied in order, once truck-1 went offline the ghost was ignored
+	announce("truck-1", service.DeviceOffline)
+	assert.Equal(t, service.DeviceOffline, next(time.Second).Status)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/v1/devices/ghost/status", "").Code)
+
+	// Case 6 : without presence the status comes from the last stored reading
+	cfg.Devices.Presence = false
+	config.SetConfig(cfg)
+	status = presence("truck-1")
+	assert.Equal(t, service.DeviceOnline, status.Status)
+	assert.Equal(t, "", status.Reason)
+	assert.Assert(t, status.Since == nil)
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+	"gotest.tools/assert"
+)
+
+func TestReplay(t *testing.T) {
+	s := newTestServer(t, config.GlobalConfig{
+		MQTTConfig: config.MQTT{Topic: "speed_topic"},
+		Devices:    config.Devices{StatusTopic: "devices/+/status"},
+		Commands:   config.Commands{Topic: "devices/+/commands", ResponseTopic: "devices/+/responses"},
+	})
+	broker := s.useBroker()
+	request := s.request
+	job := func(w *httptest.ResponseRecorder) models.ReplayJob {
+		var job models.ReplayJob
+		s.decode(w, &job)
+		return job
+	}
+	// wait polls the job until it has status
+	wait := func(id, status string) models.ReplayJob {
+		var replay models.ReplayJob
+		eventually(t, "replay "+id+" is not "+status, func() bool {
+			replay = job(request(http.MethodGet, "/v1/replay/"+id, ""))
+			return replay.Status == status
+		})
+		return replay
+	}
+
+	// five readings 100ms apart
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		at := start.Add(time.Duration(i) * 100 * time.Millisecond)
+		entry, _ := json.Marshal(models.HistoryEntry{Speed: 10 + i, DeviceID: "truck-1", Timestamp: at})
+		assert.NilError(t, s.redis.ZAdd("speed_history", &redis.Z{Score: float64(at.UnixMilli()), Member: entry}).Err())
+	}
+
+	// Case 1 : invalid requests, topics the service ingests and status and command topics
+	// of devices are rejected
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/v1/replay", `{"topic": "replay"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/v1/replay", `{"from": "2026-01-02T00:00:00Z", "to": "2026-01-01T00:00:00Z", "topic": "replay"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/v1/replay", `{"from": "2026-01-01T00:00:00Z", "to": "2026-01-02T00:00:00Z", "topic": "replay/#"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/v1/replay", `{"from": "2026-01-01T00:00:00Z", "to": "2026-01-02T00:00:00Z", "topic": "speed_topic", "speed_factor": 0}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/v1/replay", `{"from": "2026-01-01T00:00:00Z", "to": "2026-01-02T00:00:00Z", "topic": "replay", "speed_factor": -1}`).Code)
+	for _, topic := range []string{"devices/truck-1/status", "devices/truck-1/commands", "devices/truck-1/responses"} {
+		assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/v1/replay", `{"from": "2026-01-01T00:00:00Z", "to": "2026-01-02T00:00:00Z", "topic": "`+topic+`"}`).Code, topic)
+	}
+
+	// Case 2 : as fast as possible, every reading of the range is published in order
+	w := request(http.MethodPost, "/v1/replay", `{"from": "2026-01-01T00:00:00.1Z", "to": "2026-01-02T00:00:00Z", "topic": "replay/speed", "speed_factor": 0}`)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	replay := wait(job(w).ID, service.ReplayCompleted)
+	assert.Equal(t, int64(4), replay.Total)
+	assert.Equal(t, int64(4), replay.Published)
+	assert.Equal(t, 1.0, replay.Progress)
+	assert.Equal(t, start.Add(400*time.Millisecond), *replay.Position)
+	messages := broker.messages()
+	assert.Equal(t, 4, len(messages))
+	for i, message := range messages {
+		var data models.SpeedData
+		assert.NilError(t, json.Unmarshal(message.payload, &data))
+		assert.Equal(t, "replay/speed", message.topic)
+		assert.Equal(t, 11+i, *data.Speed)
+		assert.Equal(t, "truck-1", data.DeviceID)
+		assert.Assert(t, data.MessageID != "")
+		// replayed readings have no message status
+		assert.Equal(t, int64(0), s.redis.Exists("message:"+data.MessageID).Val())
+	}
+	// finished jobs cannot be paused
+	assert.Equal(t, http.StatusConflict, request(http.MethodPost, "/v1/replay/"+replay.ID+"/pause", "").Code)
+
+	// Case 3 : twice as fast as the original timing
+	w = request(http.MethodPost, "/v1/replay", `{"from": "2026-01-01T00:00:00Z", "to": "2026-01-02T00:00:00Z", "topic": "replay/speed", "speed_factor": 2}`)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	wait(job(w).ID, service.ReplayCompleted)
+	messages = broker.messages()[4:]
+	assert.Equal(t, 5, len(messages))
+	elapsed := messages[4].at.Sub(messages[0].at)
+	assert.Assert(t, elapsed >= 200*time.Millisecond && elapsed < time.Second, "replayed in %v", elapsed)
+
+	// Case 4 : a paused replay publishes nothing until it is resumed, and can be cancelled
+	w = request(http.MethodPost, "/v1/replay", `{"from": "2026-01-01T00:00:00Z", "to": "2026-01-02T00:00:00Z", "topic": "replay/speed", "speed_factor": 0.2}`)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	id := job(w).ID
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/v1/replay/"+id+"/pause", "").Code)
+	time.Sleep(300 * time.Millisecond)
+	paused := len(broker.messages())
+	time.Sleep(600 * time.Millisecond)
+	assert.Equal(t, paused, len(broker.messages()))
+	assert.Equal(t, service.ReplayRunning, job(request(http.MethodPost, "/v1/replay/"+id+"/resume", "")).Status)
+	assert.Equal(t, service.ReplayCancelled, job(request(http.MethodPost, "/v1/replay/"+id+"/cancel", "")).Status)
+	replay = wait(id, service.ReplayCancelled)
+	assert.Assert(t, replay.Published < 5)
+	assert.Assert(t, replay.FinishedAt != nil)
+
+	// Case 5 : a replay waits while the broker is disconnected and continues once it
+	// is back
+	broker.disconnected.Store(true)
+	before := len(broker.messages())
+	w = request(http.MethodPost, "/v1/replay", `{"from": "2026-01-01T00:00:00Z", "to": "2026-01-02T00:00:00Z", "topic": "replay/speed", "speed_factor": 0}`)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	id = job(w).ID
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, before, len(broker.messages()))
+	assert.Equal(t, service.ReplayRunning, job(request(http.MethodGet, "/v1/replay/"+id, "")).Status)
+	broker.disconnected.Store(false)
+	replay = wait(id, service.ReplayCompleted)
+	assert.Equal(t, int64(5), replay.Published)
+	assert.Equal(t, before+5, len(broker.messages()))
+
+	// Case 6 : an instance runs a bounded number of replays at a time
+	var running []string
+	for {
+		w = request(http.MethodPost, "/v1/replay", `{"from": "2026-01-01T00:00:00Z", "to": "2026-01-02T00:00:00Z", "topic": "replay/speed", "speed_factor": 0.1}`)
+		if w.Code != http.StatusAccepted {
+			break
+		}
+		running = append(running, job(w).ID)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Assert(t, len(running) > 0)
+	for _, id := range running {
+		assert.Equal(t, http.StatusOK, request(http.MethodPost, "/v1/replay/"+id+"/cancel", "").Code)
+		wait(id, service.ReplayCancelled)
+	}
+	eventually(t, "a replay slot is not released", func() bool {
+		w = request(http.MethodPost, "/v1/replay", `{"from": "2026-01-01T00:00:00Z", "to": "2026-01-02T00:00:00Z", "topic": "replay/speed", "speed_factor": 0}`)
+		return w.Code == http.StatusAccepted
+	})
+	wait(job(w).ID, service.ReplayCompleted)
+
+	// Case 7 : unknown jobs
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/v1/replay/unknown", "").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodPost, "/v1/replay/unknown/cancel", "").Code)
+}
@@ -1,98 +1,147 @@
 package server
 
 import (
-	"context"
-	"log"
+	_ "embed"
 	"net/http"
-	"os"
-	"os/signal"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mqtt-pipeline/internal/config"
 	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/gql"
 	"github.com/mqtt-pipeline/internal/middleware"
 	"github.com/mqtt-pipeline/internal/service"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
 )
 
 func registerGetTokenEndPoints(handler gin.IRoutes) {
-	handler.POST(constants.ForwardSlash+strings.Join([]string{}, constants.ForwardSlash), middleware.ValidateGetTokenEndointRequest(), service.GenerateToken())
+	handler.POST(constants.ForwardSlash+strings.Join([]string{}, constants.ForwardSlash), middleware.RateLimit(constants.TokenRoute), middleware.ValidateGetTokenEndointRequest(), service.GenerateToken())
 }
 
 func registerPublishEndpointPoints(handler gin.IRoutes) {
-	handler.POST(constants.ForwardSlash+strings.Join([]string{constants.Publish}, constants.ForwardSlash), middleware.Authorization(), middleware.ValidatePublishEndpointRequest(), service.Publish())
+	handler.POST(constants.ForwardSlash+strings.Join([]string{constants.Publish}, constants.ForwardSlash), middleware.Authorization(), middleware.RateLimit(constants.PublishRoute), middleware.ValidatePublishEndpointRequest(), middleware.Idempotency(), service.Publish())
 }
 
 func registerSpeedDataEndPoints(handler gin.IRoutes) {
-	handler.GET(constants.ForwardSlash, middleware.Authorization(), service.GetSpeedData())
+	handler.GET(constants.ForwardSlash, middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), service.GetSpeedData())
+	handler.GET(constants.ForwardSlash+strings.Join([]string{constants.Speed, constants.Export}, constants.ForwardSlash), middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), service.ExportSpeedData())
 }
 
-func Start() {
-	plainHandler := gin.New()
-
-	mqttPipelineHandler := plainHandler.Group(constants.ForwardSlash + constants.Version).Use(gin.Recovery()).
-		Use(middleware.SetTransactionId())
-	registerGetTokenEndPoints(mqttPipelineHandler)
-	registerPublishEndpointPoints(mqttPipelineHandler)
-	registerSpeedDataEndPoints(mqttPipelineHandler)
-
-	srv := &http.Server{
-		Handler:      plainHandler,
-		Addr:         ":4000",
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-	}
-
-	// Start Server
-	go func() {
-		log.Println("Starting Server")
-		if err := srv.ListenAndServe(); err != nil {
-			log.Fatal(err)
-		}
-	}()
+func registerImportEndPoints(handler gin.IRoutes) {
+	imports := constants.ForwardSlash + strings.Join([]string{constants.Speed, constants.Import}, constants.ForwardSlash)
+	job := imports + constants.ForwardSlash + ":" + constants.ImportIDParam
+	handler.POST(imports, middleware.Authorization(), middleware.RateLimit(constants.PublishRoute), service.ImportSpeedData())
+	handler.GET(job, middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), service.GetImportJob())
+	handler.GET(job+constants.ForwardSlash+constants.Rejections, middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), service.GetImportRejections())
+}
 
-	waitForShutdown(srv)
+func registerReplayEndPoints(handler gin.IRoutes) {
+	replays := constants.ForwardSlash + constants.Replay
+	replay := replays + constants.ForwardSlash + ":" + constants.ReplayIDParam
+	handler.POST(replays, middleware.Authorization(), middleware.RateLimit(constants.PublishRoute), service.StartReplay())
+	handler.GET(replay, middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), service.GetReplay())
+	handler.POST(replay+constants.ForwardSlash+constants.Pause, middleware.Authorization(), middleware.RateLimit(constants.PublishRoute), service.UpdateReplay(service.ReplayPause))
+	handler.POST(replay+constants.ForwardSlash+constants.Resume, middleware.Authorization(), middleware.RateLimit(constants.PublishRoute), service.UpdateReplay(service.ReplayResume))
+	handler.POST(replay+constants.ForwardSlash+constants.Cancel, middleware.Authorization(), middleware.RateLimit(constants.PublishRoute), service.UpdateReplay(service.ReplayCancel))
 }
 
-func waitForShutdown(srv *http.Server) {
+func registerDeviceEndPoints(handler gin.IRoutes) {
+	devices := constants.ForwardSlash + constants.Devices
+	device := devices + constants.ForwardSlash + ":" + constants.DeviceIDParam
+	handler.POST(devices, middleware.Authorization(), middleware.RequireAdmin(), middleware.RateLimit(constants.PublishRoute), service.CreateDevice())
+	handler.GET(devices, middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), service.ListDevices())
+	handler.GET(device, middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), service.GetDevice())
+	handler.PATCH(device, middleware.Authorization(), middleware.RequireAdmin(), middleware.RateLimit(constants.PublishRoute), service.PatchDevice())
+	handler.DELETE(device, middleware.Authorization(), middleware.RequireAdmin(), middleware.RateLimit(constants.PublishRoute), service.DeleteDevice())
+	handler.GET(device+constants.ForwardSlash+constants.Status, middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), service.GetDevicePresence())
+	commands := device + constants.ForwardSlash + constants.Commands
+	handler.POST(commands, middleware.Authorization(), middleware.RequireAdmin(), middleware.RateLimit(constants.PublishRoute), service.PostCommand())
+	handler.GET(commands, middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), service.ListCommands())
+	handler.GET(commands+constants.ForwardSlash+":"+constants.CommandIDParam, middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), service.GetCommand())
+}
 
-	/*
-		if somewhere you are listening for output from a channel but in the meanwhile that channel not being given any input,
-		the listening place will be blocked until it receives the output.
-	*/
+func registerMessageStatusEndPoints(handler gin.IRoutes) {
+	handler.GET(constants.ForwardSlash+strings.Join([]string{constants.Messages, ":" + constants.MessageIDParam}, constants.ForwardSlash), middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), service.GetMessageStatus())
+}
 
-	interruptChan := make(chan os.Signal, 1)
+func registerMetricEndPoints(handler gin.IRoutes) {
+	metric := constants.ForwardSlash + strings.Join([]string{constants.Metrics, ":" + constants.MetricParam}, constants.ForwardSlash)
+	handler.GET(metric, middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), service.GetMetricReadings())
+	handler.GET(metric+constants.ForwardSlash+constants.Rollups, middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), service.GetMetricRollups())
+	handler.GET(metric+constants.ForwardSlash+constants.Devices, middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), service.GetMetricDevices())
+}
 
-	/*
-		SIGINT means is Signal Interrupted, send when the user types the INTR character (e.g. Ctrl-C).
-		SIGTERM signal is a generic signal used to cause program termination.
-		The below statement is to send the interruot signal to the channel "interruptChan".
-	*/
+func registerGraphQLEndPoints(handler gin.IRoutes) {
+	handler.POST(constants.ForwardSlash+constants.GraphQL, middleware.Authorization(), middleware.RateLimit(constants.SpeedRoute), gql.Handler())
+	// websocket clients authenticate in the connection_init message instead
+	handler.GET(constants.ForwardSlash+constants.GraphQL, gql.WebSocketHandler())
+}
 
-	signal.Notify(interruptChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+func registerTenantEndPoints(handler gin.IRoutes) {
+	tenants := constants.ForwardSlash + strings.Join([]string{constants.Admin, constants.Tenants}, constants.ForwardSlash)
+	tenant := tenants + constants.ForwardSlash + ":" + constants.TenantIDParam
+	handler.POST(tenants, middleware.Authorization(), middleware.RequireGlobalAdmin(), service.CreateTenant())
+	handler.GET(tenants, middleware.Authorization(), middleware.RequireGlobalAdmin(), service.ListTenants())
+	handler.GET(tenant, middleware.Authorization(), middleware.RequireGlobalAdmin(), service.GetTenant())
+	handler.POST(tenant+constants.ForwardSlash+constants.Suspend, middleware.Authorization(), middleware.RequireGlobalAdmin(), service.UpdateTenantStatus(service.TenantSuspended))
+	handler.POST(tenant+constants.ForwardSlash+constants.Activate, middleware.Authorization(), middleware.RequireGlobalAdmin(), service.UpdateTenantStatus(service.TenantActive))
+}
 
-	// Block until we receive our signal.
-	<-interruptChan
+func registerStorageEndPoints(handler gin.IRoutes) {
+	storage := constants.ForwardSlash + strings.Join([]string{constants.Admin, constants.Storage}, constants.ForwardSlash)
+	handler.GET(storage, middleware.Authorization(), middleware.RequireGlobalAdmin(), service.GetStorageUsage())
+}
 
-	// Create a deadline to wait for.
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+//go:embed openapi.json
+var openAPISpec []byte
 
-	/*
-		some zombie connections may still be there and use your memory,
-		in order to solve this, the safest way is to setup a timeout threshold using the Context.
-	*/
+func registerOpenAPIEndPoints(handler gin.IRoutes) {
+	handler.GET(constants.ForwardSlash+constants.OpenAPI, func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, constants.ContentType, openAPISpec)
+	})
+}
 
-	defer cancel()
+func registerHealthEndPoints(handler gin.IRoutes) {
+	handler.GET(constants.ForwardSlash+constants.Healthz, service.Liveness())
+	handler.GET(constants.ForwardSlash+constants.Readyz, service.Readiness())
+}
 
-	/*
-		The timer context and the cancel function (the cancel function releases its resources) will be returned,
-		 and you can use that context to perform Shutdown(ctx) ,
-		inside the Shutdown it check if the timer context Done channel is closed and will not run indefinitely.
-	*/
+// New builds the HTTP server with every route registered. The caller owns its lifecycle.
+func New() *http.Server {
+	cfg := config.GetConfig()
+	return &http.Server{
+		Handler:      newRouter(),
+		Addr:         cfg.Server.Address,
+		ReadTimeout:  time.Duration(cfg.Server.ReadTimeOut) * time.Second,
+		WriteTimeout: time.Duration(cfg.Server.WriteTimeOut) * time.Second,
+	}
+}
 
-	srv.Shutdown(ctx)
+func newRouter() *gin.Engine {
+	plainHandler := gin.New()
+	// the client IP only comes from X-Forwarded-For when the peer is a trusted proxy,
+	// otherwise anyone could pick the IP the rate limits apply to
+	if err := plainHandler.SetTrustedProxies(config.GetConfig().Server.TrustedProxies); err != nil {
+		utils.Logger.Error("invalid trusted proxies, trusting none", zap.Error(err))
+		_ = plainHandler.SetTrustedProxies(nil)
+	}
+	registerHealthEndPoints(plainHandler.Group(constants.ForwardSlash).Use(gin.Recovery()))
 
-	log.Println("Shutting down")
-	os.Exit(0)
+	mqttPipelineHandler := plainHandler.Group(constants.ForwardSlash + constants.Version).Use(gin.Recovery()).
+		Use(middleware.SetTransactionId()).Use(middleware.RequestLogger()).Use(middleware.AccessLog())
+	registerGetTokenEndPoints(mqttPipelineHandler)
+	registerPublishEndpointPoints(mqttPipelineHandler)
+	registerSpeedDataEndPoints(mqttPipelineHandler)
+	registerImportEndPoints(mqttPipelineHandler)
+	registerReplayEndPoints(mqttPipelineHandler)
+	registerDeviceEndPoints(mqttPipelineHandler)
+	registerMessageStatusEndPoints(mqttPipelineHandler)
+	registerMetricEndPoints(mqttPipelineHandler)
+	registerGraphQLEndPoints(mqttPipelineHandler)
+	registerTenantEndPoints(mqttPipelineHandler)
+	registerStorageEndPoints(mqttPipelineHandler)
+	registerOpenAPIEndPoints(mqttPipelineHandler)
+	return plainHandler
 }
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/middleware"
+	"github.com/mqtt-pipeline/internal/utils"
+	"gotest.tools/assert"
+)
+
+func TestOpenAPISpec(t *testing.T) {
+	// init logging client
+	utils.InitLogClient()
+
+	router := newRouter()
+
+	// Case 1 : the spec is served as JSON
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/v1/openapi.json", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var spec struct {
+		OpenAPI string                            `json:"openapi"`
+		Paths   map[string]map[string]interface{} `json:"paths"`
+	}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &spec))
+	assert.Equal(t, "3.0.3", spec.OpenAPI)
+
+	// Case 2 : the documented operations are exactly the registered routes
+	pathParam := regexp.MustCompile(`\{(\w+)\}`)
+	var documented []string
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			documented = append(documented, strings.ToUpper(method)+" "+pathParam.ReplaceAllString(path, ":$1"))
+		}
+	}
+	var registered []string
+	for _, route := range router.Routes() {
+		registered = append(registered, route.Method+" "+route.Path)
+	}
+	sort.Strings(documented)
+	sort.Strings(registered)
+	assert.DeepEqual(t, registered, documented)
+}
+
+func TestTrustedProxies(t *testing.T) {
+	cfg := config.GlobalConfig{RateLimit: config.RateLimit{
+		Enabled: true,
+		Routes:  []config.RateLimitRule{{Route: constants.TokenRoute, Key: middleware.RateLimitByIP, Algorithm: middleware.SlidingWindow, Limit: 2, Window: 60}},
+	}}
+	s := newTestServer(t, cfg)
+	middleware.NewRateLimiter(s.redis)
+	// token requests from a peer, each claiming another client IP
+	request := func(router http.Handler, forwardedFor string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/v1/", strings.NewReader(`{"email": "a@example.com"}`))
+		req.RemoteAddr = "10.1.2.3:40000"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Case 1 : by default X-Forwarded-For is ignored and the peer is rate limited
+	for i := 0; i < 2; i++ {
+		assert.Assert(t, request(s.router, "192.0.2."+strconv.Itoa(i)) != http.StatusTooManyRequests)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, request(s.router, "192.0.2.9"))
+
+	// Case 2 : behind a trusted proxy every client has its own limit
+	cfg.Server.TrustedProxies = []string{"10.0.0.0/8"}
+	config.SetConfig(cfg)
+	router := newRouter()
+	for i := 10; i < 15; i++ {
+		assert.Assert(t, request(router, "192.0.2."+strconv.Itoa(i)) != http.StatusTooManyRequests)
+	}
+}
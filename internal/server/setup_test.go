@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+	"github.com/mqtt-pipeline/internal/utils"
+	"gotest.tools/assert"
+)
+
+// testServer is the router of the service on its own redis, with a token to call it.
+type testServer struct {
+	t      *testing.T
+	redis  *redis.Client
+	router *gin.Engine
+	token  string
+}
+
+// newTestServer starts the service on a new miniredis with cfg, which is reset when the
+// test ends.
+func newTestServer(t *testing.T, cfg config.GlobalConfig) *testServer {
+	// init logging client
+	utils.InitLogClient()
+
+	redisServer := miniredis.RunT(t)
+	return startTestServer(t, redis.NewClient(&redis.Options{Addr: redisServer.Addr()}), cfg)
+}
+
+// newIngestionTestServer starts the service on the flushed redis of the ingest worker,
+// for tests that ingest readings through utils.SpeedChannel.
+func newIngestionTestServer(t *testing.T, cfg config.GlobalConfig) *testServer {
+	// init logging client
+	utils.InitLogClient()
+
+	redisClient := ingestionRedis()
+	assert.NilError(t, redisClient.FlushAll().Err())
+	return startTestServer(t, redisClient, cfg)
+}
+
+func startTestServer(t *testing.T, redisClient *redis.Client, cfg config.GlobalConfig) *testServer {
+	service.NewMQTTPipelineService(redisClient)
+	config.SetConfig(cfg)
+	t.Cleanup(func() { config.SetConfig(config.GlobalConfig{}) })
+
+	token, err := service.MintToken("ankitchahal20@gmail.com", time.Minute)
+	assert.NilError(t, err)
+	return &testServer{t: t, redis: redisClient, router: newRouter(), token: token}
+}
+
+// ingestionRedis starts the ingest worker and returns its redis. The worker can only
+// be started once per process and keeps the redis client it was started with.
+var ingestionRedis = sync.OnceValue(func() *redis.Client {
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+	service.NewMQTTPipelineService(redisClient)
+	utils.SpeedChannel = make(chan models.Reading, 10)
+	service.StartIngestion()
+	return redisClient
+})
+
+// request calls the router with the token of the server.
+func (s *testServer) request(method, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	return s.send(req)
+}
+
+// send calls the router with req, authorized with the token of the server unless it
+// already has an authorization header.
+func (s *testServer) send(req *http.Request) *httptest.ResponseRecorder {
+	if req.Header.Get("authorization") == "" {
+		req.Header.Set("authorization", s.token)
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+// decode unmarshals the JSON body of w into v.
+func (s *testServer) decode(w *httptest.ResponseRecorder, v interface{}) {
+	s.t.Helper()
+	assert.NilError(s.t, json.Unmarshal(w.Body.Bytes(), v))
+}
+
+// useBroker connects the service to a fakeBroker until the test ends.
+func (s *testServer) useBroker() *fakeBroker {
+	broker := &fakeBroker{}
+	utils.MQTTClient = broker
+	utils.CommandClient = broker
+	s.t.Cleanup(func() {
+		utils.MQTTClient = nil
+		utils.CommandClient = nil
+	})
+	return broker
+}
+
+// eventually polls condition every 10ms until it holds, and fails the test with what
+// after 3s.
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for i := 0; i < 300; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(what)
+}
+
+// doneToken is a token of an operation that has completed.
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// failedToken is a token of an operation that has failed with err.
+type failedToken struct {
+	doneToken
+	err error
+}
+
+func (t failedToken) Error() error { return t.err }
+
+type publishedMessage struct {
+	topic   string
+	qos     byte
+	payload []byte
+	at      time.Time
+
+	// MQTT 5 properties of commands
+	correlationID string
+	responseTopic string
+	expiry        time.Duration
+}
+
+// fakeBroker is a connected client that records what is published through it, with
+// the MQTT 5 client commands are published with.
+type fakeBroker struct {
+	mqtt.Client
+	mu              sync.Mutex
+	published       []publishedMessage
+	disconnected    atomic.Bool
+	rejectPublishes atomic.Bool
+}
+
+func (f *fakeBroker) IsConnected() bool      { return !f.disconnected.Load() }
+func (f *fakeBroker) IsConnectionOpen() bool { return !f.disconnected.Load() }
+
+func (f *fakeBroker) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if f.rejectPublishes.Load() {
+		return failedToken{err: errors.New("publish rejected")}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, publishedMessage{topic: topic, qos: qos, payload: payload.([]byte), at: time.Now()})
+	return doneToken{}
+}
+
+func (f *fakeBroker) PublishCommand(ctx context.Context, topic string, payload []byte, correlationID, responseTopic string, expiry time.Duration) error {
+	if f.rejectPublishes.Load() {
+		return errors.New("publish rejected")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, publishedMessage{topic: topic, qos: 1, payload: payload, at: time.Now(),
+		correlationID: correlationID, responseTopic: responseTopic, expiry: expiry})
+	return nil
+}
+
+func (f *fakeBroker) messages() []publishedMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]publishedMessage(nil), f.published...)
+}
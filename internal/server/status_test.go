@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+	"gotest.tools/assert"
+)
+
+func TestAsyncPublish(t *testing.T) {
+	s := newTestServer(t, config.GlobalConfig{
+		MQTTConfig:    config.MQTT{Topic: "speed_topic", QoS: 1},
+		MessageStatus: config.MessageStatus{Enabled: true},
+	})
+	broker := s.useBroker()
+	status := func(token, messageID string) (int, models.MessageStatus) {
+		req, _ := http.NewRequest(http.MethodGet, "/v1/messages/"+messageID, nil)
+		req.Header.Set("authorization", token)
+		w := s.send(req)
+		var status models.MessageStatus
+		if w.Code == http.StatusOK {
+			s.decode(w, &status)
+		}
+		return w.Code, status
+	}
+
+	// Case 1 : async publishes return the message ID before the broker confirms it
+	w := s.request(http.MethodPost, "/v1/publish?async=true", `{"speed": 42, "message_id": "m1"}`)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var accepted map[string]string
+	s.decode(w, &accepted)
+	assert.Equal(t, "m1", accepted["message_id"])
+	assert.Equal(t, service.StatusQueued, accepted["status"])
+	assert.Equal(t, "/v1/messages/m1", accepted["status_url"])
+	eventually(t, "async publish was not acknowledged", func() bool {
+		_, current := status(s.token, "m1")
+		return current.Status == service.StatusAcknowledged
+	})
+	_, current := status(s.token, "m1")
+	assert.Assert(t, current.QueuedAt != nil && current.PublishedAt != nil && current.AcknowledgedAt != nil)
+	assert.Equal(t, 1, len(broker.messages()))
+	assert.Equal(t, byte(1), broker.messages()[0].qos)
+
+	// Case 2 : Prefer: respond-async publishes asynchronously too, sync publishes answer
+	// once the broker confirmed them
+	req, _ := http.NewRequest(http.MethodPost, "/v1/publish", strings.NewReader(`{"speed": 43, "message_id": "m2"}`))
+	req.Header.Set("Prefer", "respond-async")
+	assert.Equal(t, http.StatusAccepted, s.send(req).Code)
+	w = s.request(http.MethodPost, "/v1/publish", `{"speed": 44, "message_id": "m3"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, current = status(s.token, "m3")
+	assert.Equal(t, service.StatusAcknowledged, current.Status)
+	eventually(t, "async publish was not sent", func() bool { return len(broker.messages()) == 3 })
+
+	// Case 3 : only the subject that published a message and admins see its status
+	other, err := service.MintToken("someone@example.com", time.Minute)
+	assert.NilError(t, err)
+	admin, err := service.MintAdminToken("admin@example.com", time.Minute)
+	assert.NilError(t, err)
+	code, _ := status(other, "m1")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = status(admin, "m1")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = status(s.token, "unknown")
+	assert.Equal(t, http.StatusNotFound, code)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/service"
+	"gotest.tools/assert"
+)
+
+func TestTenantAdmin(t *testing.T) {
+	server := newTestServer(t, config.GlobalConfig{Tenancy: config.Tenancy{Enabled: true, DefaultReadingsPerDay: 100}})
+	adminToken, err := service.MintAdminToken("admin@example.com", time.Minute)
+	assert.NilError(t, err)
+	admin := func(method, path, body string) *http.Request {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("authorization", adminToken)
+		return req
+	}
+
+	// Case 1 : the admin APIs need an admin token
+	w := server.request(http.MethodPost, "/v1/admin/tenants", `{"id":"acme"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = server.request(http.MethodGet, "/v1/admin/tenants", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Case 2 : creating a tenant returns its API key once, with the default quota
+	w = server.send(admin(http.MethodPost, "/v1/admin/tenants", `{"id":"acme","name":"Acme"}`))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		Tenant models.Tenant `json:"tenant"`
+		APIKey string        `json:"api_key"`
+	}
+	server.decode(w, &created)
+	assert.Equal(t, "acme", created.Tenant.ID)
+	assert.Equal(t, service.TenantActive, created.Tenant.Status)
+	assert.Equal(t, int64(100), created.Tenant.Quota.ReadingsPerDay)
+	assert.Assert(t, created.APIKey != "")
+
+	// Case 3 : duplicate and invalid tenants are rejected
+	w = server.send(admin(http.MethodPost, "/v1/admin/tenants", `{"id":"acme"}`))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = server.send(admin(http.MethodPost, "/v1/admin/tenants", `{"id":"Not Valid"}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = server.send(admin(http.MethodPost, "/v1/admin/tenants", `{"id":"negative","quota":{"max_devices":-1}}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Case 4 : tenants are listed and looked up with their usage
+	w = server.send(admin(http.MethodGet, "/v1/admin/tenants", ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list struct{ Tenants []models.Tenant }
+	server.decode(w, &list)
+	assert.Equal(t, 1, len(list.Tenants))
+	w = server.send(admin(http.MethodGet, "/v1/admin/tenants/acme", ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var tenant models.Tenant
+	server.decode(w, &tenant)
+	assert.Assert(t, tenant.Usage != nil)
+	w = server.send(admin(http.MethodGet, "/v1/admin/tenants/missing", ""))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Case 5 : admin tokens of a tenant manage its devices but not the tenants
+	tenantAdminToken, err := service.MintTenantAdminToken("admin@example.com", "acme", time.Minute)
+	assert.NilError(t, err)
+	asTenantAdmin := func(method, path, body string) int {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("authorization", tenantAdminToken)
+		return server.send(req).Code
+	}
+	assert.Equal(t, http.StatusCreated, asTenantAdmin(http.MethodPost, "/v1/devices", `{"id":"truck-1"}`))
+	assert.Equal(t, http.StatusForbidden, asTenantAdmin(http.MethodGet, "/v1/admin/tenants", ""))
+	assert.Equal(t, http.StatusForbidden, asTenantAdmin(http.MethodGet, "/v1/admin/tenants/acme", ""))
+	assert.Equal(t, http.StatusForbidden, asTenantAdmin(http.MethodPost, "/v1/admin/tenants/acme/suspend", ""))
+	assert.Equal(t, http.StatusForbidden, asTenantAdmin(http.MethodGet, "/v1/admin/storage", ""))
+
+	// Case 6 : tokens are only issued for the API key of an active tenant
+	tokenRequest := func(apiKey string) int {
+		req, _ := http.NewRequest(http.MethodPost, "/v1/", strings.NewReader(`{"email":"ankitchahal20@gmail.com","tenant":"acme","api_key":"`+apiKey+`"}`))
+		return server.send(req).Code
+	}
+	assert.Equal(t, http.StatusOK, tokenRequest(created.APIKey))
+	assert.Equal(t, http.StatusUnauthorized, tokenRequest("wrong"))
+
+	w = server.send(admin(http.MethodPost, "/v1/admin/tenants/acme/suspend", ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusForbidden, tokenRequest(created.APIKey))
+	w = server.send(admin(http.MethodPost, "/v1/admin/tenants/missing/suspend", ""))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = server.send(admin(http.MethodPost, "/v1/admin/tenants/acme/activate", ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusOK, tokenRequest(created.APIKey))
+}
+
+func TestTenantScopedRequests(t *testing.T) {
+	server := newTestServer(t, config.GlobalConfig{Tenancy: config.Tenancy{Enabled: true}})
+	tokens := map[string]string{}
+	for _, id := range []string{"north", "south"} {
+		_, _, err := service.RegisterTenant(context.Background(), models.TenantRequest{ID: id})
+		assert.NilError(t, err)
+		tokens[id], err = service.MintTenantToken("ankitchahal20@gmail.com", id, time.Minute)
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, server.redis.Set("tenant:{north}:latest_speed_data", `{"speed":10}`, 0).Err())
+	latest := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, "/v1/", nil)
+		req.Header.Set("authorization", token)
+		return server.send(req)
+	}
+
+	// Case 1 : a tenant sees its own data and not that of other tenants
+	w := latest(tokens["north"])
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"latest_speed":10}`, w.Body.String())
+	w = latest(tokens["south"])
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"latest_speed":"No speed data found in redis"}`, w.Body.String())
+
+	// Case 2 : tokens without a tenant are rejected
+	w = latest(server.token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Case 3 : tokens of a suspended tenant are rejected
+	_, err := service.SetTenantStatus(context.Background(), "north", service.TenantSuspended)
+	assert.NilError(t, err)
+	w = latest(tokens["north"])
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
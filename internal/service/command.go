@@ -0,0 +1,501 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	CommandPending      = "pending"
+	CommandSent         = "sent"
+	CommandAcknowledged = "acknowledged"
+	CommandFailed       = "failed"
+	CommandTimedOut     = "timed_out"
+)
+
+// actions moving a command between states
+const (
+	commandSend    = "send"
+	commandAck     = "ack"
+	commandFail    = "fail"
+	commandTimeout = "timeout"
+)
+
+const (
+	// commandDeadlinesKey is a sorted set of the commands waiting for a response by the
+	// time they time out in milliseconds.
+	commandDeadlinesKey = "command_deadlines"
+	// maxDeviceCommands is how many of its latest commands are listed for a device.
+	maxDeviceCommands = 1000
+	// commandSweepInterval is how often commands are checked for timeouts.
+	commandSweepInterval = time.Second
+
+	// defaults when [commands] timeout and retention are not set
+	defaultCommandTimeout   = 30 * time.Second
+	defaultCommandRetention = 24 * time.Hour
+)
+
+var (
+	ErrCommandsDisabled      = errors.New("commands are disabled")
+	ErrCommandNotFound       = errors.New("command not found")
+	ErrInvalidCommand        = errors.New("command name is required")
+	ErrInvalidCommandTimeout = errors.New("command timeout must not be negative")
+	ErrCommandNotSent        = errors.New("command could not be sent to the broker")
+)
+
+// commandStatusScript applies an action to a command when its current status allows
+// it, so that a response arriving after the timeout does not change the outcome. With
+// a device in ARGV[2] only a command sent to that device is changed. It returns
+// whether the action was applied and the resulting status, or an empty status when the
+// command does not exist.
+var commandStatusScript = redis.NewScript(`
+local transitions = {
+	send = {pending = 'sent'},
+	ack = {pending = 'acknowledged', sent = 'acknowledged'},
+	fail = {pending = 'failed', sent = 'failed'},
+	timeout = {pending = 'timed_out', sent = 'timed_out'},
+}
+local current = redis.call('HGET', KEYS[1], 'status')
+if not current then
+	return {0, ''}
+end
+if ARGV[2] ~= '' and redis.call('HGET', KEYS[1], 'device_id') ~= ARGV[2] then
+	return {0, current}
+end
+local next = transitions[ARGV[1]][current]
+if not next then
+	return {0, current}
+end
+redis.call('HSET', KEYS[1], 'status', next)
+if next == 'sent' then
+	redis.call('HSET', KEYS[1], 'sent_at', ARGV[3])
+else
+	redis.call('HSET', KEYS[1], 'completed_at', ARGV[3], 'result', ARGV[4], 'error', ARGV[5])
+end
+return {1, next}
+`)
+
+// commandKey is a hash of a command and its state, scoped to the tenant of ctx.
+func commandKey(ctx context.Context, commandID string) string {
+	return scopedKey(ctx, "command:"+commandID)
+}
+
+// deviceCommandsKey is a sorted set of the commands of a device by creation time.
+func deviceCommandsKey(ctx context.Context, deviceID string) string {
+	return scopedKey(ctx, "device_commands:"+deviceID)
+}
+
+func commandRetention() time.Duration {
+	if seconds := config.GetConfig().Commands.Retention; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultCommandRetention
+}
+
+// SendCommand publishes a command to a device of the tenant of ctx with QoS 1 over
+// MQTT 5 and returns it once the broker accepted it. The device acknowledges it on its
+// response topic, or it times out.
+func SendCommand(ctx context.Context, deviceID string, req models.CommandRequest) (*models.Command, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	command, payload, err := mqttPipelineClient.createCommand(ctx, deviceID, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := mqttPipelineClient.publishCommand(ctx, command, payload); err != nil {
+		return nil, err
+	}
+	// the device may have responded already
+	sent, err := mqttPipelineClient.lookupCommand(ctx, deviceID, command.ID)
+	if err != nil {
+		return nil, err
+	}
+	if sent == nil {
+		return nil, ErrCommandNotFound
+	}
+	return sent, nil
+}
+
+// createCommand validates a command to a device of the tenant of ctx and records it
+// as pending, returning it with the message to publish.
+func (service *MQTTPipelineService) createCommand(ctx context.Context, deviceID string, req models.CommandRequest) (*models.Command, []byte, error) {
+	cfg := config.GetConfig()
+	if !cfg.Commands.Enabled {
+		return nil, nil, ErrCommandsDisabled
+	}
+	if !deviceIDPattern.MatchString(deviceID) {
+		return nil, nil, ErrInvalidDevice
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		return nil, nil, ErrInvalidCommand
+	}
+	if req.Timeout < 0 {
+		return nil, nil, ErrInvalidCommandTimeout
+	}
+	// commands are only sent to devices the registry would accept readings of
+	if _, err := service.admitDevice(ctx, models.Reading{DeviceID: deviceID}); err != nil {
+		return nil, nil, err
+	}
+	if utils.CommandClient == nil || !utils.CommandClient.IsConnected() {
+		return nil, nil, fmt.Errorf("%w, the broker is unavailable", ErrCommandNotSent)
+	}
+
+	timeout := defaultCommandTimeout
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Second
+	} else if cfg.Commands.Timeout > 0 {
+		timeout = time.Duration(cfg.Commands.Timeout) * time.Second
+	}
+	tenant := TenantFromContext(ctx)
+	now := time.Now().UTC()
+	command := &models.Command{
+		ID:            uuid.New().String(),
+		DeviceID:      deviceID,
+		Name:          req.Name,
+		Params:        req.Params,
+		Topic:         utils.DeviceTopic(tenant, cfg.Commands.Topic, deviceID),
+		ResponseTopic: utils.DeviceTopic(tenant, cfg.Commands.ResponseTopic, deviceID),
+		Status:        CommandPending,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(timeout),
+	}
+
+	key := commandKey(ctx, command.ID)
+	devices := deviceCommandsKey(ctx, deviceID)
+	ttl := timeout + commandRetention()
+	_, err := service.withContext(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(key, "device_id", deviceID, "name", command.Name, "params", string(command.Params), "topic", command.Topic,
+			"response_topic", command.ResponseTopic, "status", command.Status, "created_at", now.Format(time.RFC3339Nano),
+			"expires_at", command.ExpiresAt.Format(time.RFC3339Nano))
+		pipe.Expire(key, ttl)
+		pipe.ZAdd(devices, &redis.Z{Score: float64(now.UnixMilli()), Member: command.ID})
+		pipe.ZRemRangeByRank(devices, 0, -maxDeviceCommands-1)
+		pipe.Expire(devices, ttl)
+		pipe.ZAdd(scopedKey(ctx, commandDeadlinesKey), &redis.Z{Score: float64(command.ExpiresAt.UnixMilli()), Member: command.ID})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, _ := json.Marshal(models.CommandMessage{
+		Name:      command.Name,
+		Params:    command.Params,
+		ExpiresAt: command.ExpiresAt,
+	})
+	return command, payload, nil
+}
+
+// publishCommand publishes a command with QoS 1, its ID as the correlation data and
+// the response topic of the device, and records it as sent once the broker
+// acknowledged it within publish_timeout, or as failed. The message expires with the
+// command, so a device that comes back later does not carry it out.
+func (service *MQTTPipelineService) publishCommand(ctx context.Context, command *models.Command, payload []byte) error {
+	commandID := command.ID
+	timeout := time.Duration(config.GetConfig().MQTTConfig.PublishTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	publishCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := errors.New("the command client is not connected")
+	// commands may have been disabled since the command was created
+	if client := utils.CommandClient; client != nil {
+		err = client.PublishCommand(publishCtx, command.Topic, payload, commandID, command.ResponseTopic, time.Until(command.ExpiresAt))
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("broker did not confirm the publish within %v", timeout)
+	}
+	if err != nil {
+		if _, _, statusErr := service.applyCommandAction(ctx, commandID, commandFail, "", "", err.Error()); statusErr != nil {
+			utils.Logger.Error("unable to record the command status", zap.String("command", commandID), zap.Error(statusErr))
+		}
+		service.withContext(ctx).ZRem(scopedKey(ctx, commandDeadlinesKey), commandID)
+		return fmt.Errorf("%w, err %v", ErrCommandNotSent, err)
+	}
+	// a command the device already responded to stays as it is
+	_, _, err = service.applyCommandAction(ctx, commandID, commandSend, "", "", "")
+	return err
+}
+
+// applyCommandAction moves a command on, returning whether the action was applied and
+// the status of the command after it. With a device ID only a command of that device
+// is changed.
+func (service *MQTTPipelineService) applyCommandAction(ctx context.Context, commandID, action, deviceID, result, errorText string) (bool, string, error) {
+	res, err := commandStatusScript.Run(service.withContext(ctx), []string{commandKey(ctx, commandID)}, action, deviceID,
+		time.Now().UTC().Format(time.RFC3339Nano), result, errorText).Result()
+	if err != nil {
+		return false, "", err
+	}
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, "", fmt.Errorf("unexpected result %v of the command status script", res)
+	}
+	applied, _ := values[0].(int64)
+	status, _ := values[1].(string)
+	return applied == 1, status, nil
+}
+
+// handleCommandResponse records the response of a device to one of its commands.
+// Responses to commands that already finished or timed out, or that were sent to
+// another device, are ignored.
+func (service *MQTTPipelineService) handleCommandResponse(reading models.Reading) {
+	tenant, deviceID, response := reading.Tenant, reading.DeviceID, reading.Response
+	ctx := WithTenant(context.Background(), tenant)
+	logger := utils.Logger.With(zap.String("tenant", tenant), zap.String("device_id", deviceID), zap.String("command", response.CorrelationID))
+	action := commandAck
+	if response.Status != "ok" {
+		action = commandFail
+	}
+	applied, status, err := service.applyCommandAction(ctx, response.CorrelationID, action, deviceID, string(response.Result), response.Error)
+	if err != nil {
+		logger.Error("unable to record the command response", zap.Error(err))
+		return
+	}
+	if !applied {
+		logger.Warn("ignoring response to the command", zap.String("status", status))
+		return
+	}
+	if err := service.withContext(ctx).ZRem(scopedKey(ctx, commandDeadlinesKey), response.CorrelationID).Err(); err != nil {
+		logger.Error("unable to remove the command deadline", zap.Error(err))
+	}
+	logger.Info("device responded to the command", zap.String("status", status))
+}
+
+// StartCommands starts the worker that times out commands the devices did not respond
+// to in time, until ctx is done. It only runs while commands are enabled.
+func StartCommands(ctx context.Context) {
+	service := mqttPipelineClient
+	go func() {
+		ticker := time.NewTicker(commandSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if !config.GetConfig().Commands.Enabled {
+				continue
+			}
+			if err := service.timeoutCommands(ctx, time.Now()); err != nil {
+				utils.Logger.Error("unable to time out the commands", zap.Error(err))
+			}
+		}
+	}()
+}
+
+// timeoutCommands marks the commands of every tenant that are due by now timed out.
+func (service *MQTTPipelineService) timeoutCommands(ctx context.Context, now time.Time) error {
+	tenants, err := tenantIDs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, tenant := range tenants {
+		tenantCtx := WithTenant(ctx, tenant)
+		deadlines := scopedKey(tenantCtx, commandDeadlinesKey)
+		due, err := service.withContext(tenantCtx).ZRangeByScore(deadlines, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(now.UnixMilli(), 10)}).Result()
+		if err != nil {
+			return err
+		}
+		for _, commandID := range due {
+			applied, _, err := service.applyCommandAction(tenantCtx, commandID, commandTimeout, "", "", "the device did not respond in time")
+			if err != nil {
+				return err
+			}
+			if applied {
+				utils.Logger.Warn("command timed out", zap.String("tenant", tenant), zap.String("command", commandID))
+			}
+			if err := service.withContext(tenantCtx).ZRem(deadlines, commandID).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LookupCommand returns a command sent to a device, or nil when it does not exist or
+// has expired.
+func LookupCommand(ctx context.Context, deviceID, commandID string) (*models.Command, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.lookupCommand(ctx, deviceID, commandID)
+}
+
+func (service *MQTTPipelineService) lookupCommand(ctx context.Context, deviceID, commandID string) (*models.Command, error) {
+	fields, err := service.withContext(ctx).HGetAll(commandKey(ctx, commandID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 || fields["device_id"] != deviceID {
+		return nil, nil
+	}
+	return commandFromFields(commandID, fields), nil
+}
+
+func commandFromFields(commandID string, fields map[string]string) *models.Command {
+	command := &models.Command{
+		ID:            commandID,
+		DeviceID:      fields["device_id"],
+		Name:          fields["name"],
+		Topic:         fields["topic"],
+		ResponseTopic: fields["response_topic"],
+		Status:        fields["status"],
+		Error:         fields["error"],
+		SentAt:        parseStatusTime(fields["sent_at"]),
+		CompletedAt:   parseStatusTime(fields["completed_at"]),
+	}
+	if params := fields["params"]; params != "" {
+		command.Params = json.RawMessage(params)
+	}
+	if result := fields["result"]; result != "" && json.Valid([]byte(result)) {
+		command.Result = json.RawMessage(result)
+	}
+	for name, field := range map[string]*time.Time{"created_at": &command.CreatedAt, "expires_at": &command.ExpiresAt} {
+		if parsed := parseStatusTime(fields[name]); parsed != nil {
+			*field = *parsed
+		}
+	}
+	return command
+}
+
+// DeviceCommands returns the latest commands sent to a device, newest first.
+func DeviceCommands(ctx context.Context, deviceID string, limit int64) ([]models.Command, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	ids, err := mqttPipelineClient.withContext(ctx).ZRevRange(deviceCommandsKey(ctx, deviceID), 0, limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]*redis.StringStringMapCmd, len(ids))
+	_, err = mqttPipelineClient.withContext(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.HGetAll(commandKey(ctx, id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	commands := make([]models.Command, 0, len(ids))
+	for i, id := range ids {
+		// commands expire before the list of the device
+		if fields := cmds[i].Val(); len(fields) > 0 {
+			commands = append(commands, *commandFromFields(id, fields))
+		}
+	}
+	return commands, nil
+}
+
+// commandError maps the errors of the command functions to a response code.
+func commandError(err error) int {
+	switch {
+	case errors.Is(err, ErrCommandNotFound), errors.Is(err, ErrDeviceUnregistered):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDeviceDisabled):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidDevice), errors.Is(err, ErrInvalidCommand), errors.Is(err, ErrInvalidCommandTimeout):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrCommandsDisabled), errors.Is(err, ErrCommandNotSent):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// PostCommand sends the command in the body to the device in the path and responds
+// with the pending command to follow, which is published in the background so that a
+// slow broker does not hold up the request.
+func PostCommand() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		deviceID := ctx.Param(constants.DeviceIDParam)
+		var req models.CommandRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			logger.Error("invalid command request", zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusBadRequest, constants.InvalidBody)
+			return
+		}
+
+		command, payload, err := mqttPipelineClient.createCommand(ctx.Request.Context(), deviceID, req)
+		if err != nil {
+			logger.Error("unable to send the command", zap.String("device", deviceID), zap.String("name", req.Name), zap.Error(err))
+			utils.RespondWithError(ctx, commandError(err), err.Error())
+			return
+		}
+		tenantCtx := WithTenant(context.Background(), TenantFromContext(ctx.Request.Context()))
+		commandLogger := logger.With(zap.String("device", deviceID), zap.String("command", command.ID))
+		asyncPublishes.Add(1)
+		asyncPending.Add(1)
+		go func() {
+			defer asyncPublishes.Done()
+			defer asyncPending.Add(-1)
+			if err := mqttPipelineClient.publishCommand(tenantCtx, command, payload); err != nil {
+				commandLogger.Error("unable to publish the command", zap.Error(err))
+			}
+		}()
+		commandLogger.Info("accepted command", zap.String("name", command.Name))
+		ctx.Header("Location", constants.ForwardSlash+strings.Join([]string{constants.Version, constants.Devices, deviceID, constants.Commands, command.ID}, constants.ForwardSlash))
+		ctx.JSON(http.StatusAccepted, command)
+	}
+}
+
+// ListCommands returns the latest commands of the device in the path, at most limit.
+func ListCommands() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		deviceID := ctx.Param(constants.DeviceIDParam)
+		limit := int64(100)
+		if value := ctx.Query(constants.Limit); value != "" {
+			var err error
+			if limit, err = strconv.ParseInt(value, 10, 64); err != nil || limit <= 0 || limit > maxDeviceCommands {
+				utils.RespondWithError(ctx, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxDeviceCommands))
+				return
+			}
+		}
+		commands, err := DeviceCommands(ctx.Request.Context(), deviceID, limit)
+		if err != nil {
+			logger.Error("unable to list the commands", zap.String("device", deviceID), zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to list the commands, err %v", err))
+			return
+		}
+		ctx.JSON(http.StatusOK, map[string]interface{}{"commands": commands})
+	}
+}
+
+// GetCommand returns the status of the command in the path.
+func GetCommand() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		deviceID := ctx.Param(constants.DeviceIDParam)
+		commandID := ctx.Param(constants.CommandIDParam)
+		command, err := LookupCommand(ctx.Request.Context(), deviceID, commandID)
+		if err != nil {
+			logger.Error("unable to get the command", zap.String("device", deviceID), zap.String("command", commandID), zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to fetch the command from redis, err %v", err))
+			return
+		}
+		if command == nil {
+			utils.RespondWithError(ctx, http.StatusNotFound, ErrCommandNotFound.Error())
+			return
+		}
+		ctx.JSON(http.StatusOK, command)
+	}
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	deadLetterKey = "dead_letters"
+	// only the most recent dead letters are kept
+	deadLetterMaxSize = 10000
+)
+
+// recordDeadLetter keeps a message that could not be ingested so it can be inspected
+// and replayed later. Failures are only logged.
+func (service *MQTTPipelineService) recordDeadLetter(ctx context.Context, topic string, payload []byte, reason string) {
+	service.storeDeadLetter(ctx, models.DeadLetter{Topic: topic, Payload: string(payload), Reason: reason, FailedAt: time.Now().UTC()})
+}
+
+// storeDeadLetter keeps a dead letter, assigning its ID.
+func (service *MQTTPipelineService) storeDeadLetter(ctx context.Context, letter models.DeadLetter) {
+	letter.ID = uuid.New().String()
+	value, _ := json.Marshal(letter)
+	_, err := service.withContext(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.LPush(deadLetterKey, value)
+		pipe.LTrim(deadLetterKey, 0, deadLetterMaxSize-1)
+		return nil
+	})
+	if err != nil {
+		utils.Logger.Error("unable to record the dead letter", zap.String("topic", letter.Topic), zap.String("reason", letter.Reason), zap.Error(err))
+	}
+}
+
+// ListDeadLetters returns up to limit dead letters, newest first. A limit of 0
+// returns all of them.
+func ListDeadLetters(ctx context.Context, limit int64) ([]models.DeadLetter, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	letters, _, err := mqttPipelineClient.listDeadLetters(ctx, limit)
+	return letters, err
+}
+
+func (service *MQTTPipelineService) listDeadLetters(ctx context.Context, limit int64) ([]models.DeadLetter, []string, error) {
+	raw, err := service.withContext(ctx).LRange(deadLetterKey, 0, limit-1).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	letters := make([]models.DeadLetter, 0, len(raw))
+	for _, item := range raw {
+		var letter models.DeadLetter
+		if err := json.Unmarshal([]byte(item), &letter); err != nil {
+			return nil, nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, raw, nil
+}
+
+// ReplayDeadLetters publishes dead letters back to the topic they were received on
+// and removes them from the list. An empty id replays all of them. It returns how
+// many were replayed.
+func ReplayDeadLetters(ctx context.Context, id string) (int, error) {
+	if mqttPipelineClient == nil {
+		return 0, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.replayDeadLetters(ctx, id)
+}
+
+func (service *MQTTPipelineService) replayDeadLetters(ctx context.Context, id string) (int, error) {
+	if utils.MQTTClient == nil || !utils.MQTTClient.IsConnectionOpen() {
+		return 0, errors.New("not connected to the MQTT broker")
+	}
+
+	letters, raw, err := service.listDeadLetters(ctx, 0)
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for i, letter := range letters {
+		if id != "" && letter.ID != id {
+			continue
+		}
+		if err := service.publishMessage(ctx, "", letter.Topic, []byte(letter.Payload)); err != nil {
+			return replayed, err
+		}
+		if err := service.withContext(ctx).LRem(deadLetterKey, 1, raw[i]).Err(); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	if id != "" && replayed == 0 {
+		return 0, errors.New("dead letter " + id + " not found")
+	}
+	return replayed, nil
+}
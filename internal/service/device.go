@@ -0,0 +1,471 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	DeviceOnline  = "online"
+	DeviceOffline = "offline"
+
+	// [devices] registry modes
+	RegistryOff    = "off"
+	RegistryFlag   = "flag"
+	RegistryReject = "reject"
+
+	// flags of readings stored from devices the registry does not allow
+	FlagUnregisteredDevice = "unregistered_device"
+	FlagDisabledDevice     = "disabled_device"
+
+	// devicesKey is a hash of every registered device by ID.
+	devicesKey = "devices"
+	// deviceLastSeenKey is a hash of the time of the last stored reading of every device.
+	deviceLastSeenKey = "device_last_seen"
+
+	// defaultOfflineAfter applies when [devices] offline_after is not set.
+	defaultOfflineAfter = 5 * time.Minute
+)
+
+var (
+	ErrDeviceNotFound     = errors.New("device not found")
+	ErrDeviceExists       = errors.New("device already exists")
+	ErrInvalidDevice      = errors.New("device id must be 1 to 128 letters, digits, ., _, : or -, starting with a letter or digit")
+	ErrInvalidDeviceTags  = errors.New("device tags must not be empty")
+	ErrDeviceIDChanged    = errors.New("the id of a device cannot be changed")
+	ErrDeviceUnregistered = errors.New("device is not registered")
+	ErrDeviceDisabled     = errors.New("device is disabled")
+)
+
+// updateDeviceScript stores a device in KEYS[1] at ARGV[1] as ARGV[3] if it is still
+// stored as ARGV[2], it returns 1 when it was stored, 0 when the device changed in the
+// meantime and -1 when it was removed.
+var updateDeviceScript = redis.NewScript(`
+local current = redis.call("HGET", KEYS[1], ARGV[1])
+if not current then
+	return -1
+end
+if current ~= ARGV[2] then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+return 1
+`)
+
+// device IDs are used as a topic level and in redis hashes
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,127}$`)
+
+// offlineAfter is how long a device stays online after its last stored reading, or
+// with presence enabled after it was last heard from.
+func offlineAfter() time.Duration {
+	if seconds := config.GetConfig().Devices.OfflineAfter; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultOfflineAfter
+}
+
+// RegisterDevice adds a device to the registry of the tenant of ctx.
+func RegisterDevice(ctx context.Context, req models.DeviceRequest) (*models.Device, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.registerDevice(ctx, req)
+}
+
+func (service *MQTTPipelineService) registerDevice(ctx context.Context, req models.DeviceRequest) (*models.Device, error) {
+	if !deviceIDPattern.MatchString(req.ID) {
+		return nil, ErrInvalidDevice
+	}
+	now := time.Now().UTC()
+	device := &models.Device{ID: req.ID, Enabled: true, CreatedAt: now, UpdatedAt: now}
+	if err := applyDeviceRequest(device, req); err != nil {
+		return nil, err
+	}
+	value, _ := json.Marshal(device)
+	created, err := service.withContext(ctx).HSetNX(scopedKey(ctx, devicesKey), device.ID, value).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, ErrDeviceExists
+	}
+	if err := service.fillDeviceStatus(ctx, device); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// applyDeviceRequest sets the fields of device that are set in req.
+func applyDeviceRequest(device *models.Device, req models.DeviceRequest) error {
+	for _, tag := range req.Tags {
+		if strings.TrimSpace(tag) == "" {
+			return ErrInvalidDeviceTags
+		}
+	}
+	if req.Name != nil {
+		device.Name = *req.Name
+	}
+	if req.Type != nil {
+		device.Type = *req.Type
+	}
+	if req.Owner != nil {
+		device.Owner = *req.Owner
+	}
+	if req.Tags != nil {
+		device.Tags = req.Tags
+	}
+	if req.FirmwareVersion != nil {
+		device.FirmwareVersion = *req.FirmwareVersion
+	}
+	if req.Enabled != nil {
+		device.Enabled = *req.Enabled
+	}
+	return nil
+}
+
+// LookupDevice returns a device with its status, or nil when it is not registered.
+func LookupDevice(ctx context.Context, deviceID string) (*models.Device, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	device, err := mqttPipelineClient.lookupDevice(ctx, deviceID)
+	if err != nil || device == nil {
+		return nil, err
+	}
+	if err := mqttPipelineClient.fillDeviceStatus(ctx, device); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// lookupDevice returns a device as it is stored, without its status.
+func (service *MQTTPipelineService) lookupDevice(ctx context.Context, deviceID string) (*models.Device, error) {
+	device, _, err := service.lookupStoredDevice(ctx, deviceID)
+	return device, err
+}
+
+// lookupStoredDevice returns a device and the value it is stored as, or nil when it is
+// not registered.
+func (service *MQTTPipelineService) lookupStoredDevice(ctx context.Context, deviceID string) (*models.Device, string, error) {
+	value, err := service.withContext(ctx).HGet(scopedKey(ctx, devicesKey), deviceID).Result()
+	if err == redis.Nil {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var device models.Device
+	if err := json.Unmarshal([]byte(value), &device); err != nil {
+		return nil, "", err
+	}
+	return &device, value, nil
+}
+
+// fillDeviceStatus sets the last seen time and status of a device.
+func (service *MQTTPipelineService) fillDeviceStatus(ctx context.Context, device *models.Device) error {
+	var lastSeen, presence *redis.StringCmd
+	_, err := service.withContext(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+		lastSeen = pipe.HGet(scopedKey(ctx, deviceLastSeenKey), device.ID)
+		presence = pipe.HGet(scopedKey(ctx, devicePresenceKey), device.ID)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	setDeviceStatus(device, lastSeen.Val(), presence.Val())
+	return nil
+}
+
+// setDeviceStatus sets the last stored reading of a device and its status, which with
+// [devices] presence enabled is its presence and otherwise depends on that reading.
+func setDeviceStatus(device *models.Device, lastSeen, presence string) {
+	device.LastSeen = parseStatusTime(lastSeen)
+	device.Status = DeviceOffline
+	if config.GetConfig().Devices.Presence {
+		if state, ok := decodePresence(presence); ok {
+			device.Status = state.Status
+		}
+		return
+	}
+	if device.LastSeen != nil && time.Since(*device.LastSeen) < offlineAfter() {
+		device.Status = DeviceOnline
+	}
+}
+
+// DeviceFilter selects devices by their fields, empty fields match every device.
+type DeviceFilter struct {
+	Type   string
+	Owner  string
+	Tag    string
+	Status string
+}
+
+func (f DeviceFilter) matches(device models.Device) bool {
+	if (f.Type != "" && device.Type != f.Type) || (f.Owner != "" && device.Owner != f.Owner) || (f.Status != "" && device.Status != f.Status) {
+		return false
+	}
+	if f.Tag == "" {
+		return true
+	}
+	for _, tag := range device.Tags {
+		if tag == f.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+// AllDevices returns the registered devices of the tenant of ctx matching filter,
+// ordered by ID.
+func AllDevices(ctx context.Context, filter DeviceFilter) ([]models.Device, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	var values, lastSeen, presence *redis.StringStringMapCmd
+	_, err := mqttPipelineClient.withContext(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+		values = pipe.HGetAll(scopedKey(ctx, devicesKey))
+		lastSeen = pipe.HGetAll(scopedKey(ctx, deviceLastSeenKey))
+		presence = pipe.HGetAll(scopedKey(ctx, devicePresenceKey))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]models.Device, 0, len(values.Val()))
+	for _, value := range values.Val() {
+		var device models.Device
+		if err := json.Unmarshal([]byte(value), &device); err != nil {
+			return nil, err
+		}
+		setDeviceStatus(&device, lastSeen.Val()[device.ID], presence.Val()[device.ID])
+		if filter.matches(device) {
+			devices = append(devices, device)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices, nil
+}
+
+// UpdateDevice changes the fields of a registered device that are set in req; its ID
+// cannot be changed.
+func UpdateDevice(ctx context.Context, deviceID string, req models.DeviceRequest) (*models.Device, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.updateDevice(ctx, deviceID, req)
+}
+
+// updateDevice applies req to the device as it is stored and only stores the result if
+// the device was not changed in the meantime, otherwise it starts over. Concurrent
+// updates of different fields therefore both apply, and a removed device stays removed.
+func (service *MQTTPipelineService) updateDevice(ctx context.Context, deviceID string, req models.DeviceRequest) (*models.Device, error) {
+	if req.ID != "" && req.ID != deviceID {
+		return nil, ErrDeviceIDChanged
+	}
+	for {
+		device, stored, err := service.lookupStoredDevice(ctx, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		if device == nil {
+			return nil, ErrDeviceNotFound
+		}
+		if err := applyDeviceRequest(device, req); err != nil {
+			return nil, err
+		}
+		device.UpdatedAt = time.Now().UTC()
+		value, _ := json.Marshal(device)
+		updated, err := updateDeviceScript.Run(service.withContext(ctx), []string{scopedKey(ctx, devicesKey)}, deviceID, stored, value).Int()
+		if err != nil {
+			return nil, err
+		}
+		switch updated {
+		case -1:
+			return nil, ErrDeviceNotFound
+		case 0:
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := service.fillDeviceStatus(ctx, device); err != nil {
+			return nil, err
+		}
+		return device, nil
+	}
+}
+
+// RemoveDevice deletes a device from the registry. Its stored readings are kept.
+func RemoveDevice(ctx context.Context, deviceID string) error {
+	if mqttPipelineClient == nil {
+		return errors.New("service is not initialised")
+	}
+	var removed *redis.IntCmd
+	_, err := mqttPipelineClient.withContext(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		removed = pipe.HDel(scopedKey(ctx, devicesKey), deviceID)
+		pipe.HDel(scopedKey(ctx, deviceLastSeenKey), deviceID)
+		pipe.HDel(scopedKey(ctx, devicePresenceKey), deviceID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if removed.Val() == 0 {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+// admitDevice checks the device of a reading against the registry. Depending on
+// [devices] registry readings of devices that are not registered or are disabled are
+// rejected, or admitted with the flag returned.
+func (service *MQTTPipelineService) admitDevice(ctx context.Context, reading models.Reading) (string, error) {
+	mode := config.GetConfig().Devices.Registry
+	if mode == "" || mode == RegistryOff {
+		return "", nil
+	}
+	flag, err := FlagUnregisteredDevice, ErrDeviceUnregistered
+	if reading.DeviceID != "" {
+		device, lookupErr := service.lookupDevice(ctx, reading.DeviceID)
+		switch {
+		case lookupErr != nil:
+			return "", lookupErr
+		case device == nil:
+		case !device.Enabled:
+			flag, err = FlagDisabledDevice, ErrDeviceDisabled
+		default:
+			return "", nil
+		}
+	}
+	if mode == RegistryReject {
+		return "", err
+	}
+	return flag, nil
+}
+
+// deviceError maps the errors of the device functions to a response code.
+func deviceError(err error) int {
+	switch {
+	case errors.Is(err, ErrDeviceNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDeviceExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidDevice), errors.Is(err, ErrInvalidDeviceTags), errors.Is(err, ErrDeviceIDChanged):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func CreateDevice() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		var req models.DeviceRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			logger.Error("invalid device request", zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusBadRequest, constants.InvalidBody)
+			return
+		}
+
+		device, err := RegisterDevice(ctx.Request.Context(), req)
+		if err != nil {
+			logger.Error("unable to register the device", zap.String("device", req.ID), zap.Error(err))
+			utils.RespondWithError(ctx, deviceError(err), err.Error())
+			return
+		}
+		logger.Info("registered device", zap.String("device", device.ID))
+		ctx.Header("Location", constants.ForwardSlash+strings.Join([]string{constants.Version, constants.Devices, device.ID}, constants.ForwardSlash))
+		ctx.JSON(http.StatusCreated, device)
+	}
+}
+
+func ListDevices() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		filter := DeviceFilter{
+			Type:   ctx.Query(constants.Type),
+			Owner:  ctx.Query(constants.Owner),
+			Tag:    ctx.Query(constants.Tag),
+			Status: ctx.Query(constants.Status),
+		}
+		if filter.Status != "" && filter.Status != DeviceOnline && filter.Status != DeviceOffline {
+			utils.RespondWithError(ctx, http.StatusBadRequest, fmt.Sprintf("status must be %v or %v", DeviceOnline, DeviceOffline))
+			return
+		}
+		devices, err := AllDevices(ctx.Request.Context(), filter)
+		if err != nil {
+			logger.Error("unable to list the devices", zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to list the devices, err %v", err))
+			return
+		}
+		ctx.JSON(http.StatusOK, map[string]interface{}{"devices": devices})
+	}
+}
+
+func GetDevice() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		deviceID := ctx.Param(constants.DeviceIDParam)
+		device, err := LookupDevice(ctx.Request.Context(), deviceID)
+		if err != nil {
+			logger.Error("unable to get the device", zap.String("device", deviceID), zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to get the device, err %v", err))
+			return
+		}
+		if device == nil {
+			utils.RespondWithError(ctx, http.StatusNotFound, fmt.Sprintf("device %v not found", deviceID))
+			return
+		}
+		ctx.JSON(http.StatusOK, device)
+	}
+}
+
+func PatchDevice() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		deviceID := ctx.Param(constants.DeviceIDParam)
+		var req models.DeviceRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			logger.Error("invalid device request", zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusBadRequest, constants.InvalidBody)
+			return
+		}
+
+		device, err := UpdateDevice(ctx.Request.Context(), deviceID, req)
+		if err != nil {
+			logger.Error("unable to update the device", zap.String("device", deviceID), zap.Error(err))
+			utils.RespondWithError(ctx, deviceError(err), err.Error())
+			return
+		}
+		logger.Info("updated device", zap.String("device", deviceID), zap.Bool("enabled", device.Enabled))
+		ctx.JSON(http.StatusOK, device)
+	}
+}
+
+func DeleteDevice() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		deviceID := ctx.Param(constants.DeviceIDParam)
+		if err := RemoveDevice(ctx.Request.Context(), deviceID); err != nil {
+			logger.Error("unable to delete the device", zap.String("device", deviceID), zap.Error(err))
+			utils.RespondWithError(ctx, deviceError(err), err.Error())
+			return
+		}
+		logger.Info("deleted device", zap.String("device", deviceID))
+		ctx.Status(http.StatusNoContent)
+	}
+}
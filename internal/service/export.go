@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/utils"
+	"github.com/parquet-go/parquet-go"
+	"go.uber.org/zap"
+)
+
+// Formats the speed history can be exported in.
+const (
+	FormatCSV     = "csv"
+	FormatNDJSON  = "ndjson"
+	FormatParquet = "parquet"
+)
+
+// exportBatchSize is the number of readings read from redis at a time, and the size of
+// a parquet row group.
+const exportBatchSize = 1000
+
+var contentTypes = map[string]string{
+	FormatCSV:     "text/csv",
+	FormatNDJSON:  "application/x-ndjson",
+	FormatParquet: "application/vnd.apache.parquet",
+}
+
+// historyWriter writes exported readings in one format. Close completes the output
+// without closing the underlying writer.
+type historyWriter interface {
+	Write(entries []models.HistoryEntry) error
+	Close() error
+}
+
+func newHistoryWriter(w io.Writer, format string) (historyWriter, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVWriter(w)
+	case FormatNDJSON:
+		return &ndjsonWriter{encoder: json.NewEncoder(w)}, nil
+	case FormatParquet:
+		return &parquetWriter{writer: parquet.NewGenericWriter[exportRow](w)}, nil
+	}
+	return nil, fmt.Errorf("format must be %v, %v or %v", FormatCSV, FormatNDJSON, FormatParquet)
+}
+
+type csvWriter struct {
+	writer *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (*csvWriter, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"timestamp", "speed", "device_id", "message_id"}); err != nil {
+		return nil, err
+	}
+	return &csvWriter{writer: writer}, nil
+}
+
+func (c *csvWriter) Write(entries []models.HistoryEntry) error {
+	for _, entry := range entries {
+		record := []string{entry.Timestamp.UTC().Format(time.RFC3339Nano), strconv.Itoa(entry.Speed), entry.DeviceID, entry.MessageID}
+		if err := c.writer.Write(record); err != nil {
+			return err
+		}
+	}
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+func (c *csvWriter) Close() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+type ndjsonWriter struct {
+	encoder *json.Encoder
+}
+
+func (n *ndjsonWriter) Write(entries []models.HistoryEntry) error {
+	for _, entry := range entries {
+		if err := n.encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
+
+// exportRow is the parquet schema of an exported reading.
+type exportRow struct {
+	Timestamp time.Time `parquet:"timestamp,timestamp(millisecond)"`
+	Speed     int64     `parquet:"speed"`
+	DeviceID  string    `parquet:"device_id"`
+	MessageID string    `parquet:"message_id"`
+}
+
+type parquetWriter struct {
+	writer *parquet.GenericWriter[exportRow]
+}
+
+// Write writes every batch as a row group, so that only one batch is held in memory.
+func (p *parquetWriter) Write(entries []models.HistoryEntry) error {
+	rows := make([]exportRow, 0, len(entries))
+	for _, entry := range entries {
+		rows = append(rows, exportRow{Timestamp: entry.Timestamp.UTC(), Speed: int64(entry.Speed), DeviceID: entry.DeviceID, MessageID: entry.MessageID})
+	}
+	if _, err := p.writer.Write(rows); err != nil {
+		return err
+	}
+	return p.writer.Flush()
+}
+
+func (p *parquetWriter) Close() error {
+	return p.writer.Close()
+}
+
+// ExportHistory writes the readings stored between from and to, oldest first, to w in
+// format, and returns how many were written. A zero from or to leaves that end of the
+// range open.
+func ExportHistory(ctx context.Context, w io.Writer, format string, from, to time.Time) (int64, error) {
+	if mqttPipelineClient == nil {
+		return 0, errors.New("service is not initialised")
+	}
+	writer, err := newHistoryWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+	return mqttPipelineClient.exportHistory(ctx, writer, from, to, nil)
+}
+
+// exportHistory writes the history in batches, calling flushed after every batch is
+// written when it is not nil.
+func (service *MQTTPipelineService) exportHistory(ctx context.Context, writer historyWriter, from, to time.Time, flushed func()) (int64, error) {
+	written := int64(0)
+	err := service.historyBatches(ctx, from, to, exportBatchSize, func(entries []models.HistoryEntry) error {
+		if err := writer.Write(entries); err != nil {
+			return err
+		}
+		written += int64(len(entries))
+		if flushed != nil {
+			flushed()
+		}
+		return nil
+	})
+	if err != nil {
+		return written, err
+	}
+	return written, writer.Close()
+}
+
+// ExportSpeedData streams the speed history between the optional from and to (RFC 3339)
+// query parameters in the format query parameter, csv by default.
+func ExportSpeedData() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		format := ctx.DefaultQuery(constants.Format, FormatCSV)
+		contentType, ok := contentTypes[format]
+		if !ok {
+			utils.RespondWithError(ctx, http.StatusBadRequest, fmt.Sprintf("format must be %v, %v or %v", FormatCSV, FormatNDJSON, FormatParquet))
+			return
+		}
+		// exports are not paginated, so unlike the other range queries there is no limit
+		from, to, ok := timeRangeQuery(ctx)
+		if !ok {
+			return
+		}
+
+		ctx.Header("Content-Type", contentType)
+		ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=speed-history.%v", format))
+		writer, err := newHistoryWriter(ctx.Writer, format)
+		if err != nil {
+			utils.RespondWithError(ctx, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// An export can outlast the [server] write timeout, every batch written extends it.
+		controller := http.NewResponseController(ctx.Writer)
+		timeout := time.Duration(config.GetConfig().Server.WriteTimeOut) * time.Second
+		extend := func() {
+			if timeout > 0 {
+				_ = controller.SetWriteDeadline(time.Now().Add(timeout))
+			}
+		}
+		flushed := func() {
+			ctx.Writer.Flush()
+			extend()
+		}
+		extend()
+
+		written, err := mqttPipelineClient.exportHistory(ctx.Request.Context(), writer, from, to, flushed)
+		if err != nil {
+			logger.Error("unable to export the speed history", zap.Int64("written", written), zap.Error(err))
+			if !ctx.Writer.Written() {
+				ctx.Writer.Header().Del("Content-Type")
+				ctx.Writer.Header().Del("Content-Disposition")
+				utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to export the speed history from redis, err %v", err))
+				return
+			}
+			// the status has been sent, the truncated body is all the client gets
+			ctx.Abort()
+			return
+		}
+		logger.Info("exported the speed history", zap.String("format", format), zap.Int64("readings", written))
+	}
+}
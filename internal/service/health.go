@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	statusUp   = "up"
+	statusDown = "down"
+	statusOK   = "ok"
+	statusFail = "unavailable"
+)
+
+var shuttingDown atomic.Bool
+
+// SetShuttingDown marks the service as draining so that readiness starts failing.
+func SetShuttingDown() {
+	shuttingDown.Store(true)
+}
+
+// Liveness reports whether the process is able to serve requests. Dependency
+// checks are included for visibility but never fail the probe.
+func Liveness() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		health := mqttPipelineClient.checkHealth(ctx.Request.Context())
+		health.Status = statusOK
+		ctx.JSON(http.StatusOK, health)
+	}
+}
+
+// Readiness reports whether the service can accept traffic. It fails when any
+// dependency is down or when a graceful shutdown is in progress.
+func Readiness() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		health := mqttPipelineClient.checkHealth(ctx.Request.Context())
+		if health.Status != statusOK {
+			utils.LoggerFromContext(ctx).Warn("readiness check failed", zap.Bool("shutting_down", health.ShuttingDown), zap.Any("checks", health.Checks))
+			ctx.JSON(http.StatusServiceUnavailable, health)
+			return
+		}
+		ctx.JSON(http.StatusOK, health)
+	}
+}
+
+func (service *MQTTPipelineService) checkHealth(ctx context.Context) models.HealthStatus {
+	cfg := config.GetConfig()
+	health := models.HealthStatus{
+		Status:       statusOK,
+		ShuttingDown: shuttingDown.Load(),
+		Checks: map[string]models.DependencyStatus{
+			"redis":        service.checkRedis(ctx, cfg.Health),
+			"mqtt":         checkMQTT(),
+			"subscription": checkSubscription(),
+			"ingest_lag":   checkIngestLag(cfg.Health),
+		},
+	}
+
+	if health.ShuttingDown {
+		health.Status = statusFail
+	}
+	for _, check := range health.Checks {
+		if check.Status != statusUp {
+			health.Status = statusFail
+		}
+	}
+	return health
+}
+
+func (service *MQTTPipelineService) checkRedis(ctx context.Context, cfg config.Health) models.DependencyStatus {
+	timeout := time.Duration(cfg.CheckTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := service.withContext(ctx).Ping().Err(); err != nil {
+		return models.DependencyStatus{Status: statusDown, Message: fmt.Sprintf("ping failed, err %v", err)}
+	}
+	return models.DependencyStatus{Status: statusUp}
+}
+
+func checkMQTT() models.DependencyStatus {
+	if utils.MQTTClient == nil || !utils.MQTTClient.IsConnectionOpen() {
+		return models.DependencyStatus{Status: statusDown, Message: "connection to the broker is not open"}
+	}
+	return models.DependencyStatus{Status: statusUp}
+}
+
+func checkSubscription() models.DependencyStatus {
+	if !utils.IsSubscribed() {
+		return models.DependencyStatus{Status: statusDown, Message: "not subscribed to the topic"}
+	}
+	return models.DependencyStatus{Status: statusUp}
+}
+
+func checkIngestLag(cfg config.Health) models.DependencyStatus {
+	stats := utils.GetIngestStats()
+	lag := stats.Lag(time.Now())
+	message := fmt.Sprintf("pending %d, lag %v", stats.Pending(), lag.Round(time.Millisecond))
+	if cfg.MaxIngestLag > 0 && lag > time.Duration(cfg.MaxIngestLag)*time.Second {
+		return models.DependencyStatus{Status: statusDown, Message: message}
+	}
+	return models.DependencyStatus{Status: statusUp, Message: message}
+}
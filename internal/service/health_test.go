@@ -0,0 +1,86 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/utils"
+	"gotest.tools/assert"
+)
+
+func TestReadiness(t *testing.T) {
+	redisServer := newTestService(t, config.GlobalConfig{MQTTConfig: config.MQTT{Topic: "speed_topic"}, Health: config.Health{CheckTimeout: 1}})
+	client := &fakeClient{}
+	useClient(t, client)
+	utils.InitMQTTSubscribe()
+	defer utils.UnsubscribeMQTT(time.Second)
+	defer shuttingDown.Store(false)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/healthz", Liveness())
+	router.GET("/readyz", Readiness())
+	probe := func(path string) (int, models.HealthStatus) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		router.ServeHTTP(w, req)
+		var health models.HealthStatus
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &health))
+		return w.Code, health
+	}
+
+	// Case 1 : ready while every dependency is up
+	code, health := probe("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, statusOK, health.Status)
+
+	// Case 2 : not ready while redis is down, and ready again once it is back
+	redisServer.Close()
+	code, health = probe("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, statusFail, health.Status)
+	assert.Equal(t, statusDown, health.Checks["redis"].Status)
+	code, _ = probe("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NilError(t, redisServer.Restart())
+	code, _ = probe("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+
+	// Case 3 : not ready while the broker is disconnected
+	client.setConnected(false)
+	code, health = probe("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, statusDown, health.Checks["mqtt"].Status)
+	client.setConnected(true)
+	code, _ = probe("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+
+	// Case 4 : a rejected reading is not left pending and the service stays ready
+	config.SetConfig(config.GlobalConfig{
+		MQTTConfig: config.MQTT{Topic: "speed_topic"},
+		Health:     config.Health{CheckTimeout: 1, MaxIngestLag: 1},
+		Devices:    config.Devices{Registry: RegistryReject},
+	})
+	stored := utils.GetIngestStats().Stored
+	mqttPipelineClient.ingestReading(models.Reading{Metric: "speed", Storage: "speed", Value: 42, Speed: 42, MessageID: "m1", DeviceID: "truck-9", ReceivedAt: time.Now(), Topic: "speed_topic"})
+	assert.Equal(t, stored+1, utils.GetIngestStats().Stored)
+	time.Sleep(1100 * time.Millisecond)
+	code, health = probe("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, statusUp, health.Checks["ingest_lag"].Status)
+
+	// Case 5 : not ready once shutdown started, while the process is still live
+	SetShuttingDown()
+	code, health = probe("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, true, health.ShuttingDown)
+	assert.Equal(t, statusUp, health.Checks["redis"].Status)
+	code, _ = probe("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/models"
+)
+
+// The keys below are scoped to the tenant of the context they are used with.
+const (
+	// latestSpeedKey holds the most recently stored speed.
+	latestSpeedKey = "latest_speed_data"
+	// speedHistoryKey is a sorted set of stored readings scored by their timestamp in
+	// milliseconds.
+	speedHistoryKey = "speed_history"
+	// deviceReadingsKey is a hash of the latest reading of every device that sent one.
+	deviceReadingsKey = "device_readings"
+)
+
+// QueryHistory returns up to limit readings stored between from and to, oldest first.
+// A zero from or to leaves that end of the range open and a limit of 0 returns all.
+func QueryHistory(ctx context.Context, from, to time.Time, limit int64) ([]models.HistoryEntry, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.scanHistory(ctx, from, to, 0, limit)
+}
+
+// ScanHistory is QueryHistory starting after the first offset readings of the range,
+// used to page through it.
+func ScanHistory(ctx context.Context, from, to time.Time, offset, limit int64) ([]models.HistoryEntry, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.scanHistory(ctx, from, to, offset, limit)
+}
+
+func (service *MQTTPipelineService) scanHistory(ctx context.Context, from, to time.Time, offset, limit int64) ([]models.HistoryEntry, error) {
+	query := &redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if !from.IsZero() {
+		query.Min = strconv.FormatInt(from.UnixMilli(), 10)
+	}
+	if !to.IsZero() {
+		query.Max = strconv.FormatInt(to.UnixMilli(), 10)
+	}
+	if limit > 0 || offset > 0 {
+		query.Offset = offset
+		query.Count = limit
+		if limit <= 0 {
+			query.Count = -1
+		}
+	}
+
+	members, err := service.withContext(ctx).ZRangeByScore(scopedKey(ctx, speedHistoryKey), query).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]models.HistoryEntry, 0, len(members))
+	for _, member := range members {
+		var entry models.HistoryEntry
+		if err := json.Unmarshal([]byte(member), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// historyBatches calls fn with the readings stored between from and to, oldest first,
+// size readings at a time, so that a range of any length can be read without holding
+// it in memory. It stops at the first error returned by fn.
+func (service *MQTTPipelineService) historyBatches(ctx context.Context, from, to time.Time, size int64, fn func([]models.HistoryEntry) error) error {
+	query := &redis.ZRangeBy{Min: "-inf", Max: "+inf", Count: size}
+	if !from.IsZero() {
+		query.Min = strconv.FormatInt(from.UnixMilli(), 10)
+	}
+	if !to.IsZero() {
+		query.Max = strconv.FormatInt(to.UnixMilli(), 10)
+	}
+	// Readings can share a score, so the next batch starts at the last score seen,
+	// skipping the readings with that score already read.
+	var lastScore float64
+	var sameScore int64
+	for {
+		members, err := service.withContext(ctx).ZRangeByScoreWithScores(scopedKey(ctx, speedHistoryKey), query).Result()
+		if err != nil {
+			return err
+		}
+		entries := make([]models.HistoryEntry, 0, len(members))
+		for _, member := range members {
+			var entry models.HistoryEntry
+			if err := json.Unmarshal([]byte(member.Member.(string)), &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			if member.Score == lastScore {
+				sameScore++
+			} else {
+				lastScore, sameScore = member.Score, 1
+			}
+		}
+		if len(entries) > 0 {
+			if err := fn(entries); err != nil {
+				return err
+			}
+		}
+		if int64(len(members)) < size {
+			return nil
+		}
+		query.Min = strconv.FormatFloat(lastScore, 'f', -1, 64)
+		query.Offset = sameScore
+	}
+}
+
+// LatestReading returns the most recently stored reading, or nil when the history is
+// empty.
+func LatestReading(ctx context.Context) (*models.HistoryEntry, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	members, err := mqttPipelineClient.withContext(ctx).ZRevRange(scopedKey(ctx, speedHistoryKey), 0, 0).Result()
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+	var entry models.HistoryEntry
+	if err := json.Unmarshal([]byte(members[0]), &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// LatestDeviceReadings returns the latest reading of every device, ordered by device ID.
+func LatestDeviceReadings(ctx context.Context) ([]models.HistoryEntry, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	values, err := mqttPipelineClient.withContext(ctx).HGetAll(scopedKey(ctx, deviceReadingsKey)).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]models.HistoryEntry, 0, len(values))
+	for _, value := range values {
+		var entry models.HistoryEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DeviceID < entries[j].DeviceID })
+	return entries, nil
+}
+
+// LatestDeviceReading returns the latest reading of a device, or nil when it has not
+// sent any.
+func LatestDeviceReading(ctx context.Context, deviceID string) (*models.HistoryEntry, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	value, err := mqttPipelineClient.withContext(ctx).HGet(scopedKey(ctx, deviceReadingsKey), deviceID).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry models.HistoryEntry
+	if err := json.Unmarshal([]byte(value), &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
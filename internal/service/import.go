@@ -0,0 +1,706 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/routing"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	ImportPending   = "pending"
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed"
+)
+
+const (
+	// importBatchSize is the number of records stored in redis at a time.
+	importBatchSize = 500
+	// maxConcurrentImports bounds the imports one instance processes at a time, the
+	// others wait as pending.
+	maxConcurrentImports = 2
+	// importFutureSkew is how far ahead of the clock an imported timestamp may be.
+	importFutureSkew = time.Minute
+	// maxRejectedRecord is the length a record is cut to in the rejection report.
+	maxRejectedRecord = 1024
+)
+
+var ErrImportNotFound = errors.New("import job not found")
+
+var importSlots = make(chan struct{}, maxConcurrentImports)
+
+// importContext is the parent of the imports run in the background.
+var importContext = context.Background()
+
+// importJobKey is a hash of the state and counters of an import job. Both import keys
+// are scoped to the tenant of ctx.
+func importJobKey(ctx context.Context, jobID string) string {
+	return scopedKey(ctx, "import:"+jobID)
+}
+
+// importRejectionsKey is a list of the records of an import job that were rejected.
+func importRejectionsKey(ctx context.Context, jobID string) string {
+	return scopedKey(ctx, "import:"+jobID+":rejections")
+}
+
+func importTTL() time.Duration {
+	ttl := config.GetConfig().Import.JobTTL
+	if ttl <= 0 {
+		ttl = 604800
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// StartImports makes ctx the parent of the uploaded imports; once it is done running
+// imports stop and are marked failed.
+func StartImports(ctx context.Context) {
+	importContext = ctx
+}
+
+// rejectedRecord is a record that cannot be imported. The rest of the file can still be.
+type rejectedRecord struct {
+	models.ImportRejection
+}
+
+func (r *rejectedRecord) Error() string {
+	return r.Reason
+}
+
+func reject(line int64, record string, reason error) *rejectedRecord {
+	if len(record) > maxRejectedRecord {
+		record = record[:maxRejectedRecord]
+	}
+	return &rejectedRecord{models.ImportRejection{Line: line, Reason: reason.Error(), Record: record}}
+}
+
+// importReader reads the records of an imported file. Next returns io.EOF after the
+// last record, a *rejectedRecord for a record that cannot be imported and any other
+// error when the rest of the file cannot be read. Last returns the line and the text of
+// the record Next returned last.
+type importReader interface {
+	Next() (models.HistoryEntry, error)
+	Last() (int64, string)
+}
+
+func newImportReader(r io.Reader, format string, now time.Time) (importReader, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVImportReader(r, now)
+	case FormatNDJSON:
+		return &ndjsonImportReader{reader: bufio.NewReader(r), now: now}, nil
+	}
+	return nil, fmt.Errorf("format must be %v or %v", FormatCSV, FormatNDJSON)
+}
+
+// csvImportReader reads the columns written by the csv export, found by the header.
+type csvImportReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+	now     time.Time
+	line    int64
+	record  string
+}
+
+func newCSVImportReader(r io.Reader, now time.Time) (*csvImportReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("the file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid header, err %v", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for _, name := range []string{"timestamp", "speed"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("the header has no %v column", name)
+		}
+	}
+	return &csvImportReader{reader: reader, columns: columns, now: now}, nil
+}
+
+func (c *csvImportReader) Next() (models.HistoryEntry, error) {
+	record, err := c.reader.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return models.HistoryEntry{}, reject(int64(parseErr.StartLine), strings.Join(record, ","), parseErr.Err)
+	}
+	if err != nil {
+		return models.HistoryEntry{}, err
+	}
+	line, _ := c.reader.FieldPos(0)
+	c.line, c.record = int64(line), strings.Join(record, ",")
+	field := func(name string) string {
+		i, ok := c.columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	entry, err := parseImportRecord(field("speed"), field("timestamp"), field("device_id"), field("message_id"), c.now)
+	if err != nil {
+		return entry, reject(c.line, c.record, err)
+	}
+	return entry, nil
+}
+
+func (c *csvImportReader) Last() (int64, string) {
+	return c.line, c.record
+}
+
+// ndjsonImportReader reads one history entry, as written by the ndjson export, per line.
+type ndjsonImportReader struct {
+	reader *bufio.Reader
+	line   int64
+	record string
+	now    time.Time
+}
+
+func (n *ndjsonImportReader) Next() (models.HistoryEntry, error) {
+	for {
+		raw, err := n.reader.ReadBytes('\n')
+		if err == io.EOF && len(raw) == 0 {
+			return models.HistoryEntry{}, io.EOF
+		}
+		if err != nil && err != io.EOF {
+			return models.HistoryEntry{}, err
+		}
+		n.line++
+		text := bytes.TrimSpace(raw)
+		if len(text) == 0 {
+			continue
+		}
+		n.record = string(text)
+
+		var record struct {
+			Speed     json.Number `json:"speed"`
+			Timestamp string      `json:"timestamp"`
+			DeviceID  string      `json:"device_id"`
+			MessageID string      `json:"message_id"`
+		}
+		if err := json.Unmarshal(text, &record); err != nil {
+			return models.HistoryEntry{}, reject(n.line, string(text), fmt.Errorf("invalid JSON, err %v", err))
+		}
+		entry, err := parseImportRecord(record.Speed.String(), record.Timestamp, record.DeviceID, record.MessageID, n.now)
+		if err != nil {
+			return entry, reject(n.line, string(text), err)
+		}
+		return entry, nil
+	}
+}
+
+func (n *ndjsonImportReader) Last() (int64, string) {
+	return n.line, n.record
+}
+
+// parseImportRecord validates an imported reading like one received on the topic.
+func parseImportRecord(speed, timestamp, deviceID, messageID string, now time.Time) (models.HistoryEntry, error) {
+	var entry models.HistoryEntry
+	if timestamp == "" {
+		return entry, errors.New("timestamp is missing")
+	}
+	at, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return entry, fmt.Errorf("invalid timestamp %q, expected RFC 3339", timestamp)
+	}
+	if at.After(now.Add(importFutureSkew)) {
+		return entry, errors.New("timestamp is in the future")
+	}
+	if speed == "" {
+		return entry, errors.New("speed is missing")
+	}
+	value, err := strconv.ParseFloat(speed, 64)
+	if err != nil {
+		return entry, fmt.Errorf("invalid speed %q", speed)
+	}
+	if err := routing.Validate(routing.DefaultRoute(), value); err != nil {
+		return entry, err
+	}
+	return models.HistoryEntry{Speed: int(value), MessageID: messageID, DeviceID: deviceID, Timestamp: at.UTC()}, nil
+}
+
+// countingReader counts the bytes read to report the progress of an import.
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func (service *MQTTPipelineService) createImportJob(ctx context.Context, format string, size int64) (*models.ImportJob, error) {
+	job := &models.ImportJob{
+		ID:        uuid.New().String(),
+		Status:    ImportPending,
+		Format:    format,
+		Size:      size,
+		CreatedAt: time.Now().UTC(),
+	}
+	key := importJobKey(ctx, job.ID)
+	_, err := service.withContext(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(key, "status", job.Status, "format", job.Format, "size", job.Size, "created_at", job.CreatedAt.Format(time.RFC3339Nano))
+		pipe.Expire(key, importTTL())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// finishImport records the final state of an import. It is written even when ctx is
+// done, so that an interrupted import does not stay running.
+func (service *MQTTPipelineService) finishImport(ctx context.Context, jobID, status string, cause error) {
+	fields := []interface{}{"status", status, "finished_at", time.Now().UTC().Format(time.RFC3339Nano)}
+	if cause != nil {
+		fields = append(fields, "error", cause.Error())
+	}
+	if err := service.withContext(context.WithoutCancel(ctx)).HSet(importJobKey(ctx, jobID), fields...).Err(); err != nil {
+		utils.Logger.Error("unable to record the import status", zap.String("import", jobID), zap.String("status", status), zap.Error(err))
+	}
+}
+
+// admitImported checks an imported reading like one received on the topic, against the
+// device registry and the quotas of the tenant, whose daily quota it counts towards on
+// the day it is imported.
+func (service *MQTTPipelineService) admitImported(ctx context.Context, entry *models.HistoryEntry) error {
+	reading := models.Reading{Tenant: TenantFromContext(ctx), DeviceID: entry.DeviceID, ReceivedAt: time.Now()}
+	flag, err := service.admitDevice(ctx, reading)
+	if err != nil {
+		return err
+	}
+	if err := service.admitReading(ctx, reading); err != nil {
+		return err
+	}
+	entry.Flag = flag
+	return nil
+}
+
+// isAdmissionRejection reports whether err rejects a single reading rather than failing
+// to check it.
+func isAdmissionRejection(err error) bool {
+	for _, rejection := range []error{ErrDeviceUnregistered, ErrDeviceDisabled, ErrQuotaExceeded, ErrTenantRequired, ErrTenantNotFound, ErrTenantSuspended} {
+		if errors.Is(err, rejection) {
+			return true
+		}
+	}
+	return false
+}
+
+// runImport validates and stores the records read from r in the speed history, in
+// batches, updating the progress of the job after every batch. Records already in the
+// history are not stored twice, so an interrupted import can be run again.
+func (service *MQTTPipelineService) runImport(ctx context.Context, jobID string, r io.Reader, format string) error {
+	logger := utils.Logger.With(zap.String("import", jobID), zap.String("tenant", TenantFromContext(ctx)))
+	jobKey := importJobKey(ctx, jobID)
+	rejectionsKey := importRejectionsKey(ctx, jobID)
+	maxRejections := int64(config.GetConfig().Import.MaxRejections)
+	if maxRejections <= 0 {
+		maxRejections = 10000
+	}
+
+	now := time.Now().UTC()
+	if err := service.withContext(ctx).HSet(jobKey, "status", ImportRunning, "started_at", now.Format(time.RFC3339Nano)).Err(); err != nil {
+		return err
+	}
+	counter := &countingReader{reader: r}
+	records, err := newImportReader(counter, format, now)
+	if err != nil {
+		service.finishImport(ctx, jobID, ImportFailed, err)
+		return err
+	}
+
+	minuteKey := rollupKey(ctx, routing.MetricSpeed, ResolutionMinute)
+	hourKey := rollupKey(ctx, routing.MetricSpeed, ResolutionHour)
+
+	var job models.ImportJob
+	var reported int64
+	batch := make([]models.HistoryEntry, 0, importBatchSize)
+	var rejections []interface{}
+	flush := func() error {
+		// Readings before the watermarks are in buckets compaction has already rolled
+		// up, so they are merged into those rollups once stored.
+		minutesUntil, err := service.watermark(ctx, minuteKey)
+		if err != nil {
+			return err
+		}
+		hoursUntil, err := service.watermark(ctx, hourKey)
+		if err != nil {
+			return err
+		}
+		ttl := importTTL()
+		added := make([]*redis.IntCmd, len(batch))
+		_, err = service.withContext(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+			for i, entry := range batch {
+				member, _ := json.Marshal(entry)
+				added[i] = pipe.ZAdd(scopedKey(ctx, speedHistoryKey), &redis.Z{Score: float64(entry.Timestamp.UnixMilli()), Member: member})
+			}
+			if len(rejections) > 0 {
+				pipe.RPush(rejectionsKey, rejections...)
+				pipe.Expire(rejectionsKey, ttl)
+			}
+			pipe.HSet(jobKey, "bytes_read", counter.read, "records", job.Records, "imported", job.Imported, "rejected", job.Rejected,
+				"updated_at", time.Now().UTC().Format(time.RFC3339Nano))
+			pipe.Expire(jobKey, ttl)
+			return nil
+		})
+		if err != nil {
+			batch, rejections = batch[:0], rejections[:0]
+			return err
+		}
+		// Readings already in the history are in the rollups already. A batch whose
+		// merge fails is not merged when it is imported again.
+		var minutes, hours []models.HistoryEntry
+		for i, entry := range batch {
+			if added[i].Val() == 0 || !entry.Timestamp.Before(minutesUntil) {
+				continue
+			}
+			minutes = append(minutes, entry)
+			if entry.Timestamp.Before(hoursUntil) {
+				hours = append(hours, entry)
+			}
+		}
+		batch, rejections = batch[:0], rejections[:0]
+		if err := service.mergeRollups(ctx, minuteKey, bucketRollups(minutes, time.Minute)); err != nil {
+			return err
+		}
+		return service.mergeRollups(ctx, hourKey, bucketRollups(hours, time.Hour))
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			err = fmt.Errorf("import interrupted, err %v", err)
+			service.finishImport(ctx, jobID, ImportFailed, err)
+			return err
+		}
+		entry, err := records.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			if err = service.admitImported(ctx, &entry); err != nil && !isAdmissionRejection(err) {
+				err = fmt.Errorf("unable to check the imported readings, err %v", err)
+				service.finishImport(ctx, jobID, ImportFailed, err)
+				return err
+			}
+			if err != nil {
+				line, record := records.Last()
+				err = reject(line, record, err)
+			}
+		}
+		var rejected *rejectedRecord
+		if errors.As(err, &rejected) {
+			job.Records++
+			job.Rejected++
+			if reported < maxRejections {
+				reported++
+				encoded, _ := json.Marshal(rejected.ImportRejection)
+				rejections = append(rejections, encoded)
+			}
+		} else if err != nil {
+			err = fmt.Errorf("unable to read the file, err %v", err)
+			service.finishImport(ctx, jobID, ImportFailed, err)
+			return err
+		} else {
+			job.Records++
+			job.Imported++
+			batch = append(batch, entry)
+		}
+
+		if len(batch) >= importBatchSize || len(rejections) >= importBatchSize {
+			if err := flush(); err != nil {
+				err = fmt.Errorf("unable to store the imported readings in redis, err %v", err)
+				service.finishImport(ctx, jobID, ImportFailed, err)
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		err = fmt.Errorf("unable to store the imported readings in redis, err %v", err)
+		service.finishImport(ctx, jobID, ImportFailed, err)
+		return err
+	}
+	service.finishImport(ctx, jobID, ImportCompleted, nil)
+	logger.Info("import completed", zap.Int64("records", job.Records), zap.Int64("imported", job.Imported), zap.Int64("rejected", job.Rejected))
+	return nil
+}
+
+// processUpload runs the import of an uploaded file once a slot is free and removes
+// the file.
+func (service *MQTTPipelineService) processUpload(ctx context.Context, jobID, path, format string) {
+	defer os.Remove(path)
+	select {
+	case importSlots <- struct{}{}:
+		defer func() { <-importSlots }()
+	case <-ctx.Done():
+		service.finishImport(ctx, jobID, ImportFailed, fmt.Errorf("import interrupted, err %v", ctx.Err()))
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		service.finishImport(ctx, jobID, ImportFailed, err)
+		return
+	}
+	defer file.Close()
+	if err := service.runImport(ctx, jobID, file, format); err != nil {
+		utils.Logger.Error("import failed", zap.String("import", jobID), zap.Error(err))
+	}
+}
+
+// ImportHistory imports the readings read from r in the foreground, used by the admin
+// tool, and returns the finished job.
+func ImportHistory(ctx context.Context, r io.Reader, format string, size int64) (*models.ImportJob, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	job, err := mqttPipelineClient.createImportJob(ctx, format, size)
+	if err != nil {
+		return nil, err
+	}
+	err = mqttPipelineClient.runImport(ctx, job.ID, r, format)
+	if finished, lookupErr := mqttPipelineClient.lookupImportJob(ctx, job.ID); lookupErr == nil && finished != nil {
+		job = finished
+	}
+	return job, err
+}
+
+// LookupImportJob returns an import job, or nil when it does not exist or has expired.
+func LookupImportJob(ctx context.Context, jobID string) (*models.ImportJob, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.lookupImportJob(ctx, jobID)
+}
+
+func (service *MQTTPipelineService) lookupImportJob(ctx context.Context, jobID string) (*models.ImportJob, error) {
+	fields, err := service.withContext(ctx).HGetAll(importJobKey(ctx, jobID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	count := func(name string) int64 {
+		value, _ := strconv.ParseInt(fields[name], 10, 64)
+		return value
+	}
+	job := &models.ImportJob{
+		ID:         jobID,
+		Status:     fields["status"],
+		Format:     fields["format"],
+		Size:       count("size"),
+		Records:    count("records"),
+		Imported:   count("imported"),
+		Rejected:   count("rejected"),
+		Error:      fields["error"],
+		StartedAt:  parseStatusTime(fields["started_at"]),
+		UpdatedAt:  parseStatusTime(fields["updated_at"]),
+		FinishedAt: parseStatusTime(fields["finished_at"]),
+	}
+	if createdAt := parseStatusTime(fields["created_at"]); createdAt != nil {
+		job.CreatedAt = *createdAt
+	}
+	switch {
+	case job.Status == ImportCompleted:
+		job.Progress = 1
+	case job.Size > 0:
+		job.Progress = float64(count("bytes_read")) / float64(job.Size)
+	}
+	return job, nil
+}
+
+// WriteImportRejections writes the rejection report of an import job to w as csv,
+// with the line, reason and record of every rejected record.
+func WriteImportRejections(ctx context.Context, jobID string, w io.Writer) error {
+	if mqttPipelineClient == nil {
+		return errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.writeImportRejections(ctx, jobID, w)
+}
+
+func (service *MQTTPipelineService) writeImportRejections(ctx context.Context, jobID string, w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"line", "reason", "record"}); err != nil {
+		return err
+	}
+	key := importRejectionsKey(ctx, jobID)
+	for start := int64(0); ; start += importBatchSize {
+		values, err := service.withContext(ctx).LRange(key, start, start+importBatchSize-1).Result()
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			var rejection models.ImportRejection
+			if err := json.Unmarshal([]byte(value), &rejection); err != nil {
+				return err
+			}
+			if err := writer.Write([]string{strconv.FormatInt(rejection.Line, 10), rejection.Reason, rejection.Record}); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+		if len(values) < importBatchSize {
+			return nil
+		}
+	}
+}
+
+// importFormat returns the format of an upload, from the format query parameter or
+// else the Content-Type.
+func importFormat(ctx *gin.Context) string {
+	if format := ctx.Query(constants.Format); format != "" {
+		return format
+	}
+	mediaType, _, _ := mime.ParseMediaType(ctx.GetHeader("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return FormatCSV
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return FormatNDJSON
+	}
+	return ""
+}
+
+// spoolUpload copies the request body to a temporary file, so that it can be imported
+// after the response is sent.
+func spoolUpload(ctx *gin.Context) (string, int64, error) {
+	cfg := config.GetConfig().Import
+	maxSize := int64(cfg.MaxSize)
+	if maxSize <= 0 {
+		maxSize = 100
+	}
+	file, err := os.CreateTemp(cfg.Dir, "mqtt-pipeline-import-*")
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := io.Copy(file, http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxSize<<20))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", 0, err
+	}
+	return file.Name(), size, nil
+}
+
+// ImportSpeedData accepts a csv or ndjson file of historical readings and imports it
+// into the speed history in the background, responding with the job to follow.
+func ImportSpeedData() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		format := importFormat(ctx)
+		if format != FormatCSV && format != FormatNDJSON {
+			utils.RespondWithError(ctx, http.StatusBadRequest, fmt.Sprintf("format must be %v or %v, set the format query parameter or the Content-Type", FormatCSV, FormatNDJSON))
+			return
+		}
+
+		path, size, err := spoolUpload(ctx)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				utils.RespondWithError(ctx, http.StatusRequestEntityTooLarge, fmt.Sprintf("the file is larger than %d bytes", tooLarge.Limit))
+				return
+			}
+			logger.Error("unable to receive the imported file", zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to receive the file, err %v", err))
+			return
+		}
+		if size == 0 {
+			os.Remove(path)
+			utils.RespondWithError(ctx, http.StatusBadRequest, "the file is empty")
+			return
+		}
+
+		job, err := mqttPipelineClient.createImportJob(ctx.Request.Context(), format, size)
+		if err != nil {
+			os.Remove(path)
+			logger.Error("unable to create the import job", zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to create the import job in redis, err %v", err))
+			return
+		}
+		logger.Info("accepted file for import", zap.String("import", job.ID), zap.String("format", format), zap.Int64("size", size))
+		go mqttPipelineClient.processUpload(WithTenant(importContext, TenantFromContext(ctx.Request.Context())), job.ID, path, format)
+
+		ctx.Header("Location", constants.ForwardSlash+strings.Join([]string{constants.Version, constants.Speed, constants.Import, job.ID}, constants.ForwardSlash))
+		ctx.JSON(http.StatusAccepted, job)
+	}
+}
+
+// GetImportJob returns the status, progress and counts of the import job in the path.
+func GetImportJob() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		jobID := ctx.Param(constants.ImportIDParam)
+		job, err := mqttPipelineClient.lookupImportJob(ctx.Request.Context(), jobID)
+		if err != nil {
+			logger.Error("unable to get the import job", zap.String("import", jobID), zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to fetch the import job from redis, err %v", err))
+			return
+		}
+		if job == nil {
+			utils.RespondWithError(ctx, http.StatusNotFound, ErrImportNotFound.Error())
+			return
+		}
+		ctx.JSON(http.StatusOK, job)
+	}
+}
+
+// GetImportRejections downloads the rejection report of the import job in the path.
+func GetImportRejections() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		jobID := ctx.Param(constants.ImportIDParam)
+		job, err := mqttPipelineClient.lookupImportJob(ctx.Request.Context(), jobID)
+		if err != nil {
+			logger.Error("unable to get the import job", zap.String("import", jobID), zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to fetch the import job from redis, err %v", err))
+			return
+		}
+		if job == nil {
+			utils.RespondWithError(ctx, http.StatusNotFound, ErrImportNotFound.Error())
+			return
+		}
+
+		ctx.Header("Content-Type", "text/csv")
+		ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=import-%v-rejections.csv", jobID))
+		ctx.Status(http.StatusOK)
+		if err := mqttPipelineClient.writeImportRejections(ctx.Request.Context(), jobID, ctx.Writer); err != nil {
+			logger.Error("unable to write the rejection report", zap.String("import", jobID), zap.Error(err))
+			ctx.Abort()
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/mqtterror"
+	"github.com/mqtt-pipeline/internal/routing"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+var ingestDone = make(chan struct{})
+
+// StartIngestion starts the worker that stores readings received on
+// utils.SpeedChannel in redis. The worker exits once the channel is closed and drained.
+func StartIngestion() {
+	go mqttPipelineClient.ingest()
+}
+
+// DrainIngestion waits until the ingest worker has stored every buffered reading.
+// If ctx expires first it returns the number of readings that were not stored.
+func DrainIngestion(ctx context.Context) (int, error) {
+	select {
+	case <-ingestDone:
+		return 0, nil
+	case <-ctx.Done():
+		return len(utils.SpeedChannel), ctx.Err()
+	}
+}
+
+// ingest stores the readings of utils.SpeedChannel and records the messages the
+// subscriber rejected on utils.DeadLetters, until SpeedChannel is closed and drained.
+func (service *MQTTPipelineService) ingest() {
+	defer close(ingestDone)
+	readings := utils.SpeedChannel
+	for {
+		select {
+		case reading, ok := <-readings:
+			if !ok {
+				service.drainDeadLetters()
+				utils.Logger.Info("ingest worker stopped")
+				return
+			}
+			service.ingestReading(reading)
+		case letter := <-utils.DeadLetters:
+			service.storeDeadLetter(context.Background(), letter)
+		}
+	}
+}
+
+// drainDeadLetters records the dead letters still buffered.
+func (service *MQTTPipelineService) drainDeadLetters() {
+	for {
+		select {
+		case letter := <-utils.DeadLetters:
+			service.storeDeadLetter(context.Background(), letter)
+		default:
+			return
+		}
+	}
+}
+
+func (service *MQTTPipelineService) ingestReading(reading models.Reading) {
+	switch reading.Kind {
+	case models.ReadingDeviceStatus:
+		service.handleDeviceStatus(reading)
+		utils.MarkStored()
+		return
+	case models.ReadingCommandResponse:
+		service.handleCommandResponse(reading)
+		utils.MarkStored()
+		return
+	}
+	logger := utils.Logger.With(zap.String("message_id", reading.MessageID), zap.String("metric", reading.Metric))
+	logger.Debug("data successfully fetched from the topic", zap.Float64("value", reading.Value))
+
+	ctx := WithTenant(context.Background(), reading.Tenant)
+	first, err := service.claimMessage(ctx, reading.MessageID)
+	if err != nil {
+		logger.Error("unable to check message for duplicates, storing it anyway", zap.Error(err))
+	} else if !first {
+		// Duplicates are counted as stored so that they do not show up as ingest lag.
+		logger.Info("dropping duplicate message")
+		utils.MarkStored()
+		return
+	}
+
+	flag, err := service.admitDevice(ctx, reading)
+	if err == nil {
+		err = service.admitReading(ctx, reading)
+	}
+	if err != nil {
+		logger.Warn("rejected reading", zap.String("tenant", reading.Tenant), zap.Error(err))
+		service.releaseMessage(ctx, reading.MessageID)
+		service.setMessageStatus(ctx, reading.MessageID, StatusFailed, err.Error())
+		service.recordDeadLetter(ctx, reading.Topic, reading.Payload, err.Error())
+		// Rejected readings are handled, so they are counted as stored like duplicates.
+		utils.MarkStored()
+		return
+	}
+	if flag != "" {
+		logger.Warn("flagged reading", zap.String("device_id", reading.DeviceID), zap.String("flag", flag))
+		reading.Flag = flag
+	}
+
+	if err := service.storeReading(ctx, reading); err != nil {
+		logger.Error("unable to store data into redis", zap.Float64("value", reading.Value), zap.String("error", err.Message))
+		service.releaseMessage(ctx, reading.MessageID)
+		service.setMessageStatus(ctx, reading.MessageID, StatusFailed, err.Message)
+		service.recordDeadLetter(ctx, reading.Topic, reading.Payload, err.Message)
+		// The reading is kept as a dead letter and will not be retried from the topic.
+		utils.MarkStored()
+		return
+	}
+	service.setMessageStatus(ctx, reading.MessageID, StatusIngested, "")
+	service.heartbeat(ctx, reading.DeviceID, reading.ReceivedAt)
+}
+
+// claimMessage marks the message ID as ingested and reports whether this is the
+// first time it has been seen. Messages without an ID are always accepted.
+func (service *MQTTPipelineService) claimMessage(ctx context.Context, messageID string) (bool, error) {
+	if messageID == "" {
+		return true, nil
+	}
+	ttl := time.Duration(config.GetConfig().Idempotency.IngestDedupTTL) * time.Second
+	return service.withContext(ctx).SetNX(scopedKey(ctx, "ingested:"+messageID), 1, ttl).Result()
+}
+
+// releaseMessage forgets a claimed message ID so that a redelivery can be stored.
+func (service *MQTTPipelineService) releaseMessage(ctx context.Context, messageID string) {
+	if messageID == "" {
+		return
+	}
+	if err := service.withContext(ctx).Del(scopedKey(ctx, "ingested:"+messageID)).Err(); err != nil {
+		utils.Logger.Error("unable to release message id", zap.String("message_id", messageID), zap.Error(err))
+	}
+}
+
+// storeReading stores a reading in the storage target of its route.
+func (service *MQTTPipelineService) storeReading(ctx context.Context, reading models.Reading) *mqtterror.MQTTPipelineError {
+	if reading.Storage == routing.StorageMetrics {
+		return service.storeMetric(ctx, reading)
+	}
+	return service.storeInRedis(ctx, reading)
+}
+
+func (service *MQTTPipelineService) storeInRedis(ctx context.Context, reading models.Reading) *mqtterror.MQTTPipelineError {
+	// Store the speed data in Redis
+	data := map[string]interface{}{"speed": reading.Speed}
+	val, err := json.Marshal(data)
+	if err != nil {
+		return &mqtterror.MQTTPipelineError{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Unable to marshal the speed data, err %v", err.Error()),
+		}
+	}
+
+	entry, err := json.Marshal(models.HistoryEntry{Speed: reading.Speed, MessageID: reading.MessageID, DeviceID: reading.DeviceID, Flag: reading.Flag, Timestamp: reading.ReceivedAt.UTC()})
+	if err != nil {
+		return &mqtterror.MQTTPipelineError{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Unable to marshal the history entry, err %v", err.Error()),
+		}
+	}
+
+	_, err = service.withContext(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(scopedKey(ctx, latestSpeedKey), val, 0)
+		pipe.ZAdd(scopedKey(ctx, speedHistoryKey), &redis.Z{Score: float64(reading.ReceivedAt.UnixMilli()), Member: entry})
+		pipe.Publish(scopedKey(ctx, liveReadingsChannel), entry)
+		if reading.DeviceID != "" {
+			pipe.HSet(scopedKey(ctx, deviceReadingsKey), reading.DeviceID, entry)
+			pipe.HSet(scopedKey(ctx, deviceLastSeenKey), reading.DeviceID, reading.ReceivedAt.UTC().Format(time.RFC3339Nano))
+		}
+		return nil
+	})
+	if err != nil {
+		return &mqtterror.MQTTPipelineError{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Unable to store the speed data in redis, err %v", err.Error()),
+		}
+	}
+	utils.MarkStored()
+	utils.Logger.Info("data stored successfully in redis", zap.Int("speed", reading.Speed), zap.Duration("ingest_latency", time.Since(reading.ReceivedAt)))
+	return nil
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/utils"
+	"gotest.tools/assert"
+)
+
+func TestDrainIngestion(t *testing.T) {
+	newTestService(t, config.GlobalConfig{MQTTConfig: config.MQTT{Topic: "speed_topic", IngestBuffer: 100}})
+	useClient(t, &fakeClient{})
+	utils.InitMQTTSubscribe()
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		utils.SpeedChannel <- models.Reading{Metric: "speed", Storage: "speed", Value: 42, Speed: 42, MessageID: fmt.Sprintf("m%d", i), ReceivedAt: start.Add(time.Duration(i) * time.Second), Topic: "speed_topic"}
+	}
+
+	// Case 1 : without a worker the readings still buffered are reported
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	pending, err := DrainIngestion(expired)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 20, pending)
+
+	// Case 2 : after unsubscribing every buffered reading and dead letter is stored
+	// before the drain returns
+	utils.DeadLetters <- models.DeadLetter{Topic: "speed_topic", Payload: "not json", Reason: "invalid JSON"}
+	StartIngestion()
+	assert.NilError(t, utils.UnsubscribeMQTT(time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pending, err = DrainIngestion(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, pending)
+	history, err := QueryHistory(context.Background(), time.Time{}, time.Time{}, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, 20, len(history))
+	letters, err := ListDeadLetters(context.Background(), 0)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(letters))
+	assert.Equal(t, "invalid JSON", letters[0].Reason)
+	assert.Assert(t, letters[0].ID != "")
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+// liveReadingsChannel is the redis pub/sub channel every stored reading is announced
+// on, so that subscribers of any instance see readings stored by all of them. Like
+// the keys it is scoped to the tenant of the reading.
+const liveReadingsChannel = "speed_live"
+
+// SubscribeReadings streams readings of the tenant of ctx as they are stored until
+// ctx is done, after which the channel is closed.
+func SubscribeReadings(ctx context.Context) (<-chan models.HistoryEntry, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+
+	readings := make(chan models.HistoryEntry, 64)
+	err := mqttPipelineClient.subscribe(ctx, scopedKey(ctx, liveReadingsChannel), func(payload []byte) bool {
+		var entry models.HistoryEntry
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			utils.Logger.Error("unable to decode live reading", zap.Error(err))
+			return true
+		}
+		select {
+		case readings <- entry:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}, func() { close(readings) })
+	if err != nil {
+		return nil, err
+	}
+	return readings, nil
+}
+
+// subscribe hands every message published on the redis channel to deliver, from a
+// goroutine, until ctx is done or deliver returns false. closed is called once the
+// subscription has ended.
+func (service *MQTTPipelineService) subscribe(ctx context.Context, channel string, deliver func(payload []byte) bool, closed func()) error {
+	pubsub := service.redisClient.Subscribe(channel)
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	go func() {
+		defer closed()
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok || !deliver([]byte(msg.Payload)) {
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
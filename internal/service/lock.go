@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+// releaseLockScript deletes a lock only while it is still held by the owner in
+// ARGV[1], so that an instance whose lock expired cannot release the lock another
+// instance acquired since.
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// renewLockScript extends a lock to ARGV[2] milliseconds while it is still held by the
+// owner in ARGV[1], and returns 0 once it is not.
+var renewLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// redisLock is a lock held in redis by one instance at a time.
+type redisLock struct {
+	key   string
+	owner string
+}
+
+// acquireLock takes the lock at key for ttl. It returns nil when another instance
+// holds it.
+func (service *MQTTPipelineService) acquireLock(ctx context.Context, key string, ttl time.Duration) (*redisLock, error) {
+	lock := &redisLock{key: key, owner: uuid.New().String()}
+	locked, err := service.withContext(ctx).SetNX(key, lock.owner, ttl).Result()
+	if err != nil || !locked {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// releaseLock releases a lock that is still held by lock.
+func (service *MQTTPipelineService) releaseLock(lock *redisLock) {
+	if err := releaseLockScript.Run(service.redisClient, []string{lock.key}, lock.owner).Err(); err != nil {
+		utils.Logger.Error("unable to release the lock", zap.String("key", lock.key), zap.Error(err))
+	}
+}
+
+// keepLock renews a lock every third of ttl until stop is called, for work that may
+// outlast ttl. The returned context is cancelled once the lock is lost, so that the
+// work stops before another instance takes over.
+func (service *MQTTPipelineService) keepLock(ctx context.Context, lock *redisLock, ttl time.Duration) (context.Context, func()) {
+	lockCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lockCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			held, err := renewLockScript.Run(service.redisClient, []string{lock.key}, lock.owner, ttl.Milliseconds()).Int()
+			if err != nil {
+				// the lock is only lost once it expires, which the next renewal may prevent
+				utils.Logger.Error("unable to renew the lock", zap.String("key", lock.key), zap.Error(err))
+				continue
+			}
+			if held == 0 {
+				utils.Logger.Warn("lost the lock", zap.String("key", lock.key))
+				cancel()
+				return
+			}
+		}
+	}()
+	return lockCtx, func() {
+		cancel()
+		<-done
+	}
+}
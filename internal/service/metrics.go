@@ -0,0 +1,270 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/mqtterror"
+	"github.com/mqtt-pipeline/internal/routing"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+// metricHistoryKey is a sorted set of the stored readings of a metric scored by their
+// timestamp in milliseconds. It is scoped to the tenant of ctx.
+func metricHistoryKey(ctx context.Context, metric string) string {
+	return scopedKey(ctx, "metric:"+metric+":history")
+}
+
+// metricDevicesKey is a hash of the latest reading of a metric of every device.
+func metricDevicesKey(ctx context.Context, metric string) string {
+	return scopedKey(ctx, "metric:"+metric+":devices")
+}
+
+// storeMetric stores a reading routed to the metrics storage.
+func (service *MQTTPipelineService) storeMetric(ctx context.Context, reading models.Reading) *mqtterror.MQTTPipelineError {
+	entry, err := json.Marshal(models.MetricEntry{
+		Metric:    reading.Metric,
+		Value:     reading.Value,
+		MessageID: reading.MessageID,
+		DeviceID:  reading.DeviceID,
+		Flag:      reading.Flag,
+		Timestamp: reading.ReceivedAt.UTC(),
+	})
+	if err != nil {
+		return &mqtterror.MQTTPipelineError{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Unable to marshal the metric entry, err %v", err.Error()),
+		}
+	}
+
+	_, err = service.withContext(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(metricHistoryKey(ctx, reading.Metric), &redis.Z{Score: float64(reading.ReceivedAt.UnixMilli()), Member: entry})
+		if reading.DeviceID != "" {
+			pipe.HSet(metricDevicesKey(ctx, reading.Metric), reading.DeviceID, entry)
+			pipe.HSet(scopedKey(ctx, deviceLastSeenKey), reading.DeviceID, reading.ReceivedAt.UTC().Format(time.RFC3339Nano))
+		}
+		return nil
+	})
+	if err != nil {
+		return &mqtterror.MQTTPipelineError{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Unable to store the %v reading in redis, err %v", reading.Metric, err.Error()),
+		}
+	}
+	utils.MarkStored()
+	utils.Logger.Info("data stored successfully in redis", zap.String("metric", reading.Metric), zap.Float64("value", reading.Value), zap.Duration("ingest_latency", time.Since(reading.ReceivedAt)))
+	return nil
+}
+
+// QueryMetric returns up to limit readings of a metric stored between from and to,
+// oldest first, with the same open ends and limit as QueryHistory. The speed metric
+// reads the speed history.
+func QueryMetric(ctx context.Context, metric string, from, to time.Time, limit int64) ([]models.MetricEntry, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.queryMetric(ctx, metric, from, to, limit)
+}
+
+func (service *MQTTPipelineService) queryMetric(ctx context.Context, metric string, from, to time.Time, limit int64) ([]models.MetricEntry, error) {
+	if metric == routing.MetricSpeed {
+		history, err := service.scanHistory(ctx, from, to, 0, limit)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]models.MetricEntry, 0, len(history))
+		for _, entry := range history {
+			entries = append(entries, models.MetricEntry{Metric: metric, Value: float64(entry.Speed), MessageID: entry.MessageID, DeviceID: entry.DeviceID, Timestamp: entry.Timestamp})
+		}
+		return entries, nil
+	}
+
+	members, err := service.withContext(ctx).ZRangeByScore(metricHistoryKey(ctx, metric), scoreRange(from, to, limit)).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]models.MetricEntry, 0, len(members))
+	for _, member := range members {
+		var entry models.MetricEntry
+		if err := json.Unmarshal([]byte(member), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// LatestMetricReadings returns the latest reading of a metric of every device that sent
+// one, ordered by device ID. The speed metric reads the latest speed readings.
+func LatestMetricReadings(ctx context.Context, metric string) ([]models.MetricEntry, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.latestMetricReadings(ctx, metric)
+}
+
+func (service *MQTTPipelineService) latestMetricReadings(ctx context.Context, metric string) ([]models.MetricEntry, error) {
+	if metric == routing.MetricSpeed {
+		latest, err := LatestDeviceReadings(ctx)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]models.MetricEntry, 0, len(latest))
+		for _, entry := range latest {
+			entries = append(entries, models.MetricEntry{Metric: metric, Value: float64(entry.Speed), MessageID: entry.MessageID, DeviceID: entry.DeviceID, Flag: entry.Flag, Timestamp: entry.Timestamp})
+		}
+		return entries, nil
+	}
+
+	values, err := service.withContext(ctx).HGetAll(metricDevicesKey(ctx, metric)).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]models.MetricEntry, 0, len(values))
+	for _, value := range values {
+		var entry models.MetricEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DeviceID < entries[j].DeviceID })
+	return entries, nil
+}
+
+// scoreRange selects the entries of a sorted set scored in milliseconds between from
+// and to, open ended when zero, and at most limit of them when it is positive.
+func scoreRange(from, to time.Time, limit int64) *redis.ZRangeBy {
+	query := &redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if !from.IsZero() {
+		query.Min = strconv.FormatInt(from.UnixMilli(), 10)
+	}
+	if !to.IsZero() {
+		query.Max = strconv.FormatInt(to.UnixMilli(), 10)
+	}
+	if limit > 0 {
+		query.Count = limit
+	}
+	return query
+}
+
+// timeRangeQuery reads the from and to (RFC 3339) query parameters, responding with 400
+// and returning false when they are invalid.
+func timeRangeQuery(ctx *gin.Context) (time.Time, time.Time, bool) {
+	var from, to time.Time
+	var err error
+	if value := ctx.Query(constants.From); value != "" {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			utils.RespondWithError(ctx, http.StatusBadRequest, fmt.Sprintf("invalid from %q, expected RFC 3339", value))
+			return from, to, false
+		}
+	}
+	if value := ctx.Query(constants.To); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			utils.RespondWithError(ctx, http.StatusBadRequest, fmt.Sprintf("invalid to %q, expected RFC 3339", value))
+			return from, to, false
+		}
+	}
+	return from, to, true
+}
+
+// rangeQuery reads the from and to (RFC 3339) and limit query parameters, responding
+// with 400 and returning false when they are invalid.
+func rangeQuery(ctx *gin.Context) (time.Time, time.Time, int64, bool) {
+	from, to, ok := timeRangeQuery(ctx)
+	if !ok {
+		return from, to, 0, false
+	}
+	var err error
+	limit := int64(100)
+	if value := ctx.Query(constants.Limit); value != "" {
+		if limit, err = strconv.ParseInt(value, 10, 64); err != nil || limit <= 0 || limit > 1000 {
+			utils.RespondWithError(ctx, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return from, to, 0, false
+		}
+	}
+	return from, to, limit, true
+}
+
+// GetMetricReadings returns the stored readings of the metric in the path, filtered
+// by the optional from and to (RFC 3339) and limit query parameters.
+func GetMetricReadings() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		metric := ctx.Param(constants.MetricParam)
+		from, to, limit, ok := rangeQuery(ctx)
+		if !ok {
+			return
+		}
+
+		entries, err := mqttPipelineClient.queryMetric(ctx.Request.Context(), metric, from, to, limit)
+		if err != nil {
+			logger.Error("unable to query the metric readings", zap.String("metric", metric), zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to fetch the %v readings from redis, err %v", metric, err))
+			return
+		}
+		ctx.JSON(http.StatusOK, map[string]interface{}{
+			"metric":   metric,
+			"readings": entries,
+		})
+	}
+}
+
+// GetMetricDevices returns the latest reading of the metric in the path of every device.
+func GetMetricDevices() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		metric := ctx.Param(constants.MetricParam)
+		entries, err := mqttPipelineClient.latestMetricReadings(ctx.Request.Context(), metric)
+		if err != nil {
+			logger.Error("unable to query the latest metric readings", zap.String("metric", metric), zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to fetch the latest %v readings from redis, err %v", metric, err))
+			return
+		}
+		ctx.JSON(http.StatusOK, map[string]interface{}{
+			"metric":  metric,
+			"devices": entries,
+		})
+	}
+}
+
+// GetMetricRollups returns the minute or hourly rollups of the metric in the path,
+// selected with the resolution query parameter, filtered like GetMetricReadings.
+func GetMetricRollups() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		metric := ctx.Param(constants.MetricParam)
+		resolution := ctx.DefaultQuery(constants.Resolution, ResolutionMinute)
+		if resolution != ResolutionMinute && resolution != ResolutionHour {
+			utils.RespondWithError(ctx, http.StatusBadRequest, fmt.Sprintf("resolution must be %v or %v", ResolutionMinute, ResolutionHour))
+			return
+		}
+		from, to, limit, ok := rangeQuery(ctx)
+		if !ok {
+			return
+		}
+
+		rollups, err := mqttPipelineClient.queryRollups(ctx.Request.Context(), metric, resolution, from, to, limit)
+		if err != nil {
+			logger.Error("unable to query the metric rollups", zap.String("metric", metric), zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to fetch the %v rollups from redis, err %v", metric, err))
+			return
+		}
+		ctx.JSON(http.StatusOK, map[string]interface{}{
+			"metric":     metric,
+			"resolution": resolution,
+			"rollups":    rollups,
+		})
+	}
+}
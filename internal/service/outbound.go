@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/mqtterror"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	outboundQueueKey = "mqtt:outbound"
+	outboundLockKey  = "mqtt:outbound:lock"
+	// outboundLockTTL is how long the flush lock outlives an instance that stops
+	// without releasing it.
+	outboundLockTTL = time.Minute
+
+	OverflowReject     = "reject"
+	OverflowDropOldest = "drop_oldest"
+)
+
+// enqueueScript appends to the outbound queue while enforcing its maximum size.
+// It returns the number of messages dropped to make room, or -1 when rejected.
+var enqueueScript = redis.NewScript(`
+local max = tonumber(ARGV[2])
+local dropped = 0
+if max > 0 then
+	local size = redis.call('LLEN', KEYS[1])
+	if size >= max then
+		if ARGV[3] ~= 'drop_oldest' then
+			return -1
+		end
+		dropped = size - max + 1
+		redis.call('LTRIM', KEYS[1], dropped, -1)
+	end
+end
+redis.call('RPUSH', KEYS[1], ARGV[1])
+return dropped
+`)
+
+// ackScript removes the head of the queue only if it is still the message that was published.
+var ackScript = redis.NewScript(`
+if redis.call('LINDEX', KEYS[1], 0) == ARGV[1] then
+	return redis.call('LPOP', KEYS[1]) and 1 or 0
+end
+return 0
+`)
+
+var flushMu sync.Mutex
+
+// outboundPending reports whether earlier publishes are still waiting for the broker,
+// in which case new ones have to be queued behind them to keep the order.
+func (service *MQTTPipelineService) outboundPending(ctx context.Context) bool {
+	if !config.GetConfig().OutboundQueue.Enabled {
+		return false
+	}
+	size, err := service.withContext(ctx).LLen(outboundQueueKey).Result()
+	if err != nil {
+		utils.Logger.Error("unable to read outbound queue size", zap.Error(err))
+		return false
+	}
+	return size > 0
+}
+
+// enqueueOutbound stores a message that could not be delivered to the broker.
+func (service *MQTTPipelineService) enqueueOutbound(ctx context.Context, messageID, topic string, payload []byte, txid string) *mqtterror.MQTTPipelineError {
+	cfg := config.GetConfig().OutboundQueue
+	if !cfg.Enabled {
+		return &mqtterror.MQTTPipelineError{
+			Code:    http.StatusServiceUnavailable,
+			Message: "MQTT broker is unavailable",
+			Trace:   txid,
+		}
+	}
+
+	message, _ := json.Marshal(models.OutboundMessage{
+		MessageID: messageID,
+		Tenant:    TenantFromContext(ctx),
+		Topic:     topic,
+		Payload:   payload,
+		QueuedAt:  time.Now().UTC(),
+	})
+	dropped, err := enqueueScript.Run(service.withContext(ctx), []string{outboundQueueKey}, message, cfg.MaxSize, cfg.OverflowPolicy).Int64()
+	if err != nil {
+		return &mqtterror.MQTTPipelineError{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Unable to queue the speed data for delivery, err %v", err),
+			Trace:   txid,
+		}
+	}
+	if dropped < 0 {
+		return &mqtterror.MQTTPipelineError{
+			Code:    http.StatusServiceUnavailable,
+			Message: "MQTT broker is unavailable and the outbound queue is full",
+			Trace:   txid,
+		}
+	}
+	if dropped > 0 {
+		utils.Logger.Warn("outbound queue full, dropped oldest messages", zap.Int64("dropped", dropped))
+	}
+	return nil
+}
+
+// StartOutboundFlusher publishes queued messages, in order, whenever the broker
+// connection comes back and periodically while it is up. It stops when ctx is done.
+func StartOutboundFlusher(ctx context.Context) {
+	interval := time.Duration(config.GetConfig().OutboundQueue.FlushInterval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-utils.Reconnected:
+			case <-ticker.C:
+			}
+			if config.GetConfig().OutboundQueue.Enabled {
+				mqttPipelineClient.flushOutbound(ctx)
+			}
+		}
+	}()
+}
+
+func (service *MQTTPipelineService) flushOutbound(ctx context.Context) {
+	flushMu.Lock()
+	defer flushMu.Unlock()
+
+	// Only one instance flushes at a time so that the order is kept across replicas.
+	lock, err := service.acquireLock(ctx, outboundLockKey, outboundLockTTL)
+	if err != nil || lock == nil {
+		return
+	}
+	defer service.releaseLock(lock)
+	// A long queue can outlast the lock, so it is renewed and the flush stops once it
+	// is lost; a message already being published is still acknowledged.
+	lockCtx, stop := service.keepLock(ctx, lock, outboundLockTTL)
+	defer stop()
+
+	flushed := 0
+	for lockCtx.Err() == nil && utils.MQTTClient.IsConnectionOpen() {
+		raw, err := service.withContext(lockCtx).LIndex(outboundQueueKey, 0).Result()
+		if err == redis.Nil {
+			break
+		}
+		if err != nil {
+			utils.Logger.Error("unable to read the outbound queue", zap.Error(err))
+			break
+		}
+
+		var message models.OutboundMessage
+		if err := json.Unmarshal([]byte(raw), &message); err != nil {
+			utils.Logger.Error("discarding malformed outbound message", zap.Error(err))
+			ackScript.Run(service.withContext(lockCtx), []string{outboundQueueKey}, raw)
+			continue
+		}
+
+		if err := service.publishMessage(WithTenant(ctx, message.Tenant), message.MessageID, message.Topic, message.Payload); err != nil {
+			utils.Logger.Error("unable to flush outbound message, will retry", zap.String("message_id", message.MessageID), zap.String("topic", message.Topic), zap.Error(err))
+			break
+		}
+		if err := ackScript.Run(service.withContext(ctx), []string{outboundQueueKey}, raw).Err(); err != nil {
+			utils.Logger.Error("unable to remove flushed message from the outbound queue", zap.Error(err))
+			break
+		}
+		flushed++
+	}
+	if flushed > 0 {
+		utils.Logger.Info("flushed outbound queue", zap.Int("messages", flushed))
+	}
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mqtt-pipeline/internal/config"
+	"gotest.tools/assert"
+)
+
+func TestOutboundScripts(t *testing.T) {
+	newTestService(t, config.GlobalConfig{})
+	redisClient := mqttPipelineClient.redisClient
+	enqueue := func(message string, max int, policy string) int64 {
+		dropped, err := enqueueScript.Run(redisClient, []string{"queue"}, message, max, policy).Int64()
+		assert.NilError(t, err)
+		return dropped
+	}
+	queue := func() []string {
+		messages, err := redisClient.LRange("queue", 0, -1).Result()
+		assert.NilError(t, err)
+		return messages
+	}
+
+	// Case 1 : without a maximum size every message is queued
+	for _, message := range []string{"m1", "m2", "m3"} {
+		assert.Equal(t, int64(0), enqueue(message, 0, OverflowReject))
+	}
+	assert.DeepEqual(t, []string{"m1", "m2", "m3"}, queue())
+
+	// Case 2 : a full queue rejects new messages with the reject policy
+	assert.Equal(t, int64(-1), enqueue("m4", 3, OverflowReject))
+	assert.DeepEqual(t, []string{"m1", "m2", "m3"}, queue())
+
+	// Case 3 : drop_oldest makes room, also when the maximum shrank below the size
+	assert.Equal(t, int64(1), enqueue("m4", 3, OverflowDropOldest))
+	assert.DeepEqual(t, []string{"m2", "m3", "m4"}, queue())
+	assert.Equal(t, int64(2), enqueue("m5", 2, OverflowDropOldest))
+	assert.DeepEqual(t, []string{"m4", "m5"}, queue())
+
+	// Case 4 : only the message that was published is acknowledged
+	acked, err := ackScript.Run(redisClient, []string{"queue"}, "m5").Int()
+	assert.NilError(t, err)
+	assert.Equal(t, 0, acked)
+	acked, err = ackScript.Run(redisClient, []string{"queue"}, "m4").Int()
+	assert.NilError(t, err)
+	assert.Equal(t, 1, acked)
+	assert.DeepEqual(t, []string{"m5"}, queue())
+}
+
+func TestFlushOutbound(t *testing.T) {
+	newTestService(t, config.GlobalConfig{
+		MQTTConfig:    config.MQTT{PublishTimeout: 1},
+		OutboundQueue: config.OutboundQueue{Enabled: true, MaxSize: 10, OverflowPolicy: OverflowReject},
+	})
+	client := &fakeClient{}
+	useClient(t, client)
+	redisClient := mqttPipelineClient.redisClient
+	ctx := context.Background()
+	for _, topic := range []string{"t1", "t2", "t3"} {
+		assert.Assert(t, mqttPipelineClient.enqueueOutbound(ctx, topic, topic, []byte(`{"speed": 1}`), "") == nil)
+	}
+
+	// Case 1 : nothing is flushed while the broker is disconnected
+	client.setConnected(false)
+	mqttPipelineClient.flushOutbound(ctx)
+	assert.Equal(t, 0, len(client.topics()))
+	assert.Equal(t, int64(3), redisClient.LLen(outboundQueueKey).Val())
+
+	// Case 2 : nothing is flushed while another instance holds the lock, which is kept
+	client.setConnected(true)
+	assert.NilError(t, redisClient.Set(outboundLockKey, "other", time.Minute).Err())
+	mqttPipelineClient.flushOutbound(ctx)
+	assert.Equal(t, 0, len(client.topics()))
+	assert.Equal(t, "other", redisClient.Get(outboundLockKey).Val())
+
+	// Case 3 : messages are published in the order they were queued and the lock released
+	assert.NilError(t, redisClient.Del(outboundLockKey).Err())
+	mqttPipelineClient.flushOutbound(ctx)
+	assert.DeepEqual(t, []string{"t1", "t2", "t3"}, client.topics())
+	assert.Equal(t, int64(0), redisClient.LLen(outboundQueueKey).Val())
+	assert.Equal(t, int64(0), redisClient.Exists(outboundLockKey).Val())
+}
+
+func TestReleaseLock(t *testing.T) {
+	newTestService(t, config.GlobalConfig{})
+	redisClient := mqttPipelineClient.redisClient
+	ctx := context.Background()
+
+	// Case 1 : a held lock cannot be acquired again
+	lock, err := mqttPipelineClient.acquireLock(ctx, "lock", time.Minute)
+	assert.NilError(t, err)
+	assert.Assert(t, lock != nil)
+	other, err := mqttPipelineClient.acquireLock(ctx, "lock", time.Minute)
+	assert.NilError(t, err)
+	assert.Assert(t, other == nil)
+
+	// Case 2 : a lock that expired and was taken over is not released by its old owner
+	assert.NilError(t, redisClient.Set("lock", "other", time.Minute).Err())
+	mqttPipelineClient.releaseLock(lock)
+	assert.Equal(t, "other", redisClient.Get("lock").Val())
+
+	// Case 3 : the owner releases its lock
+	assert.NilError(t, redisClient.Del("lock").Err())
+	lock, err = mqttPipelineClient.acquireLock(ctx, "lock", time.Minute)
+	assert.NilError(t, err)
+	mqttPipelineClient.releaseLock(lock)
+	assert.Equal(t, int64(0), redisClient.Exists("lock").Val())
+}
@@ -0,0 +1,343 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// reasons of presence changes
+	PresenceReasonStatus  = "status_message"
+	PresenceReasonReading = "reading"
+	PresenceReasonTimeout = "heartbeat_timeout"
+
+	// devicePresenceKey is a hash of the presence of every device by ID, as JSON with
+	// its status, reason and since and last_seen in milliseconds.
+	devicePresenceKey = "device_presence"
+	// presenceChannel is the redis pub/sub channel presence changes are announced on,
+	// scoped to the tenant of the device like liveReadingsChannel.
+	presenceChannel = "device_presence"
+
+	// defaultWebhookTimeout applies when [devices] webhook_timeout is not set.
+	defaultWebhookTimeout = 5 * time.Second
+	// webhookWorkers post the presence changes, which wait in a queue of
+	// webhookQueueSize deliveries and are dropped when it is full.
+	webhookWorkers   = 4
+	webhookQueueSize = 1000
+)
+
+// webhookDelivery is a presence change waiting to be posted to a webhook.
+type webhookDelivery struct {
+	url     string
+	payload []byte
+	timeout time.Duration
+}
+
+var (
+	// webhookClient posts the presence webhooks with its own connection pool, so that
+	// slow webhooks do not hold up other outgoing requests.
+	webhookClient = &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	webhookQueue  = make(chan webhookDelivery, webhookQueueSize)
+	startWebhooks sync.Once
+)
+
+// presenceScript records that a device was heard from (online) or went offline and
+// returns 1 when its status changed, so that of all instances only the one making the
+// change announces it. With a cutoff in ARGV[5] the device only goes offline when it is
+// still online and was last seen at or before the cutoff.
+var presenceScript = redis.NewScript(`
+local raw = redis.call('HGET', KEYS[1], ARGV[1])
+local state = {}
+if raw then
+	state = cjson.decode(raw)
+end
+if ARGV[5] ~= '' and (state.status ~= 'online' or (state.last_seen or 0) > tonumber(ARGV[5])) then
+	return 0
+end
+local now = tonumber(ARGV[4])
+if ARGV[2] == 'online' then
+	state.last_seen = now
+end
+local changed = state.status ~= ARGV[2]
+if changed then
+	state.status = ARGV[2]
+	state.reason = ARGV[3]
+	state.since = now
+end
+redis.call('HSET', KEYS[1], ARGV[1], cjson.encode(state))
+if changed then
+	return 1
+end
+return 0
+`)
+
+// presenceState is a device in devicePresenceKey.
+type presenceState struct {
+	Status   string `json:"status"`
+	Reason   string `json:"reason"`
+	Since    int64  `json:"since"`
+	LastSeen int64  `json:"last_seen"`
+}
+
+func decodePresence(value string) (presenceState, bool) {
+	var state presenceState
+	if value == "" || json.Unmarshal([]byte(value), &state) != nil {
+		return state, false
+	}
+	return state, true
+}
+
+func millisTime(millis int64) *time.Time {
+	if millis == 0 {
+		return nil
+	}
+	at := time.UnixMilli(millis).UTC()
+	return &at
+}
+
+// handleDeviceStatus applies the status a device published on the status topic at the
+// time it was received. With the registry rejecting them, devices that are not
+// registered or are disabled are ignored.
+func (service *MQTTPipelineService) handleDeviceStatus(status models.Reading) {
+	ctx := WithTenant(context.Background(), status.Tenant)
+	if _, err := service.admitDevice(ctx, models.Reading{DeviceID: status.DeviceID}); err != nil {
+		utils.Logger.Warn("ignoring status of the device", zap.String("tenant", status.Tenant), zap.String("device_id", status.DeviceID), zap.Error(err))
+		return
+	}
+	if err := service.setPresence(ctx, status.DeviceID, status.Status, PresenceReasonStatus, status.ReceivedAt, time.Time{}); err != nil {
+		utils.Logger.Error("unable to record the status of the device", zap.String("device_id", status.DeviceID), zap.Error(err))
+	}
+}
+
+// heartbeat marks the device of a stored reading online when presence is enabled.
+func (service *MQTTPipelineService) heartbeat(ctx context.Context, deviceID string, at time.Time) {
+	if deviceID == "" || !config.GetConfig().Devices.Presence {
+		return
+	}
+	if err := service.setPresence(ctx, deviceID, DeviceOnline, PresenceReasonReading, at, time.Time{}); err != nil {
+		utils.Logger.Error("unable to record the presence of the device", zap.String("device_id", deviceID), zap.Error(err))
+	}
+}
+
+// setPresence records the status of a device and announces it when it changed. With a
+// non-zero cutoff the device only goes offline if it was not seen after the cutoff.
+func (service *MQTTPipelineService) setPresence(ctx context.Context, deviceID, status, reason string, at, cutoff time.Time) error {
+	cutoffArg := ""
+	if !cutoff.IsZero() {
+		cutoffArg = fmt.Sprint(cutoff.UnixMilli())
+	}
+	changed, err := presenceScript.Run(service.withContext(ctx), []string{scopedKey(ctx, devicePresenceKey)}, deviceID, status, reason, at.UnixMilli(), cutoffArg).Int()
+	if err != nil || changed == 0 {
+		return err
+	}
+	event := models.PresenceEvent{DeviceID: deviceID, Tenant: TenantFromContext(ctx), Status: status, Reason: reason, At: at.UTC()}
+	utils.Logger.Info("device presence changed", zap.String("tenant", event.Tenant), zap.String("device_id", deviceID), zap.String("status", status), zap.String("reason", reason))
+	service.announcePresence(ctx, event)
+	return nil
+}
+
+// announcePresence publishes a presence change to the live stream and posts it to the
+// configured webhooks. Delivery is best effort, failures are only logged.
+func (service *MQTTPipelineService) announcePresence(ctx context.Context, event models.PresenceEvent) {
+	payload, _ := json.Marshal(event)
+	if err := service.withContext(ctx).Publish(scopedKey(ctx, presenceChannel), payload).Err(); err != nil {
+		utils.Logger.Error("unable to publish the presence change", zap.String("device_id", event.DeviceID), zap.Error(err))
+	}
+
+	cfg := config.GetConfig().Devices
+	timeout := defaultWebhookTimeout
+	if cfg.WebhookTimeout > 0 {
+		timeout = time.Duration(cfg.WebhookTimeout) * time.Second
+	}
+	if len(cfg.Webhooks) == 0 {
+		return
+	}
+	startWebhooks.Do(func() {
+		for i := 0; i < webhookWorkers; i++ {
+			go func() {
+				for delivery := range webhookQueue {
+					postWebhook(delivery.url, delivery.payload, delivery.timeout)
+				}
+			}()
+		}
+	})
+	for _, webhook := range cfg.Webhooks {
+		select {
+		case webhookQueue <- webhookDelivery{url: webhook, payload: payload, timeout: timeout}:
+		default:
+			utils.Logger.Error("presence webhook queue is full, dropping the change", zap.String("url", webhook), zap.String("device_id", event.DeviceID))
+		}
+	}
+}
+
+func postWebhook(url string, payload []byte, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		utils.Logger.Error("unable to create the webhook request", zap.String("url", url), zap.Error(err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		utils.Logger.Warn("unable to deliver the presence webhook", zap.String("url", url), zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		utils.Logger.Warn("presence webhook was not accepted", zap.String("url", url), zap.Int("status", resp.StatusCode))
+	}
+}
+
+// StartPresence starts the worker that marks devices offline once nothing arrived from
+// them for [devices] offline_after, until ctx is done. It only sweeps while presence is
+// enabled.
+func StartPresence(ctx context.Context) {
+	service := mqttPipelineClient
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(presenceSweepInterval()):
+			}
+			if !config.GetConfig().Devices.Presence {
+				continue
+			}
+			if err := service.sweepPresence(ctx, time.Now()); err != nil {
+				utils.Logger.Error("unable to sweep the device presence", zap.Error(err))
+			}
+		}
+	}()
+}
+
+// presenceSweepInterval checks a few times per offline_after, so that devices go
+// offline soon after their heartbeat timeout.
+func presenceSweepInterval() time.Duration {
+	interval := offlineAfter() / 4
+	if interval > 30*time.Second {
+		interval = 30 * time.Second
+	}
+	return interval
+}
+
+// sweepPresence marks the online devices of every tenant that were last seen before
+// now - offline_after offline.
+func (service *MQTTPipelineService) sweepPresence(ctx context.Context, now time.Time) error {
+	tenants, err := tenantIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	cutoff := now.Add(-offlineAfter())
+	for _, tenant := range tenants {
+		tenantCtx := WithTenant(ctx, tenant)
+		states, err := service.withContext(tenantCtx).HGetAll(scopedKey(tenantCtx, devicePresenceKey)).Result()
+		if err != nil {
+			return err
+		}
+		for deviceID, value := range states {
+			state, ok := decodePresence(value)
+			if !ok || state.Status != DeviceOnline || state.LastSeen > cutoff.UnixMilli() {
+				continue
+			}
+			if err := service.setPresence(tenantCtx, deviceID, DeviceOffline, PresenceReasonTimeout, now, cutoff); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SubscribePresence streams the presence changes of the devices of the tenant of ctx
+// until ctx is done, after which the channel is closed.
+func SubscribePresence(ctx context.Context) (<-chan models.PresenceEvent, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+
+	events := make(chan models.PresenceEvent, 64)
+	err := mqttPipelineClient.subscribe(ctx, scopedKey(ctx, presenceChannel), func(payload []byte) bool {
+		var event models.PresenceEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			utils.Logger.Error("unable to decode presence change", zap.Error(err))
+			return true
+		}
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}, func() { close(events) })
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// LookupPresence returns whether a device is online. With presence enabled it comes
+// from the status messages, readings and heartbeat timeout of the device, otherwise
+// only from its last stored reading. Devices that are unknown return ErrDeviceNotFound.
+func LookupPresence(ctx context.Context, deviceID string) (*models.DevicePresence, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	var registered *redis.BoolCmd
+	var lastSeen, presence *redis.StringCmd
+	_, err := mqttPipelineClient.withContext(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+		registered = pipe.HExists(scopedKey(ctx, devicesKey), deviceID)
+		lastSeen = pipe.HGet(scopedKey(ctx, deviceLastSeenKey), deviceID)
+		presence = pipe.HGet(scopedKey(ctx, devicePresenceKey), deviceID)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	result := &models.DevicePresence{DeviceID: deviceID}
+	if state, ok := decodePresence(presence.Val()); ok && config.GetConfig().Devices.Presence {
+		result.Status = state.Status
+		result.Reason = state.Reason
+		result.Since = millisTime(state.Since)
+		result.LastSeen = millisTime(state.LastSeen)
+		return result, nil
+	}
+	if !registered.Val() && lastSeen.Val() == "" {
+		return nil, ErrDeviceNotFound
+	}
+	var device models.Device
+	setDeviceStatus(&device, lastSeen.Val(), "")
+	result.Status = device.Status
+	result.LastSeen = device.LastSeen
+	return result, nil
+}
+
+func GetDevicePresence() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		deviceID := ctx.Param(constants.DeviceIDParam)
+		presence, err := LookupPresence(ctx.Request.Context(), deviceID)
+		if err != nil {
+			logger.Error("unable to get the status of the device", zap.String("device", deviceID), zap.Error(err))
+			utils.RespondWithError(ctx, deviceError(err), err.Error())
+			return
+		}
+		ctx.JSON(http.StatusOK, presence)
+	}
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/mqtterror"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+var (
+	asyncPublishes sync.WaitGroup
+	asyncPending   atomic.Int64
+)
+
+// prepareMessage assigns the message ID and builds the MQTT payload. The ID is taken
+// from the request body, then from the idempotency middleware, and generated
+// otherwise; the ingest side uses it to drop duplicates. The device-id header, when
+// sent, identifies the device of the reading.
+func prepareMessage(ctx *gin.Context, speedInfo models.SpeedData) (string, []byte) {
+	if device := ctx.GetHeader(constants.DeviceID); device != "" {
+		speedInfo.DeviceID = device
+	}
+	if speedInfo.MessageID == "" {
+		speedInfo.MessageID = ctx.GetString(constants.MessageIDKey)
+	}
+	if speedInfo.MessageID == "" {
+		speedInfo.MessageID = uuid.New().String()
+	}
+	payload, _ := json.Marshal(speedInfo)
+	return speedInfo.MessageID, payload
+}
+
+// PublishReading publishes a reading outside of an HTTP request, the same way the
+// publish endpoint does, for the tenant of ctx. It returns the message ID and whether
+// the reading was put on the outbound queue instead.
+func PublishReading(ctx context.Context, speedInfo models.SpeedData) (string, bool, error) {
+	if mqttPipelineClient == nil {
+		return "", false, errors.New("service is not initialised")
+	}
+	if err := mqttPipelineClient.checkPublish(ctx); err != nil {
+		return "", false, err
+	}
+	if speedInfo.MessageID == "" {
+		speedInfo.MessageID = uuid.New().String()
+	}
+	payload, _ := json.Marshal(speedInfo)
+	logger := utils.Logger.With(zap.String("message_id", speedInfo.MessageID))
+
+	queued, err := mqttPipelineClient.deliver(ctx, logger, speedInfo.MessageID, utils.TenantTopic(TenantFromContext(ctx)), payload, "")
+	if err != nil {
+		return "", false, errors.New(err.Message)
+	}
+	return speedInfo.MessageID, queued, nil
+}
+
+// isAsyncPublish reports whether the caller asked for the message ID to be returned
+// before the broker has confirmed the publish, using ?async= or Prefer: respond-async,
+// and falls back to the async_publish setting.
+func isAsyncPublish(ctx *gin.Context) bool {
+	if value := ctx.Query(constants.Async); value != "" {
+		async, err := strconv.ParseBool(value)
+		return err == nil && async
+	}
+	if strings.Contains(ctx.GetHeader(constants.Prefer), constants.RespondAsync) {
+		return true
+	}
+	return config.GetConfig().MQTTConfig.AsyncPublish
+}
+
+// publishAsync records the message as queued and delivers it in the background.
+func (service *MQTTPipelineService) publishAsync(ctx *gin.Context, speedInfo models.SpeedData) string {
+	txid := ctx.Request.Header.Get(constants.TransactionID)
+	messageID, payload := prepareMessage(ctx, speedInfo)
+	logger := utils.LoggerFromContext(ctx).With(zap.String("message_id", messageID))
+	service.setMessageStatus(ctx.Request.Context(), messageID, StatusQueued, "")
+
+	tenantCtx := WithSubject(WithTenant(context.Background(), TenantFromContext(ctx.Request.Context())), SubjectFromContext(ctx.Request.Context()))
+	asyncPublishes.Add(1)
+	asyncPending.Add(1)
+	go func() {
+		defer asyncPublishes.Done()
+		defer asyncPending.Add(-1)
+		if _, err := service.deliver(tenantCtx, logger, messageID, utils.TenantTopic(TenantFromContext(tenantCtx)), payload, txid); err != nil {
+			logger.Error("unable to publish the speed data asynchronously", zap.String("error", err.Message))
+		}
+	}()
+	logger.Info("accepted message for asynchronous publishing")
+	return messageID
+}
+
+// WaitForAsyncPublishes waits for background publishes of readings and commands to
+// finish. If ctx expires first it returns how many were still running.
+func WaitForAsyncPublishes(ctx context.Context) int64 {
+	done := make(chan struct{})
+	go func() {
+		asyncPublishes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+		return asyncPending.Load()
+	}
+}
+
+// deliver publishes the payload to topic and records each delivery stage. It falls
+// back to the outbound queue when the broker is unavailable, earlier messages are still
+// queued or the publish is not confirmed in time.
+func (service *MQTTPipelineService) deliver(ctx context.Context, logger *zap.Logger, messageID, topic string, payload []byte, txid string) (bool, *mqtterror.MQTTPipelineError) {
+	cfg := config.GetConfig()
+	if !utils.MQTTClient.IsConnectionOpen() || service.outboundPending(ctx) {
+		return service.queuePublish(ctx, logger, messageID, topic, payload, txid)
+	}
+
+	if err := service.publishMessage(ctx, messageID, topic, payload); err != nil {
+		logger.Error("unable to publish the message on the topic", zap.String("topic", topic), zap.Error(err))
+		if cfg.OutboundQueue.Enabled {
+			return service.queuePublish(ctx, logger, messageID, topic, payload, txid)
+		}
+		service.setMessageStatus(ctx, messageID, StatusFailed, err.Error())
+		return false, &mqtterror.MQTTPipelineError{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Unable to send the speed data on the topic, err %v", err),
+			Trace:   txid,
+		}
+	}
+	logger.Info("succesfully publish the message on the topic", zap.String("topic", topic))
+	return false, nil
+}
+
+// publishMessage sends one message with the configured QoS and waits at most
+// publish_timeout for the broker. With QoS 0 completion only means the message was
+// written to the connection; with QoS 1 and 2 it means the broker acknowledged it.
+func (service *MQTTPipelineService) publishMessage(ctx context.Context, messageID, topic string, payload []byte) error {
+	cfg := config.GetConfig().MQTTConfig
+	qos := byte(cfg.QoS)
+	timeout := time.Duration(cfg.PublishTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	token := utils.MQTTClient.Publish(topic, qos, false, payload)
+	if qos > 0 {
+		service.setMessageStatus(ctx, messageID, StatusPublished, "")
+	}
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("broker did not confirm the publish within %v", timeout)
+	}
+	if token.Error() != nil {
+		return token.Error()
+	}
+
+	if qos > 0 {
+		service.setMessageStatus(ctx, messageID, StatusAcknowledged, "")
+	} else {
+		service.setMessageStatus(ctx, messageID, StatusPublished, "")
+	}
+	return nil
+}
+
+func (service *MQTTPipelineService) queuePublish(ctx context.Context, logger *zap.Logger, messageID, topic string, payload []byte, txid string) (bool, *mqtterror.MQTTPipelineError) {
+	if err := service.enqueueOutbound(ctx, messageID, topic, payload, txid); err != nil {
+		logger.Error("unable to queue the message for delivery", zap.String("error", err.Message))
+		service.setMessageStatus(ctx, messageID, StatusFailed, err.Message)
+		return false, err
+	}
+	service.setMessageStatus(ctx, messageID, StatusQueued, "")
+	logger.Info("broker unavailable, message queued for delivery", zap.String("topic", topic))
+	return true, nil
+}
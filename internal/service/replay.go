@@ -0,0 +1,543 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	ReplayRunning   = "running"
+	ReplayPaused    = "paused"
+	ReplayCompleted = "completed"
+	ReplayCancelled = "cancelled"
+	ReplayFailed    = "failed"
+)
+
+// actions moving a replay job between states
+const (
+	ReplayPause  = "pause"
+	ReplayResume = "resume"
+	ReplayCancel = "cancel"
+	replayFinish = "finish"
+	replayFail   = "fail"
+)
+
+const (
+	// replayBatchSize is the number of readings read from the history at a time.
+	replayBatchSize = 500
+	// replayPollInterval is how often a running replay records its progress and checks
+	// whether it was paused or cancelled.
+	replayPollInterval = 250 * time.Millisecond
+	// replayTTL is how long a replay job is kept after its last update.
+	replayTTL = 7 * 24 * time.Hour
+	// replayDisconnectTimeout is how long a replay waits for the broker to reconnect
+	// before it fails.
+	replayDisconnectTimeout = time.Minute
+	// maxConcurrentReplays bounds the replays one instance runs at a time.
+	maxConcurrentReplays = 4
+)
+
+var (
+	ErrReplayNotFound = errors.New("replay job not found")
+	ErrReplayFinished = errors.New("replay job has already finished")
+	ErrTooManyReplays = fmt.Errorf("at most %d replays run at a time", maxConcurrentReplays)
+	errReplayStopped  = errors.New("replay stopped")
+)
+
+var replaySlots = make(chan struct{}, maxConcurrentReplays)
+
+// replayContext is the parent of the replays run in the background.
+var replayContext = context.Background()
+
+// replayStatusScript applies an action to a replay job when its current status allows
+// it, so that a job cancelled while the replay finishes stays cancelled. It returns
+// whether the action was applied and the resulting status, or an empty status when the
+// job does not exist.
+var replayStatusScript = redis.NewScript(`
+local transitions = {
+	pause = {running = 'paused', paused = 'paused'},
+	resume = {paused = 'running', running = 'running'},
+	cancel = {running = 'cancelled', paused = 'cancelled'},
+	finish = {running = 'completed', paused = 'completed'},
+	fail = {running = 'failed', paused = 'failed'},
+}
+local current = redis.call('HGET', KEYS[1], 'status')
+if not current then
+	return {0, ''}
+end
+local next = transitions[ARGV[1]][current]
+if not next then
+	return {0, current}
+end
+redis.call('HSET', KEYS[1], 'status', next)
+if next ~= 'running' and next ~= 'paused' then
+	redis.call('HSET', KEYS[1], 'finished_at', ARGV[2])
+end
+return {1, next}
+`)
+
+// replayJobKey is a hash of the request, state and counters of a replay job, scoped to
+// the tenant of ctx.
+func replayJobKey(ctx context.Context, jobID string) string {
+	return scopedKey(ctx, "replay:"+jobID)
+}
+
+// StartReplays makes ctx the parent of the replays started through the API; once it
+// is done running replays stop and are marked failed.
+func StartReplays(ctx context.Context) {
+	replayContext = ctx
+}
+
+// replayTopic validates a replay request and returns the topic it publishes to, below
+// the tenant of ctx. Topics the service ingests are refused, replaying onto them would
+// store the readings a second time, and so are the status and command topics of
+// devices, which devices and the service act on.
+func replayTopic(ctx context.Context, req models.ReplayRequest) (string, error) {
+	if req.From.IsZero() || req.To.IsZero() {
+		return "", errors.New("from and to are required")
+	}
+	if !req.From.Before(req.To) {
+		return "", errors.New("from must be before to")
+	}
+	if req.SpeedFactor != nil && (*req.SpeedFactor < 0 || math.IsNaN(*req.SpeedFactor) || math.IsInf(*req.SpeedFactor, 0)) {
+		return "", errors.New("speed_factor must be 0 or a positive number")
+	}
+	if strings.TrimSpace(req.Topic) == "" {
+		return "", errors.New("topic is required")
+	}
+	if strings.ContainsAny(req.Topic, "+#\x00") {
+		return "", fmt.Errorf("topic %q must not contain wildcards", req.Topic)
+	}
+	topic := req.Topic
+	if tenant := TenantFromContext(ctx); tenant != "" {
+		topic = tenant + "/" + topic
+	}
+	if utils.Ingested(topic) {
+		return "", fmt.Errorf("topic %q is ingested by the service, replaying onto it would store the readings again", req.Topic)
+	}
+	if utils.DeviceControlTopic(topic) {
+		return "", fmt.Errorf("topic %q is a status or command topic of devices", req.Topic)
+	}
+	return topic, nil
+}
+
+func (service *MQTTPipelineService) createReplay(ctx context.Context, req models.ReplayRequest, topic string) (*models.ReplayJob, error) {
+	total, err := service.withContext(ctx).ZCount(scopedKey(ctx, speedHistoryKey), strconv.FormatInt(req.From.UnixMilli(), 10), strconv.FormatInt(req.To.UnixMilli(), 10)).Result()
+	if err != nil {
+		return nil, err
+	}
+	job := &models.ReplayJob{
+		ID:          uuid.New().String(),
+		Status:      ReplayRunning,
+		Topic:       topic,
+		From:        req.From.UTC(),
+		To:          req.To.UTC(),
+		SpeedFactor: 1,
+		Total:       total,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if req.SpeedFactor != nil {
+		job.SpeedFactor = *req.SpeedFactor
+	}
+	key := replayJobKey(ctx, job.ID)
+	_, err = service.withContext(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(key, "status", job.Status, "topic", job.Topic, "from", job.From.Format(time.RFC3339Nano), "to", job.To.Format(time.RFC3339Nano),
+			"speed_factor", job.SpeedFactor, "total", job.Total, "created_at", job.CreatedAt.Format(time.RFC3339Nano))
+		pipe.Expire(key, replayTTL)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// applyReplayAction moves a replay job on, returning whether the action was applied and
+// the status of the job after it.
+func (service *MQTTPipelineService) applyReplayAction(ctx context.Context, jobID, action string) (bool, string, error) {
+	result, err := replayStatusScript.Run(service.withContext(ctx), []string{replayJobKey(ctx, jobID)}, action, time.Now().UTC().Format(time.RFC3339Nano)).Result()
+	if err != nil {
+		return false, "", err
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, "", fmt.Errorf("unexpected result %v of the replay status script", result)
+	}
+	applied, _ := values[0].(int64)
+	status, _ := values[1].(string)
+	return applied == 1, status, nil
+}
+
+// publishReplayed publishes a replayed reading with the configured QoS, waiting at most
+// publish_timeout for the broker. Unlike publishes through the API replayed readings
+// have no message status and are not kept in the outbound queue.
+func publishReplayed(topic string, payload []byte) error {
+	cfg := config.GetConfig().MQTTConfig
+	timeout := time.Duration(cfg.PublishTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	token := utils.MQTTClient.Publish(topic, byte(cfg.QoS), false, payload)
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("broker did not confirm the publish within %v", timeout)
+	}
+	return token.Error()
+}
+
+// runReplay publishes the readings of the job's range onto its topic, waiting between
+// readings to keep their timing divided by the speed factor. It records its progress
+// and follows pause and cancel requests every replayPollInterval, and waits up to
+// replayDisconnectTimeout for the broker while it is disconnected.
+func (service *MQTTPipelineService) runReplay(ctx context.Context, job *models.ReplayJob) error {
+	logger := utils.Logger.With(zap.String("replay", job.ID), zap.String("topic", job.Topic))
+	key := replayJobKey(ctx, job.ID)
+	if err := service.withContext(ctx).HSet(key, "started_at", time.Now().UTC().Format(time.RFC3339Nano)).Err(); err != nil {
+		return err
+	}
+
+	var published int64
+	var position time.Time
+	var lastPoll time.Time
+	// the reading at baseAt was replayed at baseWall, later readings are due relative to
+	// it; both are reset after a pause
+	var baseWall, baseAt time.Time
+
+	// record stores the progress and returns the status of the job.
+	record := func(ctx context.Context) (string, error) {
+		lastPoll = time.Now()
+		fields := []interface{}{"published", published, "updated_at", lastPoll.UTC().Format(time.RFC3339Nano)}
+		if !position.IsZero() {
+			fields = append(fields, "position", position.Format(time.RFC3339Nano))
+		}
+		var status *redis.StringCmd
+		_, err := service.withContext(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(key, fields...)
+			pipe.Expire(key, replayTTL)
+			status = pipe.HGet(key, "status")
+			return nil
+		})
+		return status.Val(), err
+	}
+
+	// control records the progress every replayPollInterval and waits while the job is
+	// paused. It returns errReplayStopped once the job is cancelled.
+	control := func() error {
+		if time.Since(lastPoll) < replayPollInterval {
+			return nil
+		}
+		paused := false
+		for {
+			status, err := record(ctx)
+			if err != nil {
+				return err
+			}
+			switch status {
+			case ReplayRunning:
+				if paused {
+					baseWall = time.Time{}
+				}
+				return nil
+			case ReplayPaused:
+				paused = true
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(replayPollInterval):
+				}
+			default:
+				return errReplayStopped
+			}
+		}
+	}
+
+	// wait returns once the reading at is due.
+	wait := func(at time.Time) error {
+		for {
+			if err := control(); err != nil {
+				return err
+			}
+			if job.SpeedFactor == 0 {
+				return nil
+			}
+			if baseWall.IsZero() {
+				baseWall, baseAt = time.Now(), at
+				return nil
+			}
+			due := baseWall.Add(time.Duration(float64(at.Sub(baseAt)) / job.SpeedFactor))
+			remaining := time.Until(due)
+			if remaining <= 0 {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(min(remaining, replayPollInterval)):
+			}
+		}
+	}
+
+	// connected returns once the broker is connected, or fails the replay when it stays
+	// disconnected for replayDisconnectTimeout, not counting the time the job is paused.
+	// The reading at is then replayed at once and later ones keep their timing to it.
+	connected := func(at time.Time) error {
+		if utils.MQTTClient.IsConnectionOpen() {
+			return nil
+		}
+		logger.Warn("broker disconnected, waiting to continue the replay")
+		for waited := time.Duration(0); !utils.MQTTClient.IsConnectionOpen(); waited += replayPollInterval {
+			if waited >= replayDisconnectTimeout {
+				return fmt.Errorf("broker disconnected for more than %v", replayDisconnectTimeout)
+			}
+			if err := control(); err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(replayPollInterval):
+			}
+		}
+		if job.SpeedFactor != 0 {
+			baseWall, baseAt = time.Now(), at
+		}
+		return nil
+	}
+
+	err := service.historyBatches(ctx, job.From, job.To, replayBatchSize, func(entries []models.HistoryEntry) error {
+		for _, entry := range entries {
+			if err := wait(entry.Timestamp); err != nil {
+				return err
+			}
+			if err := connected(entry.Timestamp); err != nil {
+				return err
+			}
+			speed := entry.Speed
+			payload, _ := json.Marshal(models.SpeedData{Speed: &speed, MessageID: uuid.New().String(), DeviceID: entry.DeviceID})
+			if err := publishReplayed(job.Topic, payload); err != nil {
+				return fmt.Errorf("unable to publish a replayed reading, err %v", err)
+			}
+			published++
+			position = entry.Timestamp
+		}
+		return nil
+	})
+	// the final state is recorded even when ctx is done
+	ctx = context.WithoutCancel(ctx)
+	if _, recordErr := record(ctx); recordErr != nil {
+		logger.Error("unable to record the replay progress", zap.Error(recordErr))
+	}
+	if errors.Is(err, errReplayStopped) {
+		logger.Info("replay cancelled", zap.Int64("published", published))
+		return nil
+	}
+	action := replayFinish
+	if err != nil {
+		action = replayFail
+		if hsetErr := service.withContext(ctx).HSet(key, "error", err.Error()).Err(); hsetErr != nil {
+			logger.Error("unable to record the replay error", zap.Error(hsetErr))
+		}
+	}
+	if _, _, statusErr := service.applyReplayAction(ctx, job.ID, action); statusErr != nil {
+		logger.Error("unable to record the replay status", zap.Error(statusErr))
+	}
+	logger.Info("replay finished", zap.Int64("published", published), zap.Error(err))
+	return err
+}
+
+// Replay creates a replay job and runs it in the foreground, used by the admin tool,
+// and returns the finished job.
+func Replay(ctx context.Context, req models.ReplayRequest) (*models.ReplayJob, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	topic, err := replayTopic(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	job, err := mqttPipelineClient.createReplay(ctx, req, topic)
+	if err != nil {
+		return nil, err
+	}
+	err = mqttPipelineClient.runReplay(ctx, job)
+	if finished, lookupErr := mqttPipelineClient.lookupReplay(context.WithoutCancel(ctx), job.ID); lookupErr == nil && finished != nil {
+		job = finished
+	}
+	return job, err
+}
+
+// LookupReplay returns a replay job, or nil when it does not exist or has expired.
+func LookupReplay(ctx context.Context, jobID string) (*models.ReplayJob, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.lookupReplay(ctx, jobID)
+}
+
+func (service *MQTTPipelineService) lookupReplay(ctx context.Context, jobID string) (*models.ReplayJob, error) {
+	fields, err := service.withContext(ctx).HGetAll(replayJobKey(ctx, jobID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	count := func(name string) int64 {
+		value, _ := strconv.ParseInt(fields[name], 10, 64)
+		return value
+	}
+	job := &models.ReplayJob{
+		ID:         jobID,
+		Status:     fields["status"],
+		Topic:      fields["topic"],
+		Total:      count("total"),
+		Published:  count("published"),
+		Position:   parseStatusTime(fields["position"]),
+		Error:      fields["error"],
+		StartedAt:  parseStatusTime(fields["started_at"]),
+		UpdatedAt:  parseStatusTime(fields["updated_at"]),
+		FinishedAt: parseStatusTime(fields["finished_at"]),
+	}
+	job.SpeedFactor, _ = strconv.ParseFloat(fields["speed_factor"], 64)
+	for name, field := range map[string]*time.Time{"from": &job.From, "to": &job.To, "created_at": &job.CreatedAt} {
+		if parsed := parseStatusTime(fields[name]); parsed != nil {
+			*field = *parsed
+		}
+	}
+	switch {
+	case job.Status == ReplayCompleted:
+		job.Progress = 1
+	case job.Total > 0:
+		job.Progress = float64(job.Published) / float64(job.Total)
+	}
+	return job, nil
+}
+
+// ControlReplay pauses, resumes or cancels a replay job, wherever it runs, and returns
+// the job. It returns ErrReplayNotFound and ErrReplayFinished when the job cannot be.
+func ControlReplay(ctx context.Context, jobID, action string) (*models.ReplayJob, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.controlReplay(ctx, jobID, action)
+}
+
+func (service *MQTTPipelineService) controlReplay(ctx context.Context, jobID, action string) (*models.ReplayJob, error) {
+	applied, status, err := service.applyReplayAction(ctx, jobID, action)
+	if err != nil {
+		return nil, err
+	}
+	if status == "" {
+		return nil, ErrReplayNotFound
+	}
+	if !applied {
+		return nil, ErrReplayFinished
+	}
+	job, err := service.lookupReplay(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil {
+		return nil, ErrReplayNotFound
+	}
+	return job, nil
+}
+
+// StartReplay starts replaying stored readings onto the topic of the request in the
+// background and responds with the job to follow.
+func StartReplay() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		var req models.ReplayRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			utils.RespondWithError(ctx, http.StatusBadRequest, fmt.Sprintf("%v, err %v", constants.InvalidBody, err))
+			return
+		}
+		topic, err := replayTopic(ctx.Request.Context(), req)
+		if err != nil {
+			utils.RespondWithError(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+		select {
+		case replaySlots <- struct{}{}:
+		default:
+			utils.RespondWithError(ctx, http.StatusTooManyRequests, ErrTooManyReplays.Error())
+			return
+		}
+
+		job, err := mqttPipelineClient.createReplay(ctx.Request.Context(), req, topic)
+		if err != nil {
+			<-replaySlots
+			logger.Error("unable to create the replay job", zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to create the replay job in redis, err %v", err))
+			return
+		}
+		logger.Info("started replay", zap.String("replay", job.ID), zap.String("topic", job.Topic), zap.Int64("total", job.Total), zap.Float64("speed_factor", job.SpeedFactor))
+		tenant := TenantFromContext(ctx.Request.Context())
+		go func() {
+			defer func() { <-replaySlots }()
+			if err := mqttPipelineClient.runReplay(WithTenant(replayContext, tenant), job); err != nil {
+				utils.Logger.Error("replay failed", zap.String("replay", job.ID), zap.Error(err))
+			}
+		}()
+
+		ctx.Header("Location", constants.ForwardSlash+strings.Join([]string{constants.Version, constants.Replay, job.ID}, constants.ForwardSlash))
+		ctx.JSON(http.StatusAccepted, job)
+	}
+}
+
+// GetReplay returns the status and progress of the replay job in the path.
+func GetReplay() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		jobID := ctx.Param(constants.ReplayIDParam)
+		job, err := mqttPipelineClient.lookupReplay(ctx.Request.Context(), jobID)
+		if err != nil {
+			logger.Error("unable to get the replay job", zap.String("replay", jobID), zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to fetch the replay job from redis, err %v", err))
+			return
+		}
+		if job == nil {
+			utils.RespondWithError(ctx, http.StatusNotFound, ErrReplayNotFound.Error())
+			return
+		}
+		ctx.JSON(http.StatusOK, job)
+	}
+}
+
+// UpdateReplay applies action, pause, resume or cancel, to the replay job in the path.
+func UpdateReplay(action string) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		jobID := ctx.Param(constants.ReplayIDParam)
+		job, err := mqttPipelineClient.controlReplay(ctx.Request.Context(), jobID, action)
+		switch {
+		case errors.Is(err, ErrReplayNotFound):
+			utils.RespondWithError(ctx, http.StatusNotFound, err.Error())
+		case errors.Is(err, ErrReplayFinished):
+			utils.RespondWithError(ctx, http.StatusConflict, err.Error())
+		case err != nil:
+			logger.Error("unable to update the replay job", zap.String("replay", jobID), zap.String("action", action), zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to update the replay job in redis, err %v", err))
+		default:
+			logger.Info("updated replay", zap.String("replay", jobID), zap.String("status", job.Status))
+			ctx.JSON(http.StatusOK, job)
+		}
+	}
+}
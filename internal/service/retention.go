@@ -0,0 +1,545 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/routing"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	ResolutionMinute = "1m"
+	ResolutionHour   = "1h"
+
+	// DefaultPolicy is the name of the retention ages used when no policy matches.
+	DefaultPolicy = "default"
+
+	retentionLockKey = "retention:lock"
+	// retentionLockTTL is how long the compaction lock outlives an instance that stops
+	// renewing it.
+	retentionLockTTL = time.Minute
+	// watermarksKey is a hash of the time, in milliseconds, up to which every rollup
+	// key has been computed. Rollups only cover complete buckets before it.
+	watermarksKey = "retention:watermarks"
+	// rollupDelay leaves time for readings stored by instances whose clock is behind
+	// before a minute is rolled up.
+	rollupDelay = time.Minute
+	// compactBatchSize is how many stored entries are read at a time while rolling up.
+	compactBatchSize = 1000
+)
+
+var ErrRetentionDisabled = errors.New("retention is disabled")
+
+// mergeRollupScript stores ARGV[3] as the rollup scored ARGV[1] in KEYS[1] if ARGV[2]
+// is still the rollup stored there, ARGV[2] being empty when there was none. It returns
+// 1 when it was stored and 0 when the rollup changed in the meantime.
+var mergeRollupScript = redis.NewScript(`
+local current = redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[1], ARGV[1])
+if (current[1] or '') ~= ARGV[2] then
+	return 0
+end
+if ARGV[2] ~= '' then
+	redis.call('ZREM', KEYS[1], ARGV[2])
+end
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[3])
+return 1
+`)
+
+// series is the stored data of one metric of one tenant.
+type series struct {
+	tenant string
+	metric string
+}
+
+// seriesKey is the key of the raw readings of a metric. Readings stored as speed are
+// kept in the speed history.
+func seriesKey(ctx context.Context, metric string) string {
+	if metric == routing.MetricSpeed {
+		return scopedKey(ctx, speedHistoryKey)
+	}
+	return metricHistoryKey(ctx, metric)
+}
+
+// rollupKey is a sorted set of the rollups of a metric at a resolution scored by the
+// start of their bucket in milliseconds.
+func rollupKey(ctx context.Context, metric, resolution string) string {
+	return seriesKey(ctx, metric) + ":" + resolution
+}
+
+// retentionPolicy returns the first policy matching the series, or the default ages.
+func retentionPolicy(s series) config.RetentionPolicy {
+	cfg := config.GetConfig().Retention
+	for _, policy := range cfg.Policies {
+		if (policy.Metric == "" || policy.Metric == s.metric) && (policy.Tenant == "" || policy.Tenant == s.tenant) {
+			return policy
+		}
+	}
+	return config.RetentionPolicy{Name: DefaultPolicy, Raw: cfg.Raw, Minute: cfg.Minute, Hour: cfg.Hour}
+}
+
+// allSeries lists the series that may hold data: speed and every metric routed to the
+// metrics storage, without a tenant and for every tenant.
+func (service *MQTTPipelineService) allSeries(ctx context.Context) ([]series, error) {
+	metrics := []string{routing.MetricSpeed}
+	seen := map[string]bool{routing.MetricSpeed: true}
+	for _, route := range config.GetConfig().Routing.Routes {
+		if route.Storage != routing.StorageSpeed && !seen[route.Metric] {
+			seen[route.Metric] = true
+			metrics = append(metrics, route.Metric)
+		}
+	}
+
+	tenants, err := tenantIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var all []series
+	for _, tenant := range tenants {
+		for _, metric := range metrics {
+			all = append(all, series{tenant: tenant, metric: metric})
+		}
+	}
+	return all, nil
+}
+
+// StartCompaction rolls up and expires stored readings every [retention] interval
+// while retention is enabled. It stops when ctx is done.
+func StartCompaction(ctx context.Context) {
+	interval := time.Duration(config.GetConfig().Retention.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if !config.GetConfig().Retention.Enabled {
+				continue
+			}
+			if err := mqttPipelineClient.compact(ctx, time.Now()); err != nil {
+				utils.Logger.Error("unable to compact the stored readings", zap.Error(err))
+			}
+		}
+	}()
+}
+
+// Compact runs one compaction pass now, used by the admin tool.
+func Compact(ctx context.Context) error {
+	if mqttPipelineClient == nil {
+		return errors.New("service is not initialised")
+	}
+	if !config.GetConfig().Retention.Enabled {
+		return ErrRetentionDisabled
+	}
+	return mqttPipelineClient.compact(ctx, time.Now())
+}
+
+func (service *MQTTPipelineService) compact(ctx context.Context, now time.Time) error {
+	// Only one instance compacts at a time, the others skip the pass.
+	lock, err := service.acquireLock(ctx, retentionLockKey, retentionLockTTL)
+	if err != nil || lock == nil {
+		return err
+	}
+	defer service.releaseLock(lock)
+	ctx, stop := service.keepLock(ctx, lock, retentionLockTTL)
+	defer stop()
+
+	all, err := service.allSeries(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range all {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := service.compactSeries(WithTenant(ctx, s.tenant), s, now); err != nil {
+			utils.Logger.Error("unable to compact series", zap.String("tenant", s.tenant), zap.String("metric", s.metric), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// compactSeries rolls raw readings up per minute and minutes per hour, then deletes
+// what is older than the policy allows. Raw readings and minutes are only deleted once
+// they have been rolled up.
+func (service *MQTTPipelineService) compactSeries(ctx context.Context, s series, now time.Time) error {
+	policy := retentionPolicy(s)
+	rawKey := seriesKey(ctx, s.metric)
+	minuteKey := rollupKey(ctx, s.metric, ResolutionMinute)
+	hourKey := rollupKey(ctx, s.metric, ResolutionHour)
+
+	minutesUntil, err := service.rollUp(ctx, rawKey, minuteKey, time.Minute, now.Add(-rollupDelay).Truncate(time.Minute))
+	if err != nil {
+		return err
+	}
+	hoursUntil, err := service.rollUp(ctx, minuteKey, hourKey, time.Hour, minutesUntil.Truncate(time.Hour))
+	if err != nil {
+		return err
+	}
+
+	expired := int64(0)
+	for _, tier := range []struct {
+		key        string
+		retention  int
+		rolledUpTo time.Time
+	}{
+		{rawKey, policy.Raw, minutesUntil},
+		{minuteKey, policy.Minute, hoursUntil},
+		{hourKey, policy.Hour, time.Time{}},
+	} {
+		if tier.retention <= 0 {
+			continue
+		}
+		cutoff := now.Add(-time.Duration(tier.retention) * time.Second)
+		if !tier.rolledUpTo.IsZero() && tier.rolledUpTo.Before(cutoff) {
+			cutoff = tier.rolledUpTo
+		}
+		removed, err := service.withContext(ctx).ZRemRangeByScore(tier.key, "-inf", "("+strconv.FormatInt(cutoff.UnixMilli(), 10)).Result()
+		if err != nil {
+			return err
+		}
+		expired += removed
+	}
+	if expired > 0 {
+		utils.Logger.Info("expired stored readings", zap.String("tenant", s.tenant), zap.String("metric", s.metric), zap.String("policy", policy.Name), zap.Int64("removed", expired))
+	}
+	return nil
+}
+
+// rollupSource decodes entries of the raw readings, with a speed or a value, and of
+// rollups, which have a count.
+type rollupSource struct {
+	Speed *float64 `json:"speed"`
+	Value *float64 `json:"value"`
+	Count int64    `json:"count"`
+	Min   float64  `json:"min"`
+	Max   float64  `json:"max"`
+	Sum   float64  `json:"sum"`
+}
+
+func (r rollupSource) rollup() models.Rollup {
+	if r.Count > 0 {
+		return models.Rollup{Count: r.Count, Min: r.Min, Max: r.Max, Sum: r.Sum}
+	}
+	value := 0.0
+	if r.Speed != nil {
+		value = *r.Speed
+	} else if r.Value != nil {
+		value = *r.Value
+	}
+	return models.Rollup{Count: 1, Min: value, Max: value, Sum: value}
+}
+
+func mergeRollup(into *models.Rollup, other models.Rollup) {
+	if into.Count == 0 || other.Min < into.Min {
+		into.Min = other.Min
+	}
+	if into.Count == 0 || other.Max > into.Max {
+		into.Max = other.Max
+	}
+	into.Count += other.Count
+	into.Sum += other.Sum
+}
+
+// rollUp summarises the entries of sourceKey into buckets of size in targetKey, from
+// the watermark of targetKey up to end, and returns the new watermark. Entries are read
+// compactBatchSize at a time; the buckets completed by a batch are written together
+// with the watermark moving past them, so that an interrupted pass resumes where it
+// stopped and only the bucket still open is held across batches.
+func (service *MQTTPipelineService) rollUp(ctx context.Context, sourceKey, targetKey string, size time.Duration, end time.Time) (time.Time, error) {
+	start, err := service.watermark(ctx, targetKey)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if start.IsZero() {
+		oldest, err := service.withContext(ctx).ZRangeWithScores(sourceKey, 0, 0).Result()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if len(oldest) == 0 {
+			// nothing stored yet, start at the first complete bucket after now
+			return end, service.withContext(ctx).HSet(watermarksKey, targetKey, end.UnixMilli()).Err()
+		}
+		start = time.UnixMilli(int64(oldest[0].Score)).Truncate(size)
+	}
+	if !start.Before(end) {
+		return start, nil
+	}
+
+	query := &redis.ZRangeBy{
+		Min:   strconv.FormatInt(start.UnixMilli(), 10),
+		Max:   "(" + strconv.FormatInt(end.UnixMilli(), 10),
+		Count: compactBatchSize,
+	}
+	// Entries can share a score, so the next batch starts at the last score read,
+	// skipping the entries with that score already read.
+	var lastScore float64
+	var sameScore int64
+	var open *models.Rollup
+	for {
+		if ctx.Err() != nil {
+			return time.Time{}, ctx.Err()
+		}
+		entries, err := service.withContext(ctx).ZRangeByScoreWithScores(sourceKey, query).Result()
+		if err != nil {
+			return time.Time{}, err
+		}
+		var complete []*models.Rollup
+		for _, entry := range entries {
+			if entry.Score == lastScore {
+				sameScore++
+			} else {
+				lastScore, sameScore = entry.Score, 1
+			}
+			member, _ := entry.Member.(string)
+			var source rollupSource
+			if err := json.Unmarshal([]byte(member), &source); err != nil {
+				utils.Logger.Warn("skipping malformed entry while rolling up", zap.String("key", sourceKey), zap.Error(err))
+				continue
+			}
+			bucket := time.UnixMilli(int64(entry.Score)).Truncate(size).UTC()
+			if open == nil || !open.Start.Equal(bucket) {
+				if open != nil {
+					complete = append(complete, open)
+				}
+				open = &models.Rollup{Start: bucket}
+			}
+			mergeRollup(open, source.rollup())
+		}
+
+		if len(entries) < compactBatchSize {
+			if open != nil {
+				complete = append(complete, open)
+			}
+			return end, service.writeRollups(ctx, targetKey, complete, end)
+		}
+		// later entries may still fall in the open bucket
+		if len(complete) > 0 {
+			if err := service.writeRollups(ctx, targetKey, complete, open.Start); err != nil {
+				return time.Time{}, err
+			}
+		}
+		query.Min = strconv.FormatFloat(lastScore, 'f', -1, 64)
+		query.Offset = sameScore
+	}
+}
+
+// writeRollups stores completed rollups in targetKey and moves its watermark to
+// rolledUpTo in one transaction.
+func (service *MQTTPipelineService) writeRollups(ctx context.Context, targetKey string, rollups []*models.Rollup, rolledUpTo time.Time) error {
+	_, err := service.withContext(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, rollup := range rollups {
+			rollup.Avg = rollup.Sum / float64(rollup.Count)
+			member, _ := json.Marshal(rollup)
+			pipe.ZAdd(targetKey, &redis.Z{Score: float64(rollup.Start.UnixMilli()), Member: member})
+		}
+		pipe.HSet(watermarksKey, targetKey, rolledUpTo.UnixMilli())
+		return nil
+	})
+	return err
+}
+
+// bucketRollups summarises history entries into buckets of size, in the order their
+// buckets first appear.
+func bucketRollups(entries []models.HistoryEntry, size time.Duration) []*models.Rollup {
+	var rollups []*models.Rollup
+	byStart := map[int64]*models.Rollup{}
+	for _, entry := range entries {
+		start := entry.Timestamp.Truncate(size).UTC()
+		rollup, ok := byStart[start.UnixMilli()]
+		if !ok {
+			rollup = &models.Rollup{Start: start}
+			byStart[start.UnixMilli()] = rollup
+			rollups = append(rollups, rollup)
+		}
+		speed := float64(entry.Speed)
+		mergeRollup(rollup, models.Rollup{Count: 1, Min: speed, Max: speed, Sum: speed})
+	}
+	return rollups
+}
+
+// mergeRollups adds rollups to those already stored in targetKey for the same buckets,
+// for readings stored after their bucket was rolled up. A rollup changed by someone
+// else while it was merged is read and merged again.
+func (service *MQTTPipelineService) mergeRollups(ctx context.Context, targetKey string, rollups []*models.Rollup) error {
+	for _, rollup := range rollups {
+		score := strconv.FormatInt(rollup.Start.UnixMilli(), 10)
+		for {
+			current, err := service.withContext(ctx).ZRangeByScore(targetKey, &redis.ZRangeBy{Min: score, Max: score}).Result()
+			if err != nil {
+				return err
+			}
+			merged := *rollup
+			stored := ""
+			if len(current) > 0 {
+				stored = current[0]
+				if err := json.Unmarshal([]byte(stored), &merged); err != nil {
+					return err
+				}
+				mergeRollup(&merged, *rollup)
+			}
+			merged.Avg = merged.Sum / float64(merged.Count)
+			member, _ := json.Marshal(merged)
+			replaced, err := mergeRollupScript.Run(service.withContext(ctx), []string{targetKey}, score, stored, member).Int()
+			if err != nil {
+				return err
+			}
+			if replaced == 1 {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (service *MQTTPipelineService) watermark(ctx context.Context, key string) (time.Time, error) {
+	millis, err := service.withContext(ctx).HGet(watermarksKey, key).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(millis), nil
+}
+
+// QueryRollups returns up to limit rollups of a metric at a resolution whose bucket
+// starts between from and to, oldest first, with the same open ends as QueryHistory.
+func QueryRollups(ctx context.Context, metric, resolution string, from, to time.Time, limit int64) ([]models.Rollup, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.queryRollups(ctx, metric, resolution, from, to, limit)
+}
+
+func (service *MQTTPipelineService) queryRollups(ctx context.Context, metric, resolution string, from, to time.Time, limit int64) ([]models.Rollup, error) {
+	if resolution != ResolutionMinute && resolution != ResolutionHour {
+		return nil, fmt.Errorf("resolution must be %v or %v", ResolutionMinute, ResolutionHour)
+	}
+	members, err := service.withContext(ctx).ZRangeByScore(rollupKey(ctx, metric, resolution), scoreRange(from, to, limit)).Result()
+	if err != nil {
+		return nil, err
+	}
+	rollups := make([]models.Rollup, 0, len(members))
+	for _, member := range members {
+		var rollup models.Rollup
+		if err := json.Unmarshal([]byte(member), &rollup); err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, rollup)
+	}
+	return rollups, nil
+}
+
+// StorageUsage returns how much is stored under every retention policy, listing the
+// series that hold data.
+func StorageUsage(ctx context.Context) ([]models.PolicyUsage, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.storageUsage(ctx)
+}
+
+func (service *MQTTPipelineService) storageUsage(ctx context.Context) ([]models.PolicyUsage, error) {
+	cfg := config.GetConfig().Retention
+	usage := []models.PolicyUsage{{Name: DefaultPolicy, RawRetention: cfg.Raw, MinuteRetention: cfg.Minute, HourRetention: cfg.Hour, Series: []models.SeriesUsage{}}}
+	byName := map[string]int{DefaultPolicy: 0}
+	for _, policy := range cfg.Policies {
+		if _, ok := byName[policy.Name]; ok {
+			continue
+		}
+		byName[policy.Name] = len(usage)
+		usage = append(usage, models.PolicyUsage{Name: policy.Name, RawRetention: policy.Raw, MinuteRetention: policy.Minute, HourRetention: policy.Hour, Series: []models.SeriesUsage{}})
+	}
+
+	all, err := service.allSeries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range all {
+		seriesCtx := WithTenant(ctx, s.tenant)
+		seriesUsage := models.SeriesUsage{Tenant: s.tenant, Metric: s.metric}
+		for key, tier := range map[string]*models.TierUsage{
+			seriesKey(seriesCtx, s.metric):                   &seriesUsage.Raw,
+			rollupKey(seriesCtx, s.metric, ResolutionMinute): &seriesUsage.Minute,
+			rollupKey(seriesCtx, s.metric, ResolutionHour):   &seriesUsage.Hour,
+		} {
+			if err := service.tierUsage(seriesCtx, key, tier); err != nil {
+				return nil, err
+			}
+		}
+		if seriesUsage.Raw.Count+seriesUsage.Minute.Count+seriesUsage.Hour.Count == 0 {
+			continue
+		}
+		compactedUntil, err := service.watermark(seriesCtx, rollupKey(seriesCtx, s.metric, ResolutionMinute))
+		if err != nil {
+			return nil, err
+		}
+		if !compactedUntil.IsZero() {
+			compactedUntil = compactedUntil.UTC()
+			seriesUsage.CompactedUntil = &compactedUntil
+		}
+
+		policy := &usage[byName[retentionPolicy(s).Name]]
+		policy.Readings += seriesUsage.Raw.Count
+		policy.Rollups += seriesUsage.Minute.Count + seriesUsage.Hour.Count
+		policy.Series = append(policy.Series, seriesUsage)
+	}
+	return usage, nil
+}
+
+func (service *MQTTPipelineService) tierUsage(ctx context.Context, key string, tier *models.TierUsage) error {
+	var count *redis.IntCmd
+	var oldest *redis.ZSliceCmd
+	_, err := service.withContext(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+		count = pipe.ZCard(key)
+		oldest = pipe.ZRangeWithScores(key, 0, 0)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tier.Count = count.Val()
+	if entries := oldest.Val(); len(entries) > 0 {
+		at := time.UnixMilli(int64(entries[0].Score)).UTC()
+		tier.Oldest = &at
+	}
+	return nil
+}
+
+// GetStorageUsage returns the storage usage per retention policy.
+func GetStorageUsage() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		usage, err := mqttPipelineClient.storageUsage(ctx.Request.Context())
+		if err != nil {
+			logger.Error("unable to get the storage usage", zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to get the storage usage, err %v", err))
+			return
+		}
+		ctx.JSON(http.StatusOK, map[string]interface{}{
+			"enabled":  config.GetConfig().Retention.Enabled,
+			"policies": usage,
+		})
+	}
+}
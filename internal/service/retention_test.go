@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"gotest.tools/assert"
+)
+
+func TestCompaction(t *testing.T) {
+	redisServer := newTestService(t, config.GlobalConfig{Retention: config.Retention{Enabled: true}})
+	ctx := context.Background()
+	client := mqttPipelineClient.redisClient
+
+	// a reading every second for three hours with the second of the minute as speed,
+	// more readings than a batch sharing one millisecond, and two readings too recent
+	// to be rolled up
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start.Add(3*time.Hour + 30*time.Second)
+	stored := 0
+	_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+		add := func(at time.Time, speed int) {
+			member, _ := json.Marshal(models.HistoryEntry{Speed: speed, MessageID: fmt.Sprintf("m%d", stored), Timestamp: at})
+			pipe.ZAdd(speedHistoryKey, &redis.Z{Score: float64(at.UnixMilli()), Member: member})
+			stored++
+		}
+		for second := 0; second < 3*3600; second++ {
+			add(start.Add(time.Duration(second)*time.Second), second%60)
+		}
+		for i := 0; i < compactBatchSize+200; i++ {
+			add(start.Add(30*time.Minute), 100)
+		}
+		add(start.Add(2*time.Hour+59*time.Minute+30*time.Second), 7)
+		add(start.Add(3*time.Hour+10*time.Second), 7)
+		return nil
+	})
+	assert.NilError(t, err)
+
+	rollups := func(resolution string) []models.Rollup {
+		rollups, err := QueryRollups(ctx, "speed", resolution, time.Time{}, time.Time{}, 0)
+		assert.NilError(t, err)
+		return rollups
+	}
+
+	// Case 1 : complete minutes before the rollup delay and complete hours are rolled up
+	assert.NilError(t, mqttPipelineClient.compact(ctx, now))
+	minutes := rollups(ResolutionMinute)
+	assert.Equal(t, 179, len(minutes))
+	assert.Equal(t, models.Rollup{Start: start, Count: 60, Min: 0, Max: 59, Sum: 1770, Avg: 29.5}, minutes[0])
+	assert.Equal(t, models.Rollup{Start: start.Add(30 * time.Minute), Count: 1260, Min: 0, Max: 100, Sum: 121770, Avg: 121770.0 / 1260}, minutes[30])
+	assert.Equal(t, start.Add(2*time.Hour+58*time.Minute), minutes[178].Start)
+	hours := rollups(ResolutionHour)
+	assert.Equal(t, 2, len(hours))
+	assert.Equal(t, models.Rollup{Start: start, Count: 4800, Min: 0, Max: 100, Sum: 60*1770 + 120000, Avg: float64(60*1770+120000) / 4800}, hours[0])
+	assert.Equal(t, int64(3600), hours[1].Count)
+
+	minutesUntil, err := mqttPipelineClient.watermark(ctx, rollupKey(ctx, "speed", ResolutionMinute))
+	assert.NilError(t, err)
+	assert.Equal(t, start.Add(2*time.Hour+59*time.Minute).UnixMilli(), minutesUntil.UnixMilli())
+	hoursUntil, err := mqttPipelineClient.watermark(ctx, rollupKey(ctx, "speed", ResolutionHour))
+	assert.NilError(t, err)
+	assert.Equal(t, start.Add(2*time.Hour).UnixMilli(), hoursUntil.UnixMilli())
+
+	// Case 2 : a second pass over the same time adds nothing
+	assert.NilError(t, mqttPipelineClient.compact(ctx, now))
+	assert.Equal(t, 179, len(rollups(ResolutionMinute)))
+	assert.Equal(t, 2, len(rollups(ResolutionHour)))
+
+	// Case 3 : entries are only expired once rolled up, the cutoff being the earlier of
+	// the retention and the watermark of the next tier
+	config.SetConfig(config.GlobalConfig{Retention: config.Retention{Enabled: true, Raw: 60, Minute: 1800, Hour: 7260}})
+	assert.NilError(t, mqttPipelineClient.compact(ctx, now))
+	// raw readings from the minute watermark on, though the retention is 30s later
+	raw, err := client.ZCard(speedHistoryKey).Result()
+	assert.NilError(t, err)
+	assert.Equal(t, int64(62), raw)
+	// minute rollups from the hour watermark on, though the retention is 30m later
+	minutes = rollups(ResolutionMinute)
+	assert.Equal(t, 59, len(minutes))
+	assert.Equal(t, start.Add(2*time.Hour), minutes[0].Start)
+	// hourly rollups within the retention
+	hours = rollups(ResolutionHour)
+	assert.Equal(t, 1, len(hours))
+	assert.Equal(t, start.Add(time.Hour), hours[0].Start)
+
+	// Case 4 : the lock is released after the pass, and no pass runs while another
+	// instance holds it
+	assert.Assert(t, !redisServer.Exists(retentionLockKey))
+	redisServer.Set(retentionLockKey, "other")
+	assert.NilError(t, mqttPipelineClient.compact(ctx, now.Add(time.Hour)))
+	assert.Equal(t, 59, len(rollups(ResolutionMinute)))
+	got, _ := redisServer.Get(retentionLockKey)
+	assert.Equal(t, "other", got)
+}
+
+func TestKeepLock(t *testing.T) {
+	redisServer := newTestService(t, config.GlobalConfig{})
+	lock, err := mqttPipelineClient.acquireLock(context.Background(), "test:lock", 300*time.Millisecond)
+	assert.NilError(t, err)
+	assert.Assert(t, lock != nil)
+	ctx, stop := mqttPipelineClient.keepLock(context.Background(), lock, 300*time.Millisecond)
+	defer stop()
+
+	// Case 1 : the lock is renewed while held
+	redisServer.SetTTL("test:lock", time.Hour)
+	deadline := time.Now().Add(3 * time.Second)
+	for redisServer.TTL("test:lock") != 300*time.Millisecond && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 300*time.Millisecond, redisServer.TTL("test:lock"))
+	assert.NilError(t, ctx.Err())
+
+	// Case 2 : the context is cancelled once another instance holds the lock
+	redisServer.Set("test:lock", "other")
+	select {
+	case <-ctx.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("context not cancelled after losing the lock")
+	}
+	got, _ := redisServer.Get("test:lock")
+	assert.Equal(t, "other", got)
+}
@@ -1,13 +1,14 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"runtime"
-	"time"
+	"strings"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/go-redis/redis/v7"
@@ -16,6 +17,7 @@ import (
 	"github.com/mqtt-pipeline/internal/models"
 	"github.com/mqtt-pipeline/internal/mqtterror"
 	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
 )
 
 var (
@@ -23,25 +25,30 @@ var (
 )
 
 type MQTTPipelineService struct {
-	redisClient *redis.Client
+	redisClient redis.UniversalClient
 }
 
-func NewMQTTPipelineService(redisClient *redis.Client) {
+func NewMQTTPipelineService(redisClient redis.UniversalClient) {
 	mqttPipelineClient = &MQTTPipelineService{
 		redisClient: redisClient,
 	}
 }
 
+// withContext binds ctx to the redis commands of the service.
+func (service *MQTTPipelineService) withContext(ctx context.Context) redis.Cmdable {
+	return utils.RedisWithContext(service.redisClient, ctx)
+}
+
 func GenerateToken() func(ctx *gin.Context) {
 	return func(context *gin.Context) {
 		var emailInfo models.Email
 		if err := context.ShouldBindBodyWith(&emailInfo, binding.JSON); err == nil {
-			txid := context.Request.Header.Get(constants.TransactionID)
-			utils.Logger.Info(fmt.Sprintf("received request for generating token, txid : %v", txid))
+			logger := utils.LoggerFromContext(context)
+			logger.Info("received request for generating token")
 
 			token, err := mqttPipelineClient.generateToken(context, emailInfo)
 			if err != nil {
-				utils.Logger.Error("unable to generate a token for the given email")
+				logger.Error("unable to generate a token for the given email", zap.String("error", err.Message))
 				context.Writer.WriteHeader(err.Code)
 			} else {
 				context.JSON(http.StatusOK, map[string]string{
@@ -54,13 +61,26 @@ func GenerateToken() func(ctx *gin.Context) {
 	}
 }
 
+// generateToken issues a token for the email. With tenancy enabled the token is
+// scoped to the tenant in the request, which has to come with the tenant's API key.
 func (service *MQTTPipelineService) generateToken(ctx *gin.Context, emailInfo models.Email) (string, *mqtterror.MQTTPipelineError) {
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["email"] = emailInfo.Email
-	claims["exp"] = time.Now().Add(time.Minute * 5).Unix()
+	if !config.GetConfig().Tenancy.Enabled {
+		emailInfo.Tenant = ""
+	} else if err := service.verifyTenantAPIKey(ctx.Request.Context(), emailInfo.Tenant, emailInfo.APIKey); err != nil {
+		return "", &mqtterror.MQTTPipelineError{
+			Code:    tenantError(err),
+			Message: err.Error(),
+			Trace:   ctx.Request.Header.Get(constants.TransactionID),
+		}
+	}
 
-	tokenString, err := token.SignedString(constants.SecretKey)
+	var tokenString string
+	var err error
+	if emailInfo.Tenant != "" {
+		tokenString, err = MintTenantToken(emailInfo.Email, emailInfo.Tenant, 0)
+	} else {
+		tokenString, err = MintToken(emailInfo.Email, 0)
+	}
 	if err != nil {
 		return "", &mqtterror.MQTTPipelineError{
 			Code:    http.StatusInternalServerError,
@@ -75,17 +95,40 @@ func Publish() func(ctx *gin.Context) {
 	return func(context *gin.Context) {
 		var speedInfo models.SpeedData
 		if err := context.ShouldBindBodyWith(&speedInfo, binding.JSON); err == nil {
-			txid := context.Request.Header.Get(constants.TransactionID)
-			utils.Logger.Info(fmt.Sprintf("received request for publish the speed on mqtt, txid : %v", txid))
+			logger := utils.LoggerFromContext(context)
+			logger.Info("received request for publish the speed on mqtt", zap.Int("speed", *speedInfo.Speed))
 
-			err := mqttPipelineClient.publish(context, speedInfo)
-			fmt.Println("runtime.NumGoroutine() : ", runtime.NumGoroutine())
+			if err := mqttPipelineClient.checkPublish(context.Request.Context()); err != nil {
+				logger.Error("publish rejected for the tenant", zap.Error(err))
+				utils.RespondWithError(context, tenantError(err), err.Error())
+				return
+			}
+
+			if isAsyncPublish(context) {
+				messageID := mqttPipelineClient.publishAsync(context, speedInfo)
+				context.JSON(http.StatusAccepted, map[string]string{
+					"message":    "Speed data accepted for publishing",
+					"message_id": messageID,
+					"status":     StatusQueued,
+					"status_url": constants.ForwardSlash + strings.Join([]string{constants.Version, constants.Messages, messageID}, constants.ForwardSlash),
+				})
+				return
+			}
+
+			messageID, queued, err := mqttPipelineClient.publish(context, speedInfo)
+			logger.Debug("publish handled", zap.Int("goroutines", runtime.NumGoroutine()))
 			if err != nil {
-				utils.Logger.Error("unable to generate a token for the given email")
+				logger.Error("unable to publish the speed data", zap.String("error", err.Message))
 				context.Writer.WriteHeader(err.Code)
+			} else if queued {
+				context.JSON(http.StatusAccepted, map[string]string{
+					"message":    "MQTT broker unavailable, speed data queued for delivery",
+					"message_id": messageID,
+				})
 			} else {
 				context.JSON(http.StatusOK, map[string]string{
-					"message": "Published speed data to MQTT Pipeline",
+					"message":    "Published speed data to MQTT Pipeline",
+					"message_id": messageID,
 				})
 			}
 		} else {
@@ -94,76 +137,32 @@ func Publish() func(ctx *gin.Context) {
 	}
 }
 
-func (service *MQTTPipelineService) publish(ctx *gin.Context, speedInfo models.SpeedData) *mqtterror.MQTTPipelineError {
-	txid := ctx.Request.Header.Get(constants.TransactionID)
-	payload, _ := json.Marshal(speedInfo)
-	cfg := config.GetConfig()
-	if token := utils.MQTTClient.Publish(cfg.MQTTConfig.Topic, 0, false, payload); token.Wait() && token.Error() != nil {
-		utils.Logger.Error(fmt.Sprintf("unable to publish the message on the topic, txid : %v", txid))
-		return &mqtterror.MQTTPipelineError{
-			Code:    http.StatusInternalServerError,
-			Message: fmt.Sprintf("Unable to send the speed data on the topic, err %v", token.Error()),
-			Trace:   txid,
-		}
-	}
-	utils.Logger.Info(fmt.Sprintf("succesfully publish the message on the topic, txid : %v", txid))
-	go service.subscribeToMQTT(ctx)
-
-	return nil
-}
-
-func (service *MQTTPipelineService) subscribeToMQTT(ctx *gin.Context) *mqtterror.MQTTPipelineError {
-	//ctxx := context.Background()
+// publish sends the reading to the topic and returns the message ID it was published
+// with. When the broker is unavailable, or earlier messages are still queued, the
+// reading is put on the outbound queue instead and queued is true.
+func (service *MQTTPipelineService) publish(ctx *gin.Context, speedInfo models.SpeedData) (string, bool, *mqtterror.MQTTPipelineError) {
 	txid := ctx.Request.Header.Get(constants.TransactionID)
+	messageID, payload := prepareMessage(ctx, speedInfo)
+	logger := utils.LoggerFromContext(ctx).With(zap.String("message_id", messageID))
 
-	// blocking call
-	speed := <-utils.SpeedChannel
-	// Save the latest speed data to Redis
-	utils.Logger.Info(fmt.Sprintf("data successfully fetched from the topic, txid : %v", txid))
-	err := service.storeInRedis(ctx, speed)
+	queued, err := service.deliver(ctx.Request.Context(), logger, messageID, utils.TenantTopic(TenantFromContext(ctx.Request.Context())), payload, txid)
 	if err != nil {
-		utils.Logger.Error(fmt.Sprintf("unable to store data into redis, txid : %v", txid))
-		return err
+		return "", false, err
 	}
-	return nil
-}
-
-func (service *MQTTPipelineService) storeInRedis(ctx *gin.Context, speed int) *mqtterror.MQTTPipelineError {
-	// Store the speed data in Redis
-	txid := ctx.Request.Header.Get(constants.TransactionID)
-	data := map[string]interface{}{"speed": speed}
-	val, err := json.Marshal(data)
-	if err != nil {
-		return &mqtterror.MQTTPipelineError{
-			Code:    http.StatusInternalServerError,
-			Message: fmt.Sprintf("Unable to send the speed data on the topic, err %v", err.Error()),
-			Trace:   txid,
-		}
-	}
-
-	err = service.redisClient.Set("latest_speed_data", val, 0).Err()
-	if err != nil {
-		return &mqtterror.MQTTPipelineError{
-			Code:    http.StatusInternalServerError,
-			Message: fmt.Sprintf("Unable to send the speed data on the topic, err %v", err.Error()),
-			Trace:   txid,
-		}
-	}
-	utils.Logger.Info(fmt.Sprintf("data stored successfully in redis , txid : %v", txid))
-	return nil
+	return messageID, queued, nil
 }
 
 func GetSpeedData() func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
-		txid := ctx.Request.Header.Get(constants.TransactionID)
-		utils.Logger.Info(fmt.Sprintf("received request to get the latest value from redis, txid : %v", txid))
+		logger := utils.LoggerFromContext(ctx)
+		logger.Info("received request to get the latest value from redis")
 		speed, err := mqttPipelineClient.getSpeedData(ctx)
 		if err != nil {
-			utils.Logger.Error("unable to get the latest speed data")
+			logger.Error("unable to get the latest speed data", zap.String("error", err.Message))
 			ctx.Writer.WriteHeader(err.Code)
 		} else {
 			if speed == nil {
-				utils.Logger.Info(fmt.Sprintf("no speed data exists in redis, txid : %v", txid))
+				logger.Info("no speed data exists in redis")
 				ctx.JSON(http.StatusOK, map[string]string{
 					"latest_speed": "No speed data found in redis",
 				})
@@ -178,28 +177,42 @@ func GetSpeedData() func(ctx *gin.Context) {
 
 func (service *MQTTPipelineService) getSpeedData(ctx *gin.Context) (*int, *mqtterror.MQTTPipelineError) {
 	txid := ctx.Request.Header.Get(constants.TransactionID)
-	val, err := service.redisClient.Get("latest_speed_data").Result()
-	if err == redis.Nil {
-		utils.Logger.Info(fmt.Sprintf("no stored in stored in redis , txid : %v", txid))
-		return nil, nil
-	}
+	logger := utils.LoggerFromContext(ctx)
+	speed, err := service.latestSpeed(ctx.Request.Context())
 	if err != nil {
-		utils.Logger.Error(fmt.Sprintf("unable to fetch latest speed data from redis , txid : %v", txid))
+		logger.Error("unable to fetch latest speed data from redis", zap.Error(err))
 		return nil, &mqtterror.MQTTPipelineError{
 			Code:    http.StatusInternalServerError,
 			Message: fmt.Sprintf("Unable to fetch latest speed data from redis, err %v", err.Error()),
 			Trace:   txid,
 		}
 	}
+	if speed == nil {
+		logger.Info("no data stored in redis")
+	}
+	return speed, nil
+}
+
+// GetLatestSpeed returns the latest stored speed, or nil when nothing has been stored.
+func GetLatestSpeed(ctx context.Context) (*int, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.latestSpeed(ctx)
+}
+
+func (service *MQTTPipelineService) latestSpeed(ctx context.Context) (*int, error) {
+	val, err := service.withContext(ctx).Get(scopedKey(ctx, latestSpeedKey)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	var data models.SpeedData
 	if err := json.Unmarshal([]byte(val), &data); err != nil {
-		utils.Logger.Error(fmt.Sprintf("unmarshalling error for redis data , txid : %v", txid))
-		return nil, &mqtterror.MQTTPipelineError{
-			Code:    http.StatusInternalServerError,
-			Message: fmt.Sprintf("error while unmarshalling the response from the redis, err %v", err.Error()),
-			Trace:   txid,
-		}
+		return nil, fmt.Errorf("error while unmarshalling the response from the redis, err %v", err.Error())
 	}
 	return data.Speed, nil
 }
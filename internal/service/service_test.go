@@ -0,0 +1,87 @@
+package service
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/utils"
+)
+
+// newTestService starts the service on a new miniredis with cfg, which is reset when
+// the test ends.
+func newTestService(t *testing.T, cfg config.GlobalConfig) *miniredis.Miniredis {
+	// init logging client
+	utils.InitLogClient()
+
+	redisServer := miniredis.RunT(t)
+	NewMQTTPipelineService(redis.NewClient(&redis.Options{Addr: redisServer.Addr()}))
+	config.SetConfig(cfg)
+	t.Cleanup(func() { config.SetConfig(config.GlobalConfig{}) })
+	return redisServer
+}
+
+// doneToken is a token of an operation that has completed.
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// fakeClient is an MQTT client that subscribes and publishes without a broker. It is
+// connected until setConnected(false).
+type fakeClient struct {
+	mqtt.Client
+	mu           sync.Mutex
+	disconnected bool
+	published    []string
+}
+
+// useClient makes client the MQTT client of the service until the test ends.
+func useClient(t *testing.T, client *fakeClient) {
+	utils.MQTTClient = client
+	t.Cleanup(func() { utils.MQTTClient = nil })
+}
+
+func (f *fakeClient) setConnected(connected bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.disconnected = !connected
+}
+
+func (f *fakeClient) IsConnected() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.disconnected
+}
+
+func (f *fakeClient) IsConnectionOpen() bool { return f.IsConnected() }
+
+func (f *fakeClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return doneToken{}
+}
+
+func (f *fakeClient) Unsubscribe(...string) mqtt.Token { return doneToken{} }
+
+func (f *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, topic)
+	return doneToken{}
+}
+
+// topics returns the topics of the messages published so far.
+func (f *fakeClient) topics() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.published...)
+}
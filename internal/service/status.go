@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/mqtterror"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	StatusQueued       = "queued"
+	StatusPublished    = "published"
+	StatusAcknowledged = "acknowledged"
+	StatusIngested     = "ingested"
+	StatusFailed       = "failed"
+)
+
+// statusScript records when a message reached a stage and moves its status forward.
+// Updates can arrive out of order (the subscriber may store a reading before the
+// publisher sees the PUBACK) so the status never goes back, and ingested is final. A
+// message that failed, for example because the broker did not confirm it in time, can
+// still be ingested, which replaces the failure and its reason. The first subject in
+// ARGV[5] to publish the message owns it.
+var statusScript = redis.NewScript(`
+local ranks = {queued = 1, published = 2, acknowledged = 3, failed = 4, ingested = 5}
+local current = redis.call('HGET', KEYS[1], 'status')
+redis.call('HSET', KEYS[1], ARGV[1] .. '_at', ARGV[3])
+if ARGV[5] ~= '' then
+	redis.call('HSETNX', KEYS[1], 'owner', ARGV[5])
+end
+if not current or ranks[ARGV[1]] > ranks[current] then
+	redis.call('HSET', KEYS[1], 'status', ARGV[1])
+	if ARGV[2] ~= '' then
+		redis.call('HSET', KEYS[1], 'reason', ARGV[2])
+	else
+		redis.call('HDEL', KEYS[1], 'reason')
+	end
+end
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+return 1
+`)
+
+type subjectContextKey struct{}
+
+// WithSubject attaches the subject of the token of a request to ctx. The statuses of
+// the messages published with ctx are only shown to that subject.
+func WithSubject(ctx context.Context, subject string) context.Context {
+	return context.WithValue(ctx, subjectContextKey{}, subject)
+}
+
+// SubjectFromContext returns the subject attached to ctx, or "" when there is none.
+func SubjectFromContext(ctx context.Context) string {
+	subject, _ := ctx.Value(subjectContextKey{}).(string)
+	return subject
+}
+
+func messageStatusKey(ctx context.Context, messageID string) string {
+	return scopedKey(ctx, "message:"+messageID)
+}
+
+// setMessageStatus records the delivery stage of a message. Tracking is best effort
+// and never fails the operation that triggered it.
+func (service *MQTTPipelineService) setMessageStatus(ctx context.Context, messageID, status, reason string) {
+	cfg := config.GetConfig().MessageStatus
+	if !cfg.Enabled || messageID == "" {
+		return
+	}
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = 86400
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if err := statusScript.Run(service.withContext(ctx), []string{messageStatusKey(ctx, messageID)}, status, reason, now, ttl, SubjectFromContext(ctx)).Err(); err != nil {
+		utils.Logger.Error("unable to record message status", zap.String("message_id", messageID), zap.String("status", status), zap.Error(err))
+	}
+}
+
+func GetMessageStatus() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		messageID := ctx.Param(constants.MessageIDParam)
+		logger.Info("received request to get the message status", zap.String("message_id", messageID))
+
+		status, err := mqttPipelineClient.getMessageStatus(ctx, messageID)
+		if err != nil {
+			logger.Error("unable to get the message status", zap.String("error", err.Message))
+			utils.RespondWithError(ctx, err.Code, err.Message)
+			return
+		}
+		ctx.JSON(http.StatusOK, status)
+	}
+}
+
+func (service *MQTTPipelineService) getMessageStatus(ctx *gin.Context, messageID string) (*models.MessageStatus, *mqtterror.MQTTPipelineError) {
+	txid := ctx.Request.Header.Get(constants.TransactionID)
+	status, owner, err := service.lookupOwnedMessageStatus(ctx.Request.Context(), messageID)
+	if err != nil {
+		return nil, &mqtterror.MQTTPipelineError{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Unable to fetch the message status from redis, err %v", err.Error()),
+			Trace:   txid,
+		}
+	}
+	// messages published by another subject are reported as unknown, those only seen
+	// by the subscriber have no owner
+	if status == nil || (owner != "" && owner != ctx.GetString(constants.EmailKey) && !ctx.GetBool(constants.AdminKey)) {
+		return nil, &mqtterror.MQTTPipelineError{
+			Code:    http.StatusNotFound,
+			Message: fmt.Sprintf("no status found for message %v", messageID),
+			Trace:   txid,
+		}
+	}
+	return status, nil
+}
+
+// LookupMessageStatus returns the delivery status of a message, or nil when none is
+// recorded.
+func LookupMessageStatus(ctx context.Context, messageID string) (*models.MessageStatus, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.lookupMessageStatus(ctx, messageID)
+}
+
+func (service *MQTTPipelineService) lookupMessageStatus(ctx context.Context, messageID string) (*models.MessageStatus, error) {
+	status, _, err := service.lookupOwnedMessageStatus(ctx, messageID)
+	return status, err
+}
+
+// lookupOwnedMessageStatus returns the delivery status of a message together with the
+// subject that published it.
+func (service *MQTTPipelineService) lookupOwnedMessageStatus(ctx context.Context, messageID string) (*models.MessageStatus, string, error) {
+	fields, err := service.withContext(ctx).HGetAll(messageStatusKey(ctx, messageID)).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(fields) == 0 {
+		return nil, "", nil
+	}
+
+	return &models.MessageStatus{
+		MessageID:      messageID,
+		Status:         fields["status"],
+		Reason:         fields["reason"],
+		QueuedAt:       parseStatusTime(fields[StatusQueued+"_at"]),
+		PublishedAt:    parseStatusTime(fields[StatusPublished+"_at"]),
+		AcknowledgedAt: parseStatusTime(fields[StatusAcknowledged+"_at"]),
+		IngestedAt:     parseStatusTime(fields[StatusIngested+"_at"]),
+		FailedAt:       parseStatusTime(fields[StatusFailed+"_at"]),
+	}, fields["owner"], nil
+}
+
+func parseStatusTime(value string) *time.Time {
+	if value == "" {
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil
+	}
+	return &parsed
+}
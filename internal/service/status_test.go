@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mqtt-pipeline/internal/config"
+	"gotest.tools/assert"
+)
+
+func TestMessageStatus(t *testing.T) {
+	newTestService(t, config.GlobalConfig{MessageStatus: config.MessageStatus{Enabled: true}})
+	ctx := WithSubject(context.Background(), "publisher@example.com")
+	lookup := func(messageID string) (string, string) {
+		status, owner, err := mqttPipelineClient.lookupOwnedMessageStatus(context.Background(), messageID)
+		assert.NilError(t, err)
+		return status.Status, owner
+	}
+
+	// Case 1 : the status moves forward through the stages
+	mqttPipelineClient.setMessageStatus(ctx, "m1", StatusQueued, "")
+	mqttPipelineClient.setMessageStatus(ctx, "m1", StatusPublished, "")
+	mqttPipelineClient.setMessageStatus(ctx, "m1", StatusAcknowledged, "")
+	status, owner := lookup("m1")
+	assert.Equal(t, StatusAcknowledged, status)
+	assert.Equal(t, "publisher@example.com", owner)
+
+	// Case 2 : stages arriving late are recorded without moving the status back
+	mqttPipelineClient.setMessageStatus(context.Background(), "m2", StatusIngested, "")
+	mqttPipelineClient.setMessageStatus(ctx, "m2", StatusAcknowledged, "")
+	full, err := mqttPipelineClient.lookupMessageStatus(context.Background(), "m2")
+	assert.NilError(t, err)
+	assert.Equal(t, StatusIngested, full.Status)
+	assert.Assert(t, full.AcknowledgedAt != nil && full.IngestedAt != nil)
+
+	// Case 3 : ingested is final, failures before it are kept with their reason
+	mqttPipelineClient.setMessageStatus(ctx, "m2", StatusFailed, "late failure")
+	status, _ = lookup("m2")
+	assert.Equal(t, StatusIngested, status)
+	mqttPipelineClient.setMessageStatus(ctx, "m3", StatusPublished, "")
+	mqttPipelineClient.setMessageStatus(ctx, "m3", StatusFailed, "broker did not confirm")
+	full, err = mqttPipelineClient.lookupMessageStatus(context.Background(), "m3")
+	assert.NilError(t, err)
+	assert.Equal(t, StatusFailed, full.Status)
+	assert.Equal(t, "broker did not confirm", full.Reason)
+
+	// Case 4 : a failed message that is ingested after all is ingested, without the reason
+	mqttPipelineClient.setMessageStatus(context.Background(), "m3", StatusIngested, "")
+	full, err = mqttPipelineClient.lookupMessageStatus(context.Background(), "m3")
+	assert.NilError(t, err)
+	assert.Equal(t, StatusIngested, full.Status)
+	assert.Equal(t, "", full.Reason)
+	assert.Assert(t, full.FailedAt != nil && full.IngestedAt != nil)
+
+	// Case 5 : the first publisher owns the message, the subscriber takes no ownership
+	mqttPipelineClient.setMessageStatus(WithSubject(context.Background(), "other@example.com"), "m1", StatusIngested, "")
+	_, owner = lookup("m1")
+	assert.Equal(t, "publisher@example.com", owner)
+	mqttPipelineClient.setMessageStatus(context.Background(), "m4", StatusIngested, "")
+	_, owner = lookup("m4")
+	assert.Equal(t, "", owner)
+
+	// Case 6 : nothing is recorded with tracking disabled
+	config.SetConfig(config.GlobalConfig{})
+	mqttPipelineClient.setMessageStatus(ctx, "m5", StatusQueued, "")
+	missing, err := mqttPipelineClient.lookupMessageStatus(context.Background(), "m5")
+	assert.NilError(t, err)
+	assert.Assert(t, missing == nil)
+}
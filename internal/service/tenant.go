@@ -0,0 +1,507 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/models"
+	"github.com/mqtt-pipeline/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	TenantActive    = "active"
+	TenantSuspended = "suspended"
+
+	// tenantsKey is a hash of every tenant by ID.
+	tenantsKey = "tenants"
+	// tenantAPIKeysKey is a hash of the SHA-256 of every tenant's API key by tenant ID.
+	tenantAPIKeysKey = "tenant_api_keys"
+	// quotaDevicesKey is a set of the devices admitted for a tenant, which count against
+	// its device quota. It is scoped to the tenant.
+	quotaDevicesKey = "quota:devices"
+)
+
+// admitDeviceScript admits the device ARGV[1] to the set KEYS[1] unless that takes it
+// past ARGV[2] devices, 0 being no limit, and returns 1 when the device is admitted.
+// The set starts out with the devices of the hash KEYS[2] that have readings.
+var admitDeviceScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  local known = redis.call('HKEYS', KEYS[2])
+  for i = 1, #known, 1000 do
+    redis.call('SADD', KEYS[1], unpack(known, i, math.min(i + 999, #known)))
+  end
+end
+if redis.call('SISMEMBER', KEYS[1], ARGV[1]) == 1 then
+  return 1
+end
+local max = tonumber(ARGV[2])
+if max > 0 and redis.call('SCARD', KEYS[1]) >= max then
+  return 0
+end
+redis.call('SADD', KEYS[1], ARGV[1])
+return 1
+`)
+
+var (
+	ErrTenantRequired  = errors.New("token is not issued for a tenant")
+	ErrTenantNotFound  = errors.New("tenant not found")
+	ErrTenantSuspended = errors.New("tenant is suspended")
+	ErrTenantExists    = errors.New("tenant already exists")
+	ErrInvalidTenant   = errors.New("tenant id must be 1 to 63 lowercase letters, digits, - or _")
+	ErrInvalidQuota    = errors.New("quotas must not be negative")
+	ErrInvalidAPIKey   = errors.New("invalid tenant or api key")
+	ErrQuotaExceeded   = errors.New("tenant quota exceeded")
+)
+
+// tenant IDs are used as a topic level and in redis keys
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+type tenantContextKey struct{}
+
+// WithTenant scopes the service calls made with ctx to a tenant.
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenantID)
+}
+
+// TenantFromContext returns the tenant ctx is scoped to, or "" when it is not.
+func TenantFromContext(ctx context.Context) string {
+	tenantID, _ := ctx.Value(tenantContextKey{}).(string)
+	return tenantID
+}
+
+// scopedKey prefixes a redis key with the tenant of ctx. Without a tenant the key is
+// unchanged, so deployments without tenancy keep their data where it was. The tenant
+// ID is a hash tag, so that all keys of a tenant are in the same Redis Cluster slot
+// and scripts and transactions can use several of them.
+func scopedKey(ctx context.Context, key string) string {
+	if tenantID := TenantFromContext(ctx); tenantID != "" {
+		return "tenant:{" + tenantID + "}:" + key
+	}
+	return key
+}
+
+// dailyReadingsKey counts the readings stored for the tenant of ctx on the day of t.
+func dailyReadingsKey(ctx context.Context, t time.Time) string {
+	return scopedKey(ctx, "quota:readings:"+t.UTC().Format("20060102"))
+}
+
+// IsAdmin reports whether the token claims grant access to the admin APIs.
+func IsAdmin(claims jwt.MapClaims) bool {
+	admin, _ := claims[constants.AdminKey].(bool)
+	return admin
+}
+
+// IsGlobalAdmin reports whether the token claims grant access to the admin APIs that
+// span every tenant, which admin tokens minted for a tenant do not.
+func IsGlobalAdmin(claims jwt.MapClaims) bool {
+	tenantID, _ := claims[constants.TenantKey].(string)
+	return IsAdmin(claims) && tenantID == ""
+}
+
+// AuthorizeTenant checks that the tenant a token was issued for is active and scopes
+// ctx to it. With tenancy disabled ctx is returned unchanged. Admin tokens need no
+// tenant. Failures to look the tenant up are returned as a TokenError.
+func AuthorizeTenant(ctx context.Context, claims jwt.MapClaims) (context.Context, error) {
+	if !config.GetConfig().Tenancy.Enabled {
+		return ctx, nil
+	}
+	tenantID, _ := claims[constants.TenantKey].(string)
+	if tenantID == "" {
+		if IsAdmin(claims) {
+			return ctx, nil
+		}
+		return nil, ErrTenantRequired
+	}
+	if mqttPipelineClient == nil {
+		return nil, &TokenError{Message: "unable to verify tenant", Err: errors.New("service is not initialised")}
+	}
+	tenant, err := mqttPipelineClient.lookupTenant(ctx, tenantID)
+	if err != nil {
+		return nil, &TokenError{Message: "unable to verify tenant", Err: err}
+	}
+	if tenant == nil {
+		return nil, ErrTenantNotFound
+	}
+	if tenant.Status == TenantSuspended {
+		return nil, ErrTenantSuspended
+	}
+	return WithTenant(ctx, tenantID), nil
+}
+
+// RegisterTenant creates an active tenant and returns it with its API key, which is
+// only stored hashed and cannot be read back.
+func RegisterTenant(ctx context.Context, req models.TenantRequest) (*models.Tenant, string, error) {
+	if mqttPipelineClient == nil {
+		return nil, "", errors.New("service is not initialised")
+	}
+	return mqttPipelineClient.registerTenant(ctx, req)
+}
+
+func (service *MQTTPipelineService) registerTenant(ctx context.Context, req models.TenantRequest) (*models.Tenant, string, error) {
+	if !tenantIDPattern.MatchString(req.ID) {
+		return nil, "", ErrInvalidTenant
+	}
+	cfg := config.GetConfig().Tenancy
+	quota := models.TenantQuota{ReadingsPerDay: cfg.DefaultReadingsPerDay, MaxDevices: cfg.DefaultMaxDevices}
+	if req.Quota != nil {
+		quota = *req.Quota
+	}
+	if quota.ReadingsPerDay < 0 || quota.MaxDevices < 0 {
+		return nil, "", ErrInvalidQuota
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	apiKey := hex.EncodeToString(secret)
+
+	now := time.Now().UTC()
+	tenant := &models.Tenant{ID: req.ID, Name: req.Name, Status: TenantActive, Quota: quota, CreatedAt: now, UpdatedAt: now}
+	value, _ := json.Marshal(tenant)
+	created, err := service.withContext(ctx).HSetNX(tenantsKey, tenant.ID, value).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	if !created {
+		return nil, "", ErrTenantExists
+	}
+	if err := service.withContext(ctx).HSet(tenantAPIKeysKey, tenant.ID, hashAPIKey(apiKey)).Err(); err != nil {
+		return nil, "", err
+	}
+	return tenant, apiKey, nil
+}
+
+func hashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// LookupTenant returns a tenant with its current usage, or nil when it does not exist.
+func LookupTenant(ctx context.Context, tenantID string) (*models.Tenant, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	tenant, err := mqttPipelineClient.lookupTenant(ctx, tenantID)
+	if err != nil || tenant == nil {
+		return nil, err
+	}
+	usage, err := mqttPipelineClient.tenantUsage(WithTenant(ctx, tenantID))
+	if err != nil {
+		return nil, err
+	}
+	tenant.Usage = &usage
+	return tenant, nil
+}
+
+func (service *MQTTPipelineService) lookupTenant(ctx context.Context, tenantID string) (*models.Tenant, error) {
+	value, err := service.withContext(ctx).HGet(tenantsKey, tenantID).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tenant models.Tenant
+	if err := json.Unmarshal([]byte(value), &tenant); err != nil {
+		return nil, err
+	}
+	return &tenant, nil
+}
+
+func (service *MQTTPipelineService) tenantUsage(ctx context.Context) (models.TenantUsage, error) {
+	var usage models.TenantUsage
+	readings, err := service.withContext(ctx).Get(dailyReadingsKey(ctx, time.Now())).Int64()
+	if err != nil && err != redis.Nil {
+		return usage, err
+	}
+	devices, err := service.withContext(ctx).SCard(scopedKey(ctx, quotaDevicesKey)).Result()
+	if err != nil {
+		return usage, err
+	}
+	// the set of a tenant is started by the first reading it ingests
+	if devices == 0 {
+		if devices, err = service.withContext(ctx).HLen(scopedKey(ctx, deviceReadingsKey)).Result(); err != nil {
+			return usage, err
+		}
+	}
+	usage.ReadingsToday = readings
+	usage.Devices = devices
+	return usage, nil
+}
+
+// AllTenants returns every tenant ordered by ID.
+func AllTenants(ctx context.Context) ([]models.Tenant, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	values, err := mqttPipelineClient.withContext(ctx).HGetAll(tenantsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	tenants := make([]models.Tenant, 0, len(values))
+	for _, value := range values {
+		var tenant models.Tenant
+		if err := json.Unmarshal([]byte(value), &tenant); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	return tenants, nil
+}
+
+// SetTenantStatus suspends or reactivates a tenant. Suspended tenants cannot use their
+// tokens or get new ones, and readings published to their topic are dead-lettered.
+func SetTenantStatus(ctx context.Context, tenantID, status string) (*models.Tenant, error) {
+	if mqttPipelineClient == nil {
+		return nil, errors.New("service is not initialised")
+	}
+	if status != TenantActive && status != TenantSuspended {
+		return nil, fmt.Errorf("unknown tenant status %q", status)
+	}
+	tenant, err := mqttPipelineClient.lookupTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if tenant == nil {
+		return nil, ErrTenantNotFound
+	}
+	tenant.Status = status
+	tenant.UpdatedAt = time.Now().UTC()
+	value, _ := json.Marshal(tenant)
+	if err := mqttPipelineClient.withContext(ctx).HSet(tenantsKey, tenantID, value).Err(); err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+// verifyTenantAPIKey checks the API key a token is requested with.
+func (service *MQTTPipelineService) verifyTenantAPIKey(ctx context.Context, tenantID, apiKey string) error {
+	stored, err := service.withContext(ctx).HGet(tenantAPIKeysKey, tenantID).Result()
+	if err == redis.Nil {
+		return ErrInvalidAPIKey
+	}
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(hashAPIKey(apiKey))) != 1 {
+		return ErrInvalidAPIKey
+	}
+	tenant, err := service.lookupTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	if tenant == nil {
+		return ErrInvalidAPIKey
+	}
+	if tenant.Status == TenantSuspended {
+		return ErrTenantSuspended
+	}
+	return nil
+}
+
+// checkPublish rejects publishes without a tenant when tenancy is enabled, and those
+// of a tenant that has used up its daily readings.
+func (service *MQTTPipelineService) checkPublish(ctx context.Context) error {
+	if !config.GetConfig().Tenancy.Enabled {
+		return nil
+	}
+	tenantID := TenantFromContext(ctx)
+	if tenantID == "" {
+		return ErrTenantRequired
+	}
+	tenant, err := service.lookupTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	if tenant == nil {
+		return ErrTenantNotFound
+	}
+	if tenant.Quota.ReadingsPerDay <= 0 {
+		return nil
+	}
+	used, err := service.withContext(ctx).Get(dailyReadingsKey(ctx, time.Now())).Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if used >= tenant.Quota.ReadingsPerDay {
+		return fmt.Errorf("%w, %d readings per day", ErrQuotaExceeded, tenant.Quota.ReadingsPerDay)
+	}
+	return nil
+}
+
+// admitReading checks a reading received on a tenant's topic before it is stored: the
+// tenant has to exist and be active, a new device must fit in its device quota, and
+// the reading is counted against its daily quota.
+func (service *MQTTPipelineService) admitReading(ctx context.Context, reading models.Reading) error {
+	if !config.GetConfig().Tenancy.Enabled {
+		return nil
+	}
+	if reading.Tenant == "" {
+		return ErrTenantRequired
+	}
+	tenant, err := service.lookupTenant(ctx, reading.Tenant)
+	if err != nil {
+		return err
+	}
+	if tenant == nil {
+		return ErrTenantNotFound
+	}
+	if tenant.Status == TenantSuspended {
+		return ErrTenantSuspended
+	}
+
+	if reading.DeviceID != "" {
+		// The check and the admission of a new device are one script, so that readings
+		// of new devices ingested at the same time cannot both take the last place.
+		admitted, err := admitDeviceScript.Run(service.withContext(ctx),
+			[]string{scopedKey(ctx, quotaDevicesKey), scopedKey(ctx, deviceReadingsKey)},
+			reading.DeviceID, tenant.Quota.MaxDevices).Int()
+		if err != nil {
+			return err
+		}
+		if admitted == 0 {
+			return fmt.Errorf("%w, %d devices", ErrQuotaExceeded, tenant.Quota.MaxDevices)
+		}
+	}
+
+	if tenant.Quota.ReadingsPerDay > 0 {
+		key := dailyReadingsKey(ctx, reading.ReceivedAt)
+		var count *redis.IntCmd
+		_, err := service.withContext(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+			count = pipe.Incr(key)
+			pipe.Expire(key, 48*time.Hour)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if count.Val() > tenant.Quota.ReadingsPerDay {
+			return fmt.Errorf("%w, %d readings per day", ErrQuotaExceeded, tenant.Quota.ReadingsPerDay)
+		}
+	}
+	return nil
+}
+
+// tenantIDs returns the tenants background jobs go through: no tenant, and every
+// tenant when tenancy is enabled.
+func tenantIDs(ctx context.Context) ([]string, error) {
+	tenants := []string{""}
+	if config.GetConfig().Tenancy.Enabled {
+		all, err := AllTenants(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, tenant := range all {
+			tenants = append(tenants, tenant.ID)
+		}
+	}
+	return tenants, nil
+}
+
+// tenantError maps the errors of the tenant functions to a response code.
+func tenantError(err error) int {
+	switch {
+	case errors.Is(err, ErrTenantNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrTenantExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidTenant), errors.Is(err, ErrInvalidQuota):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrTenantRequired), errors.Is(err, ErrTenantSuspended):
+		return http.StatusForbidden
+	case errors.Is(err, ErrInvalidAPIKey):
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+func CreateTenant() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		var req models.TenantRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			logger.Error("invalid tenant request", zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusBadRequest, constants.InvalidBody)
+			return
+		}
+
+		tenant, apiKey, err := RegisterTenant(ctx.Request.Context(), req)
+		if err != nil {
+			logger.Error("unable to create the tenant", zap.String("tenant", req.ID), zap.Error(err))
+			utils.RespondWithError(ctx, tenantError(err), err.Error())
+			return
+		}
+		logger.Info("created tenant", zap.String("tenant", tenant.ID))
+		ctx.JSON(http.StatusCreated, map[string]interface{}{
+			"tenant":  tenant,
+			"api_key": apiKey,
+		})
+	}
+}
+
+func ListTenants() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		tenants, err := AllTenants(ctx.Request.Context())
+		if err != nil {
+			logger.Error("unable to list the tenants", zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to list the tenants, err %v", err))
+			return
+		}
+		ctx.JSON(http.StatusOK, map[string]interface{}{"tenants": tenants})
+	}
+}
+
+func GetTenant() func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		tenantID := ctx.Param(constants.TenantIDParam)
+		tenant, err := LookupTenant(ctx.Request.Context(), tenantID)
+		if err != nil {
+			logger.Error("unable to get the tenant", zap.String("tenant", tenantID), zap.Error(err))
+			utils.RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to get the tenant, err %v", err))
+			return
+		}
+		if tenant == nil {
+			utils.RespondWithError(ctx, http.StatusNotFound, fmt.Sprintf("tenant %v not found", tenantID))
+			return
+		}
+		ctx.JSON(http.StatusOK, tenant)
+	}
+}
+
+// UpdateTenantStatus returns the handler that moves a tenant to status.
+func UpdateTenantStatus(status string) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		logger := utils.LoggerFromContext(ctx)
+		tenantID := ctx.Param(constants.TenantIDParam)
+		tenant, err := SetTenantStatus(ctx.Request.Context(), tenantID, status)
+		if err != nil {
+			logger.Error("unable to update the tenant status", zap.String("tenant", tenantID), zap.String("status", status), zap.Error(err))
+			utils.RespondWithError(ctx, tenantError(err), err.Error())
+			return
+		}
+		logger.Info("updated tenant status", zap.String("tenant", tenantID), zap.String("status", status))
+		ctx.JSON(http.StatusOK, tenant)
+	}
+}
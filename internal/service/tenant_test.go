@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"gotest.tools/assert"
+)
+
+func TestAdmitReading(t *testing.T) {
+	redisServer := newTestService(t, config.GlobalConfig{Tenancy: config.Tenancy{Enabled: true}})
+	ctx := context.Background()
+
+	register := func(id string, quota models.TenantQuota) {
+		_, _, err := RegisterTenant(ctx, models.TenantRequest{ID: id, Quota: &quota})
+		assert.NilError(t, err)
+	}
+	admit := func(tenant, deviceID string, at time.Time) error {
+		return mqttPipelineClient.admitReading(WithTenant(ctx, tenant), models.Reading{Tenant: tenant, DeviceID: deviceID, ReceivedAt: at})
+	}
+	now := time.Now()
+
+	// Case 1 : readings without a tenant or of an unknown tenant are rejected
+	assert.Equal(t, ErrTenantRequired, admit("", "d1", now))
+	assert.Equal(t, ErrTenantNotFound, admit("missing", "d1", now))
+
+	// Case 2 : new devices beyond the device quota are rejected, known ones are not
+	register("fleet", models.TenantQuota{MaxDevices: 2})
+	assert.NilError(t, admit("fleet", "d1", now))
+	assert.NilError(t, admit("fleet", "d2", now))
+	assert.Assert(t, errors.Is(admit("fleet", "d3", now), ErrQuotaExceeded))
+	assert.NilError(t, admit("fleet", "d1", now))
+
+	// Case 3 : devices that already have readings count against the quota
+	register("legacy", models.TenantQuota{MaxDevices: 1})
+	redisServer.HSet("tenant:{legacy}:device_readings", "old", `{"speed":1,"device_id":"old"}`)
+	assert.Assert(t, errors.Is(admit("legacy", "new", now), ErrQuotaExceeded))
+	assert.NilError(t, admit("legacy", "old", now))
+
+	// Case 4 : new devices admitted at the same time cannot exceed the quota
+	register("race", models.TenantQuota{MaxDevices: 5})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	admitted := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(deviceID string) {
+			defer wg.Done()
+			if admit("race", deviceID, now) == nil {
+				mu.Lock()
+				admitted++
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("d%d", i))
+	}
+	wg.Wait()
+	assert.Equal(t, 5, admitted)
+	tenant, err := LookupTenant(ctx, "race")
+	assert.NilError(t, err)
+	assert.Equal(t, int64(5), tenant.Usage.Devices)
+
+	// Case 5 : readings beyond the daily quota are rejected until the next day
+	register("daily", models.TenantQuota{ReadingsPerDay: 2})
+	assert.NilError(t, admit("daily", "", now))
+	assert.NilError(t, admit("daily", "", now))
+	assert.Assert(t, errors.Is(admit("daily", "", now), ErrQuotaExceeded))
+	assert.NilError(t, admit("daily", "", now.Add(24*time.Hour)))
+	tenant, err = LookupTenant(ctx, "daily")
+	assert.NilError(t, err)
+	assert.Equal(t, int64(3), tenant.Usage.ReadingsToday)
+
+	// Case 6 : readings of suspended tenants are rejected until they are reactivated
+	_, err = SetTenantStatus(ctx, "fleet", TenantSuspended)
+	assert.NilError(t, err)
+	assert.Equal(t, ErrTenantSuspended, admit("fleet", "d1", now))
+	_, err = SetTenantStatus(ctx, "fleet", TenantActive)
+	assert.NilError(t, err)
+	assert.NilError(t, admit("fleet", "d1", now))
+}
+
+func TestTenantIsolation(t *testing.T) {
+	newTestService(t, config.GlobalConfig{Tenancy: config.Tenancy{Enabled: true}})
+	ctx := context.Background()
+	for _, id := range []string{"north", "south"} {
+		_, _, err := RegisterTenant(ctx, models.TenantRequest{ID: id})
+		assert.NilError(t, err)
+	}
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	mqttPipelineClient.ingestReading(models.Reading{Tenant: "north", Storage: "speed", Speed: 10, DeviceID: "n1", MessageID: "m1", ReceivedAt: start})
+	mqttPipelineClient.ingestReading(models.Reading{Tenant: "south", Storage: "speed", Speed: 20, DeviceID: "s1", MessageID: "m1", ReceivedAt: start})
+
+	// Case 1 : each tenant only sees its own readings, even with the same message ID
+	for tenant, speed := range map[string]int{"north": 10, "south": 20} {
+		history, err := QueryHistory(WithTenant(ctx, tenant), time.Time{}, time.Time{}, 0)
+		assert.NilError(t, err)
+		assert.Equal(t, 1, len(history))
+		assert.Equal(t, speed, history[0].Speed)
+	}
+
+	// Case 2 : devices of other tenants are not visible
+	devices, err := LatestDeviceReadings(WithTenant(ctx, "north"))
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(devices))
+	assert.Equal(t, "n1", devices[0].DeviceID)
+	entry, err := LatestDeviceReading(WithTenant(ctx, "north"), "s1")
+	assert.NilError(t, err)
+	assert.Assert(t, entry == nil)
+
+	// Case 3 : nothing is stored outside the tenants
+	history, err := QueryHistory(ctx, time.Time{}, time.Time{}, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(history))
+}
+
+func TestScopedKey(t *testing.T) {
+	// Case 1 : keys without a tenant are unchanged
+	assert.Equal(t, "devices", scopedKey(context.Background(), "devices"))
+
+	// Case 2 : the tenant ID is the hash tag of its keys, so they share a cluster slot
+	ctx := WithTenant(context.Background(), "north")
+	assert.Equal(t, "tenant:{north}:devices", scopedKey(ctx, "devices"))
+	assert.Equal(t, "tenant:{north}:quota:devices", scopedKey(ctx, quotaDevicesKey))
+}
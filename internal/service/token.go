@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"github.com/mqtt-pipeline/internal/utils"
+)
+
+var (
+	ErrTokenExpired = errors.New("token expired")
+	ErrTokenInvalid = errors.New("invalid token")
+	ErrTokenRevoked = errors.New("token revoked")
+)
+
+// TokenError is returned by VerifyToken when the token cannot be parsed or its
+// revocation cannot be checked, as opposed to a token that is rejected.
+type TokenError struct {
+	Message string
+	Err     error
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("%v, err %v", e.Message, e.Err)
+}
+
+func (e *TokenError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyToken checks the signature, expiry and revocation of a token and returns its
+// claims. Rejected tokens return ErrTokenExpired, ErrTokenInvalid or ErrTokenRevoked.
+func VerifyToken(ctx context.Context, tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return utils.SigningKey(), nil
+	})
+	if err != nil {
+		if vErr, ok := err.(*jwt.ValidationError); ok && vErr.Errors == jwt.ValidationErrorExpired {
+			return nil, ErrTokenExpired
+		}
+		return nil, &TokenError{Message: "error while parsing token", Err: err}
+	}
+	if !token.Valid {
+		return nil, ErrTokenInvalid
+	}
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	tokenID, _ := claims[constants.TokenIDKey].(string)
+	revoked, err := IsTokenRevoked(ctx, tokenID)
+	if err != nil {
+		return nil, &TokenError{Message: "unable to verify token", Err: err}
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+func revokedTokenKey(tokenID string) string {
+	return "revoked_token:" + tokenID
+}
+
+// MintToken signs a token for email. A zero ttl uses [auth] token_ttl.
+func MintToken(email string, ttl time.Duration) (string, error) {
+	return mintToken(jwt.MapClaims{constants.EmailKey: email}, ttl)
+}
+
+// MintTenantToken signs a token for email that is scoped to a tenant.
+func MintTenantToken(email, tenantID string, ttl time.Duration) (string, error) {
+	return mintToken(jwt.MapClaims{constants.EmailKey: email, constants.TenantKey: tenantID}, ttl)
+}
+
+// MintAdminToken signs a token for email that may use the admin APIs.
+func MintAdminToken(email string, ttl time.Duration) (string, error) {
+	return mintToken(jwt.MapClaims{constants.EmailKey: email, constants.AdminKey: true}, ttl)
+}
+
+// MintTenantAdminToken signs an admin token for email that is scoped to a tenant, to
+// manage the devices of the tenant.
+func MintTenantAdminToken(email, tenantID string, ttl time.Duration) (string, error) {
+	return mintToken(jwt.MapClaims{constants.EmailKey: email, constants.TenantKey: tenantID, constants.AdminKey: true}, ttl)
+}
+
+func mintToken(claims jwt.MapClaims, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		ttl = time.Duration(config.GetConfig().Auth.TokenTTL) * time.Second
+	}
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+
+	now := time.Now()
+	claims[constants.TokenIDKey] = uuid.New().String()
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Unix()
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(utils.SigningKey())
+}
+
+// RevokeToken rejects the token for the rest of its lifetime and returns its ID. The
+// token has to be signed with the current key; expired tokens are accepted and need
+// no revocation.
+func RevokeToken(ctx context.Context, tokenString string) (string, error) {
+	if mqttPipelineClient == nil {
+		return "", errors.New("service is not initialised")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return utils.SigningKey(), nil
+	})
+	if err != nil {
+		if vErr, ok := err.(*jwt.ValidationError); !ok || vErr.Errors != jwt.ValidationErrorExpired {
+			return "", fmt.Errorf("invalid token, err %v", err)
+		}
+	}
+
+	tokenID, _ := claims[constants.TokenIDKey].(string)
+	if tokenID == "" {
+		return "", errors.New("token has no jti claim and cannot be revoked")
+	}
+	exp, _ := claims["exp"].(float64)
+	ttl := time.Until(time.Unix(int64(exp), 0))
+	if ttl <= 0 {
+		return tokenID, nil
+	}
+	return tokenID, mqttPipelineClient.withContext(ctx).Set(revokedTokenKey(tokenID), 1, ttl).Err()
+}
+
+// IsTokenRevoked reports whether the token with the given ID has been revoked.
+func IsTokenRevoked(ctx context.Context, tokenID string) (bool, error) {
+	if mqttPipelineClient == nil || tokenID == "" {
+		return false, nil
+	}
+	n, err := mqttPipelineClient.withContext(ctx).Exists(revokedTokenKey(tokenID)).Result()
+	return n > 0, err
+}
@@ -0,0 +1,231 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/mqtt-pipeline/internal/config"
+	"go.uber.org/zap"
+)
+
+// CommandPublisher sends commands to devices over MQTT 5, which carries the command ID
+// and the topic to respond on as the correlation data and response topic properties.
+type CommandPublisher interface {
+	IsConnected() bool
+	// PublishCommand publishes payload on topic with QoS 1 and returns once the broker
+	// acknowledged it. The broker drops the message when it was not delivered within
+	// expiry.
+	PublishCommand(ctx context.Context, topic string, payload []byte, correlationID, responseTopic string, expiry time.Duration) error
+}
+
+// CommandClient sends the commands, nil until InitCommands connected it.
+var CommandClient CommandPublisher
+
+var (
+	commandsMu sync.Mutex
+	commands   *commandConnection
+)
+
+// commandConnection is the MQTT 5 connection commands are sent and responses received
+// on. The paho client used for readings only speaks MQTT 3.1.1, which has no
+// properties.
+type commandConnection struct {
+	manager   *autopaho.ConnectionManager
+	connected atomic.Bool
+	// receive is set when the responses of the devices are subscribed to
+	receive bool
+
+	mu             sync.Mutex
+	responseFilter string
+}
+
+// InitCommands connects the client commands are sent with when [commands] is enabled.
+// With receive set it subscribes to the response topic of every device and queues the
+// responses for the ingest worker.
+func InitCommands(receive bool) {
+	if !config.GetConfig().Commands.Enabled {
+		return
+	}
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	conn, err := connectCommands(receive)
+	if err != nil {
+		Logger.Fatal("unable to connect the command client to the MQTT broker", zap.Error(err))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := conn.manager.AwaitConnection(ctx); err != nil {
+		Logger.Fatal("failed to connect the command client to the MQTT broker", zap.String("broker", brokerAddress()), zap.Error(err))
+	}
+	commands, CommandClient = conn, conn
+}
+
+// connectCommands starts the command connection, which reconnects on its own until it
+// is disconnected.
+func connectCommands(receive bool) (*commandConnection, error) {
+	cfg := config.GetConfig()
+	broker, err := url.Parse(brokerAddress())
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker address, err %v", err)
+	}
+	conn := &commandConnection{receive: receive}
+	clientCfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{broker},
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: true,
+		ConnectUsername:               cfg.MQTTConfig.Username,
+		ConnectPassword:               []byte(cfg.MQTTConfig.Password),
+		OnConnectionUp:                conn.onConnectionUp,
+		OnConnectError: func(err error) {
+			Logger.Error("unable to connect the command client to the MQTT broker", zap.String("broker", broker.String()), zap.Error(err))
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: clientID() + "-commands",
+			OnClientError: func(err error) {
+				conn.connected.Store(false)
+				Logger.Error("command client lost the connection to the MQTT broker", zap.Error(err))
+			},
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				conn.connected.Store(false)
+				Logger.Error("MQTT broker disconnected the command client", zap.Uint8("reason_code", disconnect.ReasonCode))
+			},
+		},
+	}
+	if receive {
+		clientCfg.OnPublishReceived = []func(paho.PublishReceived) (bool, error){receiveCommandResponse}
+	}
+	conn.manager, err = autopaho.NewConnection(context.Background(), clientCfg)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// onConnectionUp runs after every successful (re)connection. The session ends with the
+// connection, so the response topic is subscribed to again.
+func (c *commandConnection) onConnectionUp(manager *autopaho.ConnectionManager, _ *paho.Connack) {
+	Logger.Info("command client connected to MQTT broker")
+	c.mu.Lock()
+	c.responseFilter = ""
+	c.mu.Unlock()
+	if c.receive {
+		if err := c.subscribeResponses(manager); err != nil {
+			Logger.Error("unable to subscribe to the command responses", zap.Error(err))
+		}
+	}
+	c.connected.Store(true)
+}
+
+// subscribeResponses moves the subscription to the configured response topic.
+// Responses are received at least once, like the commands are sent.
+func (c *commandConnection) subscribeResponses(manager *autopaho.ConnectionManager) error {
+	filter := subscriptionFilter(config.GetConfig().Commands.ResponseTopic)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if filter == c.responseFilter {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if c.responseFilter != "" {
+		if _, err := manager.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{c.responseFilter}}); err != nil {
+			return fmt.Errorf("unable to unsubscribe from %v, err %v", c.responseFilter, err)
+		}
+		c.responseFilter = ""
+	}
+	if _, err := manager.Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: filter, QoS: 1}}}); err != nil {
+		return err
+	}
+	c.responseFilter = filter
+	Logger.Info("successfully subscribed to the command responses", zap.String("topic", filter))
+	return nil
+}
+
+func (c *commandConnection) IsConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *commandConnection) PublishCommand(ctx context.Context, topic string, payload []byte, correlationID, responseTopic string, expiry time.Duration) error {
+	seconds := uint32(math.Max(1, math.Ceil(expiry.Seconds())))
+	_, err := c.manager.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		QoS:     1,
+		Payload: payload,
+		Properties: &paho.PublishProperties{
+			CorrelationData: []byte(correlationID),
+			ResponseTopic:   responseTopic,
+			ContentType:     "application/json",
+			MessageExpiry:   &seconds,
+		},
+	})
+	return err
+}
+
+// receiveCommandResponse queues a message published on the response topic of a device
+// for the ingest worker, correlated by its correlation data.
+func receiveCommandResponse(received paho.PublishReceived) (bool, error) {
+	publish := received.Packet
+	tenant, topic := splitTenant(publish.Topic)
+	deviceID, ok := topicDevice(config.GetConfig().Commands.ResponseTopic, topic)
+	if !ok {
+		deadLetter(publish.Topic, publish.Payload, "topic is not the response topic of a device")
+		return true, nil
+	}
+	correlationID := ""
+	if publish.Properties != nil {
+		correlationID = string(publish.Properties.CorrelationData)
+	}
+	handleCommandResponse(tenant, deviceID, correlationID, publish.Topic, publish.Payload)
+	return true, nil
+}
+
+// ResubscribeCommands applies a reloaded [commands] config: the command client is
+// connected when commands were enabled and disconnected when they were disabled, and
+// the responses are subscribed to on the configured response topic.
+func ResubscribeCommands() error {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	if !config.GetConfig().Commands.Enabled {
+		if commands == nil {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := commands.manager.Disconnect(ctx)
+		commands, CommandClient = nil, nil
+		return err
+	}
+	if commands == nil {
+		// the responses are subscribed to once the connection is up
+		conn, err := connectCommands(true)
+		if err != nil {
+			return err
+		}
+		commands, CommandClient = conn, conn
+		return nil
+	}
+	if !commands.connected.Load() {
+		// onConnectionUp subscribes with the new settings once the connection is back.
+		return nil
+	}
+	return commands.subscribeResponses(commands.manager)
+}
+
+// DisconnectCommands closes the command connection.
+func DisconnectCommands(ctx context.Context) error {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	if commands == nil {
+		return nil
+	}
+	err := commands.manager.Disconnect(ctx)
+	commands, CommandClient = nil, nil
+	return err
+}
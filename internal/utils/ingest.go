@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var (
+	subscribed     atomic.Bool
+	receivedCount  atomic.Int64
+	storedCount    atomic.Int64
+	lastReceivedAt atomic.Int64
+	lastStoredAt   atomic.Int64
+	pendingSince   atomic.Int64
+)
+
+// IngestStats is a snapshot of the subscriber side of the pipeline.
+type IngestStats struct {
+	Received       int64
+	Stored         int64
+	LastReceivedAt time.Time
+	LastStoredAt   time.Time
+	PendingSince   time.Time
+}
+
+// Pending returns the number of readings received from the topic but not yet stored.
+func (s IngestStats) Pending() int64 {
+	if s.Received < s.Stored {
+		return 0
+	}
+	return s.Received - s.Stored
+}
+
+// Lag returns how long the ingest queue has been non-empty without making progress.
+func (s IngestStats) Lag(now time.Time) time.Duration {
+	if s.Pending() == 0 {
+		return 0
+	}
+	since := s.PendingSince
+	if s.LastStoredAt.After(since) {
+		since = s.LastStoredAt
+	}
+	if since.IsZero() {
+		return 0
+	}
+	return now.Sub(since)
+}
+
+// IsSubscribed reports whether the subscription on the configured topic is active.
+func IsSubscribed() bool {
+	return subscribed.Load()
+}
+
+func setSubscribed(value bool) {
+	subscribed.Store(value)
+}
+
+func markReceived() {
+	now := time.Now().UnixNano()
+	if receivedCount.Load() <= storedCount.Load() {
+		pendingSince.Store(now)
+	}
+	receivedCount.Add(1)
+	lastReceivedAt.Store(now)
+}
+
+// unmarkReceived takes back markReceived for a reading that never reached the queue.
+func unmarkReceived() {
+	receivedCount.Add(-1)
+}
+
+// MarkStored records that a reading received from the topic has been persisted, or
+// handled without being stored, such as a duplicate or a rejected reading.
+func MarkStored() {
+	storedCount.Add(1)
+	lastStoredAt.Store(time.Now().UnixNano())
+}
+
+// GetIngestStats returns the current ingest counters.
+func GetIngestStats() IngestStats {
+	return IngestStats{
+		Received:       receivedCount.Load(),
+		Stored:         storedCount.Load(),
+		LastReceivedAt: unixNanoToTime(lastReceivedAt.Load()),
+		LastStoredAt:   unixNanoToTime(lastStoredAt.Load()),
+		PendingSince:   unixNanoToTime(pendingSince.Load()),
+	}
+}
+
+func unixNanoToTime(value int64) time.Time {
+	if value == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, value)
+}
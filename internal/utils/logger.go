@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/constants"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var logLevel = zap.NewAtomicLevelAt(zap.DebugLevel)
+
+// InitLogger replaces the development logger with one built from the [log] section.
+func InitLogger(cfg config.Log) error {
+	if cfg.Level != "" {
+		if err := SetLogLevel(cfg.Level); err != nil {
+			return err
+		}
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.TimeKey = "time"
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	var encoder zapcore.Encoder
+	switch strings.ToLower(cfg.Format) {
+	case "", "json":
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	case "console":
+		encoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+
+	var writer zapcore.WriteSyncer
+	switch cfg.Output {
+	case "", "stdout":
+		writer = zapcore.Lock(os.Stdout)
+	case "stderr":
+		writer = zapcore.Lock(os.Stderr)
+	default:
+		writer = zapcore.AddSync(&lumberjack.Logger{
+			Filename:   cfg.Output,
+			MaxSize:    cfg.MaxSize,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAge,
+			Compress:   cfg.Compress,
+		})
+	}
+
+	Logger = zap.New(zapcore.NewCore(encoder, writer, logLevel), zap.AddCaller())
+	return nil
+}
+
+// SetLogLevel changes the level of the global logger and every logger derived from it.
+func SetLogLevel(level string) error {
+	parsed, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q, err %v", level, err)
+	}
+	logLevel.SetLevel(parsed)
+	return nil
+}
+
+// WithLogFields attaches fields to the request-scoped logger.
+func WithLogFields(ctx *gin.Context, fields ...zap.Field) *zap.Logger {
+	logger := LoggerFromContext(ctx).With(fields...)
+	ctx.Set(constants.LoggerKey, logger)
+	return logger
+}
+
+// LoggerFromContext returns the request-scoped logger, falling back to the global one.
+func LoggerFromContext(ctx *gin.Context) *zap.Logger {
+	if ctx != nil {
+		if value, ok := ctx.Get(constants.LoggerKey); ok {
+			if logger, ok := value.(*zap.Logger); ok {
+				return logger
+			}
+		}
+	}
+	return Logger
+}
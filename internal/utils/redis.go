@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"go.uber.org/zap"
+)
+
+// InitRedis creates the client for the configured topology (single node, Sentinel
+// or Cluster) and waits until Redis answers a PING, exiting if it never does.
+func InitRedis() redis.UniversalClient {
+	cfg := config.GetConfig().RedisConfig
+	client, err := NewRedisClient(cfg)
+	if err != nil {
+		Logger.Fatal("invalid redis configuration", zap.Error(err))
+	}
+
+	if err := checkRedis(client, time.Duration(cfg.StartupTimeout)*time.Second); err != nil {
+		Logger.Fatal("unable to connect to redis", zap.String("mode", redisMode(cfg)), zap.Error(err))
+	}
+	Logger.Info("connected to redis", zap.String("mode", redisMode(cfg)))
+	return client
+}
+
+// NewRedisClient builds a client from the [redis] section without connecting.
+func NewRedisClient(cfg config.Redis) (redis.UniversalClient, error) {
+	tlsConfig, err := redisTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	seconds := func(value int) time.Duration {
+		return time.Duration(value) * time.Second
+	}
+
+	switch redisMode(cfg) {
+	case "sentinel":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.MasterName,
+			SentinelAddrs:    cfg.Addrs,
+			SentinelUsername: cfg.SentinelUsername,
+			SentinelPassword: cfg.SentinelPassword,
+			Username:         cfg.Username,
+			Password:         cfg.Password,
+			DB:               cfg.DBNum,
+			MaxRetries:       cfg.MaxRetries,
+			DialTimeout:      seconds(cfg.DialTimeout),
+			ReadTimeout:      seconds(cfg.ReadTimeout),
+			WriteTimeout:     seconds(cfg.WriteTimeout),
+			PoolSize:         cfg.PoolSize,
+			MinIdleConns:     cfg.MinIdleConns,
+			MaxConnAge:       seconds(cfg.MaxConnAge),
+			PoolTimeout:      seconds(cfg.PoolTimeout),
+			IdleTimeout:      seconds(cfg.IdleTimeout),
+			TLSConfig:        tlsConfig,
+		}), nil
+	case "cluster":
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        cfg.Addrs,
+			Username:     cfg.Username,
+			Password:     cfg.Password,
+			MaxRetries:   cfg.MaxRetries,
+			DialTimeout:  seconds(cfg.DialTimeout),
+			ReadTimeout:  seconds(cfg.ReadTimeout),
+			WriteTimeout: seconds(cfg.WriteTimeout),
+			PoolSize:     cfg.PoolSize,
+			MinIdleConns: cfg.MinIdleConns,
+			MaxConnAge:   seconds(cfg.MaxConnAge),
+			PoolTimeout:  seconds(cfg.PoolTimeout),
+			IdleTimeout:  seconds(cfg.IdleTimeout),
+			TLSConfig:    tlsConfig,
+		}), nil
+	case "single":
+		return redis.NewClient(&redis.Options{
+			Addr:         cfg.URL,
+			Username:     cfg.Username,
+			Password:     cfg.Password,
+			DB:           cfg.DBNum,
+			MaxRetries:   cfg.MaxRetries,
+			DialTimeout:  seconds(cfg.DialTimeout),
+			ReadTimeout:  seconds(cfg.ReadTimeout),
+			WriteTimeout: seconds(cfg.WriteTimeout),
+			PoolSize:     cfg.PoolSize,
+			MinIdleConns: cfg.MinIdleConns,
+			MaxConnAge:   seconds(cfg.MaxConnAge),
+			PoolTimeout:  seconds(cfg.PoolTimeout),
+			IdleTimeout:  seconds(cfg.IdleTimeout),
+			TLSConfig:    tlsConfig,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown redis mode %q", cfg.Mode)
+	}
+}
+
+// RedisWithContext binds ctx to the commands sent through client.
+func RedisWithContext(client redis.UniversalClient, ctx context.Context) redis.Cmdable {
+	switch c := client.(type) {
+	case *redis.Client:
+		return c.WithContext(ctx)
+	case *redis.ClusterClient:
+		return c.WithContext(ctx)
+	default:
+		return client
+	}
+}
+
+func redisMode(cfg config.Redis) string {
+	if cfg.Mode == "" {
+		return "single"
+	}
+	return cfg.Mode
+}
+
+// redisTLSConfig enables TLS when redis_tls is set or any certificate is configured.
+// Certificates are PEM encoded, usually given as file:// or vault: references.
+func redisTLSConfig(cfg config.Redis) (*tls.Config, error) {
+	if !cfg.TLS && cfg.Cert == "" && cfg.ClientCert == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.TLSServerName,
+		InsecureSkipVerify: cfg.TLSSkipVerify,
+	}
+	if cfg.Cert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(cfg.Cert)) {
+			return nil, fmt.Errorf("redis_cert does not contain a valid PEM certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.ClientCert != "" {
+		certificate, err := tls.X509KeyPair([]byte(cfg.ClientCert), []byte(cfg.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis client certificate, err %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// checkRedis pings Redis with a backoff until it answers or timeout elapses.
+func checkRedis(client redis.UniversalClient, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	backoff := 250 * time.Millisecond
+	for {
+		err := client.Ping().Err()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("no answer within %v, last error %v", timeout, err)
+		}
+		Logger.Warn("redis not reachable yet, retrying", zap.Duration("backoff", backoff), zap.Error(err))
+		time.Sleep(backoff)
+		if backoff < 4*time.Second {
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/mqtt-pipeline/internal/config"
+	"gotest.tools/assert"
+)
+
+// selfSigned returns a PEM encoded self-signed certificate and its private key.
+func selfSigned(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "redis"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NilError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NilError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestNewRedisClient(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Redis
+		// addr is the address of a single node client, sentinel clients report
+		// FailoverClient
+		addr    string
+		cluster []string
+		err     string
+	}{
+		{name: "single by default", cfg: config.Redis{URL: "localhost:6379", DBNum: 2}, addr: "localhost:6379"},
+		{name: "single", cfg: config.Redis{Mode: "single", URL: "redis:6379"}, addr: "redis:6379"},
+		{name: "sentinel", cfg: config.Redis{Mode: "sentinel", MasterName: "mymaster", Addrs: []string{"s1:26379", "s2:26379"}}, addr: "FailoverClient"},
+		{name: "cluster", cfg: config.Redis{Mode: "cluster", Addrs: []string{"n1:6379", "n2:6379"}}, cluster: []string{"n1:6379", "n2:6379"}},
+		{name: "unknown mode", cfg: config.Redis{Mode: "ring"}, err: `unknown redis mode "ring"`},
+		{name: "invalid tls", cfg: config.Redis{Mode: "cluster", Cert: "not a certificate"}, err: "redis_cert does not contain a valid PEM certificate"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := NewRedisClient(test.cfg)
+			if test.err != "" {
+				assert.Error(t, err, test.err)
+				return
+			}
+			assert.NilError(t, err)
+			defer client.Close()
+			switch c := client.(type) {
+			case *redis.Client:
+				assert.Equal(t, test.addr, c.Options().Addr)
+				assert.Equal(t, test.cfg.DBNum, c.Options().DB)
+			case *redis.ClusterClient:
+				assert.DeepEqual(t, test.cluster, c.Options().Addrs)
+			default:
+				t.Fatalf("unexpected client %T", client)
+			}
+		})
+	}
+}
+
+func TestRedisTLSConfig(t *testing.T) {
+	cert, key := selfSigned(t)
+	otherCert, _ := selfSigned(t)
+	tests := []struct {
+		name         string
+		cfg          config.Redis
+		disabled     bool
+		rootCAs      bool
+		certificates int
+		skipVerify   bool
+		serverName   string
+		err          string
+	}{
+		{name: "disabled", cfg: config.Redis{}, disabled: true},
+		{name: "system roots", cfg: config.Redis{TLS: true, TLSServerName: "redis.internal"}, serverName: "redis.internal"},
+		{name: "ca certificate", cfg: config.Redis{Cert: cert}, rootCAs: true},
+		{name: "client certificate", cfg: config.Redis{ClientCert: cert, ClientKey: key}, certificates: 1},
+		{name: "insecure skip verify", cfg: config.Redis{TLS: true, TLSSkipVerify: true}, skipVerify: true},
+		{name: "invalid ca", cfg: config.Redis{Cert: "not a certificate"}, err: "redis_cert does not contain a valid PEM certificate"},
+		{name: "client key mismatch", cfg: config.Redis{ClientCert: otherCert, ClientKey: key}, err: "invalid redis client certificate"},
+		{name: "client key missing", cfg: config.Redis{ClientCert: cert}, err: "invalid redis client certificate"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tlsConfig, err := redisTLSConfig(test.cfg)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			assert.NilError(t, err)
+			if test.disabled {
+				assert.Assert(t, tlsConfig == nil)
+				return
+			}
+			assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+			assert.Equal(t, test.rootCAs, tlsConfig.RootCAs != nil)
+			assert.Equal(t, test.certificates, len(tlsConfig.Certificates))
+			assert.Equal(t, test.skipVerify, tlsConfig.InsecureSkipVerify)
+			assert.Equal(t, test.serverName, tlsConfig.ServerName)
+		})
+	}
+}
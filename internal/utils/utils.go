@@ -3,72 +3,486 @@ package utils
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gin-gonic/gin"
-	"github.com/go-redis/redis/v7"
 	"github.com/mqtt-pipeline/internal/config"
 	"github.com/mqtt-pipeline/internal/constants"
 	"github.com/mqtt-pipeline/internal/models"
 	"github.com/mqtt-pipeline/internal/mqtterror"
+	"github.com/mqtt-pipeline/internal/routing"
 	"go.uber.org/zap"
 )
 
 var Logger *zap.Logger
 var MQTTClient mqtt.Client
-var SpeedChannel = make(chan int)
 
-func InitRedis() *redis.Client {
-	cfg := config.GetConfig()
-	client := redis.NewClient(&redis.Options{
-		Addr:        cfg.RedisConfig.URL,
-		Password:    "",
-		DB:          cfg.RedisConfig.DBNum,
-		IdleTimeout: time.Duration(cfg.RedisConfig.IdleTimeout),
-	})
+// SpeedChannel buffers readings between the topic subscription and the ingest worker.
+// It is closed once the subscription has been removed during shutdown.
+var SpeedChannel chan models.Reading
+
+// Reconnected receives a value every time the connection to the broker is established.
+var Reconnected = make(chan struct{}, 1)
+
+// DeadLetters buffers the messages from the topic that cannot be turned into a reading
+// until the ingest worker records them, so that the MQTT client never waits for redis.
+var DeadLetters = make(chan models.DeadLetter, deadLetterBuffer)
+
+// deadLetterBuffer is how many rejected messages wait for the ingest worker before
+// more are dropped.
+const deadLetterBuffer = 1000
+
+var (
+	subscriptionWanted atomic.Bool
+	subscriptionMu     sync.Mutex
+	subscribedFilters  []string
+	speedChannelMu     sync.RWMutex
+	speedChannelClosed bool
+	droppedCount       atomic.Int64
+
+	// speedChannelClosing is closed when shutdown starts, to wake up enqueueReading
+	// waiting for room while holding the read lock closeSpeedChannel needs.
+	speedChannelClosing = make(chan struct{})
+	closingMu           sync.Mutex
+	closingSignalled    bool
+)
 
-	return client
+// SigningKey returns the key used to sign and verify tokens. Without [auth] jwt_secret
+// the built-in development key is used.
+func SigningKey() []byte {
+	if secret := config.GetConfig().Auth.JWTSecret; secret != "" {
+		return []byte(secret)
+	}
+	return constants.SecretKey
 }
 
+// InitLogClient creates a development logger used until the [log] config is loaded.
 func InitLogClient() {
-	Logger, _ = zap.NewDevelopment()
+	cfg := zap.NewDevelopmentConfig()
+	cfg.Level = logLevel
+	Logger, _ = cfg.Build()
+}
+
+// brokerAddress returns the configured broker, a public test broker when it is not set.
+func brokerAddress() string {
+	if broker := config.GetConfig().MQTTConfig.MQTTBroker; broker != "" {
+		return broker
+	}
+	return "tcp://broker.emqx.io:1883"
+}
+
+func clientID() string {
+	if id := config.GetConfig().MQTTConfig.ClientID; id != "" {
+		return id
+	}
+	return "go-app"
 }
 
 func InitMQTT() {
 	cfg := config.GetConfig()
-	var mqttBroker string = cfg.MQTTConfig.MQTTBroker
-	if mqttBroker == "" {
-		mqttBroker = "tcp://broker.emqx.io:1883"
-	}
+	mqttBroker := brokerAddress()
 
 	opts := mqtt.NewClientOptions().AddBroker(mqttBroker)
-	opts.SetClientID("go-app")
+	opts.SetClientID(clientID())
 	opts.SetCleanSession(true)
+	opts.SetAutoReconnect(true)
+	if cfg.MQTTConfig.Username != "" {
+		opts.SetUsername(cfg.MQTTConfig.Username)
+		opts.SetPassword(cfg.MQTTConfig.Password)
+	}
+	// messages of every subscription go to handleMessage once, even when they match
+	// more than one of the routing filters
+	opts.SetDefaultPublishHandler(handleMessage)
+	opts.SetOnConnectHandler(onConnect)
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		setSubscribed(false)
+		Logger.Error("connection to MQTT broker lost", zap.String("broker", mqttBroker), zap.Error(err))
+	})
 	MQTTClient = mqtt.NewClient(opts)
 	if token := MQTTClient.Connect(); token.Wait() && token.Error() != nil {
-		fmt.Println("Failed to connect to MQTT broker")
-		fmt.Println("MQTT Broker Address:", mqttBroker)
-		fmt.Println("Error:", token.Error())
-		log.Fatal(token.Error())
+		Logger.Fatal("failed to connect to MQTT broker", zap.String("broker", mqttBroker), zap.Error(token.Error()))
+	}
+}
+
+// onConnect runs after every successful (re)connection. The session is clean, so the
+// subscription has to be restored before queued publishes are flushed.
+func onConnect(client mqtt.Client) {
+	Logger.Info("connected to MQTT broker")
+	if subscriptionWanted.Load() {
+		if err := subscribe(); err != nil {
+			Logger.Error("unable to restore the subscription after reconnecting", zap.Error(err))
+		}
+	}
+	select {
+	case Reconnected <- struct{}{}:
+	default:
 	}
 }
 
 func InitMQTTSubscribe() {
+	cfg := config.GetConfig()
+	bufferSize := cfg.MQTTConfig.IngestBuffer
+	if bufferSize <= 0 {
+		bufferSize = 1
+	}
+	openSpeedChannel(bufferSize)
+	subscriptionWanted.Store(true)
+
+	if err := subscribe(); err != nil {
+		closeSpeedChannel()
+		Logger.Fatal("unable to subscribe to the topics", zap.Error(err))
+	}
+}
+
+// TenantTopic returns the topic readings of a tenant are published on, the
+// configured topic below the tenant ID. Without a tenant it is the configured topic.
+func TenantTopic(tenant string) string {
+	topic := config.GetConfig().MQTTConfig.Topic
+	if tenant == "" {
+		return topic
+	}
+	return tenant + "/" + topic
+}
+
+// DeviceTopic returns the topic of a device for a topic whose + level is the device ID,
+// below the tenant ID when there is a tenant.
+func DeviceTopic(tenant, topic, deviceID string) string {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		if level == "+" {
+			levels[i] = deviceID
+		}
+	}
+	if tenant == "" {
+		return strings.Join(levels, "/")
+	}
+	return tenant + "/" + strings.Join(levels, "/")
+}
+
+// splitTenant returns the tenant a message was published for, the first level of its
+// topic when tenancy is enabled, and the topic below it.
+func splitTenant(topic string) (string, string) {
+	if !config.GetConfig().Tenancy.Enabled {
+		return "", topic
+	}
+	tenant, rest, _ := strings.Cut(topic, "/")
+	return tenant, rest
+}
+
+// Ingested reports whether messages published on topic are received and stored by
+// the service, because the topic or a routing rule matches it.
+func Ingested(topic string) bool {
+	_, rest := splitTenant(topic)
+	_, ok := routing.Resolve(rest)
+	return ok
+}
+
+// DeviceControlTopic reports whether topic is the status, command or command response topic of
+// a device, where devices and the service act on the messages published.
+func DeviceControlTopic(topic string) bool {
+	cfg := config.GetConfig()
+	_, rest := splitTenant(topic)
+	for _, filter := range []string{cfg.Devices.StatusTopic, cfg.Commands.Topic, cfg.Commands.ResponseTopic} {
+		if _, ok := topicDevice(filter, rest); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriptionFilter is the filter the service subscribes to for topic, covering the
+// topic of every tenant when tenancy is enabled.
+func subscriptionFilter(topic string) string {
+	if config.GetConfig().Tenancy.Enabled {
+		return "+/" + topic
+	}
+	return topic
+}
+
+// subscribe subscribes to the [mqtt] topic and the filter of every routing rule.
+// Messages are delivered to the default publish handler.
+func subscribe() error {
+	cfg := config.GetConfig()
+	filters := map[string]byte{}
+	var names []string
+	for _, topic := range routing.Topics() {
+		filter := subscriptionFilter(topic)
+		filters[filter] = byte(cfg.MQTTConfig.QoS)
+		names = append(names, filter)
+	}
+	if cfg.Devices.Presence {
+		filter := subscriptionFilter(cfg.Devices.StatusTopic)
+		filters[filter] = byte(cfg.MQTTConfig.QoS)
+		names = append(names, filter)
+	}
+
+	subscriptionMu.Lock()
+	defer subscriptionMu.Unlock()
+	token := MQTTClient.SubscribeMultiple(filters, nil)
+	if token.Wait() && token.Error() != nil {
+		setSubscribed(false)
+		return token.Error()
+	}
+	subscribedFilters = names
+	setSubscribed(true)
+	Logger.Info("successfully subscribed to the topics", zap.Strings("topics", names))
+	return nil
+}
 
+// unsubscribe removes the subscriptions made by the last call to subscribe.
+func unsubscribe(timeout time.Duration) error {
+	subscriptionMu.Lock()
+	defer subscriptionMu.Unlock()
+	if len(subscribedFilters) == 0 {
+		return nil
+	}
+	token := MQTTClient.Unsubscribe(subscribedFilters...)
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("timed out unsubscribing from %v", strings.Join(subscribedFilters, ", "))
+	}
+	if token.Error() != nil {
+		return token.Error()
+	}
+	subscribedFilters = nil
+	return nil
+}
+
+// handleMessage turns a message into a reading of the metric its topic is routed to.
+func handleMessage(client mqtt.Client, msg mqtt.Message) {
+	tenant, topic := splitTenant(msg.Topic())
 	cfg := config.GetConfig()
-	if token := MQTTClient.Subscribe(cfg.MQTTConfig.Topic, 0, func(client mqtt.Client, msg mqtt.Message) {
-		var speedData models.SpeedData
-		if err := json.Unmarshal(msg.Payload(), &speedData); err == nil {
-			SpeedChannel <- *speedData.Speed
+	if deviceID, ok := topicDevice(cfg.Devices.StatusTopic, topic); ok && cfg.Devices.Presence {
+		handleStatus(tenant, deviceID, msg)
+		return
+	}
+	route, ok := routing.Resolve(topic)
+	if !ok {
+		deadLetter(msg.Topic(), msg.Payload(), "no routing rule matches the topic")
+		return
+	}
+	decoded, err := routing.Decode(route, topic, msg.Payload())
+	if err != nil {
+		deadLetter(msg.Topic(), msg.Payload(), err.Error())
+		return
+	}
+	if err := routing.Validate(route, decoded.Value); err != nil {
+		deadLetter(msg.Topic(), msg.Payload(), err.Error())
+		return
+	}
+	enqueueReading(models.Reading{
+		Metric:     route.Metric,
+		Value:      decoded.Value,
+		Storage:    route.Storage,
+		Speed:      int(decoded.Value),
+		MessageID:  decoded.MessageID,
+		DeviceID:   decoded.DeviceID,
+		Tenant:     tenant,
+		ReceivedAt: time.Now(),
+		Topic:      msg.Topic(),
+		Payload:    msg.Payload(),
+	})
+}
+
+// topicDevice returns the device of a topic matching filter, the level matching the +
+// of the filter.
+func topicDevice(filter, topic string) (string, bool) {
+	if filter == "" {
+		return "", false
+	}
+	filterLevels, topicLevels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if len(filterLevels) != len(topicLevels) {
+		return "", false
+	}
+	deviceID := ""
+	for i, level := range filterLevels {
+		switch {
+		case level == "+":
+			deviceID = topicLevels[i]
+		case level != topicLevels[i]:
+			return "", false
 		}
-	}); token.Wait() && token.Error() != nil {
+	}
+	return deviceID, deviceID != ""
+}
+
+// handleStatus queues the status a device published for the ingest worker, behind the
+// readings received before it. The payload is online or offline, as text or as
+// {"status": ...}. An empty payload only clears the retained status of the topic and
+// is ignored.
+func handleStatus(tenant, deviceID string, msg mqtt.Message) {
+	payload := strings.TrimSpace(string(msg.Payload()))
+	if payload == "" {
+		return
+	}
+	status := payload
+	if strings.HasPrefix(payload, "{") {
+		var body struct {
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(msg.Payload(), &body); err != nil {
+			deadLetter(msg.Topic(), msg.Payload(), fmt.Sprintf("invalid device status, err %v", err))
+			return
+		}
+		status = body.Status
+	}
+	status = strings.ToLower(status)
+	if status != "online" && status != "offline" {
+		deadLetter(msg.Topic(), msg.Payload(), fmt.Sprintf("device status must be online or offline, got %q", status))
+		return
+	}
+	enqueueReading(models.Reading{
+		Kind:       models.ReadingDeviceStatus,
+		Status:     status,
+		DeviceID:   deviceID,
+		Tenant:     tenant,
+		ReceivedAt: time.Now(),
+		Topic:      msg.Topic(),
+		Payload:    msg.Payload(),
+	})
+}
+
+// handleCommandResponse queues the response of a device to one of its commands for the
+// ingest worker. Responses carry the ID of the command as their correlation data and a
+// status of ok or error.
+func handleCommandResponse(tenant, deviceID, correlationID, topic string, payload []byte) {
+	if correlationID == "" {
+		deadLetter(topic, payload, "command response has no correlation data")
+		return
+	}
+	var response models.CommandResponse
+	if err := json.Unmarshal(payload, &response); err != nil {
+		deadLetter(topic, payload, fmt.Sprintf("invalid command response, err %v", err))
+		return
+	}
+	if response.Status != "ok" && response.Status != "error" {
+		deadLetter(topic, payload, fmt.Sprintf("command response status must be ok or error, got %q", response.Status))
+		return
+	}
+	response.CorrelationID = correlationID
+	enqueueReading(models.Reading{
+		Kind:       models.ReadingCommandResponse,
+		Response:   &response,
+		DeviceID:   deviceID,
+		Tenant:     tenant,
+		ReceivedAt: time.Now(),
+		Topic:      topic,
+		Payload:    payload,
+	})
+}
+
+func deadLetter(topic string, payload []byte, reason string) {
+	Logger.Warn("rejected message from the topic", zap.String("topic", topic), zap.String("reason", reason))
+	select {
+	case DeadLetters <- models.DeadLetter{Topic: topic, Payload: string(payload), Reason: reason, FailedAt: time.Now().UTC()}:
+	default:
+		Logger.Error("dead letter buffer is full, dropping the message", zap.String("topic", topic), zap.String("reason", reason))
+	}
+}
+
+// Resubscribe moves the subscriptions to the currently configured topic, routing
+// rules and QoS, used when the config is reloaded.
+func Resubscribe() error {
+	if !subscriptionWanted.Load() || MQTTClient == nil || !MQTTClient.IsConnectionOpen() {
+		// onConnect subscribes with the new settings once the connection is back.
+		return nil
+	}
+	if err := unsubscribe(10 * time.Second); err != nil {
+		return fmt.Errorf("unable to unsubscribe, err %v", err)
+	}
+	setSubscribed(false)
+	return subscribe()
+}
+
+// UnsubscribeMQTT removes the topic subscription and closes SpeedChannel so the
+// ingest worker can drain whatever is still buffered.
+func UnsubscribeMQTT(timeout time.Duration) error {
+	subscriptionWanted.Store(false)
+	var err error
+	if MQTTClient != nil && MQTTClient.IsConnectionOpen() {
+		err = unsubscribe(timeout)
+	}
+	setSubscribed(false)
+	closeSpeedChannel()
+	return err
+}
+
+// DroppedReadings returns how many readings arrived after SpeedChannel was closed.
+func DroppedReadings() int64 {
+	return droppedCount.Load()
+}
+
+// enqueueReading hands a reading to the ingest worker. While the buffer is full it
+// waits up to [mqtt] ingest_timeout milliseconds, after which the message is
+// dead-lettered instead of holding up the MQTT client.
+func enqueueReading(reading models.Reading) {
+	if !sendReading(reading) {
+		deadLetter(reading.Topic, reading.Payload, "ingest buffer is full")
+	}
+}
+
+// sendReading sends a reading to SpeedChannel and reports whether the ingest worker
+// will see it. Readings arriving during shutdown are dropped.
+func sendReading(reading models.Reading) bool {
+	speedChannelMu.RLock()
+	defer speedChannelMu.RUnlock()
+	if speedChannelClosed {
+		droppedCount.Add(1)
+		Logger.Warn("dropping reading received after unsubscribe", zap.String("metric", reading.Metric), zap.Float64("value", reading.Value))
+		return true
+	}
+	markReceived()
+	select {
+	case SpeedChannel <- reading:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(time.Duration(config.GetConfig().MQTTConfig.IngestTimeout) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case SpeedChannel <- reading:
+		return true
+	case <-timer.C:
+		unmarkReceived()
+		return false
+	case <-speedChannelClosing:
+		unmarkReceived()
+		droppedCount.Add(1)
+		Logger.Warn("dropping reading waiting for the ingest buffer during shutdown", zap.String("metric", reading.Metric), zap.Float64("value", reading.Value))
+		return true
+	}
+}
+
+// openSpeedChannel replaces SpeedChannel with an open channel buffering size readings.
+func openSpeedChannel(size int) {
+	speedChannelMu.Lock()
+	defer speedChannelMu.Unlock()
+	closingMu.Lock()
+	defer closingMu.Unlock()
+	SpeedChannel = make(chan models.Reading, size)
+	speedChannelClosed = false
+	speedChannelClosing = make(chan struct{})
+	closingSignalled = false
+}
+
+func closeSpeedChannel() {
+	closingMu.Lock()
+	if !closingSignalled {
+		close(speedChannelClosing)
+		closingSignalled = true
+	}
+	closingMu.Unlock()
+
+	speedChannelMu.Lock()
+	defer speedChannelMu.Unlock()
+	if !speedChannelClosed && SpeedChannel != nil {
 		close(SpeedChannel)
-		Logger.Error(fmt.Sprint("Unable to fetch data from the topic", nil))
-		Logger.Fatal("unable Unable to fetch data from the topic")
 	}
-	Logger.Info(fmt.Sprint("successfully to send the fetch data from the topic", nil))
+	speedChannelClosed = true
 }
 
 func RespondWithError(c *gin.Context, statusCode int, message string) {
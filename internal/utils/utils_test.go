@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mqtt-pipeline/internal/config"
+	"github.com/mqtt-pipeline/internal/models"
+	"gotest.tools/assert"
+)
+
+func TestEnqueueReading(t *testing.T) {
+	// init logging client
+	InitLogClient()
+
+	config.SetConfig(config.GlobalConfig{MQTTConfig: config.MQTT{IngestTimeout: 50}})
+	defer config.SetConfig(config.GlobalConfig{})
+	// reasons returns the reasons of the dead letters buffered since the last call
+	reasons := func() []string {
+		var reasons []string
+		for len(DeadLetters) > 0 {
+			reasons = append(reasons, (<-DeadLetters).Reason)
+		}
+		return reasons
+	}
+	openSpeedChannel(1)
+	defer closeSpeedChannel()
+	received := GetIngestStats().Received
+
+	// Case 1 : readings are queued while there is room
+	enqueueReading(models.Reading{MessageID: "m1", Topic: "speed_topic"})
+	assert.Equal(t, 1, len(SpeedChannel))
+	assert.Equal(t, received+1, GetIngestStats().Received)
+
+	// Case 2 : with the buffer full the reading is dead-lettered after ingest_timeout
+	start := time.Now()
+	enqueueReading(models.Reading{MessageID: "m2", Topic: "speed_topic"})
+	assert.Assert(t, time.Since(start) >= 50*time.Millisecond)
+	assert.DeepEqual(t, []string{"ingest buffer is full"}, reasons())
+	assert.Equal(t, received+1, GetIngestStats().Received)
+
+	// Case 3 : a reading waiting for room is dropped as soon as shutdown starts
+	config.SetConfig(config.GlobalConfig{MQTTConfig: config.MQTT{IngestTimeout: 60000}})
+	dropped := DroppedReadings()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		enqueueReading(models.Reading{MessageID: "m3", Topic: "speed_topic"})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		closeSpeedChannel()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("closing the channel waited for the blocked reading")
+	}
+	<-done
+	assert.Equal(t, dropped+1, DroppedReadings())
+	assert.Equal(t, 0, len(reasons()))
+
+	// Case 4 : buffered readings can still be drained, later ones are dropped
+	reading, ok := <-SpeedChannel
+	assert.Assert(t, ok)
+	assert.Equal(t, "m1", reading.MessageID)
+	_, ok = <-SpeedChannel
+	assert.Assert(t, !ok)
+	enqueueReading(models.Reading{MessageID: "m4", Topic: "speed_topic"})
+	assert.Equal(t, dropped+2, DroppedReadings())
+	assert.Equal(t, 0, len(reasons()))
+}
+
+// fakeMessage is a message received from the broker.
+type fakeMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m fakeMessage) Topic() string   { return m.topic }
+func (m fakeMessage) Payload() []byte { return m.payload }
+
+func TestDeviceMessages(t *testing.T) {
+	// init logging client
+	InitLogClient()
+
+	config.SetConfig(config.GlobalConfig{
+		MQTTConfig: config.MQTT{IngestTimeout: 50},
+		Devices:    config.Devices{Presence: true, StatusTopic: "devices/+/status"},
+		Commands:   config.Commands{Enabled: true, ResponseTopic: "devices/+/responses"},
+	})
+	defer config.SetConfig(config.GlobalConfig{})
+	openSpeedChannel(10)
+	defer closeSpeedChannel()
+	for len(DeadLetters) > 0 {
+		<-DeadLetters
+	}
+
+	// Case 1 : statuses are queued for the ingest worker, as text or JSON
+	handleMessage(nil, fakeMessage{topic: "devices/truck-1/status", payload: []byte("Online")})
+	handleMessage(nil, fakeMessage{topic: "devices/truck-1/status", payload: []byte(`{"status": "offline"}`)})
+	assert.Equal(t, 2, len(SpeedChannel))
+	for _, want := range []string{"online", "offline"} {
+		reading := <-SpeedChannel
+		assert.Equal(t, models.ReadingDeviceStatus, reading.Kind)
+		assert.Equal(t, want, reading.Status)
+		assert.Equal(t, "truck-1", reading.DeviceID)
+		assert.Equal(t, "devices/truck-1/status", reading.Topic)
+	}
+
+	// Case 2 : empty payloads are ignored and invalid statuses dead-lettered
+	handleMessage(nil, fakeMessage{topic: "devices/truck-1/status", payload: nil})
+	handleMessage(nil, fakeMessage{topic: "devices/truck-1/status", payload: []byte("lost")})
+	assert.Equal(t, 0, len(SpeedChannel))
+	assert.Equal(t, 1, len(DeadLetters))
+	assert.Equal(t, "devices/truck-1/status", (<-DeadLetters).Topic)
+
+	// Case 3 : command responses are queued for the ingest worker with their
+	// correlation data, responses without it dead-lettered
+	response := func(correlationData, payload string) paho.PublishReceived {
+		publish := &paho.Publish{Topic: "devices/truck-1/responses", Payload: []byte(payload)}
+		if correlationData != "" {
+			publish.Properties = &paho.PublishProperties{CorrelationData: []byte(correlationData)}
+		}
+		return paho.PublishReceived{Packet: publish}
+	}
+	receiveCommandResponse(response("c1", `{"status": "ok", "result": {"limit": 80}}`))
+	receiveCommandResponse(response("", `{"status": "ok"}`))
+	assert.Equal(t, 1, len(SpeedChannel))
+	reading := <-SpeedChannel
+	assert.Equal(t, models.ReadingCommandResponse, reading.Kind)
+	assert.Equal(t, "truck-1", reading.DeviceID)
+	assert.Equal(t, "c1", reading.Response.CorrelationID)
+	assert.Equal(t, `{"limit": 80}`, string(reading.Response.Result))
+	assert.Equal(t, 1, len(DeadLetters))
+	assert.Equal(t, "command response has no correlation data", (<-DeadLetters).Reason)
+}
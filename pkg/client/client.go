@@ -0,0 +1,207 @@
+// Package client is a typed Go client for the MQTT Pipeline Service REST API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Client calls the API of one service instance. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	deviceID   string
+	tenant     string
+	apiKey     string
+
+	mu    sync.RWMutex
+	token string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests, http.DefaultClient otherwise.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithToken sets the token sent with authenticated requests.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithDeviceID sends the device-id header with every request.
+func WithDeviceID(deviceID string) Option {
+	return func(c *Client) {
+		c.deviceID = deviceID
+	}
+}
+
+// WithTenant requests tokens for the tenant, authenticated with its API key, when
+// the service runs with multi-tenancy enabled.
+func WithTenant(tenant, apiKey string) Option {
+	return func(c *Client) {
+		c.tenant = tenant
+		c.apiKey = apiKey
+	}
+}
+
+// New returns a client for the service at baseURL, e.g. http://127.0.0.1:4000.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// SetToken replaces the token sent with authenticated requests.
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+// Token returns the token sent with authenticated requests.
+func (c *Client) Token() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.token
+}
+
+// GenerateToken requests a token for email and uses it for later requests.
+func (c *Client) GenerateToken(ctx context.Context, email string) (string, error) {
+	var resp TokenResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/", nil, TokenRequest{Email: email, Tenant: c.tenant, APIKey: c.apiKey}, &resp); err != nil {
+		return "", err
+	}
+	c.SetToken(resp.Token)
+	return resp.Token, nil
+}
+
+// Publish sends a speed reading to the MQTT topic.
+func (c *Client) Publish(ctx context.Context, speed int, opts PublishOptions) (*PublishResponse, error) {
+	header := http.Header{}
+	if opts.IdempotencyKey != "" {
+		header.Set("Idempotency-Key", opts.IdempotencyKey)
+	}
+	path := "/v1/publish"
+	if opts.Async {
+		path += "?" + url.Values{"async": {"true"}}.Encode()
+	}
+
+	var resp PublishResponse
+	if err := c.do(ctx, http.MethodPost, path, header, SpeedData{Speed: speed, MessageID: opts.MessageID}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// LatestSpeed returns the latest stored speed, or nil when nothing has been stored.
+func (c *Client) LatestSpeed(ctx context.Context) (*int, error) {
+	var resp struct {
+		LatestSpeed json.RawMessage `json:"latest_speed"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	// the service answers with a message instead of a number when there is no data
+	speed, err := strconv.Atoi(string(resp.LatestSpeed))
+	if err != nil {
+		return nil, nil
+	}
+	return &speed, nil
+}
+
+// MessageStatus returns the delivery status of a published message.
+func (c *Client) MessageStatus(ctx context.Context, messageID string) (*MessageStatus, error) {
+	var resp MessageStatus
+	if err := c.do(ctx, http.MethodGet, "/v1/messages/"+url.PathEscape(messageID), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Ready returns the readiness of the service and its dependencies. A service that
+// is not ready is reported as an *Error with the health status in its body.
+func (c *Client) Ready(ctx context.Context) (*HealthStatus, error) {
+	var resp HealthStatus
+	if err := c.do(ctx, http.MethodGet, "/readyz", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("transaction-id", uuid.New().String())
+	if c.deviceID != "" {
+		req.Header.Set("device-id", c.deviceID)
+	}
+	if token := c.Token(); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		apiErr := &Error{StatusCode: resp.StatusCode, Body: data}
+		_ = json.Unmarshal(data, apiErr)
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return apiErr
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("unable to decode the response, err %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestClient(t *testing.T) {
+	var latest *int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			var req TokenRequest
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			_ = json.NewEncoder(w).Encode(TokenResponse{Token: "token-for-" + req.Email})
+		case r.Header.Get("Authorization") == "":
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"Unauthorized"}`))
+		case latest == nil:
+			_, _ = w.Write([]byte(`{"latest_speed":"No speed data found in redis"}`))
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]int{"latest_speed": *latest})
+		}
+	})
+	mux.HandleFunc("/v1/publish", func(w http.ResponseWriter, r *http.Request) {
+		var req SpeedData
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if r.Header.Get("Idempotency-Key") == "limited" {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"code":429,"message":"rate limit exceeded","trace":"t"}`))
+			return
+		}
+		latest = &req.Speed
+		if r.URL.Query().Get("async") == "true" {
+			w.WriteHeader(http.StatusAccepted)
+			_ = json.NewEncoder(w).Encode(PublishResponse{MessageID: req.MessageID, Status: "queued"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(PublishResponse{Message: "Published speed data to MQTT Pipeline", MessageID: req.MessageID})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx := context.Background()
+	c := New(server.URL + "/")
+
+	// Case 1 : requests without a token are rejected
+	_, err := c.LatestSpeed(ctx)
+	var apiErr *Error
+	assert.Assert(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+
+	// Case 2 : the generated token is used for later requests
+	token, err := c.GenerateToken(ctx, "ankitchahal20@gmail.com")
+	assert.NilError(t, err)
+	assert.Equal(t, "token-for-ankitchahal20@gmail.com", c.Token())
+	assert.Equal(t, token, c.Token())
+
+	// Case 3 : no speed stored yet
+	speed, err := c.LatestSpeed(ctx)
+	assert.NilError(t, err)
+	assert.Assert(t, speed == nil)
+
+	// Case 4 : publish and read the speed back
+	resp, err := c.Publish(ctx, 42, PublishOptions{MessageID: "m1"})
+	assert.NilError(t, err)
+	assert.Equal(t, "m1", resp.MessageID)
+	speed, err = c.LatestSpeed(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, 42, *speed)
+
+	// Case 5 : async publish
+	resp, err = c.Publish(ctx, 43, PublishOptions{MessageID: "m2", Async: true})
+	assert.NilError(t, err)
+	assert.Equal(t, "queued", resp.Status)
+
+	// Case 6 : errors carry the service error and Retry-After
+	_, err = c.Publish(ctx, 44, PublishOptions{IdempotencyKey: "limited"})
+	assert.Assert(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+	assert.Equal(t, "rate limit exceeded", apiErr.Message)
+	assert.Equal(t, 3*time.Second, apiErr.RetryAfter)
+}
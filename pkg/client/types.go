@@ -0,0 +1,78 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+type TokenRequest struct {
+	Email  string `json:"email"`
+	Tenant string `json:"tenant,omitempty"`
+	APIKey string `json:"api_key,omitempty"`
+}
+
+type TokenResponse struct {
+	Token string `json:"token"`
+}
+
+type SpeedData struct {
+	Speed     int    `json:"speed"`
+	MessageID string `json:"message_id,omitempty"`
+}
+
+// PublishOptions are optional settings of a publish request.
+type PublishOptions struct {
+	// MessageID is generated by the service when empty.
+	MessageID string
+	// IdempotencyKey makes retries return the original response.
+	IdempotencyKey string
+	// Async returns as soon as the service accepted the reading.
+	Async bool
+}
+
+type PublishResponse struct {
+	Message   string `json:"message"`
+	MessageID string `json:"message_id"`
+	Status    string `json:"status,omitempty"`
+	StatusURL string `json:"status_url,omitempty"`
+}
+
+type MessageStatus struct {
+	MessageID      string     `json:"message_id"`
+	Status         string     `json:"status"`
+	Reason         string     `json:"reason,omitempty"`
+	QueuedAt       *time.Time `json:"queued_at,omitempty"`
+	PublishedAt    *time.Time `json:"published_at,omitempty"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	IngestedAt     *time.Time `json:"ingested_at,omitempty"`
+	FailedAt       *time.Time `json:"failed_at,omitempty"`
+}
+
+type DependencyStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+type HealthStatus struct {
+	Status       string                      `json:"status"`
+	ShuttingDown bool                        `json:"shutting_down"`
+	Checks       map[string]DependencyStatus `json:"checks"`
+}
+
+// Error is returned for responses with a 4xx or 5xx status.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       int    `json:"code"`
+	Message    string `json:"message"`
+	Trace      string `json:"trace"`
+	// RetryAfter is set from the Retry-After header of rate limited responses.
+	RetryAfter time.Duration `json:"-"`
+	Body       []byte        `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("mqtt-pipeline: http %d", e.StatusCode)
+	}
+	return fmt.Sprintf("mqtt-pipeline: http %d: %s", e.StatusCode, e.Message)
+}
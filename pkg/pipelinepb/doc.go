@@ -0,0 +1,5 @@
+// Package pipelinepb contains the protobuf messages and gRPC stubs of the Pipeline
+// service defined in pipeline.proto.
+package pipelinepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative pipeline.proto
@@ -0,0 +1,342 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: pipeline.proto
+
+package pipelinepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Pipeline_Publish_FullMethodName       = "/mqttpipeline.v1.Pipeline/Publish"
+	Pipeline_PublishStream_FullMethodName = "/mqttpipeline.v1.Pipeline/PublishStream"
+	Pipeline_GetLatest_FullMethodName     = "/mqttpipeline.v1.Pipeline/GetLatest"
+	Pipeline_QueryHistory_FullMethodName  = "/mqttpipeline.v1.Pipeline/QueryHistory"
+	Pipeline_Subscribe_FullMethodName     = "/mqttpipeline.v1.Pipeline/Subscribe"
+)
+
+// PipelineClient is the client API for Pipeline service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Pipeline is the gRPC API of the MQTT Pipeline Service. Every call needs the token
+// returned by POST /v1/ in the authorization metadata.
+type PipelineClient interface {
+	// Publish sends one speed reading to the MQTT topic.
+	Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error)
+	// PublishStream sends every reading of the stream and reports the outcome once the
+	// client closes it.
+	PublishStream(ctx context.Context, opts ...grpc.CallOption) (Pipeline_PublishStreamClient, error)
+	// GetLatest returns the latest stored speed.
+	GetLatest(ctx context.Context, in *GetLatestRequest, opts ...grpc.CallOption) (*GetLatestResponse, error)
+	// QueryHistory returns stored readings within a time range, oldest first.
+	QueryHistory(ctx context.Context, in *QueryHistoryRequest, opts ...grpc.CallOption) (*QueryHistoryResponse, error)
+	// Subscribe streams readings as they are stored.
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Pipeline_SubscribeClient, error)
+}
+
+type pipelineClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPipelineClient(cc grpc.ClientConnInterface) PipelineClient {
+	return &pipelineClient{cc}
+}
+
+func (c *pipelineClient) Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PublishResponse)
+	err := c.cc.Invoke(ctx, Pipeline_Publish_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pipelineClient) PublishStream(ctx context.Context, opts ...grpc.CallOption) (Pipeline_PublishStreamClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Pipeline_ServiceDesc.Streams[0], Pipeline_PublishStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pipelinePublishStreamClient{ClientStream: stream}
+	return x, nil
+}
+
+type Pipeline_PublishStreamClient interface {
+	Send(*PublishRequest) error
+	CloseAndRecv() (*PublishStreamResponse, error)
+	grpc.ClientStream
+}
+
+type pipelinePublishStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *pipelinePublishStreamClient) Send(m *PublishRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *pipelinePublishStreamClient) CloseAndRecv() (*PublishStreamResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(PublishStreamResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *pipelineClient) GetLatest(ctx context.Context, in *GetLatestRequest, opts ...grpc.CallOption) (*GetLatestResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetLatestResponse)
+	err := c.cc.Invoke(ctx, Pipeline_GetLatest_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pipelineClient) QueryHistory(ctx context.Context, in *QueryHistoryRequest, opts ...grpc.CallOption) (*QueryHistoryResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(QueryHistoryResponse)
+	err := c.cc.Invoke(ctx, Pipeline_QueryHistory_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pipelineClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Pipeline_SubscribeClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Pipeline_ServiceDesc.Streams[1], Pipeline_Subscribe_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pipelineSubscribeClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Pipeline_SubscribeClient interface {
+	Recv() (*Reading, error)
+	grpc.ClientStream
+}
+
+type pipelineSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *pipelineSubscribeClient) Recv() (*Reading, error) {
+	m := new(Reading)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PipelineServer is the server API for Pipeline service.
+// All implementations must embed UnimplementedPipelineServer
+// for forward compatibility
+//
+// Pipeline is the gRPC API of the MQTT Pipeline Service. Every call needs the token
+// returned by POST /v1/ in the authorization metadata.
+type PipelineServer interface {
+	// Publish sends one speed reading to the MQTT topic.
+	Publish(context.Context, *PublishRequest) (*PublishResponse, error)
+	// PublishStream sends every reading of the stream and reports the outcome once the
+	// client closes it.
+	PublishStream(Pipeline_PublishStreamServer) error
+	// GetLatest returns the latest stored speed.
+	GetLatest(context.Context, *GetLatestRequest) (*GetLatestResponse, error)
+	// QueryHistory returns stored readings within a time range, oldest first.
+	QueryHistory(context.Context, *QueryHistoryRequest) (*QueryHistoryResponse, error)
+	// Subscribe streams readings as they are stored.
+	Subscribe(*SubscribeRequest, Pipeline_SubscribeServer) error
+	mustEmbedUnimplementedPipelineServer()
+}
+
+// UnimplementedPipelineServer must be embedded to have forward compatible implementations.
+type UnimplementedPipelineServer struct {
+}
+
+func (UnimplementedPipelineServer) Publish(context.Context, *PublishRequest) (*PublishResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Publish not implemented")
+}
+func (UnimplementedPipelineServer) PublishStream(Pipeline_PublishStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method PublishStream not implemented")
+}
+func (UnimplementedPipelineServer) GetLatest(context.Context, *GetLatestRequest) (*GetLatestResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLatest not implemented")
+}
+func (UnimplementedPipelineServer) QueryHistory(context.Context, *QueryHistoryRequest) (*QueryHistoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryHistory not implemented")
+}
+func (UnimplementedPipelineServer) Subscribe(*SubscribeRequest, Pipeline_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedPipelineServer) mustEmbedUnimplementedPipelineServer() {}
+
+// UnsafePipelineServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PipelineServer will
+// result in compilation errors.
+type UnsafePipelineServer interface {
+	mustEmbedUnimplementedPipelineServer()
+}
+
+func RegisterPipelineServer(s grpc.ServiceRegistrar, srv PipelineServer) {
+	s.RegisterService(&Pipeline_ServiceDesc, srv)
+}
+
+func _Pipeline_Publish_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PublishRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PipelineServer).Publish(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pipeline_Publish_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PipelineServer).Publish(ctx, req.(*PublishRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pipeline_PublishStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PipelineServer).PublishStream(&pipelinePublishStreamServer{ServerStream: stream})
+}
+
+type Pipeline_PublishStreamServer interface {
+	SendAndClose(*PublishStreamResponse) error
+	Recv() (*PublishRequest, error)
+	grpc.ServerStream
+}
+
+type pipelinePublishStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *pipelinePublishStreamServer) SendAndClose(m *PublishStreamResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *pipelinePublishStreamServer) Recv() (*PublishRequest, error) {
+	m := new(PublishRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Pipeline_GetLatest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetLatestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PipelineServer).GetLatest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pipeline_GetLatest_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PipelineServer).GetLatest(ctx, req.(*GetLatestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pipeline_QueryHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryHistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PipelineServer).QueryHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pipeline_QueryHistory_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PipelineServer).QueryHistory(ctx, req.(*QueryHistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pipeline_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PipelineServer).Subscribe(m, &pipelineSubscribeServer{ServerStream: stream})
+}
+
+type Pipeline_SubscribeServer interface {
+	Send(*Reading) error
+	grpc.ServerStream
+}
+
+type pipelineSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *pipelineSubscribeServer) Send(m *Reading) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Pipeline_ServiceDesc is the grpc.ServiceDesc for Pipeline service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Pipeline_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "mqttpipeline.v1.Pipeline",
+	HandlerType: (*PipelineServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Publish",
+			Handler:    _Pipeline_Publish_Handler,
+		},
+		{
+			MethodName: "GetLatest",
+			Handler:    _Pipeline_GetLatest_Handler,
+		},
+		{
+			MethodName: "QueryHistory",
+			Handler:    _Pipeline_QueryHistory_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PublishStream",
+			Handler:       _Pipeline_PublishStream_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Pipeline_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pipeline.proto",
+}